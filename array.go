@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// IntArrayValue and FloatArrayValue are packed arrays of numbers, made by the
+// ints() and floats() builtins. Oak programs can use them anywhere a list of
+// numbers is expected, and type() reports them as lists, but their elements
+// are stored unboxed so that numeric code and native elementwise operations
+// don't pay for a Value per element.
+//
+// Numbers stored into an int array are truncated to ints, and numbers stored
+// into a float array are converted to floats.
+type IntArrayValue []int64
+type FloatArrayValue []float64
+
+// numArray is implemented by the packed numeric array types.
+type numArray interface {
+	Value
+	length() int
+	at(i int) Value
+	// store sets the element at index i, or appends to the array if i is its
+	// length. It reports whether v is a number that can be stored.
+	store(i int, v Value) bool
+	list() *ListValue
+}
+
+func toInt(v Value) (int64, bool) {
+	switch n := v.(type) {
+	case IntValue:
+		return int64(n), true
+	case FloatValue:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+func toFloat(v Value) (float64, bool) {
+	switch n := v.(type) {
+	case IntValue:
+		return float64(n), true
+	case FloatValue:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func numArrayString(a numArray) string {
+	valStrings := make([]string, a.length())
+	for i := range valStrings {
+		valStrings[i] = a.at(i).String()
+	}
+	return "[" + strings.Join(valStrings, ", ") + "]"
+}
+
+func numArrayEq(a numArray, u Value) bool {
+	if _, ok := u.(EmptyValue); ok {
+		return true
+	}
+
+	var length int
+	var at func(int) Value
+	switch w := u.(type) {
+	case numArray:
+		length, at = w.length(), w.at
+	case *ListValue:
+		length, at = len(w.elems), func(i int) Value { return w.elems[i] }
+	default:
+		return false
+	}
+
+	if a.length() != length {
+		return false
+	}
+	for i := 0; i < length; i++ {
+		if !a.at(i).Eq(at(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *IntArrayValue) String() string {
+	return numArrayString(v)
+}
+func (v *IntArrayValue) Eq(u Value) bool {
+	return numArrayEq(v, u)
+}
+func (v *IntArrayValue) length() int {
+	return len(*v)
+}
+func (v *IntArrayValue) at(i int) Value {
+	return IntValue((*v)[i])
+}
+func (v *IntArrayValue) store(i int, x Value) bool {
+	n, ok := toInt(x)
+	if !ok {
+		return false
+	}
+	if i == len(*v) {
+		*v = append(*v, n)
+	} else {
+		(*v)[i] = n
+	}
+	return true
+}
+func (v *IntArrayValue) list() *ListValue {
+	elems := make([]Value, len(*v))
+	for i, n := range *v {
+		elems[i] = IntValue(n)
+	}
+	return MakeList(elems...)
+}
+
+func (v *FloatArrayValue) String() string {
+	return numArrayString(v)
+}
+func (v *FloatArrayValue) Eq(u Value) bool {
+	return numArrayEq(v, u)
+}
+func (v *FloatArrayValue) length() int {
+	return len(*v)
+}
+func (v *FloatArrayValue) at(i int) Value {
+	return FloatValue((*v)[i])
+}
+func (v *FloatArrayValue) store(i int, x Value) bool {
+	n, ok := toFloat(x)
+	if !ok {
+		return false
+	}
+	if i == len(*v) {
+		*v = append(*v, n)
+	} else {
+		(*v)[i] = n
+	}
+	return true
+}
+func (v *FloatArrayValue) list() *ListValue {
+	elems := make([]Value, len(*v))
+	for i, n := range *v {
+		elems[i] = FloatValue(n)
+	}
+	return MakeList(elems...)
+}
+
+// asList returns the elements of a list or packed numeric array as a list.
+func asList(v Value) (*ListValue, bool) {
+	switch list := v.(type) {
+	case *ListValue:
+		return list, true
+	case numArray:
+		return list.list(), true
+	}
+	return nil, false
+}
+
+// floatsOf returns the elements of a numeric array as floats, without copying
+// if it's already a float array.
+func floatsOf(a numArray) []float64 {
+	switch arr := a.(type) {
+	case *FloatArrayValue:
+		return *arr
+	case *IntArrayValue:
+		floats := make([]float64, len(*arr))
+		for i, n := range *arr {
+			floats[i] = float64(n)
+		}
+		return floats
+	}
+	panic(fmt.Sprintf("Unexpected numeric array type: %s", a))
+}
+
+// makeNumArray creates a packed array of the kind named by name ("ints" or
+// "floats") from arg, which is either a length or a list of numbers.
+func (c *Context) makeNumArray(name string, arg Value) (Value, *runtimeError) {
+	ints := name == "ints"
+
+	switch src := arg.(type) {
+	case IntValue:
+		if src < 0 {
+			return nil, &runtimeError{
+				kind:   "valueError",
+				reason: fmt.Sprintf("Cannot make %s of negative length %d", name, src),
+			}
+		}
+		if err := c.allocList(int(src), int(src)); err != nil {
+			return nil, err
+		}
+		if ints {
+			arr := make(IntArrayValue, src)
+			return &arr, nil
+		}
+		arr := make(FloatArrayValue, src)
+		return &arr, nil
+	case *ListValue, numArray:
+		list, _ := asList(src)
+		if err := c.allocList(len(list.elems), len(list.elems)); err != nil {
+			return nil, err
+		}
+		var arr numArray
+		if ints {
+			arr = &IntArrayValue{}
+		} else {
+			arr = &FloatArrayValue{}
+		}
+		for i, el := range list.elems {
+			if !arr.store(i, el) {
+				return nil, &runtimeError{
+					kind:   "typeError",
+					reason: fmt.Sprintf("%s() takes a list of numbers, but got %s in %s", name, el, src),
+				}
+			}
+		}
+		return arr, nil
+	}
+
+	return nil, &runtimeError{
+		kind:   "typeError",
+		reason: fmt.Sprintf("Mismatched types in call %s(%s)", name, arg),
+	}
+}
+
+// allocNumArrayOp records the allocation of the result of vadd or vscale on
+// the array a, which is as long as a.
+func (c *Context) allocNumArrayOp(a Value) *runtimeError {
+	if arr, ok := a.(numArray); ok {
+		return c.allocList(arr.length(), arr.length())
+	}
+	return nil
+}
+
+// numArrayOp applies an elementwise arithmetic operation to a numeric array
+// and either another numeric array of the same length or a number. The result
+// is an int array only if both operands are ints.
+func numArrayOp(name string, a, b Value, intOp func(x, y int64) int64, floatOp func(x, y float64) float64) (Value, *runtimeError) {
+	left, ok := a.(numArray)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call %s(%s, %s)", name, a, b),
+		}
+	}
+
+	switch right := b.(type) {
+	case IntValue, FloatValue:
+		if leftInts, ok := left.(*IntArrayValue); ok {
+			if n, ok := right.(IntValue); ok {
+				result := make(IntArrayValue, len(*leftInts))
+				for i, x := range *leftInts {
+					result[i] = intOp(x, int64(n))
+				}
+				return &result, nil
+			}
+		}
+
+		n, _ := toFloat(right)
+		xs := floatsOf(left)
+		result := make(FloatArrayValue, len(xs))
+		for i, x := range xs {
+			result[i] = floatOp(x, n)
+		}
+		return &result, nil
+	case numArray:
+		if left.length() != right.length() {
+			return nil, &runtimeError{
+				kind:   "valueError",
+				reason: fmt.Sprintf("Cannot %s arrays of different lengths %d and %d", name, left.length(), right.length()),
+			}
+		}
+
+		leftInts, ok1 := left.(*IntArrayValue)
+		rightInts, ok2 := right.(*IntArrayValue)
+		if ok1 && ok2 {
+			result := make(IntArrayValue, len(*leftInts))
+			for i, x := range *leftInts {
+				result[i] = intOp(x, (*rightInts)[i])
+			}
+			return &result, nil
+		}
+
+		xs, ys := floatsOf(left), floatsOf(right)
+		result := make(FloatArrayValue, len(xs))
+		for i, x := range xs {
+			result[i] = floatOp(x, ys[i])
+		}
+		return &result, nil
+	}
+
+	return nil, &runtimeError{
+		kind:   "typeError",
+		reason: fmt.Sprintf("Mismatched types in call %s(%s, %s)", name, a, b),
+	}
+}
+
+// rangeLen returns the number of elements in the range from start up to but
+// not including end, with the given step. If the range's length is within
+// rounding error of an integer, it's rounded, so that a float step that evenly
+// divides the range doesn't produce an extra element at its end.
+func rangeLen(start, end, step float64) (int, bool) {
+	if step == 0 {
+		return 0, true
+	}
+
+	q := (end - start) / step
+	if math.IsNaN(q) || math.IsInf(q, 0) {
+		return 0, false
+	}
+	if r := math.Round(q); math.Abs(q-r) < 1e-9*math.Max(1, math.Abs(r)) {
+		q = r
+	}
+	if q <= 0 {
+		return 0, true
+	}
+	return int(math.Ceil(q)), true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Static files embedded in packed binaries with oak pack --embed, and read by
+// the assets standard library.
+//
+// A packed binary with assets has them before its bundle, as a MessagePack map
+// of paths to file contents followed by its length and PackAssetsMagicBytes, in
+// the same way as the bundle itself. Binaries packed without assets are
+// unchanged.
+
+const PackAssetsMagicBytes = "assets\x10\x15"
+
+// packedAssets holds the files embedded in a packed binary, by path. It's nil
+// when the running program isn't a packed binary with assets.
+var packedAssets map[string][]byte
+
+// readPackAssets reads the assets of a packed binary whose bundle starts at
+// offset end, if it has any.
+func readPackAssets(c *Context, exeFile *os.File, end int64) (map[string][]byte, bool) {
+	readFrom := end - 24 - 8
+	if readFrom < 0 {
+		return nil, false
+	}
+	trailer := make([]byte, 24+8)
+	if _, err := exeFile.ReadAt(trailer, readFrom); err != nil {
+		return nil, false
+	}
+	if !bytes.Equal(trailer[24:], []byte(PackAssetsMagicBytes)) {
+		return nil, false
+	}
+
+	size, err := strconv.ParseInt(string(bytes.TrimLeft(trailer[:24], " ")), 10, 64)
+	if err != nil || size > readFrom {
+		return nil, false
+	}
+	data := make([]byte, size)
+	if _, err := exeFile.ReadAt(data, readFrom-size); err != nil {
+		return nil, false
+	}
+
+	d := msgpackDecoder{c: c, data: data}
+	v, runtimeErr := d.value()
+	if runtimeErr != nil {
+		return nil, false
+	}
+	files, ok := v.(ObjectValue)
+	if !ok {
+		return nil, false
+	}
+	assets := make(map[string][]byte, len(files))
+	for name, content := range files {
+		content, ok := content.(*StringValue)
+		if !ok {
+			return nil, false
+		}
+		assets[cleanAssetPath(name)] = *content
+	}
+	return assets, true
+}
+
+// cleanAssetPath returns the path under which an asset is stored, so that
+// paths like ./static/app.js and static/app.js read the same asset.
+func cleanAssetPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, "\\", "/")), "/")
+}
+
+func (c *Context) oakAssetsRead(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___assets_read", args, 1); err != nil {
+		return nil, err
+	}
+
+	name, ok := args[0].(*StringValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___assets_read(%s)", args[0]),
+		}
+	}
+
+	// programs that aren't packed read assets from disk, so that they run the
+	// same way before they're packed
+	if packedAssets == nil {
+		content, err := os.ReadFile(string(*name))
+		if err != nil {
+			return null, nil
+		}
+		return MakeString(string(content)), nil
+	}
+
+	content, ok := packedAssets[cleanAssetPath(string(*name))]
+	if !ok {
+		return null, nil
+	}
+	return MakeString(string(content)), nil
+}
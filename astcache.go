@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Caching parsed modules. Parsing takes up much of the startup time of short
+// programs that import large modules, like the standard libraries, so the
+// syntax tree of each module is saved to a cache directory as a .oakc file
+// named by a hash of its source, and loaded from there whenever the same
+// source is run again. The cache is best-effort: a module that can't be read
+// from or written to the cache is parsed as usual.
+//
+// Syntax trees are cached before they're resolved. Each node is a tag byte,
+// its position in the source, and its contents, encoded as in marshal.go.
+const astCacheVersion = 1
+
+// astCacheDisabled, if set, makes every module be parsed from source. It's set
+// with the --no-cache flag.
+var astCacheDisabled bool
+
+// astCacheMinSize is the size of the smallest source that's cached, since
+// very short programs parse faster than their cache files can be read.
+const astCacheMinSize = 1024
+
+// The cache keeps at most astCacheMaxFiles files, none older than
+// astCacheMaxAge, since files of changed sources or of earlier interpreter
+// binaries are never read again. Older files are removed whenever one is
+// written, and a module whose file was removed is parsed and cached again.
+const (
+	astCacheMaxFiles = 1000
+	astCacheMaxAge   = 30 * 24 * time.Hour
+)
+
+const (
+	astNil byte = iota
+	astEmpty
+	astNull
+	astString
+	astInt
+	astFloat
+	astBool
+	astAtom
+	astList
+	astSpread
+	astObject
+	astFn
+	astIdentifier
+	astAssignment
+	astPropertyAccess
+	astUnary
+	astBinary
+	astFnCall
+	astIfExpr
+	astBlock
+)
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendBool(buf []byte, b bool) []byte {
+	if b {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+
+func appendNodes(buf []byte, nodes []astNode) []byte {
+	buf = appendUvarint(buf, uint64(len(nodes)))
+	for _, node := range nodes {
+		buf = appendNode(buf, node)
+	}
+	return buf
+}
+
+func appendNode(buf []byte, node astNode) []byte {
+	if node == nil {
+		return append(buf, astNil)
+	}
+
+	var tag byte
+	switch node.(type) {
+	case emptyNode:
+		tag = astEmpty
+	case nullNode:
+		tag = astNull
+	case stringNode:
+		tag = astString
+	case intNode:
+		tag = astInt
+	case floatNode:
+		tag = astFloat
+	case boolNode:
+		tag = astBool
+	case atomNode:
+		tag = astAtom
+	case listNode:
+		tag = astList
+	case spreadNode:
+		tag = astSpread
+	case objectNode:
+		tag = astObject
+	case fnNode:
+		tag = astFn
+	case identifierNode:
+		tag = astIdentifier
+	case assignmentNode:
+		tag = astAssignment
+	case propertyAccessNode:
+		tag = astPropertyAccess
+	case unaryNode:
+		tag = astUnary
+	case binaryNode:
+		tag = astBinary
+	case fnCallNode:
+		tag = astFnCall
+	case ifExprNode:
+		tag = astIfExpr
+	case blockNode:
+		tag = astBlock
+	}
+	p := node.pos()
+	buf = append(buf, tag)
+	buf = appendUvarint(buf, uint64(p.offset))
+	buf = appendUvarint(buf, uint64(p.line))
+	buf = appendUvarint(buf, uint64(p.col))
+
+	switch n := node.(type) {
+	case stringNode:
+		buf = appendString(buf, string(n.payload))
+	case intNode:
+		buf = appendVarint(buf, n.payload)
+	case floatNode:
+		buf = appendFloat(buf, n.payload)
+	case boolNode:
+		buf = appendBool(buf, n.payload)
+	case atomNode:
+		buf = appendString(buf, n.payload)
+	case listNode:
+		buf = appendNodes(buf, n.elems)
+	case spreadNode:
+		buf = appendNode(buf, n.elem)
+	case objectNode:
+		buf = appendUvarint(buf, uint64(len(n.entries)))
+		for _, entry := range n.entries {
+			buf = appendNode(buf, entry.key)
+			buf = appendNode(buf, entry.val)
+		}
+	case fnNode:
+		buf = appendString(buf, n.name)
+		buf = appendUvarint(buf, uint64(len(n.args)))
+		for _, arg := range n.args {
+			buf = appendString(buf, arg)
+		}
+		buf = appendString(buf, n.restArg)
+		buf = appendNode(buf, n.body)
+		buf = appendString(buf, n.doc)
+	case identifierNode:
+		buf = appendString(buf, n.payload)
+	case assignmentNode:
+		buf = appendBool(buf, n.isLocal)
+		buf = appendNode(buf, n.left)
+		buf = appendNode(buf, n.right)
+		buf = appendString(buf, n.doc)
+	case propertyAccessNode:
+		buf = appendNode(buf, n.left)
+		buf = appendNode(buf, n.right)
+		buf = appendBool(buf, n.optional)
+	case unaryNode:
+		buf = appendUvarint(buf, uint64(n.op))
+		buf = appendNode(buf, n.right)
+	case binaryNode:
+		buf = appendUvarint(buf, uint64(n.op))
+		buf = appendNode(buf, n.left)
+		buf = appendNode(buf, n.right)
+	case fnCallNode:
+		buf = appendNode(buf, n.fn)
+		buf = appendNodes(buf, n.args)
+		buf = appendNode(buf, n.restArg)
+	case ifExprNode:
+		buf = appendNode(buf, n.cond)
+		buf = appendUvarint(buf, uint64(len(n.branches)))
+		for _, br := range n.branches {
+			buf = appendNode(buf, br.target)
+			buf = appendNode(buf, br.guard)
+			buf = appendNode(buf, br.body)
+		}
+	case blockNode:
+		buf = appendNodes(buf, n.exprs)
+	}
+	return buf
+}
+
+var errBadASTCache = errors.New("invalid cached syntax tree")
+
+// astDecoder decodes a syntax tree encoded by appendNodes.
+type astDecoder struct {
+	data []byte
+	i    int
+}
+
+func (d *astDecoder) uvarint() (uint64, error) {
+	n, size := binary.Uvarint(d.data[d.i:])
+	if size <= 0 {
+		return 0, errBadASTCache
+	}
+	d.i += size
+	return n, nil
+}
+
+// length reads a length prefix, which can't be greater than the number of
+// bytes left, since every element takes at least one byte.
+func (d *astDecoder) length() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)-d.i) {
+		return 0, errBadASTCache
+	}
+	return int(n), nil
+}
+
+func (d *astDecoder) string() (string, error) {
+	n, err := d.length()
+	if err != nil {
+		return "", err
+	}
+	s := string(d.data[d.i : d.i+n])
+	d.i += n
+	return s, nil
+}
+
+func (d *astDecoder) bool() (bool, error) {
+	if d.i >= len(d.data) {
+		return false, errBadASTCache
+	}
+	b := d.data[d.i] == 1
+	d.i++
+	return b, nil
+}
+
+func (d *astDecoder) nodes() ([]astNode, error) {
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]astNode, n)
+	for i := range nodes {
+		if nodes[i], err = d.node(); err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+func (d *astDecoder) node() (astNode, error) {
+	if d.i >= len(d.data) {
+		return nil, errBadASTCache
+	}
+	tag := d.data[d.i]
+	d.i++
+	if tag == astNil {
+		return nil, nil
+	}
+
+	var p [3]uint64
+	for j := range p {
+		n, err := d.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		p[j] = n
+	}
+	tok := &token{pos: pos{fileName: "(input)", offset: int(p[0]), line: int(p[1]), col: int(p[2])}}
+
+	// errors are collected in err, so that each case can read fields in order
+	// and check for errors once
+	var err error
+	str := func() string {
+		var s string
+		if err == nil {
+			s, err = d.string()
+		}
+		return s
+	}
+	boolean := func() bool {
+		var b bool
+		if err == nil {
+			b, err = d.bool()
+		}
+		return b
+	}
+	op := func() tokKind {
+		var n uint64
+		if err == nil {
+			n, err = d.uvarint()
+		}
+		return tokKind(n)
+	}
+	child := func() astNode {
+		var n astNode
+		if err == nil {
+			n, err = d.node()
+		}
+		return n
+	}
+	children := func() []astNode {
+		var ns []astNode
+		if err == nil {
+			ns, err = d.nodes()
+		}
+		return ns
+	}
+	count := func() int {
+		var n int
+		if err == nil {
+			n, err = d.length()
+		}
+		return n
+	}
+
+	var node astNode
+	switch tag {
+	case astEmpty:
+		node = emptyNode{tok: tok}
+	case astNull:
+		node = nullNode{tok: tok}
+	case astString:
+		node = stringNode{payload: []byte(str()), tok: tok}
+	case astInt:
+		n, size := binary.Varint(d.data[d.i:])
+		if size <= 0 {
+			return nil, errBadASTCache
+		}
+		d.i += size
+		node = intNode{payload: n, tok: tok}
+	case astFloat:
+		if len(d.data)-d.i < 8 {
+			return nil, errBadASTCache
+		}
+		f := math.Float64frombits(binary.BigEndian.Uint64(d.data[d.i:]))
+		d.i += 8
+		node = floatNode{payload: f, tok: tok}
+	case astBool:
+		node = boolNode{payload: boolean(), tok: tok}
+	case astAtom:
+		node = atomNode{payload: str(), tok: tok}
+	case astList:
+		node = listNode{elems: children(), tok: tok}
+	case astSpread:
+		node = spreadNode{elem: child(), tok: tok}
+	case astObject:
+		entries := make([]objectEntry, count())
+		for i := range entries {
+			entries[i] = objectEntry{key: child(), val: child()}
+		}
+		node = objectNode{entries: entries, tok: tok}
+	case astFn:
+		n := fnNode{name: str(), tok: tok}
+		n.args = make([]string, count())
+		for i := range n.args {
+			n.args[i] = str()
+		}
+		n.restArg = str()
+		n.body = child()
+		n.doc = str()
+		node = n
+	case astIdentifier:
+		node = identifierNode{payload: str(), tok: tok}
+	case astAssignment:
+		node = assignmentNode{isLocal: boolean(), left: child(), right: child(), doc: str(), tok: tok}
+	case astPropertyAccess:
+		node = propertyAccessNode{left: child(), right: child(), optional: boolean(), tok: tok}
+	case astUnary:
+		node = unaryNode{op: op(), right: child(), tok: tok}
+	case astBinary:
+		node = binaryNode{op: op(), left: child(), right: child(), tok: tok}
+	case astFnCall:
+		node = fnCallNode{fn: child(), args: children(), restArg: child(), tok: tok}
+	case astIfExpr:
+		n := ifExprNode{cond: child(), tok: tok}
+		n.branches = make([]ifBranch, count())
+		for i := range n.branches {
+			n.branches[i] = ifBranch{target: child(), guard: child(), body: child()}
+		}
+		node = n
+	case astBlock:
+		node = blockNode{exprs: children(), tok: tok}
+	default:
+		return nil, errBadASTCache
+	}
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// astCachePath returns the path of the cache file for a module's source. The
+// cache is keyed by the interpreter binary too, because the encoding of
+// syntax trees may change between versions.
+func astCachePath(src []byte) (string, error) {
+	dir, err := oakCacheDir()
+	if err != nil {
+		return "", err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %d %d\n", astCacheVersion, info.Size(), info.ModTime().UnixNano())
+	h.Write(src)
+	return filepath.Join(dir, "oakc", fmt.Sprintf("%x.oakc", h.Sum(nil))), nil
+}
+
+func readASTCache(cachePath string) ([]astNode, bool) {
+	data, err := os.ReadFile(cachePath)
+	if err != nil || len(data) == 0 || data[0] != astCacheVersion {
+		return nil, false
+	}
+	d := astDecoder{data: data, i: 1}
+	nodes, err := d.nodes()
+	if err != nil || d.i != len(data) {
+		return nil, false
+	}
+	return nodes, true
+}
+
+// writeASTCache writes a cache file through a temporary file, so that other
+// processes never read a partly written file.
+func writeASTCache(cachePath string, nodes []astNode) {
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), ".oakc-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(appendNodes([]byte{astCacheVersion}, nodes))
+	if closeErr := tmp.Close(); err != nil || closeErr != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if err := os.Rename(tmp.Name(), cachePath); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	pruneASTCache(filepath.Dir(cachePath))
+}
+
+// pruneASTCache removes the files in the cache directory dir past the newest
+// astCacheMaxFiles, and any written longer than astCacheMaxAge ago.
+func pruneASTCache(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) <= 1 {
+		return
+	}
+
+	type cacheFile struct {
+		path string
+		mod  time.Time
+	}
+	files := make([]cacheFile, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, cacheFile{path: filepath.Join(dir, entry.Name()), mod: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mod.After(files[j].mod) })
+
+	now := time.Now()
+	for i, file := range files {
+		if i >= astCacheMaxFiles || now.Sub(file.mod) > astCacheMaxAge {
+			os.Remove(file.path)
+		}
+	}
+}
+
+// parseCached parses the source of a module, or loads its syntax tree from the
+// cache if it's been parsed before.
+func parseCached(src []byte) ([]astNode, error) {
+	cachePath := ""
+	if !astCacheDisabled && len(src) >= astCacheMinSize {
+		if p, err := astCachePath(src); err == nil {
+			cachePath = p
+			if nodes, ok := readASTCache(cachePath); ok {
+				return nodes, nil
+			}
+		}
+	}
+
+	tokenizer := newReaderTokenizer(bytes.NewReader(src))
+	parser := newStreamingParser(&tokenizer)
+	nodes, err := parser.parse()
+	if tokenizer.err != nil {
+		return nil, tokenizer.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cachePath != "" {
+		writeASTCache(cachePath, nodes)
+	}
+	return nodes, nil
+}
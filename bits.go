@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Native implementations of the bits standard library, which shifts, rotates,
+// and complements the bits of ints as 64-bit two's complement numbers. Rotates
+// and logical shifts may work on a narrower width of bits, like 32 for hashes
+// defined on 32-bit words.
+
+// bitsArgs returns the arguments to the builtin name as ints: count ints, and
+// then, if withWidth is set, the width of bits to work on, which may be ? or
+// missing for 64.
+func bitsArgs(name string, args []Value, count int, withWidth bool) ([]int64, uint, *runtimeError) {
+	if len(args) < count {
+		return nil, 0, &runtimeError{
+			kind:   "argumentError",
+			reason: fmt.Sprintf("%s requires %d arguments, got %d", name, count, len(args)),
+		}
+	}
+
+	ints := make([]int64, count)
+	for i, arg := range args[:count] {
+		n, ok := arg.(IntValue)
+		if !ok {
+			return nil, 0, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Argument %d to %s must be an int, got %s", i, name, arg),
+			}
+		}
+		ints[i] = int64(n)
+	}
+
+	width := uint(64)
+	if withWidth && len(args) > count {
+		switch arg := args[count].(type) {
+		case NullValue:
+		case IntValue:
+			if arg < 1 || arg > 64 {
+				return nil, 0, &runtimeError{
+					kind:   "valueError",
+					reason: fmt.Sprintf("Width of bits to %s must be between 1 and 64, got %d", name, arg),
+				}
+			}
+			width = uint(arg)
+		default:
+			return nil, 0, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Width of bits to %s must be an int, got %s", name, arg),
+			}
+		}
+	}
+	return ints, width, nil
+}
+
+// bitsShift returns a shift count argument to the builtin name, which must not
+// be negative.
+func bitsShift(name string, k int64) (uint, *runtimeError) {
+	if k < 0 {
+		return 0, &runtimeError{
+			kind:   "valueError",
+			reason: fmt.Sprintf("Shift count to %s must not be negative, got %d", name, k),
+		}
+	}
+	if k > 64 {
+		k = 64
+	}
+	return uint(k), nil
+}
+
+// bitsMask returns the mask of the low width bits of a 64-bit int.
+func bitsMask(width uint) uint64 {
+	if width == 64 {
+		return ^uint64(0)
+	}
+	return 1<<width - 1
+}
+
+func (c *Context) oakBitsShl(args []Value) (Value, *runtimeError) {
+	ints, _, err := bitsArgs("___bits_shl", args, 2, false)
+	if err != nil {
+		return nil, err
+	}
+	k, err := bitsShift("___bits_shl", ints[1])
+	if err != nil {
+		return nil, err
+	}
+	return IntValue(ints[0] << k), nil
+}
+
+// oakBitsShr shifts an int right, copying its sign bit into the high bits.
+func (c *Context) oakBitsShr(args []Value) (Value, *runtimeError) {
+	ints, _, err := bitsArgs("___bits_shr", args, 2, false)
+	if err != nil {
+		return nil, err
+	}
+	k, err := bitsShift("___bits_shr", ints[1])
+	if err != nil {
+		return nil, err
+	}
+	return IntValue(ints[0] >> k), nil
+}
+
+// oakBitsUshr shifts the low width bits of an int right as an unsigned
+// number, filling the high bits with zeroes.
+func (c *Context) oakBitsUshr(args []Value) (Value, *runtimeError) {
+	ints, width, err := bitsArgs("___bits_ushr", args, 2, true)
+	if err != nil {
+		return nil, err
+	}
+	k, err := bitsShift("___bits_ushr", ints[1])
+	if err != nil {
+		return nil, err
+	}
+	return IntValue(int64((uint64(ints[0]) & bitsMask(width)) >> k)), nil
+}
+
+// oakBitsRotl rotates the low width bits of an int left by k bits, or right
+// if k is negative.
+func (c *Context) oakBitsRotl(args []Value) (Value, *runtimeError) {
+	ints, width, err := bitsArgs("___bits_rotl", args, 2, true)
+	if err != nil {
+		return nil, err
+	}
+
+	n := uint64(ints[0]) & bitsMask(width)
+	k := uint(((ints[1] % int64(width)) + int64(width)) % int64(width))
+	if k == 0 {
+		return IntValue(int64(n)), nil
+	}
+	return IntValue(int64((n<<k | n>>(width-k)) & bitsMask(width))), nil
+}
+
+func (c *Context) oakBitsNot(args []Value) (Value, *runtimeError) {
+	ints, _, err := bitsArgs("___bits_not", args, 1, false)
+	if err != nil {
+		return nil, err
+	}
+	return IntValue(^ints[0]), nil
+}
@@ -1,3 +1,6 @@
+//go:build !js
+// +build !js
+
 package main
 
 import (
@@ -6,10 +9,20 @@ import (
 	_ "embed"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
 
 	"github.com/chzyer/readline"
 )
@@ -34,13 +47,37 @@ var cmdpack string
 //go:embed cmd/build.oak
 var cmdbuild string
 
+//go:embed cmd/site.oak
+var cmdsite string
+
+//go:embed cmd/deps.oak
+var cmddeps string
+
+//go:embed cmd/ast.oak
+var cmdast string
+
+//go:embed cmd/lint.oak
+var cmdlint string
+
+//go:embed cmd/typecheck.oak
+var cmdtypecheck string
+
+//go:embed cmd/bench.oak
+var cmdbench string
+
 var cliCommands = map[string]string{
-	"version": cmdversion,
-	"help":    cmdhelp,
-	"cat":     cmdcat,
-	"fmt":     cmdfmt,
-	"pack":    cmdpack,
-	"build":   cmdbuild,
+	"version":   cmdversion,
+	"help":      cmdhelp,
+	"cat":       cmdcat,
+	"fmt":       cmdfmt,
+	"pack":      cmdpack,
+	"build":     cmdbuild,
+	"site":      cmdsite,
+	"deps":      cmddeps,
+	"ast":       cmdast,
+	"lint":      cmdlint,
+	"typecheck": cmdtypecheck,
+	"bench":     cmdbench,
 }
 
 func isStdinReadable() bool {
@@ -49,16 +86,42 @@ func isStdinReadable() bool {
 }
 
 func performCommandIfExists(command string) bool {
+	if command == "--trace" || strings.HasPrefix(command, "--trace=") {
+		runWithTrace(strings.TrimPrefix(strings.TrimPrefix(command, "--trace"), "="))
+		return true
+	}
+
 	switch command {
 	case "repl":
-		runRepl()
+		runRepl(replLoadPaths(os.Args[2:]))
 		return true
-	case "eval":
+	case "eval", "-e", "--eval":
 		runEval()
 		return true
 	case "pipe":
 		runPipe()
 		return true
+	case "--watch", "-w":
+		runWatch()
+		return true
+	case "--timeout", "-t":
+		runWithTimeout()
+		return true
+	case "--offline":
+		runOffline()
+		return true
+	case "--no-cache":
+		runNoCache()
+		return true
+	case "--no-plugins":
+		runNoPlugins()
+		return true
+	case "get":
+		runGet(os.Args[2:])
+		return true
+	case "kernel":
+		runKernel(os.Args[2:])
+		return true
 	}
 
 	commandProgram, ok := cliCommands[command]
@@ -132,6 +195,10 @@ func runPackFile() bool {
 	defer ctx.Wait()
 	ctx.LoadBuiltins()
 
+	if assets, ok := readPackAssets(&ctx, exeFile, readBundleFrom); ok {
+		packedAssets = assets
+	}
+
 	if _, err := ctx.Eval(bytes.NewReader(bundleBytes)); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -140,6 +207,102 @@ func runPackFile() bool {
 	return true
 }
 
+// evalTimeout, if nonzero, is how long a program run from a file or stdin may
+// run before it is cancelled. It's set with the --timeout flag.
+var evalTimeout time.Duration
+
+// cancelAfterTimeout ends the program run in ctx with an error once
+// evalTimeout passes. Cancelling the context would only stop code that's
+// running, and a program can just as well be waiting forever on a server, a
+// timer, or input(), so the process exits instead.
+func cancelAfterTimeout(ctx *Context) {
+	if evalTimeout > 0 {
+		time.AfterFunc(evalTimeout, func() {
+			ctx.Cancel()
+			flushStdStreams()
+			restoreTerminal()
+			fmt.Printf("Program timed out after %s\n", evalTimeout)
+			os.Exit(1)
+		})
+	}
+}
+
+func runWithTimeout() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: oak --timeout <duration> [filename] [arguments]")
+		os.Exit(1)
+	}
+
+	timeout, err := time.ParseDuration(os.Args[2])
+	if err != nil || timeout <= 0 {
+		fmt.Printf("Invalid timeout %s, expected a duration like 5s or 100ms\n", os.Args[2])
+		os.Exit(1)
+	}
+	evalTimeout = timeout
+
+	// the program sees its arguments as if it were run without --timeout
+	os.Args = append(os.Args[:1], os.Args[3:]...)
+	if len(os.Args) > 1 {
+		runFile(os.Args[1])
+	} else {
+		runStdin()
+	}
+}
+
+// evalTrace, if set, traces function calls in a program run from a file or
+// stdin. It's set with the --trace flag.
+var evalTrace *tracer
+
+func traceIfEnabled(ctx *Context) {
+	if evalTrace != nil {
+		ctx.SetTrace(evalTrace.out, evalTrace.pattern)
+	}
+}
+
+func runWithTrace(pattern string) {
+	evalTrace = &tracer{out: stderrStream}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			fmt.Printf("Invalid trace pattern %s: %s\n", pattern, err)
+			os.Exit(1)
+		}
+		evalTrace.pattern = re
+	}
+	runWithoutFlag()
+}
+
+// runWithoutFlag removes a global flag like --offline from the command line,
+// and runs the command, program, or REPL that the rest of it asks for. The
+// program sees its arguments as if it were run without the flag.
+func runWithoutFlag() {
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	if len(os.Args) > 1 {
+		if isCommand := performCommandIfExists(os.Args[1]); !isCommand {
+			runFile(os.Args[1])
+		}
+	} else if isStdinReadable() {
+		runStdin()
+	} else {
+		runRepl(nil)
+	}
+}
+
+func runOffline() {
+	remoteOffline = true
+	runWithoutFlag()
+}
+
+func runNoCache() {
+	astCacheDisabled = true
+	runWithoutFlag()
+}
+
+func runNoPlugins() {
+	pluginsDisabled = true
+	runWithoutFlag()
+}
+
 func runFile(filePath string) {
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -148,11 +311,20 @@ func runFile(filePath string) {
 	}
 	defer file.Close()
 
+	src, err := io.ReadAll(file)
+	if err != nil {
+		fmt.Printf("Could not read %s: %s\n", filePath, err)
+		os.Exit(1)
+	}
+
 	ctx := NewContext(path.Dir(filePath))
 	defer ctx.Wait()
 	ctx.LoadBuiltins()
+	ctx.LoadPlugins()
+	cancelAfterTimeout(&ctx)
+	traceIfEnabled(&ctx)
 
-	if _, err = ctx.Eval(file); err != nil {
+	if _, err = ctx.EvalSource(src); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -162,6 +334,9 @@ func runStdin() {
 	ctx := NewContextWithCwd()
 	defer ctx.Wait()
 	ctx.LoadBuiltins()
+	ctx.LoadPlugins()
+	cancelAfterTimeout(&ctx)
+	traceIfEnabled(&ctx)
 
 	if _, err := ctx.Eval(os.Stdin); err != nil {
 		fmt.Println(err)
@@ -169,28 +344,377 @@ func runStdin() {
 	}
 }
 
-func runRepl() {
+// replLoadPaths collects the files passed to `oak repl` with --load (or -l)
+// flags, in the order they appear on the command line. Both `--load a.oak`
+// and `--load=a.oak` forms are accepted.
+func replLoadPaths(args []string) []string {
+	paths := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--load" || arg == "-l":
+			if i+1 < len(args) {
+				paths = append(paths, args[i+1])
+				i++
+			}
+		case strings.HasPrefix(arg, "--load="):
+			paths = append(paths, strings.TrimPrefix(arg, "--load="))
+		}
+	}
+	return paths
+}
+
+// replCommands lists meta-commands available in the REPL, invoked as
+// `:command [argument]`. Lines beginning with any other atom are evaluated as
+// Oak programs as usual, so meta-commands never shadow atom literals that are
+// not in this table.
+var replCommands = map[string]string{
+	"help":    "list available meta-commands",
+	"load":    "evaluate Oak source files into the REPL scope",
+	"type":    "evaluate an expression and print the type of its value",
+	"time":    "evaluate an expression and report how long it took",
+	"env":     "list bindings defined in the REPL scope",
+	"clear":   "reset the REPL scope and imported modules to a fresh environment",
+	"save":    "save REPL bindings to a file, " + replSessionFile + " by default",
+	"restore": "restore REPL bindings saved with :save",
+	"res":     "print result __n, or all recent results",
+	"exit":    "exit the REPL",
+}
+
+// replSessionFile is the default file used by :save and :restore
+const replSessionFile = "session.oak"
+
+// replResultLimit is the number of recent results the REPL keeps as __1,
+// __2, and so on, with __1 the most recent.
+const replResultLimit = 10
+
+// pushReplResult keeps a result evaluated in the REPL as __ and __1, moving
+// earlier results down the stack of recent results.
+func (c *Context) pushReplResult(val Value) {
+	for i := replResultLimit; i > 1; i-- {
+		if prev, ok := c.scope.vars["__"+strconv.Itoa(i-1)]; ok {
+			c.scope.put("__"+strconv.Itoa(i), prev)
+		}
+	}
+	c.scope.put("__1", val)
+	c.scope.put("__", val)
+}
+
+// parseReplCommand reports whether a line of REPL input is a meta-command,
+// and if so, returns its name and argument string.
+func parseReplCommand(line string) (name, arg string, ok bool) {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, ":") {
+		return "", "", false
+	}
+
+	name = trimmed[1:]
+	if idx := strings.IndexAny(name, " \t"); idx >= 0 {
+		name, arg = name[:idx], strings.TrimSpace(name[idx+1:])
+	}
+	_, ok = replCommands[name]
+	return name, arg, ok
+}
+
+// loadFile evaluates an Oak source file into the top-level scope of the
+// context. Imports within the file are resolved relative to the file itself.
+func (c *Context) loadFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("Could not open %s: %s", filePath, err)
+	}
+	defer file.Close()
+
+	rootPath := c.rootPath
+	c.rootPath = path.Dir(filePath)
+	defer func() { c.rootPath = rootPath }()
+
+	_, err = c.Eval(file)
+	return err
+}
+
+// replBindings returns the sorted names of top-level bindings in the REPL
+// scope, excluding builtins and auto-imported standard libraries, which are
+// always present and would only bury the user's own bindings.
+func (c *Context) replBindings() []string {
+	names := make([]string, 0, len(c.scope.vars))
+	for name, val := range c.scope.vars {
+		if _, ok := val.(BuiltinFnValue); ok {
+			continue
+		}
+		if isStdLib(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// serializeValue renders an Oak value as Oak source text that evaluates back
+// to an equal value. Functions and lists or objects that contain themselves
+// cannot be serialized, so serializeValue reports false for them and for any
+// composite value containing them. parents holds the lists, objects, and maps
+// that contain v, as in stringify.
+func serializeValue(v Value, parents map[uintptr]bool) (string, bool) {
+	if id, ok := containerID(v); ok {
+		if parents[id] {
+			return "", false
+		}
+		parents[id] = true
+		defer delete(parents, id)
+	}
+
+	switch val := v.(type) {
+	case NullValue:
+		return "?", true
+	case EmptyValue:
+		return "_", true
+	case IntValue, BoolValue:
+		return val.String(), true
+	case FloatValue:
+		// NaN and infinities have no literal, but float() parses them
+		if math.IsNaN(float64(val)) || math.IsInf(float64(val), 0) {
+			return "float('" + val.String() + "')", true
+		}
+		src := strconv.FormatFloat(float64(val), 'f', -1, 64)
+		if !strings.ContainsRune(src, '.') {
+			src += ".0"
+		}
+		return src, true
+	case DecimalValue:
+		return "decimal(" + quoteOakString([]byte(val.rat.RatString())) + ")", true
+	case *StringValue:
+		return quoteOakString(*val), true
+	case AtomValue:
+		name := string(val)
+		if isValidIdentifier(name) {
+			return ":" + name, true
+		}
+		return "atom(" + quoteOakString([]byte(name)) + ")", true
+	case numArray:
+		return serializeValue(val.list(), parents)
+	case *ListValue:
+		elems := make([]string, len(val.elems))
+		for i, el := range val.elems {
+			src, ok := serializeValue(el, parents)
+			if !ok {
+				return "", false
+			}
+			elems[i] = src
+		}
+		return "[" + strings.Join(elems, ", ") + "]", true
+	case ObjectValue:
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		entries := make([]string, len(keys))
+		for i, key := range keys {
+			src, ok := serializeValue(val[key], parents)
+			if !ok {
+				return "", false
+			}
+			entries[i] = quoteOakString([]byte(key)) + ": " + src
+		}
+		return "{" + strings.Join(entries, ", ") + "}", true
+	case *MapValue:
+		entries := make([]string, 0, val.len())
+		ok := true
+		val.each(func(key, el Value) {
+			keySrc, keyOk := serializeValue(key, parents)
+			elSrc, elOk := serializeValue(el, parents)
+			ok = ok && keyOk && elOk
+			entries = append(entries, "["+keySrc+", "+elSrc+"]")
+		})
+		if !ok {
+			return "", false
+		}
+		return "map([" + strings.Join(entries, ", ") + "])", true
+	}
+	return "", false
+}
+
+// isValidIdentifier reports whether a string may be used as a bare Oak
+// identifier, for example as the name of an atom literal.
+func isValidIdentifier(name string) bool {
+	if name == "" || name == "_" {
+		return false
+	}
+	for i, c := range name {
+		if unicode.IsLetter(c) || c == '_' || c == '?' || c == '!' {
+			continue
+		}
+		if i > 0 && unicode.IsDigit(c) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// performReplCommand runs a REPL meta-command by name. It reports whether the
+// REPL should exit after the command.
+func (c *Context) performReplCommand(name, arg string) (exit bool) {
+	switch name {
+	case "help":
+		names := make([]string, 0, len(replCommands))
+		for name := range replCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  :%-8s %s\n", name, replCommands[name])
+		}
+	case "type":
+		if arg == "" {
+			fmt.Println("Usage: :type <expr>")
+			return
+		}
+		val, err := c.Eval(strings.NewReader(arg))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		typ, _ := c.oakType([]Value{val})
+		fmt.Println(typ)
+	case "time":
+		if arg == "" {
+			fmt.Println("Usage: :time <expr>")
+			return
+		}
+		start := time.Now()
+		val, err := c.Eval(strings.NewReader(arg))
+		elapsed := time.Since(start)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println(val)
+		}
+		fmt.Printf("(%s)\n", elapsed)
+	case "env":
+		for _, name := range c.replBindings() {
+			typ, _ := c.oakType([]Value{c.scope.vars[name]})
+			fmt.Printf("  %s %s\n", name, typ)
+		}
+	case "save":
+		filePath := arg
+		if filePath == "" {
+			filePath = replSessionFile
+		}
+
+		session := strings.Builder{}
+		session.WriteString("// oak repl session\n")
+		for _, name := range c.replBindings() {
+			src, ok := serializeValue(c.scope.vars[name], map[uintptr]bool{})
+			if !ok {
+				fmt.Printf("Skipping %s, which cannot be saved\n", name)
+				continue
+			}
+			session.WriteString(name + " := " + src + "\n")
+		}
+
+		if err := os.WriteFile(filePath, []byte(session.String()), 0644); err != nil {
+			fmt.Printf("Could not save session to %s: %s\n", filePath, err)
+		}
+	case "restore":
+		filePath := arg
+		if filePath == "" {
+			filePath = replSessionFile
+		}
+		if err := c.loadFile(filePath); err != nil {
+			fmt.Println(err)
+		}
+	case "clear":
+		c.scope = scope{
+			parent: nil,
+			vars:   map[string]Value{},
+		}
+		c.eng.mainScope = c.scope
+		// imported modules are evaluated again the next time they're imported
+		c.eng.importMap = map[string]scope{}
+		c.LoadBuiltins()
+		c.LoadPlugins()
+		if err := c.loadAllLibs(); err != nil {
+			fmt.Println(err)
+		}
+	case "res":
+		if arg == "" {
+			for i := 1; i <= replResultLimit; i++ {
+				if val, ok := c.scope.vars["__"+strconv.Itoa(i)]; ok {
+					fmt.Printf("  __%-3d %s\n", i, val)
+				}
+			}
+			return
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > replResultLimit {
+			fmt.Printf("Usage: :res [n], where n is between 1 and %d\n", replResultLimit)
+			return
+		}
+		if val, ok := c.scope.vars["__"+strconv.Itoa(n)]; ok {
+			fmt.Println(val)
+		} else {
+			fmt.Printf("No result __%d\n", n)
+		}
+	case "exit":
+		return true
+	case "load":
+		paths := strings.Fields(arg)
+		if len(paths) == 0 {
+			fmt.Println("Usage: :load <file> [files...]")
+			return
+		}
+		for _, filePath := range paths {
+			if err := c.loadFile(filePath); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+	}
+	return false
+}
+
+func runRepl(loadPaths []string) {
 	var historyFilePath string
 	homeDir, err := os.UserHomeDir()
 	if err == nil {
 		historyFilePath = path.Join(homeDir, ".oak_history")
 	}
 
+	// history is saved to historyFilePath by replHistory rather than by
+	// readline, which rewrites the file when it grows too long
 	rl, err := readline.NewEx(&readline.Config{
-		Prompt:      "> ",
-		HistoryFile: historyFilePath,
+		Prompt:                 "> ",
+		Painter:                replPainter{},
+		HistoryLimit:           replHistoryLimit,
+		HistorySearchFold:      true,
+		DisableAutoSaveHistory: true,
 	})
 	if err != nil {
 		fmt.Println("Could not open the repl")
 		os.Exit(1)
 	}
 	defer rl.Close()
+	history := openReplHistory(historyFilePath, func(line string) {
+		rl.SaveHistory(line)
+	})
 
 	ctx := NewContextWithCwd()
 	ctx.LoadBuiltins()
+	ctx.LoadPlugins()
 	ctx.mustLoadAllLibs()
 
+	for _, filePath := range loadPaths {
+		if err := ctx.loadFile(filePath); err != nil {
+			fmt.Println(err)
+		}
+	}
+
 	for {
+		history.merge()
 		line, err := rl.Readline()
 		if err != nil { // io.EOF
 			break
@@ -200,6 +724,14 @@ func runRepl() {
 		if strings.TrimSpace(line) == "" {
 			continue
 		}
+		history.save(line)
+
+		if name, arg, ok := parseReplCommand(line); ok {
+			if exit := ctx.performReplCommand(name, arg); exit {
+				break
+			}
+			continue
+		}
 
 		val, err := ctx.Eval(strings.NewReader(line))
 		if err != nil {
@@ -208,15 +740,21 @@ func runRepl() {
 		}
 		fmt.Println(val)
 
-		// keep last evaluated result as __ in REPL
-		ctx.scope.put("__", val)
+		// keep recently evaluated results as __, __1, __2... in REPL
+		ctx.pushReplResult(val)
 	}
 }
 
 func runEval() {
+	if len(os.Args) == 3 && os.Args[2] == "--stdio" {
+		runEvalSession(os.Stdin, os.Stdout)
+		return
+	}
+
 	ctx := NewContextWithCwd()
 	defer ctx.Wait()
 	ctx.LoadBuiltins()
+	ctx.LoadPlugins()
 	ctx.mustLoadAllLibs()
 
 	if isStdinReadable() {
@@ -246,6 +784,7 @@ func runPipe() {
 	ctx := NewContextWithCwd()
 	defer ctx.Wait()
 	ctx.LoadBuiltins()
+	ctx.LoadPlugins()
 	ctx.mustLoadAllLibs()
 
 	rootScope := ctx.scope
@@ -293,3 +832,168 @@ func runPipe() {
 		}
 	}
 }
+
+// staticImports returns the absolute paths of all Oak source files statically
+// imported by the file at filePath, including filePath itself and transitive
+// imports. Imports are resolved as import() resolves them. Standard libraries,
+// URLs, and imports of dynamically computed paths are ignored, as are files
+// that cannot be read or parsed.
+func staticImports(filePath string) []string {
+	seen := map[string]bool{}
+	paths := []string{}
+
+	var visitFile func(string)
+	visitFile = func(filePath string) {
+		if seen[filePath] {
+			return
+		}
+		seen[filePath] = true
+		paths = append(paths, filePath)
+
+		program, err := os.ReadFile(filePath)
+		if err != nil {
+			return
+		}
+		tokenizer := newTokenizer(string(program))
+		parser := newParser(tokenizer.tokenize())
+		nodes, err := parser.parse()
+		if err != nil {
+			return
+		}
+
+		for _, node := range nodes {
+			walkNode(node, func(node astNode) bool {
+				call, ok := node.(fnCallNode)
+				if !ok || len(call.args) != 1 {
+					return true
+				}
+				if ident, ok := call.fn.(identifierNode); !ok || ident.payload != "import" {
+					return true
+				}
+				pathNode, ok := call.args[0].(stringNode)
+				if !ok || isStdLib(string(pathNode.payload)) || isRemoteImport(string(pathNode.payload)) {
+					return true
+				}
+
+				// a module that doesn't exist yet is watched at the first
+				// path import() would try, so creating it is a change
+				ctx := NewContext(filepath.Dir(filePath))
+				importPath, tried := ctx.resolveModule(string(pathNode.payload))
+				if importPath == "" {
+					importPath = tried[0]
+				}
+				visitFile(importPath)
+				return true
+			})
+		}
+	}
+
+	if absPath, err := filepath.Abs(filePath); err == nil {
+		visitFile(absPath)
+	}
+	return paths
+}
+
+// modTimes returns the last modification time of each file, or the zero time
+// for files that do not exist
+func modTimes(paths []string) map[string]time.Time {
+	times := map[string]time.Time{}
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			times[p] = info.ModTime()
+		} else {
+			times[p] = time.Time{}
+		}
+	}
+	return times
+}
+
+// waitForChange blocks until any of the given files change on disk, then
+// waits until changes settle for a short debounce period before returning.
+func waitForChange(paths []string) {
+	const pollInterval = 250 * time.Millisecond
+	const debounce = 100 * time.Millisecond
+
+	changed := func(before map[string]time.Time) bool {
+		for p, t := range modTimes(paths) {
+			if !t.Equal(before[p]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	last := modTimes(paths)
+	for !changed(last) {
+		time.Sleep(pollInterval)
+	}
+	for {
+		last = modTimes(paths)
+		time.Sleep(debounce)
+		if !changed(last) {
+			return
+		}
+	}
+}
+
+// runWatch runs an Oak program and re-runs it from scratch whenever the
+// entrypoint or any file it statically imports changes. Each run happens in a
+// fresh child process, so a restart tears down all pending asynchronous work
+// of the previous run, including open servers and timers.
+func runWatch() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: oak --watch <filename> [arguments]")
+		os.Exit(1)
+	}
+	filePath := os.Args[2]
+
+	exePath, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Could not find the Oak interpreter: %s\n", err)
+		os.Exit(1)
+	}
+
+	// make sure the running program does not outlive the watcher
+	var running *exec.Cmd
+	var runningLock sync.Mutex
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		runningLock.Lock()
+		if running != nil {
+			_ = running.Process.Kill()
+		}
+		os.Exit(1)
+	}()
+
+	for {
+		cmd := exec.Command(exePath, os.Args[2:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		runningLock.Lock()
+		if err := cmd.Start(); err != nil {
+			fmt.Printf("[oak --watch] Could not run %s: %s\n", filePath, err)
+			os.Exit(1)
+		}
+		running = cmd
+		runningLock.Unlock()
+
+		exited := make(chan struct{})
+		go func() {
+			_ = cmd.Wait()
+			close(exited)
+		}()
+
+		waitForChange(staticImports(filePath))
+
+		select {
+		case <-exited:
+		default:
+			_ = cmd.Process.Kill()
+			<-exited
+		}
+		fmt.Printf("[oak --watch] Restarting %s\n", filePath)
+	}
+}
@@ -0,0 +1,1069 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain runs the oak command instead of the tests when the test binary is
+// started by runCommand, so commands can be tested in a child process.
+func TestMain(m *testing.M) {
+	if args := os.Getenv("OAK_TEST_COMMAND_ARGS"); args != "" {
+		os.Args = append([]string{"oak"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCommand runs oak with args and stdin in a child process, since commands
+// read and write the standard streams and may exit the process. It returns
+// the command's standard output and exit code.
+func runCommand(t *testing.T, stdin string, args ...string) (string, int) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "OAK_TEST_COMMAND_ARGS="+strings.Join(args, "\n"))
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(out), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("Could not run oak %s: %s", strings.Join(args, " "), err)
+	}
+	return string(out), 0
+}
+
+func TestTimeoutStopsWaitingProgram(t *testing.T) {
+	// the program runs in a child process, since timing out exits it
+	if prog := os.Getenv("OAK_TEST_TIMEOUT_PROGRAM"); prog != "" {
+		evalTimeout = 100 * time.Millisecond
+		runFile(prog)
+		return
+	}
+
+	dir := t.TempDir()
+	for name, program := range map[string]string{
+		"listen": `listen('127.0.0.1:0', fn(evt) ?)`,
+		"input":  `input(fn(evt) ?)`,
+		"wait":   `wait(60, fn {})`,
+	} {
+		prog := filepath.Join(dir, name+".oak")
+		os.WriteFile(prog, []byte(program), 0644)
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestTimeoutStopsWaitingProgram$")
+		cmd.Env = append(os.Environ(), "OAK_TEST_TIMEOUT_PROGRAM="+prog)
+		// stdin is left open, so input() waits for it
+		stdin, _ := cmd.StdinPipe()
+		defer stdin.Close()
+
+		start := time.Now()
+		out, err := cmd.Output()
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+			t.Errorf("Expected %s to exit with status 1 on timeout, got %v", name, err)
+		}
+		if !strings.Contains(string(out), "Program timed out after 100ms") {
+			t.Errorf("Expected %s to report a timeout, got %q", name, out)
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("Expected %s to stop soon after its timeout, took %s", name, elapsed)
+		}
+	}
+}
+
+func TestSiteCommand(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"content/index.md":       "---\ntitle: Home\n---\n# Welcome\n",
+		"content/posts/first.md": "---\ntitle: First\nlayout: post\n---\nHello **world**\n",
+		"content/posts/draft.md": "---\ntitle: Draft\ndraft: true\n---\nNot yet\n",
+		"content/style.css":      "body {}\n",
+		"templates/post.html":    "<h1>{{ page.title }}</h1>{{ raw content }}{{ each p in site.pages }}[{{ p.url }}]{{ end }}",
+	} {
+		filePath := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{"oak", "site",
+		"--src", filepath.Join(dir, "content"),
+		"--out", filepath.Join(dir, "public"),
+		"--templates", filepath.Join(dir, "templates"),
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	defer func(s *outStream) { stdoutStream = s }(stdoutStream)
+	stdoutStream = &outStream{file: devNull}
+
+	ctx := NewContext(dir)
+	ctx.LoadBuiltins()
+	if _, err := ctx.Eval(strings.NewReader(cmdsite)); err != nil {
+		t.Fatalf("Did not expect oak site to return an error: %s", err.Error())
+	}
+	ctx.Wait()
+
+	for name, expected := range map[string]string{
+		"public/posts/first.html": "<h1>First</h1><p>Hello <strong>world</strong></p>[/][/posts/first.html]",
+		"public/style.css":        "body {}\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("Expected %s to be built: %s", name, err.Error())
+		} else if string(data) != expected {
+			t.Errorf("Expected %s to be %s, got %s", name, strconv.Quote(expected), strconv.Quote(string(data)))
+		}
+	}
+	index, _ := os.ReadFile(filepath.Join(dir, "public/index.html"))
+	if !strings.Contains(string(index), "<title>Home</title>") || !strings.Contains(string(index), "<h1>Welcome</h1>") {
+		t.Errorf("Expected index.html to use the default template, got %s", index)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "public/posts/draft.html")); err == nil {
+		t.Errorf("Expected drafts to be skipped")
+	}
+}
+
+func TestDepsCommand(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"main.oak":  "std := import('std')\nfmt := import('fmt')\na := import('./lib/a')\nopt := lazyImport('./optional')\nstd.println(a.x)\n",
+		"lib/a.oak": "b := import('./b')\nx := 1\n",
+		"lib/b.oak": "a := import('./a')\n",
+	} {
+		filePath := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := os.Create(filepath.Join(dir, "out.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	defer func(s *outStream) { stdoutStream = s }(stdoutStream)
+	stdoutStream = &outStream{file: out}
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{"oak", "deps", filepath.Join(dir, "main.oak"), "--format", "json"}
+
+	ctx := NewContext(dir)
+	ctx.LoadBuiltins()
+	if _, err := ctx.Eval(strings.NewReader(cmddeps)); err != nil {
+		t.Fatalf("Did not expect oak deps to return an error: %s", err.Error())
+	}
+	ctx.Wait()
+
+	data, _ := os.ReadFile(out.Name())
+	var graph struct {
+		Entry   string
+		Modules map[string][]struct {
+			Name string
+			Kind string
+			Path string
+			Lazy bool
+		}
+		Unused []struct{ Module, Name string }
+		Cycles [][]string
+	}
+	if err := json.Unmarshal(data, &graph); err != nil {
+		t.Fatalf("Could not parse oak deps output %s: %s", data, err)
+	}
+
+	if graph.Entry != "main.oak" || len(graph.Modules) != 3 {
+		t.Errorf("Unexpected modules in %s", data)
+	}
+	if imports := graph.Modules["main.oak"]; len(imports) != 4 ||
+		imports[2].Path != "lib/a.oak" || imports[3].Kind != "missing" || !imports[3].Lazy {
+		t.Errorf("Unexpected imports of main.oak in %s", data)
+	}
+	if len(graph.Unused) != 1 || graph.Unused[0].Module != "main.oak" || graph.Unused[0].Name != "fmt" {
+		t.Errorf("Expected fmt to be unused in %s", data)
+	}
+	if len(graph.Cycles) != 1 || strings.Join(graph.Cycles[0], " ") != "lib/a.oak lib/b.oak lib/a.oak" {
+		t.Errorf("Expected a cycle between lib/a.oak and lib/b.oak in %s", data)
+	}
+}
+
+func TestPackAssets(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "page.html"), []byte("<p>on disk</p>"), 0644)
+
+	ctx := NewContext(dir)
+	ctx.LoadBuiltins()
+	readAssets := func() Value {
+		t.Helper()
+		val, err := ctx.Eval(strings.NewReader(fmt.Sprintf(`
+		assets := import('assets')
+		[assets.read('%s'), assets.read('./static/app.css'), assets.read('static/../missing.txt')]
+		`, filepath.Join(dir, "page.html"))))
+		if err != nil {
+			t.Fatalf("Could not read assets: %s", err)
+		}
+		return val
+	}
+
+	// without packed assets, assets are read from disk
+	expected := MakeList(MakeString("<p>on disk</p>"), null, null)
+	if val := readAssets(); !val.Eq(expected) {
+		t.Errorf("Expected %s, got %s", expected, val)
+	}
+
+	archive, runtimeErr := msgpackValue(nil, ObjectValue{
+		"static/app.css": MakeString("body {}"),
+		"data/\xff.bin":  MakeString("\x00\xff"),
+	}, map[uintptr]bool{})
+	if runtimeErr != nil {
+		t.Fatalf("Could not encode assets: %s", runtimeErr)
+	}
+	var packed bytes.Buffer
+	packed.WriteString("\x7fELF interpreter")
+	packed.Write(archive)
+	fmt.Fprintf(&packed, "%24d%s", len(archive), PackAssetsMagicBytes)
+	bundleStart := packed.Len()
+	packed.WriteString("bundle")
+	fmt.Fprintf(&packed, "%24d%s", len("bundle"), PackFileMagicBytes)
+
+	exePath := filepath.Join(dir, "app")
+	os.WriteFile(exePath, packed.Bytes(), 0755)
+	exeFile, err := os.Open(exePath)
+	if err != nil {
+		t.Fatalf("Could not open packed file: %s", err)
+	}
+	defer exeFile.Close()
+
+	if _, ok := readPackAssets(&ctx, exeFile, 16); ok {
+		t.Errorf("Expected no assets in a binary without them")
+	}
+	assets, ok := readPackAssets(&ctx, exeFile, int64(bundleStart))
+	if !ok {
+		t.Fatalf("Could not read packed assets")
+	}
+	if string(assets["data/\xff.bin"]) != "\x00\xff" {
+		t.Errorf("Expected binary asset to be read, got %q", assets["data/\xff.bin"])
+	}
+
+	packedAssets = assets
+	defer func() { packedAssets = nil }()
+	expected = MakeList(null, MakeString("body {}"), null)
+	if val := readAssets(); !val.Eq(expected) {
+		t.Errorf("Expected %s, got %s", expected, val)
+	}
+}
+
+func TestASTCommand(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main.oak"), []byte("x := 1\nstd.println(x + 2)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.Create(filepath.Join(dir, "out.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	defer func(s *outStream) { stdoutStream = s }(stdoutStream)
+	stdoutStream = &outStream{file: out}
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{"oak", "ast", filepath.Join(dir, "main.oak"), "--format", "json"}
+
+	ctx := NewContext(dir)
+	ctx.LoadBuiltins()
+	if _, err := ctx.Eval(strings.NewReader(cmdast)); err != nil {
+		t.Fatalf("Did not expect oak ast to return an error: %s", err.Error())
+	}
+	ctx.Wait()
+
+	data, _ := os.ReadFile(out.Name())
+	type node struct {
+		Type string
+		Pos  struct{ Offset, Line, Col int }
+		Op   string
+		Left *node
+		Args []node
+	}
+	var nodes []node
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		t.Fatalf("Could not parse oak ast output %s: %s", data, err)
+	}
+
+	if len(nodes) != 2 || nodes[0].Type != "assignment" || nodes[0].Left.Type != "identifier" {
+		t.Errorf("Unexpected nodes in %s", data)
+	}
+	if call := nodes[1]; call.Type != "fnCall" || len(call.Args) != 1 || call.Args[0].Op != "plus" {
+		t.Errorf("Unexpected function call in %s", data)
+	}
+	if pos := nodes[1].Args[0].Pos; pos.Line != 2 || pos.Col != 15 || pos.Offset != 21 {
+		t.Errorf("Unexpected position of binary expression %v in %s", pos, data)
+	}
+}
+
+func TestLintCommand(t *testing.T) {
+	dir := t.TempDir()
+	program := `std := import('std')
+
+fn f(xs) {
+	unused := 1
+	total := 0
+	total = 2
+	obj := { a: 1, a: 2 }
+	if total {
+		_ -> obj
+		1 -> total
+	}
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "main.oak"), []byte(program), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.Create(filepath.Join(dir, "out.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	defer func(s *outStream) { stdoutStream = s }(stdoutStream)
+	stdoutStream = &outStream{file: out}
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{"oak", "lint", filepath.Join(dir, "main.oak"), "--disable", "shadow", "--format", "json"}
+
+	ctx := NewContext(dir)
+	ctx.LoadBuiltins()
+	exitCode := 0
+	ctx.LoadFunc("exit", func(args []Value) (Value, *runtimeError) {
+		exitCode = int(args[0].(IntValue))
+		return null, nil
+	})
+	if _, err := ctx.Eval(strings.NewReader(cmdlint)); err != nil {
+		t.Fatalf("Did not expect oak lint to return an error: %s", err.Error())
+	}
+	ctx.Wait()
+
+	data, _ := os.ReadFile(out.Name())
+	var problems []struct {
+		Line int
+		Col  int
+		Rule string
+	}
+	if err := json.Unmarshal(data, &problems); err != nil {
+		t.Fatalf("Could not parse oak lint output %s: %s", data, err)
+	}
+
+	expected := []string{
+		"1:1 unused-import",
+		"4:2 unused-variable",
+		"6:2 suspicious-assignment",
+		"7:17 literal",
+		"10:3 unreachable",
+	}
+	reported := make([]string, len(problems))
+	for i, p := range problems {
+		reported[i] = fmt.Sprintf("%d:%d %s", p.Line, p.Col, p.Rule)
+	}
+	if strings.Join(reported, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected problems %v, got %v", expected, reported)
+	}
+	if exitCode != 1 {
+		t.Errorf("Expected oak lint to exit with 1, got %d", exitCode)
+	}
+}
+
+func TestTypecheckCommand(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"geo.oak": `fn area(w: int, h: int) -> int w * h
+fn label(n: number) -> string n
+`,
+		"main.oak": `geo := import('./geo')
+
+a := geo.area(2, 'x')
+b: string := geo.area(2, 3)
+fn twice(f: fn(int) -> int, x: int) -> int f(f(x))
+twice(fn(s: string) s, 1)
+n := 1
+n <- 'anything'
+count: int := 0
+count <- n
+`,
+	}
+	for name, program := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(program), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := os.Create(filepath.Join(dir, "out.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	defer func(s *outStream) { stdoutStream = s }(stdoutStream)
+	stdoutStream = &outStream{file: out}
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{"oak", "typecheck", filepath.Join(dir, "main.oak"), "--format", "json"}
+
+	ctx := NewContext(dir)
+	ctx.LoadBuiltins()
+	exitCode := 0
+	ctx.LoadFunc("exit", func(args []Value) (Value, *runtimeError) {
+		exitCode = int(args[0].(IntValue))
+		return null, nil
+	})
+	if _, err := ctx.Eval(strings.NewReader(cmdtypecheck)); err != nil {
+		t.Fatalf("Did not expect oak typecheck to return an error: %s", err.Error())
+	}
+	ctx.Wait()
+
+	data, _ := os.ReadFile(out.Name())
+	var problems []struct {
+		File    string
+		Line    int
+		Col     int
+		Message string
+	}
+	if err := json.Unmarshal(data, &problems); err != nil {
+		t.Fatalf("Could not parse oak typecheck output %s: %s", data, err)
+	}
+
+	expected := []string{
+		"geo.oak:2:1 label returns string, got number",
+		"main.oak:3:18 argument 2 of geo.area expects int, got string",
+		"main.oak:4:1 b is declared string, got int",
+		"main.oak:6:7 argument 1 of twice expects fn(int) -> int, got fn(string) -> string",
+	}
+	reported := make([]string, len(problems))
+	for i, p := range problems {
+		reported[i] = fmt.Sprintf("%s:%d:%d %s", filepath.Base(p.File), p.Line, p.Col, p.Message)
+	}
+	if strings.Join(reported, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected problems %v, got %v", expected, reported)
+	}
+	if exitCode != 1 {
+		t.Errorf("Expected oak typecheck to exit with 1, got %d", exitCode)
+	}
+}
+
+func TestREPLResultStack(t *testing.T) {
+	ctx := NewContext("/tmp")
+	for i := 1; i <= replResultLimit+2; i++ {
+		ctx.pushReplResult(IntValue(i))
+	}
+
+	last := IntValue(replResultLimit + 2)
+	for name, expected := range map[string]Value{
+		"__":                                 last,
+		"__1":                                last,
+		"__2":                                last - 1,
+		"__" + strconv.Itoa(replResultLimit): IntValue(3),
+	} {
+		if val, ok := ctx.scope.vars[name]; !ok || !val.Eq(expected) {
+			t.Errorf("Expected %s to be %s, got %v", name, expected, val)
+		}
+	}
+	if _, ok := ctx.scope.vars["__"+strconv.Itoa(replResultLimit+1)]; ok {
+		t.Errorf("Expected at most %d results to be kept", replResultLimit)
+	}
+}
+
+func TestREPLSaveRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.oak")
+
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	if _, err := ctx.Eval(strings.NewReader(`
+	nums := [1, 2.5, float('NaN'), float('+Inf'), float('-Inf')]
+	obj := { name: 'oak', tags: [:a, :b] }
+	cycle := [1]
+	cycle << cycle
+	self := {}
+	self.self := self
+	nested := { inner: self }
+	f := fn() 1
+	`)); err != nil {
+		t.Fatalf("Did not expect program to return an error: %s", err.Error())
+	}
+	ctx.performReplCommand("save", path)
+
+	restored := NewContext("/tmp")
+	restored.LoadBuiltins()
+	restored.performReplCommand("restore", path)
+
+	val, err := restored.Eval(strings.NewReader(`[string(nums), obj]`))
+	if err != nil {
+		t.Fatalf("Did not expect restored session to return an error: %s", err.Error())
+	}
+	expected := MakeList(
+		MakeString("[1, 2.5, NaN, +Inf, -Inf]"),
+		ObjectValue{
+			"name": MakeString("oak"),
+			"tags": MakeList(AtomValue("a"), AtomValue("b")),
+		},
+	)
+	if !val.Eq(expected) {
+		t.Errorf("Expected restored session %s, got %s", expected, val)
+	}
+	for _, name := range []string{"cycle", "self", "nested", "f"} {
+		if _, ok := restored.scope.vars[name]; ok {
+			t.Errorf("Expected %s not to be saved", name)
+		}
+	}
+}
+
+func TestBenchCommand(t *testing.T) {
+	dir := t.TempDir()
+	program := `fn run(b) {
+	b.bench('sum', fn {
+		1 + 2
+	})
+	b.bench('list', fn {
+		[1, 2, 3]
+	})
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "ops.bench.oak"), []byte(program), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the baseline is much faster than any real run, so every benchmark in it
+	// regresses
+	baseline := `[{"name": "sum", "ns": 0.001, "allocs": 0, "bytes": 0}]`
+	if err := os.WriteFile(filepath.Join(dir, "baseline.json"), []byte(baseline), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.Create(filepath.Join(dir, "out.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	defer func(s *outStream) { stdoutStream = s }(stdoutStream)
+	stdoutStream = &outStream{file: out}
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{"oak", "bench", dir, "--time", "0.001", "--baseline", filepath.Join(dir, "baseline.json"), "--format", "json"}
+
+	ctx := NewContext(dir)
+	ctx.LoadBuiltins()
+	exitCode := 0
+	ctx.LoadFunc("exit", func(args []Value) (Value, *runtimeError) {
+		exitCode = int(args[0].(IntValue))
+		return null, nil
+	})
+	if _, err := ctx.Eval(strings.NewReader(cmdbench)); err != nil {
+		t.Fatalf("Did not expect oak bench to return an error: %s", err.Error())
+	}
+	ctx.Wait()
+
+	data, _ := os.ReadFile(out.Name())
+	var results []struct {
+		Name      string
+		Runs      int
+		Ns        float64
+		Regressed bool `json:"regressed?"`
+	}
+	if err := json.Unmarshal(data, &results); err != nil {
+		t.Fatalf("Could not parse oak bench output %s: %s", data, err)
+	}
+
+	if len(results) != 2 || results[0].Name != "sum" || results[1].Name != "list" {
+		t.Fatalf("Expected results for sum and list, got %s", data)
+	}
+	for _, result := range results {
+		if result.Runs <= 0 || result.Ns <= 0 {
+			t.Errorf("Expected %s to be run and timed, got %d runs at %f ns", result.Name, result.Runs, result.Ns)
+		}
+	}
+	if !results[0].Regressed || results[1].Regressed {
+		t.Errorf("Expected only sum to regress, got %s", data)
+	}
+	if exitCode != 1 {
+		t.Errorf("Expected oak bench to exit with 1, got %d", exitCode)
+	}
+}
+
+func TestSignalHandler(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+
+	_, err := ctx.Eval(strings.NewReader(`
+	received := []
+	stop := signal(:hup, fn(sig) {
+		received << sig
+		stop()
+	})
+	`))
+	if err != nil {
+		t.Fatalf("Did not expect signal() to return an error: %s", err.Error())
+	}
+
+	proc, _ := os.FindProcess(os.Getpid())
+	if err := proc.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("Could not send signal: %s", err.Error())
+	}
+
+	// Wait returns only once the handler has stopped itself
+	done := make(chan struct{})
+	go func() {
+		ctx.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Signal handler did not run and stop")
+	}
+
+	received, _ := ctx.scope.get("received")
+	if !received.Eq(MakeList(AtomValue("hup"))) {
+		t.Errorf("Expected handler to receive :hup, got %s", received)
+	}
+}
+
+func TestPlugins(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test plugin is a shell script")
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "echo"), []byte(`#!/bin/sh
+while read -r line; do
+	id=$(echo "$line" | sed 's/.*"id":\([0-9]*\).*/\1/')
+	case "$line" in
+		*'"method":"oak.builtins"'*)
+			echo '{"jsonrpc":"2.0","id":'$id',"result":["echo","fail","print"]}' ;;
+		*'"method":"echo"'*)
+			echo '{"jsonrpc":"2.0","id":'$id',"result":'$(echo "$line" | sed 's/.*"params":\(.*\)}$/\1/')'}' ;;
+		*)
+			echo '{"jsonrpc":"2.0","id":'$id',"error":{"code":1,"message":"no connection"}}' ;;
+	esac
+done
+`), 0755)
+	os.WriteFile(filepath.Join(dir, "README"), []byte("not a plugin"), 0644)
+
+	plugins := startPlugins(dir)
+	defer func() {
+		for _, p := range plugins {
+			p.close()
+		}
+	}()
+	if len(plugins) != 1 {
+		t.Fatalf("Expected 1 plugin, got %d", len(plugins))
+	}
+
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	ctx.definePlugins(plugins)
+
+	val, err := ctx.Eval(strings.NewReader(`
+	[echo(1, 2.5, 'str', :atom, [true, ?], {a: 1}), type(print)]
+	`))
+	if err != nil {
+		t.Fatalf("Did not expect plugin call to return an error: %s", err.Error())
+	}
+	expected := MakeList(
+		MakeList(IntValue(1), FloatValue(2.5), MakeString("str"), MakeString("atom"),
+			MakeList(oakTrue, null), ObjectValue{"a": IntValue(1)}),
+		AtomValue("function"),
+	)
+	if !val.Eq(expected) {
+		t.Errorf("Expected %s from plugin, got %s", expected, val)
+	}
+	if _, ok := ctx.scope.vars["print"].(BuiltinFnValue); !ok || ctx.scope.vars["print"].(BuiltinFnValue).name != "print" {
+		t.Errorf("Expected plugin not to replace print")
+	}
+
+	_, err = ctx.Eval(strings.NewReader(`fail()`))
+	if err == nil || !strings.Contains(err.Error(), "Error in fail(): no connection") {
+		t.Errorf("Expected error from plugin, got %v", err)
+	}
+}
+
+func TestEvalSession(t *testing.T) {
+	defer func(out, err *outStream) {
+		stdoutStream, stderrStream = out, err
+	}(stdoutStream, stderrStream)
+	stdoutStream = &outStream{file: os.Stdout}
+	stderrStream = &outStream{file: os.Stderr}
+
+	var in bytes.Buffer
+	for _, req := range []string{
+		`{"id":1,"code":"x := 1 + 2"}`,
+		`{"id":"two","code":"print('hi\\n'), x * 10"}`,
+		`{"id":3,"code":"__ + 1"}`,
+		`{"id":4,"code":"x +"}`,
+		`{"id":5,"code":"y.z"}`,
+		`not json`,
+	} {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(req), req)
+	}
+
+	var out bytes.Buffer
+	runEvalSession(&in, &out)
+
+	reader := bufio.NewReader(&out)
+	messages := []string{}
+	for {
+		body, err := readSessionMessage(reader)
+		if err != nil {
+			break
+		}
+		messages = append(messages, string(body))
+	}
+
+	expected := []string{
+		`{"id":1,"result":"3"}`,
+		`{"id":"two","output":"hi\n","stream":"stdout"}`,
+		`{"id":"two","result":"30"}`,
+		`{"id":3,"result":"31"}`,
+		`{"id":4,"error":{"message":"Unexpected token , at start of unit","kind":"parseError","line":1,"col":4}}`,
+		`{"id":5,"error":{"message":"y is undefined","kind":"nameError","line":1,"col":1}}`,
+		`{"id":null,"error":{"message":"Invalid request: invalid character 'o' in literal null (expecting 'u')"}}`,
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d messages from session, got %d: %v", len(expected), len(messages), messages)
+	}
+	for i, msg := range messages {
+		if msg != expected[i] {
+			t.Errorf("Expected message %s from session, got %s", expected[i], msg)
+		}
+	}
+}
+
+func TestKernel(t *testing.T) {
+	defer func(out, err *outStream) {
+		stdoutStream, stderrStream = out, err
+	}(stdoutStream, stderrStream)
+	stdoutStream = &outStream{file: os.Stdout}
+	stderrStream = &outStream{file: os.Stderr}
+
+	k, stop, err := startKernel(kernelConnection{
+		Transport:       "tcp",
+		IP:              "127.0.0.1",
+		ShellPort:       9920,
+		IOPubPort:       9921,
+		StdinPort:       9922,
+		ControlPort:     9923,
+		HBPort:          9924,
+		Key:             "secret",
+		SignatureScheme: "hmac-sha256",
+	})
+	if err != nil {
+		t.Fatalf("Could not start kernel: %s", err.Error())
+	}
+	defer stop()
+
+	dial := func(port int, socketType string) *zmtpConn {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatalf("Could not connect to kernel: %s", err.Error())
+		}
+		zc, err := zmtpHandshake(conn, socketType, false)
+		if err != nil {
+			t.Fatalf("Could not connect to kernel: %s", err.Error())
+		}
+		return zc
+	}
+	shell := dial(9920, "DEALER")
+	defer shell.Close()
+	iopub := dial(9921, "SUB")
+	defer iopub.Close()
+	iopub.send([][]byte{{1}})
+	for subscribed := false; !subscribed; {
+		k.iopubLock.Lock()
+		subscribed = len(k.subscribers) == 1
+		k.iopubLock.Unlock()
+	}
+
+	hb := dial(9924, "REQ")
+	defer hb.Close()
+	hb.send([][]byte{{}, []byte("ping")})
+	if frames, err := hb.receive(); err != nil || string(frames[1]) != "ping" {
+		t.Errorf("Expected heartbeat to be echoed, got %v, %v", frames, err)
+	}
+
+	request := func(msgType string, content interface{}) map[string]interface{} {
+		shell.send(k.frames(nil, nil, msgType, content))
+		frames, err := shell.receive()
+		if err != nil {
+			t.Fatalf("Did not get reply to %s: %s", msgType, err.Error())
+		}
+		reply, err := k.parseMessage(frames)
+		if err != nil {
+			t.Fatalf("Invalid reply to %s: %s", msgType, err.Error())
+		}
+		var replyContent map[string]interface{}
+		json.Unmarshal(reply.content, &replyContent)
+		return replyContent
+	}
+	// published returns the content of the messages published on iopub
+	// until the kernel is idle, by type
+	published := func() map[string]map[string]interface{} {
+		msgs := map[string]map[string]interface{}{}
+		for {
+			frames, err := iopub.receive()
+			if err != nil {
+				t.Fatalf("Did not get published message: %s", err.Error())
+			}
+			msg, err := k.parseMessage(frames)
+			if err != nil {
+				t.Fatalf("Invalid published message: %s", err.Error())
+			}
+			var content map[string]interface{}
+			json.Unmarshal(msg.content, &content)
+			if msg.header.MsgType == "status" && content["execution_state"] == "idle" {
+				return msgs
+			}
+			msgs[msg.header.MsgType] = content
+		}
+	}
+
+	info := request("kernel_info_request", map[string]interface{}{})
+	if info["implementation"] != "oak" {
+		t.Errorf("Expected kernel info for oak, got %v", info)
+	}
+	published()
+
+	reply := request("execute_request", map[string]interface{}{
+		"code": "x := 2, print('hi\\n'), [{ a: x }, { a: 3, b: '<b>' }]",
+	})
+	if reply["status"] != "ok" || reply["execution_count"] != 1.0 {
+		t.Errorf("Expected successful execution, got %v", reply)
+	}
+	msgs := published()
+	if msgs["stream"]["text"] != "hi\n" {
+		t.Errorf("Expected printed output to be published, got %v", msgs["stream"])
+	}
+	data := msgs["execute_result"]["data"].(map[string]interface{})
+	expectedHTML := "<table>\n<tr><th>a</th><th>b</th></tr>\n<tr><td>2</td><td></td></tr>\n<tr><td>3</td><td>&lt;b&gt;</td></tr>\n</table>"
+	if data["text/plain"] != "[{a: 2}, {a: 3, b: '<b>'}]" || data["text/html"] != expectedHTML {
+		t.Errorf("Expected result to be displayed as a table, got %v", data)
+	}
+
+	reply = request("execute_request", map[string]interface{}{"code": "x + y"})
+	if reply["status"] != "error" || reply["ename"] != "nameError" {
+		t.Errorf("Expected execution to fail, got %v", reply)
+	}
+	if msgs := published(); msgs["error"]["evalue"] != "y is undefined" {
+		t.Errorf("Expected error to be published, got %v", msgs["error"])
+	}
+
+	complete := request("complete_request", map[string]interface{}{"code": "1 + x", "cursor_pos": 5})
+	if matches := complete["matches"].([]interface{}); len(matches) != 1 || matches[0] != "x" || complete["cursor_start"] != 4.0 {
+		t.Errorf("Expected completion of x, got %v", complete)
+	}
+	published()
+
+	if status := request("is_complete_request", map[string]interface{}{"code": "fn f {"})["status"]; status != "incomplete" {
+		t.Errorf("Expected unclosed brace to be incomplete, got %v", status)
+	}
+}
+
+func TestREPLHighlight(t *testing.T) {
+	line := []rune("x := f('hi', :a) // note")
+	painted := string(replPainter{}.Paint(line, len("x := f('hi', :a)")))
+
+	for _, part := range []string{
+		"x \x1b[0;31m:=\x1b[0;0m f",
+		"\x1b[0;33m'hi'\x1b[0;0m",
+		"\x1b[0;35m:\x1b[0;0m\x1b[0;35ma\x1b[0;0m",
+		"\x1b[1;4m(\x1b[0;0m",
+		"\x1b[1;4m)\x1b[0;0m",
+		"\x1b[0;90m// note\x1b[0;0m",
+	} {
+		if !strings.Contains(painted, part) {
+			t.Errorf("Expected %q in highlighted line %q", part, painted)
+		}
+	}
+
+	// without a bracket at the cursor, no brackets are highlighted
+	if painted := string(replPainter{}.Paint(line, 2)); strings.Contains(painted, "\x1b[1;4m") {
+		t.Errorf("Did not expect highlighted brackets in %q", painted)
+	}
+
+	// incomplete and invalid input is painted as is
+	for _, src := range []string{"f('unterminated", "[1, 2", "a $ b \\", ""} {
+		painted := string(replPainter{}.Paint([]rune(src), len(src)))
+		stripped := regexp.MustCompile("\x1b\\[[0-9;]*m").ReplaceAllString(painted, "")
+		if stripped != src {
+			t.Errorf("Expected %q to be painted without changes, got %q", src, painted)
+		}
+	}
+}
+
+func TestREPLHistory(t *testing.T) {
+	historyPath := filepath.Join(t.TempDir(), ".oak_history")
+
+	var first, second []string
+	h1 := openReplHistory(historyPath, func(line string) { first = append(first, line) })
+	h2 := openReplHistory(historyPath, func(line string) { second = append(second, line) })
+
+	h1.save("x := 1")
+	h1.save("x := 1")
+	h2.merge()
+	h2.save("y := 2")
+	h1.merge()
+	h1.save("x + y")
+	h2.merge()
+
+	expected := "x := 1, y := 2, x + y"
+	if got := strings.Join(first, ", "); got != expected {
+		t.Errorf("Expected first session history %q, got %q", expected, got)
+	}
+	if got := strings.Join(second, ", "); got != expected {
+		t.Errorf("Expected second session history %q, got %q", expected, got)
+	}
+
+	// a history file that's grown too long is trimmed when it's opened
+	lines := []string{}
+	for i := 0; i < 3*replHistoryLimit; i++ {
+		lines = append(lines, strconv.Itoa(i), strconv.Itoa(i))
+	}
+	os.WriteFile(historyPath, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+
+	var loaded []string
+	openReplHistory(historyPath, func(line string) { loaded = append(loaded, line) })
+	if len(loaded) != replHistoryLimit || loaded[0] != strconv.Itoa(2*replHistoryLimit) {
+		t.Errorf("Expected the last %d lines of history, got %d", replHistoryLimit, len(loaded))
+	}
+	data, _ := os.ReadFile(historyPath)
+	if count := bytes.Count(data, []byte{'\n'}); count != replHistoryLimit {
+		t.Errorf("Expected history file to be trimmed to %d lines, got %d", replHistoryLimit, count)
+	}
+}
+
+func TestStaticImports(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"main.oak": `std := import('std')
+			lib := import('lib')
+			views := import('./views')
+			greeter := import('greeter')
+			missing := import('missing')
+			dynamic := import('dyn' + 'amic')`,
+		"lib.oak":                                "util := import('util')",
+		"util/main.oak":                          "lib := import('../lib')",
+		"views/index.oak":                        "",
+		"oak.pkg":                                "example.com/user/greeter v1.0.0\n",
+		"libs/example.com/user/greeter/main.oak": "",
+		"dynamic.oak":                            "",
+	} {
+		filePath := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{
+		"main.oak",
+		"lib.oak",
+		"util/main.oak",
+		"views/index.oak",
+		"libs/example.com/user/greeter/main.oak",
+		"missing.oak",
+	}
+	for i, name := range expected {
+		expected[i] = filepath.Join(dir, name)
+	}
+	paths := staticImports(filepath.Join(dir, "main.oak"))
+	if strings.Join(paths, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected static imports %v, got %v", expected, paths)
+	}
+}
+
+func TestREPLLoad(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib.oak")
+	helper := filepath.Join(dir, "helper.oak")
+	os.WriteFile(lib, []byte("x := 41\nfn inc(n) n + 1\n"), 0644)
+	os.WriteFile(helper, []byte("y := inc(x)\n"), 0644)
+
+	out, code := runCommand(t, "[x, inc(x), y]\n", "repl", "--load", lib, "--load="+helper)
+	if code != 0 || out != "[41, 42, 42]\n" {
+		t.Errorf("Expected loaded bindings to be visible in the REPL, got %q (exit %d)", out, code)
+	}
+
+	out, _ = runCommand(t, "x\n", "repl", "--load", filepath.Join(dir, "missing.oak"), "-l", lib)
+	if !strings.Contains(out, "Could not open") || !strings.HasSuffix(out, "41\n") {
+		t.Errorf("Expected a missing file not to stop the REPL from loading others, got %q", out)
+	}
+}
+
+func TestREPLCommands(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib.oak")
+	mod := filepath.Join(dir, "mod")
+	session := filepath.Join(dir, "session.oak")
+	os.WriteFile(lib, []byte("x := 41\n"), 0644)
+	os.WriteFile(mod+".oak", []byte("print('imported\\n')\n"), 0644)
+
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"type", ":type 1 + 2\n:type\n", ":int\nUsage: :type <expr>\n"},
+		{"env", "x := 1, y := 'a', 0\n:env\n", "0\n  __ :int\n  __1 :int\n  x :int\n  y :string\n"},
+		{"load", ":load " + lib + "\nx\n:load\n", "41\nUsage: :load <file> [files...]\n"},
+		{"res", "1\n2\n:res\n:res 2\n:res 5\n:res 0\n", "1\n2\n  __1   2\n  __2   1\n1\nNo result __5\nUsage: :res [n], where n is between 1 and 10\n"},
+		{"save and restore", "x := 41, 0\n:save " + session + "\n:clear\n:restore " + session + "\nx\n", "0\n41\n"},
+		{"clear", "x := 1, import('" + mod + "'), 0\n:clear\nx\nimport('" + mod + "'), 0\n",
+			"imported\n0\nRuntime error [1:1]: x is undefined\n\nimported\n0\n"},
+		{"exit", "1\n:exit\n2\n", "1\n"},
+	} {
+		out, code := runCommand(t, tc.input, "repl")
+		if code != 0 || out != tc.expected {
+			t.Errorf("Expected :%s to print %q, got %q (exit %d)", tc.name, tc.expected, out, code)
+		}
+	}
+
+	out, _ := runCommand(t, ":help\n", "repl")
+	for name, description := range replCommands {
+		if !strings.Contains(out, fmt.Sprintf("  :%-8s %s\n", name, description)) {
+			t.Errorf("Expected :help to describe :%s, got %q", name, out)
+		}
+	}
+
+	out, _ = runCommand(t, ":time 1 + 2\n", "repl")
+	if !regexp.MustCompile(`^3\n\(\S+\)\n$`).MatchString(out) {
+		t.Errorf("Expected :time to print the result and its duration, got %q", out)
+	}
+}
+
+func TestEvalCommand(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		stdin    string
+		expected string
+		code     int
+	}{
+		{[]string{"-e", "1 + 2"}, "", "3\n", 0},
+		{[]string{"--eval", "x := 'a'", "+ 'b'"}, "", "ab\n", 0},
+		{[]string{"eval", "[len(stdin), stdin]"}, "abc\n", "[4, 'abc\n']\n", 0},
+		{[]string{"-e", "1 +"}, "", "Parse error at [1:4]: Unexpected token , at start of unit\n", 1},
+		{[]string{"-e", "x.y"}, "", "Runtime error [1:1]: x is undefined\n\n", 1},
+	} {
+		out, code := runCommand(t, tc.stdin, tc.args...)
+		if out != tc.expected || code != tc.code {
+			t.Errorf("Expected oak %s to print %q and exit %d, got %q (exit %d)",
+				strings.Join(tc.args, " "), tc.expected, tc.code, out, code)
+		}
+	}
+}
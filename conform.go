@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// conform() checks a value against a schema describing the shape of valid
+// values, and returns a list of every way in which the value doesn't conform
+// to it, so that data from outside a program, like the body of a JSON API
+// request, can be validated in one pass.
+//
+// A schema is an atom naming a type, like :string, or an object with any of
+// the keys:
+//
+//	type      an atom or list of atoms naming the types a value may have, as
+//	          returned by type(), or :number for ints and floats, or :any
+//	enum      a list of the values allowed
+//	min, max  bounds on a number, or on the length of a string or list
+//	items     a schema for each element of a list
+//	keys      an object of schemas for the keys of an object
+//	required  a list of the keys an object must have, since keys are otherwise
+//	          optional
+//	closed?   if true, an object may have no keys other than those in keys
+//
+// Each problem is an object { path, kind, message }, where path is the list of
+// keys and indexes leading to the value from the one checked, and kind is one
+// of :type, :enum, :range, :required, or :key.
+
+type conformer struct {
+	problems []Value
+	path     []Value
+}
+
+func (cf *conformer) report(kind, message string) {
+	path := make([]Value, len(cf.path))
+	copy(path, cf.path)
+	cf.problems = append(cf.problems, ObjectValue{
+		"path":    MakeList(path...),
+		"kind":    AtomValue(kind),
+		"message": MakeString(message),
+	})
+}
+
+// schemaField returns the value of a key in a schema, if it's given and not ?.
+func schemaField(schema ObjectValue, key string) (Value, bool) {
+	v, ok := schema[key]
+	if _, null := v.(NullValue); null {
+		return nil, false
+	}
+	return v, ok
+}
+
+func schemaError(key, expected string, got Value) *runtimeError {
+	return &runtimeError{
+		kind:   "typeError",
+		reason: fmt.Sprintf("conform() schema %s must be %s, got %s", key, expected, got),
+	}
+}
+
+func conformKey(key Value) string {
+	switch k := key.(type) {
+	case *StringValue:
+		return string(*k)
+	case AtomValue:
+		return string(k)
+	}
+	return key.String()
+}
+
+func (cf *conformer) conform(v Value, schema Value) *runtimeError {
+	var spec ObjectValue
+	switch s := schema.(type) {
+	case AtomValue:
+		spec = ObjectValue{"type": s}
+	case ObjectValue:
+		spec = s
+	default:
+		return &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("conform() schema must be an atom or object, got %s", schema),
+		}
+	}
+
+	if types, ok := schemaField(spec, "type"); ok {
+		matched, names, err := conformType(v, types)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			// the rest of the schema doesn't apply to a value of another type
+			cf.report("type", fmt.Sprintf("expected %s, got %s", strings.Join(names, " or "), string(valueType(v))))
+			return nil
+		}
+	}
+
+	if enum, ok := schemaField(spec, "enum"); ok {
+		allowed, ok := enum.(*ListValue)
+		if !ok {
+			return schemaError("enum", "a list", enum)
+		}
+		found := false
+		for _, a := range allowed.elems {
+			if a.Eq(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			options := make([]string, len(allowed.elems))
+			for i, a := range allowed.elems {
+				options[i] = a.String()
+			}
+			cf.report("enum", fmt.Sprintf("expected one of %s, got %s", strings.Join(options, ", "), v))
+		}
+	}
+
+	if err := cf.conformRange(v, spec); err != nil {
+		return err
+	}
+
+	switch val := v.(type) {
+	case *ListValue:
+		if items, ok := schemaField(spec, "items"); ok {
+			for i, elem := range val.elems {
+				if err := cf.conformAt(IntValue(i), elem, items); err != nil {
+					return err
+				}
+			}
+		}
+	case numArray:
+		if items, ok := schemaField(spec, "items"); ok {
+			for i := 0; i < val.length(); i++ {
+				if err := cf.conformAt(IntValue(i), val.at(i), items); err != nil {
+					return err
+				}
+			}
+		}
+	case ObjectValue:
+		return cf.conformObject(val, spec)
+	}
+	return nil
+}
+
+// conformAt checks the value under key in the value being checked.
+func (cf *conformer) conformAt(key Value, v Value, schema Value) *runtimeError {
+	cf.path = append(cf.path, key)
+	defer func() { cf.path = cf.path[:len(cf.path)-1] }()
+	return cf.conform(v, schema)
+}
+
+// conformType reports whether v has one of the types named by types, an atom
+// or a list of atoms, and returns their names.
+func conformType(v Value, types Value) (bool, []string, *runtimeError) {
+	var atoms []Value
+	switch t := types.(type) {
+	case AtomValue:
+		atoms = []Value{t}
+	case *ListValue:
+		atoms = t.elems
+	default:
+		return false, nil, schemaError("type", "an atom or list of atoms", types)
+	}
+
+	actual := valueType(v)
+	matched := false
+	names := make([]string, len(atoms))
+	for i, a := range atoms {
+		name, ok := a.(AtomValue)
+		if !ok {
+			return false, nil, schemaError("type", "an atom or list of atoms", types)
+		}
+		names[i] = string(name)
+
+		switch name {
+		case "any":
+			matched = true
+		case "number":
+			matched = matched || actual == "int" || actual == "float"
+		default:
+			matched = matched || name == actual
+		}
+	}
+	return matched, names, nil
+}
+
+func (cf *conformer) conformRange(v Value, spec ObjectValue) *runtimeError {
+	var n float64
+	var got, what string
+	switch val := v.(type) {
+	case IntValue, FloatValue:
+		n, _ = toFloat(v)
+		got = v.String()
+	case *StringValue:
+		n = float64(len(*val))
+		got, what = strconv.Itoa(len(*val)), "length "
+	case *ListValue:
+		n = float64(len(val.elems))
+		got, what = strconv.Itoa(len(val.elems)), "length "
+	case numArray:
+		n = float64(val.length())
+		got, what = strconv.Itoa(val.length()), "length "
+	default:
+		return nil
+	}
+
+	if min, ok := schemaField(spec, "min"); ok {
+		bound, ok := toFloat(min)
+		if !ok {
+			return schemaError("min", "a number", min)
+		}
+		if n < bound {
+			cf.report("range", fmt.Sprintf("expected %sat least %s, got %s", what, min, got))
+		}
+	}
+	if max, ok := schemaField(spec, "max"); ok {
+		bound, ok := toFloat(max)
+		if !ok {
+			return schemaError("max", "a number", max)
+		}
+		if n > bound {
+			cf.report("range", fmt.Sprintf("expected %sat most %s, got %s", what, max, got))
+		}
+	}
+	return nil
+}
+
+func (cf *conformer) conformObject(obj ObjectValue, spec ObjectValue) *runtimeError {
+	if required, ok := schemaField(spec, "required"); ok {
+		keys, ok := required.(*ListValue)
+		if !ok {
+			return schemaError("required", "a list", required)
+		}
+		for _, key := range keys.elems {
+			name := conformKey(key)
+			if _, ok := schemaField(obj, name); !ok {
+				cf.path = append(cf.path, MakeString(name))
+				cf.report("required", "missing required key "+name)
+				cf.path = cf.path[:len(cf.path)-1]
+			}
+		}
+	}
+
+	var keySchemas ObjectValue
+	if keys, ok := schemaField(spec, "keys"); ok {
+		if keySchemas, ok = keys.(ObjectValue); !ok {
+			return schemaError("keys", "an object", keys)
+		}
+		names := make([]string, 0, len(keySchemas))
+		for name := range keySchemas {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			// missing keys are reported only if they're required
+			if val, ok := schemaField(obj, name); ok {
+				if err := cf.conformAt(MakeString(name), val, keySchemas[name]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if closed, ok := spec["closed?"].(BoolValue); ok && bool(closed) {
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			if _, ok := keySchemas[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cf.path = append(cf.path, MakeString(name))
+			cf.report("key", "unexpected key "+name)
+			cf.path = cf.path[:len(cf.path)-1]
+		}
+	}
+	return nil
+}
+
+func (c *Context) oakConform(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("conform", args, 2); err != nil {
+		return nil, err
+	}
+
+	cf := conformer{problems: []Value{}}
+	if err := cf.conform(args[0], args[1]); err != nil {
+		return nil, err
+	}
+	return MakeList(cf.problems...), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Interpreters for other platforms, for oak pack --os and --arch. They're
+// built from the Oak module with the Go toolchain, at the version of the
+// running interpreter, and kept in the cache directory.
+
+const oakModulePath = "github.com/thesephist/oak"
+
+// oakBuildVersion returns the module path and version the running interpreter
+// was built from. Interpreters built from a source tree with changes that
+// aren't committed have no version that can be installed, and are given as
+// the latest version.
+func oakBuildVersion() (string, string) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Path == "" {
+		return oakModulePath, "latest"
+	}
+	if info.Main.Version == "" || info.Main.Version == "(devel)" || strings.HasSuffix(info.Main.Version, "+dirty") {
+		return info.Main.Path, "latest"
+	}
+	return info.Main.Path, info.Main.Version
+}
+
+// crossRuntime returns the path of an Oak interpreter for the given OS and
+// architecture, building it if it isn't in the cache. The running interpreter
+// is used for its own platform.
+func crossRuntime(goos, goarch string) (string, error) {
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+	if goos == runtime.GOOS && goarch == runtime.GOARCH {
+		return os.Executable()
+	}
+
+	dir, err := oakCacheDir()
+	if err != nil {
+		return "", err
+	}
+	modPath, version := oakBuildVersion()
+	name := fmt.Sprintf("oak-%s-%s-%s", version, goos, goarch)
+	if goos == "windows" {
+		name += ".exe"
+	}
+	runtimePath := filepath.Join(dir, "runtimes", name)
+
+	// the latest version changes, so it's built again every time
+	if version != "latest" {
+		if _, err := os.Stat(runtimePath); err == nil {
+			return runtimePath, nil
+		}
+	}
+
+	if _, err := exec.LookPath("go"); err != nil {
+		return "", fmt.Errorf("building an interpreter for %s/%s requires Go, or use --interp", goos, goarch)
+	}
+	gopath, err := os.MkdirTemp("", "oak-runtime-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(gopath)
+
+	// downloaded modules are kept in the usual module cache, rather than the
+	// temporary GOPATH, so that they're only downloaded once
+	modCache, err := exec.Command("go", "env", "GOMODCACHE").Output()
+	if err != nil {
+		return "", fmt.Errorf("could not find Go module cache: %s", err)
+	}
+	cmd := exec.Command("go", "install", modPath+"@"+version)
+	cmd.Env = append(os.Environ(),
+		"GOOS="+goos,
+		"GOARCH="+goarch,
+		"GOPATH="+gopath,
+		"GOMODCACHE="+strings.TrimSpace(string(modCache)),
+		"GOBIN=",
+		"CGO_ENABLED=0",
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("could not build interpreter for %s/%s: %s", goos, goarch, strings.TrimSpace(string(out)))
+	}
+
+	// go install puts binaries for other platforms in a directory named for
+	// the platform
+	built := filepath.Join(gopath, "bin", goos+"_"+goarch, filepath.Base(modPath))
+	if goos == "windows" {
+		built += ".exe"
+	}
+	if err := os.MkdirAll(filepath.Dir(runtimePath), 0755); err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(built)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(runtimePath, content, 0755); err != nil {
+		return "", err
+	}
+	return runtimePath, nil
+}
+
+func (c *Context) rtBuild(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___runtime_build", args, 2); err != nil {
+		return nil, err
+	}
+
+	goos, ok1 := args[0].(*StringValue)
+	goarch, ok2 := args[1].(*StringValue)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___runtime_build(%s, %s)", args[0], args[1]),
+		}
+	}
+
+	runtimePath, err := crossRuntime(string(*goos), string(*goarch))
+	if err != nil {
+		return errObj(err.Error()), nil
+	}
+	return MakeString(runtimePath), nil
+}
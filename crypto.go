@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+)
+
+// Cryptographic primitives for the crypto standard library.
+
+var cryptoHashesByName = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+func (c *Context) oakCryptoHMAC(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___crypto_hmac", args, 3); err != nil {
+		return nil, err
+	}
+
+	alg, ok1 := args[0].(AtomValue)
+	key, ok2 := args[1].(*StringValue)
+	data, ok3 := args[2].(*StringValue)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___crypto_hmac(%s, %s, %s)", args[0], args[1], args[2]),
+		}
+	}
+	newHash, ok := cryptoHashesByName[string(alg)]
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "valueError",
+			reason: fmt.Sprintf("Unknown hash algorithm %s in call ___crypto_hmac()", alg),
+		}
+	}
+
+	mac := hmac.New(newHash, *key)
+	mac.Write(*data)
+	return MakeString(string(mac.Sum(nil))), nil
+}
+
+func (c *Context) oakCryptoEqual(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___crypto_equal", args, 2); err != nil {
+		return nil, err
+	}
+
+	a, ok1 := args[0].(*StringValue)
+	b, ok2 := args[1].(*StringValue)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___crypto_equal(%s, %s)", args[0], args[1]),
+		}
+	}
+	return BoolValue(subtle.ConstantTimeCompare(*a, *b) == 1), nil
+}
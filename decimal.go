@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// DecimalValue is an exact rational number, made by the decimal() builtin for
+// arithmetic that floats get wrong, like sums of money. Arithmetic between
+// decimals and ints is exact and returns decimals, and dividing decimals keeps
+// the exact fraction, so decimal(1) / 3 * 3 is 1. Decimals don't mix with
+// floats in arithmetic, since the result could be neither exact nor fast.
+//
+// A decimal is shown as its exact decimal digits, or as a fraction like 1/3
+// if it has no finite decimal expansion. The big.Rat of a decimal is never
+// changed once the decimal is made.
+type DecimalValue struct {
+	rat *big.Rat
+}
+
+func makeDecimal(rat *big.Rat) DecimalValue {
+	return DecimalValue{rat: rat}
+}
+
+func (v DecimalValue) String() string {
+	if places, ok := decimalPlaces(v.rat); ok {
+		return v.rat.FloatString(places)
+	}
+	return v.rat.RatString()
+}
+
+func (v DecimalValue) Eq(u Value) bool {
+	switch w := u.(type) {
+	case EmptyValue:
+		return true
+	case DecimalValue:
+		return v.rat.Cmp(w.rat) == 0
+	case IntValue:
+		return v.rat.IsInt() && v.rat.Num().IsInt64() && v.rat.Num().Int64() == int64(w)
+	case FloatValue:
+		// a decimal equals a float only if it's exactly the float's value, so
+		// decimal('0.5') = 0.5 but decimal('0.1') != 0.1
+		if math.IsInf(float64(w), 0) || math.IsNaN(float64(w)) {
+			return false
+		}
+		return v.rat.Cmp(new(big.Rat).SetFloat64(float64(w))) == 0
+	}
+	return false
+}
+
+// decimalPlaces returns the number of decimal places needed to write r
+// exactly, and false if r has no finite decimal expansion, which is when the
+// denominator has prime factors other than 2 and 5.
+func decimalPlaces(r *big.Rat) (int, bool) {
+	denom := new(big.Int).Set(r.Denom())
+	two, five := big.NewInt(2), big.NewInt(5)
+	mod := new(big.Int)
+
+	twos, fives := 0, 0
+	for denom.Cmp(big.NewInt(1)) != 0 {
+		if mod.Mod(denom, two).Sign() == 0 {
+			denom.Quo(denom, two)
+			twos++
+		} else if mod.Mod(denom, five).Sign() == 0 {
+			denom.Quo(denom, five)
+			fives++
+		} else {
+			return 0, false
+		}
+	}
+	if twos > fives {
+		return twos, true
+	}
+	return fives, true
+}
+
+// decimalOperand returns an int or decimal operand of arithmetic with a
+// decimal as a rational.
+func decimalOperand(v Value) (*big.Rat, bool) {
+	switch n := v.(type) {
+	case DecimalValue:
+		return n.rat, true
+	case IntValue:
+		return new(big.Rat).SetInt64(int64(n)), true
+	}
+	return nil, false
+}
+
+func decimalBinaryOp(op tokKind, left, right *big.Rat) (Value, *runtimeError) {
+	switch op {
+	case plus:
+		return makeDecimal(new(big.Rat).Add(left, right)), nil
+	case minus:
+		return makeDecimal(new(big.Rat).Sub(left, right)), nil
+	case times:
+		return makeDecimal(new(big.Rat).Mul(left, right)), nil
+	case divide:
+		if right.Sign() == 0 {
+			return nil, &runtimeError{
+				kind:   "zeroDivisionError",
+				reason: "Division by zero",
+			}
+		}
+		return makeDecimal(new(big.Rat).Quo(left, right)), nil
+	case modulus:
+		if right.Sign() == 0 {
+			return nil, &runtimeError{
+				kind:   "zeroDivisionError",
+				reason: "Division by zero",
+			}
+		}
+		// like the modulus of ints and floats, the result has the sign of the
+		// dividend
+		quo := new(big.Rat).Quo(left, right)
+		trunc := new(big.Rat).SetInt(new(big.Int).Quo(quo.Num(), quo.Denom()))
+		return makeDecimal(new(big.Rat).Sub(left, trunc.Mul(trunc, right))), nil
+	case power:
+		return decimalPow(left, right)
+	case greater:
+		return BoolValue(left.Cmp(right) > 0), nil
+	case less:
+		return BoolValue(left.Cmp(right) < 0), nil
+	case geq:
+		return BoolValue(left.Cmp(right) >= 0), nil
+	case leq:
+		return BoolValue(left.Cmp(right) <= 0), nil
+	}
+	return nil, &runtimeError{
+		kind: "typeError",
+		reason: fmt.Sprintf("Invalid binary operator %s for decimals %s, %s",
+			token{kind: op}, makeDecimal(left), makeDecimal(right)),
+	}
+}
+
+// decimalPow raises a decimal to an int power, which keeps the result exact.
+func decimalPow(base, exp *big.Rat) (Value, *runtimeError) {
+	if !exp.IsInt() || !exp.Num().IsInt64() {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Cannot raise decimal %s to non-int power %s", makeDecimal(base), makeDecimal(exp)),
+		}
+	}
+
+	n := exp.Num().Int64()
+	if n < 0 {
+		if base.Sign() == 0 {
+			return nil, &runtimeError{
+				kind:   "zeroDivisionError",
+				reason: "Division by zero",
+			}
+		}
+		base, n = new(big.Rat).Inv(base), -n
+	}
+	e := big.NewInt(n)
+	num := new(big.Int).Exp(base.Num(), e, nil)
+	denom := new(big.Int).Exp(base.Denom(), e, nil)
+	return makeDecimal(new(big.Rat).SetFrac(num, denom)), nil
+}
+
+// decimal(x) returns a decimal with the value of a number or a string like
+// '19.99', '-2.5e3', or '1/3', or ? if x isn't a number. A float becomes the
+// decimal it's written as, so decimal(0.1) is exactly 0.1.
+func (c *Context) oakDecimal(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("decimal", args, 1); err != nil {
+		return nil, err
+	}
+
+	switch arg := args[0].(type) {
+	case DecimalValue:
+		return arg, nil
+	case IntValue:
+		return makeDecimal(new(big.Rat).SetInt64(int64(arg))), nil
+	case FloatValue:
+		f := float64(arg)
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return null, nil
+		}
+		rat, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+		return makeDecimal(rat), nil
+	case *StringValue:
+		rat, ok := new(big.Rat).SetString(arg.stringContent())
+		if !ok {
+			return null, nil
+		}
+		return makeDecimal(rat), nil
+	default:
+		return null, nil
+	}
+}
+
+// decimalRound(d, places?, mode?) rounds a decimal or int to the given number
+// of decimal places, or to tens, hundreds, and so on if places is negative.
+// Halves are rounded to the even neighbor unless another mode is given.
+func (c *Context) oakDecimalRound(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("decimalRound", args, 1); err != nil {
+		return nil, err
+	}
+
+	rat, ok := decimalOperand(args[0])
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("decimalRound takes a decimal, but got %s", args[0]),
+		}
+	}
+
+	places := 0
+	if len(args) > 1 {
+		switch arg := args[1].(type) {
+		case NullValue:
+		case IntValue:
+			places = int(arg)
+		default:
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Places to decimalRound must be an int, got %s", args[1]),
+			}
+		}
+	}
+
+	mode := AtomValue("halfEven")
+	if len(args) > 2 {
+		switch arg := args[2].(type) {
+		case NullValue:
+		case AtomValue:
+			mode = arg
+		default:
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Rounding mode to decimalRound must be an atom, got %s", args[2]),
+			}
+		}
+	}
+
+	rounded, err := roundRat(rat, places, mode)
+	if err != nil {
+		return nil, err
+	}
+	return makeDecimal(rounded), nil
+}
+
+// roundRat rounds r to a number of decimal places by a rounding mode, one of
+// halfEven, halfUp, halfDown, up, down, ceil, or floor, where up and down
+// mean away from and toward zero.
+func roundRat(r *big.Rat, places int, mode AtomValue) (*big.Rat, *runtimeError) {
+	switch mode {
+	case "halfEven", "halfUp", "halfDown", "up", "down", "ceil", "floor":
+	default:
+		return nil, &runtimeError{
+			kind:   "valueError",
+			reason: fmt.Sprintf("Unknown rounding mode %s", mode),
+		}
+	}
+
+	exp := places
+	if exp < 0 {
+		exp = -exp
+	}
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))
+
+	scaled := new(big.Rat).Set(r)
+	if places >= 0 {
+		scaled.Mul(scaled, scale)
+	} else {
+		scaled.Quo(scaled, scale)
+	}
+
+	// quo is truncated toward zero, so a nonzero rem has the sign of r
+	quo, rem := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	var away bool
+	if rem.Sign() != 0 {
+		// half compares the remainder to half of the denominator
+		twice := new(big.Int).Abs(rem)
+		half := twice.Lsh(twice, 1).Cmp(scaled.Denom())
+
+		switch mode {
+		case "halfEven":
+			away = half > 0 || half == 0 && quo.Bit(0) == 1
+		case "halfUp":
+			away = half >= 0
+		case "halfDown":
+			away = half > 0
+		case "up":
+			away = true
+		case "down":
+			away = false
+		case "ceil":
+			away = r.Sign() > 0
+		case "floor":
+			away = r.Sign() < 0
+		}
+	}
+	if away {
+		quo.Add(quo, big.NewInt(int64(r.Sign())))
+	}
+
+	rounded := new(big.Rat).SetInt(quo)
+	if places >= 0 {
+		return rounded.Quo(rounded, scale), nil
+	}
+	return rounded.Mul(rounded, scale), nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+)
+
+// emitter() returns an event emitter, an object with the methods on, once,
+// off, and emit. emit(event, args...) doesn't call the handlers of the event
+// itself, but queues calls to them on the event loop, where they run in the
+// order they were emitted after the code that emitted them returns. This lets
+// parts of an async program announce events to each other without running
+// each other's code in the middle of their own.
+
+type emitHandler struct {
+	id   int
+	fn   Value
+	once bool
+}
+
+type emitCall struct {
+	fn   Value
+	args []Value
+}
+
+type emitter struct {
+	handlers map[string][]emitHandler
+	nextID   int
+	// handler calls queued by emit, which one task of the event loop runs
+	// in order, so that events are handled in the order they're emitted
+	queue    []emitCall
+	draining bool
+}
+
+func eventName(event Value) string {
+	switch e := event.(type) {
+	case *StringValue:
+		return string(*e)
+	case AtomValue:
+		return string(e)
+	}
+	return event.String()
+}
+
+func (em *emitter) add(event string, fn Value, once bool) int {
+	em.nextID++
+	// appended into a new slice, because emit may be reading the old one
+	handlers := em.handlers[event]
+	em.handlers[event] = append(handlers[:len(handlers):len(handlers)], emitHandler{id: em.nextID, fn: fn, once: once})
+	return em.nextID
+}
+
+// remove removes the handlers of event for which drop returns true.
+func (em *emitter) remove(event string, drop func(emitHandler) bool) {
+	remaining := []emitHandler{}
+	for _, h := range em.handlers[event] {
+		if !drop(h) {
+			remaining = append(remaining, h)
+		}
+	}
+	if len(remaining) > 0 {
+		em.handlers[event] = remaining
+	} else {
+		delete(em.handlers, event)
+	}
+}
+
+func (c *Context) drainEmitter(em *emitter) {
+	c.Lock()
+	defer c.Unlock()
+
+	// handlers may emit more events, which are handled in this same task
+	for len(em.queue) > 0 {
+		call := em.queue[0]
+		em.queue = em.queue[1:]
+		if _, err := c.EvalFnValue(call.fn, false, call.args...); err != nil {
+			c.eng.reportErr(err)
+		}
+	}
+	em.queue = nil
+	em.draining = false
+}
+
+func (c *Context) oakEmitter(_ []Value) (Value, *runtimeError) {
+	em := &emitter{handlers: map[string][]emitHandler{}}
+
+	requireHandler := func(name string, args []Value) *runtimeError {
+		if err := c.requireArgLen(name, args, 2); err != nil {
+			return err
+		}
+		switch args[1].(type) {
+		case FnValue, BuiltinFnValue:
+			return nil
+		}
+		return &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Second argument to %s must be a function, got %s", name, args[1]),
+		}
+	}
+	listen := func(name string, once bool) BuiltinFnValue {
+		return BuiltinFnValue{
+			name: name,
+			fn: func(args []Value) (Value, *runtimeError) {
+				if err := requireHandler(name, args); err != nil {
+					return nil, err
+				}
+				event := eventName(args[0])
+				id := em.add(event, args[1], once)
+				return BuiltinFnValue{
+					name: "off",
+					fn: func(_ []Value) (Value, *runtimeError) {
+						em.remove(event, func(h emitHandler) bool { return h.id == id })
+						return null, nil
+					},
+				}, nil
+			},
+		}
+	}
+
+	return ObjectValue{
+		"on":   listen("on", false),
+		"once": listen("once", true),
+		"off": BuiltinFnValue{
+			name: "off",
+			fn: func(args []Value) (Value, *runtimeError) {
+				if err := c.requireArgLen("off", args, 1); err != nil {
+					return nil, err
+				}
+				event := eventName(args[0])
+				if len(args) < 2 {
+					delete(em.handlers, event)
+					return null, nil
+				}
+				fn := args[1]
+				em.remove(event, func(h emitHandler) bool { return h.fn.Eq(fn) })
+				return null, nil
+			},
+		},
+		"emit": BuiltinFnValue{
+			name: "emit",
+			fn: func(args []Value) (Value, *runtimeError) {
+				if err := c.requireArgLen("emit", args, 1); err != nil {
+					return nil, err
+				}
+				event := eventName(args[0])
+				handlers := em.handlers[event]
+				if len(handlers) == 0 {
+					return IntValue(0), nil
+				}
+
+				eventArgs := args[1:]
+				for _, h := range handlers {
+					em.queue = append(em.queue, emitCall{fn: h.fn, args: eventArgs})
+				}
+				// once handlers are removed as they're queued, so that they
+				// handle only the first event emitted after they're added
+				em.remove(event, func(h emitHandler) bool { return h.once })
+
+				if !em.draining {
+					em.draining = true
+					c.eng.Add(1)
+					go func() {
+						defer c.eng.Done()
+						c.drainEmitter(em)
+					}()
+				}
+				return IntValue(len(handlers)), nil
+			},
+		},
+	}, nil
+}
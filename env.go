@@ -5,14 +5,18 @@ import (
 	"bytes"
 	"context"
 	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
+	"math/big"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"runtime"
@@ -26,6 +30,7 @@ import (
 func (c *Context) requireArgLen(fnName string, args []Value, count int) *runtimeError {
 	if len(args) < count {
 		return &runtimeError{
+			kind:   "argumentError",
 			reason: fmt.Sprintf("%s requires %d arguments, got %d", fnName, count, len(args)),
 		}
 	}
@@ -67,15 +72,52 @@ func (c *Context) LoadBuiltins() {
 
 	// core language and reflection
 	c.LoadFunc("import", c.oakImport)
+	c.LoadFunc("lazyImport", c.oakLazyImport)
 	c.LoadFunc("int", c.oakInt)
 	c.LoadFunc("float", c.oakFloat)
+	c.LoadFunc("divmod", c.oakDivmod)
+	c.LoadFunc("decimal", c.oakDecimal)
+	c.LoadFunc("decimalRound", c.oakDecimalRound)
 	c.LoadFunc("atom", c.oakAtom)
 	c.LoadFunc("string", c.oakString)
+	c.LoadFunc("format", c.oakFormat)
 	c.LoadFunc("codepoint", c.oakCodepoint)
 	c.LoadFunc("char", c.oakChar)
 	c.LoadFunc("type", c.oakType)
 	c.LoadFunc("len", c.oakLen)
 	c.LoadFunc("keys", c.oakKeys)
+	c.LoadFunc("map", c.oakMap)
+	c.LoadFunc("mapGet", c.oakMapGet)
+	c.LoadFunc("mapSet", c.oakMapSet)
+	c.LoadFunc("mapDelete", c.oakMapDelete)
+	c.LoadFunc("mapHas?", c.oakMapHas)
+	c.LoadFunc("mapEntries", c.oakMapEntries)
+	c.LoadFunc("sublist", c.oakSublist)
+	c.LoadFunc("___slice", c.oakSlice)
+	c.LoadFunc("join", c.oakJoin)
+	c.LoadFunc("ints", c.oakInts)
+	c.LoadFunc("floats", c.oakFloats)
+	c.LoadFunc("range", c.oakRange)
+	c.LoadFunc("vadd", c.oakVadd)
+	c.LoadFunc("vscale", c.oakVscale)
+	c.LoadFunc("vsum", c.oakVsum)
+	c.LoadFunc("vdot", c.oakVdot)
+	c.LoadFunc("assert", c.oakAssert)
+	c.LoadFunc("try", c.oakTry)
+	c.LoadFunc("raise", c.oakRaise)
+	c.LoadFunc("compose", c.oakCompose)
+	c.LoadFunc("pipe", c.oakPipe)
+	c.LoadFunc("generator", c.oakGenerator)
+	c.LoadFunc("seq", c.oakSeq)
+	c.LoadFunc("___for", c.oakFor)
+	c.LoadFunc("marshal", c.oakMarshal)
+	c.LoadFunc("unmarshal", c.oakUnmarshal)
+	c.LoadFunc("conform", c.oakConform)
+	c.LoadFunc("emitter", c.oakEmitter)
+	c.LoadFunc("task", c.oakTask)
+	c.LoadFunc("___async", c.oakAsync)
+	c.LoadFunc("___await", c.oakAwait)
+	c.LoadFunc("workers", c.oakWorkers)
 
 	// os interfaces
 	c.LoadFunc("args", c.oakArgs)
@@ -87,20 +129,28 @@ func (c *Context) LoadBuiltins() {
 	c.LoadFunc("wait", c.callbackify(c.oakWait))
 	c.LoadFunc("exit", c.oakExit)
 	c.LoadFunc("exec", c.callbackify(c.oakExec))
+	c.LoadFunc("spawn", c.oakSpawn)
+	c.LoadFunc("signal", c.oakSignal)
 
 	// i/o interfaces
 	c.LoadFunc("input", c.callbackify(c.oakInput))
+	c.LoadFunc("lines", c.oakLines)
 	c.LoadFunc("print", c.oakPrint)
+	c.LoadFunc("stdio", c.oakStdio)
 	c.LoadFunc("ls", c.callbackify(c.oakLs))
 	c.LoadFunc("rm", c.callbackify(c.oakRm))
 	c.LoadFunc("mkdir", c.callbackify(c.oakMkdir))
 	c.LoadFunc("stat", c.callbackify(c.oakStat))
+	c.LoadFunc("walk", c.oakWalk)
+	c.LoadFunc("watch", c.oakWatch)
 	c.LoadFunc("open", c.callbackify(c.oakOpen))
 	c.LoadFunc("close", c.callbackify(c.oakClose))
 	c.LoadFunc("read", c.callbackify(c.oakRead))
 	c.LoadFunc("write", c.callbackify(c.oakWrite))
 	c.LoadFunc("listen", c.oakListen)
 	c.LoadFunc("req", c.callbackify(c.oakReq))
+	c.LoadFunc("udpListen", c.oakUDPListen)
+	c.LoadFunc("udpSend", c.callbackify(c.oakUDPSend))
 
 	// math
 	c.LoadFunc("sin", c.oakSin)
@@ -117,7 +167,68 @@ func (c *Context) LoadBuiltins() {
 	c.LoadFunc("___runtime_lib?", c.rtIsLib)
 	c.LoadFunc("___runtime_gc", c.rtGC)
 	c.LoadFunc("___runtime_mem", c.rtMem)
+	c.LoadFunc("___runtime_heap", c.rtHeap)
 	c.LoadFunc("___runtime_proc", c.rtProc)
+	c.LoadFunc("___runtime_build", c.rtBuild)
+	c.LoadFunc("___debug_watch", c.oakDebugWatch)
+	c.LoadFunc("___reactive_subscribe", c.oakReactiveSubscribe)
+	c.LoadFunc("___reactive_flush", c.oakReactiveFlush)
+	c.LoadFunc("___str_split", c.oakStrSplit)
+	c.LoadFunc("___str_replace", c.oakStrReplace)
+	c.LoadFunc("___str_index", c.oakStrIndex)
+	c.LoadFunc("___str_rindex", c.oakStrRindex)
+	c.LoadFunc("___str_trim_start", c.oakStrTrimStart)
+	c.LoadFunc("___str_trim_end", c.oakStrTrimEnd)
+	c.LoadFunc("___str_pad_start", c.oakStrPadStart)
+	c.LoadFunc("___str_pad_end", c.oakStrPadEnd)
+	c.LoadFunc("___str_upper", c.oakStrUpper)
+	c.LoadFunc("___str_lower", c.oakStrLower)
+	c.LoadFunc("___bits_shl", c.oakBitsShl)
+	c.LoadFunc("___bits_shr", c.oakBitsShr)
+	c.LoadFunc("___bits_ushr", c.oakBitsUshr)
+	c.LoadFunc("___bits_rotl", c.oakBitsRotl)
+	c.LoadFunc("___bits_not", c.oakBitsNot)
+	c.LoadFunc("___msgpack_serialize", c.oakMsgpackSerialize)
+	c.LoadFunc("___msgpack_parse", c.oakMsgpackParse)
+	c.LoadFunc("___yaml_serialize", c.oakYamlSerialize)
+	c.LoadFunc("___yaml_parse", c.oakYamlParse)
+	c.LoadFunc("___toml_serialize", c.oakTomlSerialize)
+	c.LoadFunc("___toml_parse", c.oakTomlParse)
+	c.LoadFunc("___template_compile", c.oakTemplateCompile)
+	c.LoadFunc("___md_render", c.oakMdRender)
+	c.LoadFunc("___assets_read", c.oakAssetsRead)
+	c.LoadFunc("___js_global", c.jsGlobal)
+	c.LoadFunc("___js_get", c.jsGet)
+	c.LoadFunc("___js_set", c.jsSet)
+	c.LoadFunc("___js_call", c.jsCall)
+	c.LoadFunc("___js_func", c.jsFunc)
+	c.LoadFunc("___ffi_open", c.oakFfiOpen)
+	c.LoadFunc("___ffi_fn", c.oakFfiFn)
+	c.LoadFunc("___rpc_listen", c.oakRPCListen)
+	c.LoadFunc("___rpc_connect", c.oakRPCConnect)
+	c.LoadFunc("___ipc_listen", c.oakIPCListen)
+	c.LoadFunc("___ipc_connect", c.oakIPCConnect)
+	c.LoadFunc("___path_abs", c.oakPathAbs)
+	c.LoadFunc("___path_rel", c.oakPathRel)
+	c.LoadFunc("___path_match", c.oakPathMatch)
+	c.LoadFunc("___path_glob", c.oakPathGlob)
+	c.LoadFunc("___path_to_slash", c.oakPathToSlash)
+	c.LoadFunc("___path_from_slash", c.oakPathFromSlash)
+	c.LoadFunc("___term_size", c.oakTermSize)
+	c.LoadFunc("___term_raw", c.oakTermRaw)
+	c.LoadFunc("___term_key", c.oakTermKey)
+	c.LoadFunc("___net_hostname", c.oakNetHostname)
+	c.LoadFunc("___net_lookup", c.oakNetLookup)
+	c.LoadFunc("___net_reverse", c.oakNetReverse)
+	c.LoadFunc("___net_interfaces", c.oakNetInterfaces)
+	c.LoadFunc("___net_ping", c.oakNetPing)
+	c.LoadFunc("___mail_message", c.oakMailMessage)
+	c.LoadFunc("___mail_send", c.callbackify(c.oakMailSend))
+	c.LoadFunc("___crypto_hmac", c.oakCryptoHMAC)
+	c.LoadFunc("___crypto_equal", c.oakCryptoEqual)
+	c.LoadFunc("___http_form", c.oakHTTPForm)
+
+	c.loadPlatformBuiltins()
 }
 
 func errObj(message string) ObjectValue {
@@ -163,6 +274,46 @@ func (c *Context) callbackify(syncFn builtinFn) builtinFn {
 	}
 }
 
+// resolveModule finds the file of a module imported by a path that isn't a
+// standard library or URL. An absolute path is used as is, and any other path
+// is relative to the directory of the importing file, so ./ and ../ work as
+// they do in file paths. A path names the file at the path with .oak appended
+// or, if there is none, the main.oak or index.oak of a directory at the path.
+// A name that doesn't begin with . and names no file may be a package added
+// with oak get.
+//
+// resolveModule returns the file it found, or "" if it found none, with the
+// files it tried in order.
+func (c *Context) resolveModule(pathStr string) (string, []string) {
+	base := filepath.FromSlash(pathStr)
+	if !filepath.IsAbs(base) {
+		base = filepath.Join(c.rootPath, base)
+	}
+
+	tried := []string{}
+	exists := func(filePath string) bool {
+		tried = append(tried, filePath)
+		info, err := os.Stat(filePath)
+		return err == nil && !info.IsDir()
+	}
+
+	for _, filePath := range []string{
+		base + ".oak",
+		filepath.Join(base, "main.oak"),
+		filepath.Join(base, "index.oak"),
+	} {
+		if exists(filePath) {
+			return filePath, tried
+		}
+	}
+	if !strings.HasPrefix(pathStr, ".") && !filepath.IsAbs(pathStr) {
+		if pkgFile, ok := c.resolvePackage(pathStr); ok && exists(pkgFile) {
+			return pkgFile, tried
+		}
+	}
+	return "", tried
+}
+
 func (c *Context) oakImport(args []Value) (Value, *runtimeError) {
 	if err := c.requireArgLen("import", args, 1); err != nil {
 		return nil, err
@@ -171,6 +322,7 @@ func (c *Context) oakImport(args []Value) (Value, *runtimeError) {
 	pathBytes, ok := args[0].(*StringValue)
 	if !ok {
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("path to import() must be a string, got %s", args[0]),
 		}
 	}
@@ -181,41 +333,116 @@ func (c *Context) oakImport(args []Value) (Value, *runtimeError) {
 		return c.LoadLib(pathStr)
 	}
 
-	filePath := pathStr + ".oak"
-	if !filepath.IsAbs(filePath) {
-		filePath = filepath.Join(c.rootPath, filePath)
+	// a URL, or any module imported by a remote module, is fetched
+	if isRemoteImport(pathStr) || isRemoteImport(c.rootPath) {
+		return c.importRemote(pathStr)
 	}
 
-	file, err := os.Open(filePath)
+	filePath, tried := c.resolveModule(pathStr)
+	if filePath == "" {
+		triedPaths := make([]Value, len(tried))
+		for i, p := range tried {
+			triedPaths[i] = MakeString(p)
+		}
+		return nil, &runtimeError{
+			kind:   "importError",
+			reason: fmt.Sprintf("Could not find module %s, tried:\n\t%s", pathStr, strings.Join(tried, "\n\t")),
+			data: ObjectValue{
+				"path":  MakeString(pathStr),
+				"tried": MakeList(triedPaths...),
+			},
+		}
+	}
+
+	if imported, ok := c.eng.importMap[filePath]; ok {
+		return moduleExports(imported), nil
+	}
+
+	src, err := os.ReadFile(filePath)
 	if err != nil {
 		return nil, &runtimeError{
+			kind:   "importError",
 			reason: fmt.Sprintf("Could not open %s, %s", filePath, err.Error()),
+			data:   ObjectValue{"path": MakeString(filePath)},
 		}
 	}
-	defer file.Close()
 
-	if imported, ok := c.eng.importMap[filePath]; ok {
-		return ObjectValue(imported.vars), nil
+	return c.evalImport(filePath, path.Dir(filePath), src, pathStr)
+}
+
+// moduleExports returns what importing a module evaluates to. A module that
+// defines a top-level export, usually an object, exports only its value, and
+// any other module exports its whole top-level scope.
+func moduleExports(s scope) Value {
+	if exports, ok := s.vars["export"]; ok {
+		return exports
+	}
+	return ObjectValue(s.vars)
+}
+
+// evalImport evaluates a module, identified by key, in a new context rooted at
+// rootPath, unless it's already been imported.
+func (c *Context) evalImport(key string, rootPath string, src []byte, pathStr string) (Value, *runtimeError) {
+	if imported, ok := c.eng.importMap[key]; ok {
+		return moduleExports(imported), nil
 	}
 
-	ctx := c.ChildContext(path.Dir(filePath))
-	c.eng.importMap[filePath] = ctx.scope
+	ctx := c.ChildContext(rootPath)
+	c.eng.importMap[key] = ctx.scope
 	ctx.LoadBuiltins()
 
 	ctx.Unlock()
-	_, err = ctx.Eval(file)
+	_, err := ctx.EvalSource(src)
 	ctx.Lock()
 	if err != nil {
 		if runtimeErr, ok := err.(*runtimeError); ok {
 			return nil, runtimeErr
 		} else {
 			return nil, &runtimeError{
+				kind:   "importError",
 				reason: fmt.Sprintf("Error importing %s: %s", pathStr, err.Error()),
+				data:   ObjectValue{"path": MakeString(pathStr)},
 			}
 		}
 	}
 
-	return ObjectValue(ctx.scope.vars), nil
+	return moduleExports(ctx.scope), nil
+}
+
+// oakLazyImport returns a function that imports a module the first time it's
+// called, so that a program doesn't pay for loading a module it may not use.
+// The function returns ? if the module can't be imported, which lets
+// programs treat a module as an optional dependency.
+func (c *Context) oakLazyImport(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("lazyImport", args, 1); err != nil {
+		return nil, err
+	}
+
+	if _, ok := args[0].(*StringValue); !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("path to lazyImport() must be a string, got %s", args[0]),
+		}
+	}
+
+	var module Value
+	return BuiltinFnValue{
+		name: "lazyImport",
+		fn: func(_ []Value) (Value, *runtimeError) {
+			if module != nil {
+				return module, nil
+			}
+			imported, err := c.oakImport(args[:1])
+			if err != nil {
+				if err.kind != "importError" {
+					return nil, err
+				}
+				imported = null
+			}
+			module = imported
+			return module, nil
+		},
+	}, nil
 }
 
 func (c *Context) oakInt(args []Value) (Value, *runtimeError) {
@@ -228,6 +455,9 @@ func (c *Context) oakInt(args []Value) (Value, *runtimeError) {
 		return arg, nil
 	case FloatValue:
 		return IntValue(math.Floor(float64(arg))), nil
+	case DecimalValue:
+		floor, _ := roundRat(arg.rat, 0, "floor")
+		return IntValue(floor.Num().Int64()), nil
 	case *StringValue:
 		n, err := strconv.ParseInt(arg.stringContent(), 10, 64)
 		if err != nil {
@@ -249,6 +479,9 @@ func (c *Context) oakFloat(args []Value) (Value, *runtimeError) {
 		return FloatValue(arg), nil
 	case FloatValue:
 		return arg, nil
+	case DecimalValue:
+		f, _ := arg.rat.Float64()
+		return FloatValue(f), nil
 	case *StringValue:
 		f, err := strconv.ParseFloat(arg.stringContent(), 64)
 		if err != nil {
@@ -260,6 +493,66 @@ func (c *Context) oakFloat(args []Value) (Value, *runtimeError) {
 	}
 }
 
+// divmod(a, b) returns [a divided by b rounded down, the remainder]. Unlike
+// %, the remainder has the sign of b, so divmod(-7, 2) is [-4, 1].
+func (c *Context) oakDivmod(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("divmod", args, 2); err != nil {
+		return nil, err
+	}
+
+	if left, ok := args[0].(IntValue); ok {
+		if right, ok := args[1].(IntValue); ok {
+			if right == 0 {
+				return nil, &runtimeError{
+					kind:   "zeroDivisionError",
+					reason: "Division by zero",
+				}
+			}
+			quo, rem := left/right, left%right
+			if rem != 0 && (rem < 0) != (right < 0) {
+				quo, rem = quo-1, rem+right
+			}
+			return MakeList(quo, rem), nil
+		}
+	}
+
+	_, leftDecimal := args[0].(DecimalValue)
+	_, rightDecimal := args[1].(DecimalValue)
+	if leftDecimal || rightDecimal {
+		left, lok := decimalOperand(args[0])
+		right, rok := decimalOperand(args[1])
+		if lok && rok {
+			if right.Sign() == 0 {
+				return nil, &runtimeError{
+					kind:   "zeroDivisionError",
+					reason: "Division by zero",
+				}
+			}
+			quo, _ := roundRat(new(big.Rat).Quo(left, right), 0, "floor")
+			rem := new(big.Rat).Sub(left, new(big.Rat).Mul(quo, right))
+			return MakeList(makeDecimal(quo), makeDecimal(rem)), nil
+		}
+	} else {
+		left, lok := toFloat(args[0])
+		right, rok := toFloat(args[1])
+		if lok && rok {
+			if right == 0 {
+				return nil, &runtimeError{
+					kind:   "zeroDivisionError",
+					reason: "Division by zero",
+				}
+			}
+			quo := math.Floor(left / right)
+			return MakeList(FloatValue(quo), FloatValue(left-quo*right)), nil
+		}
+	}
+
+	return nil, &runtimeError{
+		kind:   "typeError",
+		reason: fmt.Sprintf("Mismatched types in call divmod(%s, %s)", args[0], args[1]),
+	}
+}
+
 func (c *Context) oakAtom(args []Value) (Value, *runtimeError) {
 	if err := c.requireArgLen("atom", args, 1); err != nil {
 		return nil, err
@@ -280,13 +573,37 @@ func (c *Context) oakString(args []Value) (Value, *runtimeError) {
 		return nil, err
 	}
 
-	switch arg := args[0].(type) {
+	val, err := c.stringMethod(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// string(x, spec) formats x like a field of format()
+	if len(args) > 1 {
+		if spec, ok := args[1].(*StringValue); ok {
+			s, err := parseFormatSpec(spec.stringContent())
+			if err != nil {
+				return nil, err
+			}
+			// checked before padding to the width allocates it
+			if err := c.allocString(s.width, 0); err != nil {
+				return nil, err
+			}
+			formatted, err := s.format(val)
+			if err != nil {
+				return nil, err
+			}
+			return c.makeString(formatted)
+		}
+	}
+
+	switch arg := val.(type) {
 	case *StringValue:
 		return arg, nil
 	case AtomValue:
-		return MakeString(string(arg)), nil
+		return c.makeString(string(arg))
 	default:
-		return MakeString(arg.String()), nil
+		return c.makeString(arg.String())
 	}
 }
 
@@ -320,39 +637,56 @@ func (c *Context) oakChar(args []Value) (Value, *runtimeError) {
 		if codepoint > 255 {
 			codepoint = 255
 		}
-		bytes := StringValue([]byte{byte(codepoint)})
-		return &bytes, nil
+		return c.makeString(string([]byte{byte(codepoint)}))
 	default:
 		return null, nil
 	}
 }
 
+// hostValue is a value from the environment a program runs in, like a
+// JavaScript object in WebAssembly, which only builtins can look inside.
+type hostValue interface {
+	Value
+	hostType() string
+}
+
 func (c *Context) oakType(args []Value) (Value, *runtimeError) {
 	if err := c.requireArgLen("type", args, 1); err != nil {
 		return nil, err
 	}
 
-	switch args[0].(type) {
+	return valueType(args[0]), nil
+}
+
+// valueType returns the atom naming the type of v, as returned by type().
+func valueType(v Value) AtomValue {
+	switch val := v.(type) {
 	case NullValue:
-		return AtomValue("null"), nil
+		return AtomValue("null")
 	case EmptyValue:
-		return AtomValue("empty"), nil
+		return AtomValue("empty")
 	case IntValue:
-		return AtomValue("int"), nil
+		return AtomValue("int")
 	case FloatValue:
-		return AtomValue("float"), nil
+		return AtomValue("float")
+	case DecimalValue:
+		return AtomValue("decimal")
 	case BoolValue:
-		return AtomValue("bool"), nil
+		return AtomValue("bool")
 	case AtomValue:
-		return AtomValue("atom"), nil
+		return AtomValue("atom")
 	case *StringValue:
-		return AtomValue("string"), nil
-	case *ListValue:
-		return AtomValue("list"), nil
+		return AtomValue("string")
+	case *ListValue, numArray:
+		return AtomValue("list")
 	case ObjectValue:
-		return AtomValue("object"), nil
+		return AtomValue("object")
+	case *MapValue:
+		return AtomValue("map")
 	case FnValue, BuiltinFnValue:
-		return AtomValue("function"), nil
+		return AtomValue("function")
+	case hostValue:
+		return AtomValue(val.hostType())
 	}
 
 	panic("Unreachable: unknown runtime value")
@@ -367,22 +701,30 @@ func (c *Context) oakLen(args []Value) (Value, *runtimeError) {
 	case *StringValue:
 		return IntValue(len(*arg)), nil
 	case *ListValue:
-		return IntValue(len(*arg)), nil
+		return IntValue(len(arg.elems)), nil
+	case numArray:
+		return IntValue(arg.length()), nil
 	case ObjectValue:
 		return IntValue(len(arg)), nil
+	case *MapValue:
+		return IntValue(arg.len()), nil
 	default:
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("%s does not support a len() call", arg),
 		}
 	}
 }
 
-func makeIntListUpTo(max int) Value {
-	list := make(ListValue, max)
+func (c *Context) makeIntListUpTo(max int) (Value, *runtimeError) {
+	if err := c.allocList(max, max); err != nil {
+		return nil, err
+	}
+	list := make([]Value, max)
 	for i := 0; i < max; i++ {
 		list[i] = IntValue(i)
 	}
-	return &list
+	return MakeList(list...), nil
 }
 
 func (c *Context) oakKeys(args []Value) (Value, *runtimeError) {
@@ -392,29 +734,476 @@ func (c *Context) oakKeys(args []Value) (Value, *runtimeError) {
 
 	switch arg := args[0].(type) {
 	case *StringValue:
-		return makeIntListUpTo(len(*arg)), nil
+		return c.makeIntListUpTo(len(*arg))
 	case *ListValue:
-		return makeIntListUpTo(len(*arg)), nil
+		return c.makeIntListUpTo(len(arg.elems))
+	case numArray:
+		return c.makeIntListUpTo(arg.length())
 	case ObjectValue:
-		keys := make(ListValue, len(arg))
+		keys := make([]Value, len(arg))
 		i := 0
 		for key := range arg {
 			keys[i] = MakeString(key)
 			i++
 		}
-		return &keys, nil
+		list := MakeList(keys...)
+		return list, c.allocValue(list, map[uintptr]bool{})
+	case *MapValue:
+		keys := make([]Value, 0, arg.len())
+		arg.each(func(key, _ Value) {
+			keys = append(keys, key)
+		})
+		return c.makeList(keys...)
 	default:
 		return MakeList(), nil
 	}
 }
 
+func (c *Context) oakSublist(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("sublist", args, 3); err != nil {
+		return nil, err
+	}
+
+	list, ok1 := asList(args[0])
+	minVal, ok2 := args[1].(IntValue)
+	maxVal, ok3 := args[2].(IntValue)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call sublist(%s, %s, %s)", args[0], args[1], args[2]),
+		}
+	}
+
+	max := int(maxVal)
+	if max > len(list.elems) {
+		max = len(list.elems)
+	}
+	min := int(minVal)
+	if min < 0 {
+		min = 0
+	}
+	if min > max {
+		min = max
+	}
+
+	return list.slice(min, max), nil
+}
+
+// ___slice is the builtin that slices xs.(start:end) desugar to.
+// ___slice(xs, start, end, optional) returns the elements of the string or
+// list xs from start up to end, where a negative bound counts back from the
+// end of xs and a ? bound is the start or end of xs. Bounds past either end
+// of xs are clamped to it. If optional is true, slicing ? returns ?.
+func (c *Context) oakSlice(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___slice", args, 4); err != nil {
+		return nil, err
+	}
+
+	var length int
+	switch xs := args[0].(type) {
+	case *StringValue:
+		length = len(*xs)
+	case *ListValue:
+		length = len(xs.elems)
+	case numArray:
+		length = xs.length()
+	default:
+		if _, ok := xs.(NullValue); ok && args[3] == oakTrue {
+			return null, nil
+		}
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Cannot slice %s, which is not a string or list", args[0]),
+		}
+	}
+
+	bound := func(arg Value, open int) (int, *runtimeError) {
+		switch n := arg.(type) {
+		case NullValue:
+			return open, nil
+		case IntValue:
+			i := int(n)
+			if i < 0 {
+				i += length
+			}
+			if i < 0 {
+				return 0, nil
+			}
+			if i > length {
+				return length, nil
+			}
+			return i, nil
+		}
+		return 0, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Bounds of a slice must be ints, got %s", arg),
+		}
+	}
+	min, err := bound(args[1], 0)
+	if err != nil {
+		return nil, err
+	}
+	max, err := bound(args[2], length)
+	if err != nil {
+		return nil, err
+	}
+	if min > max {
+		min = max
+	}
+
+	switch xs := args[0].(type) {
+	case *StringValue:
+		if err := c.allocString(max-min, max-min); err != nil {
+			return nil, err
+		}
+		return MakeString(string((*xs)[min:max])), nil
+	case *ListValue:
+		return xs.slice(min, max), nil
+	default:
+		list, _ := asList(xs)
+		return list.slice(min, max), nil
+	}
+}
+
+func (c *Context) oakJoin(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("join", args, 1); err != nil {
+		return nil, err
+	}
+
+	list, ok := args[0].(*ListValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call join(%s)", args[0]),
+		}
+	}
+
+	sep := []byte{}
+	if len(args) > 1 {
+		sepString, ok := args[1].(*StringValue)
+		if !ok {
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Mismatched types in call join(%s, %s)", args[0], args[1]),
+			}
+		}
+		sep = *sepString
+	}
+
+	parts := make([][]byte, len(list.elems))
+	size := len(sep) * (len(parts) - 1)
+	for i, el := range list.elems {
+		part, ok := el.(*StringValue)
+		if !ok {
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("join() takes a list of strings, but got %s in %s", el, list),
+			}
+		}
+		parts[i] = *part
+		size += len(*part)
+	}
+	if err := c.allocString(size, size); err != nil {
+		return nil, err
+	}
+
+	joined := StringValue(bytes.Join(parts, sep))
+	return &joined, nil
+}
+
+func (c *Context) oakInts(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("ints", args, 1); err != nil {
+		return nil, err
+	}
+	return c.makeNumArray("ints", args[0])
+}
+
+func (c *Context) oakFloats(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("floats", args, 1); err != nil {
+		return nil, err
+	}
+	return c.makeNumArray("floats", args[0])
+}
+
+func (c *Context) oakRange(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("range", args, 1); err != nil {
+		return nil, err
+	}
+
+	// range(end), range(start, end), range(start, end, step)
+	var start, end, step Value = IntValue(0), args[0], IntValue(1)
+	if len(args) > 1 && args[1] != null {
+		start, end = args[0], args[1]
+	}
+	if len(args) > 2 && args[2] != null {
+		step = args[2]
+	}
+
+	startNum, ok1 := toFloat(start)
+	endNum, ok2 := toFloat(end)
+	stepNum, ok3 := toFloat(step)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call range(%s, %s, %s)", start, end, step),
+		}
+	}
+
+	n, ok := rangeLen(startNum, endNum, stepNum)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "valueError",
+			reason: fmt.Sprintf("range(%s, %s, %s) does not have a finite length", start, end, step),
+		}
+	}
+	if err := c.allocList(n, n); err != nil {
+		return nil, err
+	}
+
+	startInt, ok1 := start.(IntValue)
+	stepInt, ok2 := step.(IntValue)
+	if ok1 && ok2 {
+		arr := make(IntArrayValue, n)
+		for i := range arr {
+			arr[i] = int64(startInt) + int64(i)*int64(stepInt)
+		}
+		return &arr, nil
+	}
+
+	// computing each element from the start avoids accumulating rounding
+	// errors in float ranges
+	arr := make(FloatArrayValue, n)
+	for i := range arr {
+		arr[i] = startNum + float64(i)*stepNum
+	}
+	return &arr, nil
+}
+
+func (c *Context) oakVadd(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("vadd", args, 2); err != nil {
+		return nil, err
+	}
+	if err := c.allocNumArrayOp(args[0]); err != nil {
+		return nil, err
+	}
+
+	return numArrayOp("vadd", args[0], args[1],
+		func(x, y int64) int64 { return x + y },
+		func(x, y float64) float64 { return x + y })
+}
+
+func (c *Context) oakVscale(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("vscale", args, 2); err != nil {
+		return nil, err
+	}
+	if err := c.allocNumArrayOp(args[0]); err != nil {
+		return nil, err
+	}
+
+	if _, ok := toFloat(args[1]); !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call vscale(%s, %s)", args[0], args[1]),
+		}
+	}
+	return numArrayOp("vscale", args[0], args[1],
+		func(x, y int64) int64 { return x * y },
+		func(x, y float64) float64 { return x * y })
+}
+
+func (c *Context) oakVsum(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("vsum", args, 1); err != nil {
+		return nil, err
+	}
+
+	switch arr := args[0].(type) {
+	case *IntArrayValue:
+		var sum int64
+		for _, n := range *arr {
+			sum += n
+		}
+		return IntValue(sum), nil
+	case *FloatArrayValue:
+		var sum float64
+		for _, n := range *arr {
+			sum += n
+		}
+		return FloatValue(sum), nil
+	}
+
+	return nil, &runtimeError{
+		kind:   "typeError",
+		reason: fmt.Sprintf("Mismatched types in call vsum(%s)", args[0]),
+	}
+}
+
+func (c *Context) oakVdot(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("vdot", args, 2); err != nil {
+		return nil, err
+	}
+
+	xs, ok1 := args[0].(numArray)
+	ys, ok2 := args[1].(numArray)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call vdot(%s, %s)", args[0], args[1]),
+		}
+	}
+
+	products, err := numArrayOp("vdot", xs, ys,
+		func(x, y int64) int64 { return x * y },
+		func(x, y float64) float64 { return x * y })
+	if err != nil {
+		return nil, err
+	}
+	return c.oakVsum([]Value{products})
+}
+
+func (c *Context) oakAssert(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("assert", args, 1); err != nil {
+		return nil, err
+	}
+
+	cond, ok := args[0].(BoolValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call assert(%s)", args[0]),
+		}
+	}
+	if cond {
+		return cond, nil
+	}
+
+	reason := "Assertion failed"
+	if len(args) > 1 {
+		if msg, ok := args[1].(*StringValue); ok {
+			reason = fmt.Sprintf("Assertion failed (%s)", string(*msg))
+		} else {
+			reason = fmt.Sprintf("Assertion failed (%s)", args[1])
+		}
+	}
+	return nil, &runtimeError{kind: "assertionError", reason: reason}
+}
+
+func (c *Context) oakTry(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("try", args, 1); err != nil {
+		return nil, err
+	}
+
+	if _, ok := args[0].(FnValue); !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call try(%s)", args[0]),
+		}
+	}
+
+	val, err := c.EvalFnValue(args[0], false)
+	if err != nil {
+		// a cancelled program must stop, so cancellation can't be recovered
+		if err.kind == "cancelled" {
+			return nil, err
+		}
+		return err.value(), nil
+	}
+	return ObjectValue{
+		"type": AtomValue("ok"),
+		"ok":   val,
+	}, nil
+}
+
+func (c *Context) oakRaise(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("raise", args, 2); err != nil {
+		return nil, err
+	}
+
+	kind, ok1 := args[0].(AtomValue)
+	msg, ok2 := args[1].(*StringValue)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call raise(%s, %s)", args[0], args[1]),
+		}
+	}
+
+	data := ObjectValue{}
+	if len(args) > 2 {
+		obj, ok := args[2].(ObjectValue)
+		if !ok {
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Mismatched types in call raise(%s, %s, %s)", args[0], args[1], args[2]),
+			}
+		}
+		data = obj
+	}
+
+	return nil, &runtimeError{
+		kind:   string(kind),
+		reason: msg.stringContent(),
+		data:   data,
+	}
+}
+
+// composeFns returns a function that calls each of fns in turn, the first with
+// the arguments to the function and the rest with the result of the one
+// before, and returns the result of the last. name is the builtin making it.
+func (c *Context) composeFns(name string, fns []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen(name, fns, 1); err != nil {
+		return nil, err
+	}
+	for i, fn := range fns {
+		switch fn.(type) {
+		case FnValue, BuiltinFnValue:
+		default:
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Argument %d to %s must be a function, got %s", i, name, fn),
+			}
+		}
+	}
+
+	return BuiltinFnValue{
+		name: name,
+		fn: func(args []Value) (Value, *runtimeError) {
+			val, err := c.EvalFnValue(fns[0], false, args...)
+			if err != nil {
+				return nil, err
+			}
+			for _, fn := range fns[1:] {
+				if val, err = c.EvalFnValue(fn, false, val); err != nil {
+					return nil, err
+				}
+			}
+			return val, nil
+		},
+	}, nil
+}
+
+// compose(f, g, h) returns a function that calls h, then g, then f, so that
+// compose(f, g, h)(x) is f(g(h(x))).
+func (c *Context) oakCompose(args []Value) (Value, *runtimeError) {
+	fns := make([]Value, len(args))
+	for i, fn := range args {
+		fns[len(args)-1-i] = fn
+	}
+	return c.composeFns("compose", fns)
+}
+
+// pipe(f, g, h) returns a function that calls f, then g, then h, so that
+// pipe(f, g, h)(x) is x |> f() |> g() |> h().
+func (c *Context) oakPipe(args []Value) (Value, *runtimeError) {
+	return c.composeFns("pipe", args)
+}
+
 func (c *Context) oakArgs(_ []Value) (Value, *runtimeError) {
 	goArgs := os.Args
-	args := make(ListValue, len(goArgs))
+	args := make([]Value, len(goArgs))
 	for i, arg := range goArgs {
 		args[i] = MakeString(arg)
 	}
-	return &args, nil
+	return MakeList(args...), nil
 }
 
 func (c *Context) oakEnv(_ []Value) (Value, *runtimeError) {
@@ -447,6 +1236,7 @@ func (c *Context) oakSrand(args []Value) (Value, *runtimeError) {
 	bufLen, ok1 := args[0].(IntValue)
 	if !ok1 {
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call srand(%s)", args[0]),
 		}
 	}
@@ -474,6 +1264,7 @@ func (c *Context) oakWait(args []Value) (Value, *runtimeError) {
 		time.Sleep(time.Duration(float64(arg) * float64(time.Second)))
 	default:
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call wait(%s)", args[0]),
 		}
 	}
@@ -488,16 +1279,89 @@ func (c *Context) oakExit(args []Value) (Value, *runtimeError) {
 
 	switch arg := args[0].(type) {
 	case IntValue:
+		flushStdStreams()
+		restoreTerminal()
 		os.Exit(int(arg))
 		// unreachable
 		return null, nil
 	default:
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call exit(%s)", args[0]),
 		}
 	}
 }
 
+// signalsByName maps the atoms accepted by signal() to OS signals.
+var signalsByName = map[string]os.Signal{
+	"int":  os.Interrupt,
+	"term": syscall.SIGTERM,
+	"hup":  sigHUP,
+}
+
+func (c *Context) oakSignal(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("signal", args, 2); err != nil {
+		return nil, err
+	}
+
+	name, ok1 := args[0].(AtomValue)
+	cb, ok2 := args[1].(FnValue)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call signal(%s, %s)", args[0], args[1]),
+		}
+	}
+	sig, ok := signalsByName[string(name)]
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "valueError",
+			reason: fmt.Sprintf("Unknown signal %s in call signal()", name),
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+	signal.Notify(signals, sig)
+
+	// a registered handler keeps the program alive, like a running server,
+	// until it's stopped
+	c.eng.Add(1)
+	go func() {
+		defer c.eng.Done()
+
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-signals:
+				c.Lock()
+				_, err := c.EvalFnValue(cb, false, name)
+				c.Unlock()
+				if err != nil {
+					c.eng.reportErr(err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	stopper := func(_ []Value) (Value, *runtimeError) {
+		// once no handlers are registered for a signal, the OS default
+		// behavior for it is restored
+		once.Do(func() {
+			signal.Stop(signals)
+			close(stopped)
+		})
+		return null, nil
+	}
+
+	return BuiltinFnValue{
+		name: "stop",
+		fn:   stopper,
+	}, nil
+}
+
 func (c *Context) oakExec(args []Value) (Value, *runtimeError) {
 	if err := c.requireArgLen("exec", args, 3); err != nil {
 		return nil, err
@@ -508,16 +1372,18 @@ func (c *Context) oakExec(args []Value) (Value, *runtimeError) {
 	stdin, ok3 := args[2].(*StringValue)
 	if !ok1 || !ok2 || !ok3 {
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call exec(%s, %s, %s)", args[0], args[1], args[2]),
 		}
 	}
 
-	argsList := make([]string, len(*cliArgs))
-	for i, arg := range *cliArgs {
+	argsList := make([]string, len(cliArgs.elems))
+	for i, arg := range cliArgs.elems {
 		if argStr, ok := arg.(*StringValue); ok {
 			argsList[i] = argStr.stringContent()
 		} else {
 			return nil, &runtimeError{
+				kind:   "typeError",
 				reason: fmt.Sprintf("Mismatched types in call exec, arguments must be strings in %s", cliArgs),
 			}
 		}
@@ -535,18 +1401,10 @@ func (c *Context) oakExec(args []Value) (Value, *runtimeError) {
 		return errObj(fmt.Sprintf("Could not start command in exec(): %s", err.Error())), nil
 	}
 
-	err = cmd.Wait()
-	exitCode := 0
-	if err != nil {
-		// if there is an err but err is just ExitErr, this means the process
-		// ran successfully but exited with an error code. We consider this ok
-		// and keep going.
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-				exitCode = status.ExitStatus()
-			}
-		}
-	}
+	// if there is an err but err is just ExitErr, this means the process ran
+	// successfully but exited with an error code. We consider this ok and keep
+	// going.
+	exitCode := exitStatus(cmd.Wait())
 
 	stdout, err := io.ReadAll(&stdoutBuf)
 	if err != nil {
@@ -558,6 +1416,12 @@ func (c *Context) oakExec(args []Value) (Value, *runtimeError) {
 		return errObj(fmt.Sprintf("Could not read stderr from exec(): %s", err.Error())), nil
 	}
 	stderrVal := StringValue(stderr)
+	if err := c.allocString(len(stdout), len(stdout)); err != nil {
+		return nil, err
+	}
+	if err := c.allocString(len(stderr), len(stderr)); err != nil {
+		return nil, err
+	}
 
 	return ObjectValue{
 		"type":   AtomValue("end"),
@@ -574,7 +1438,11 @@ func initInputReader() {
 	inputReader = bufio.NewReader(os.Stdin)
 }
 
-func (c *Context) oakInput(_ []Value) (Value, *runtimeError) {
+func (c *Context) oakInput(args []Value) (Value, *runtimeError) {
+	if len(args) > 0 {
+		return c.oakPromptInput(args)
+	}
+
 	inputReaderInit.Do(initInputReader)
 	str, err := inputReader.ReadString('\n')
 	if err == io.EOF {
@@ -605,11 +1473,12 @@ func (c *Context) oakPrint(args []Value) (Value, *runtimeError) {
 	outputString, ok := args[0].(*StringValue)
 	if !ok {
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Unexpected argument to print: %s", args[0]),
 		}
 	}
 
-	n, _ := os.Stdout.Write(*outputString)
+	n, _ := stdoutStream.Write(*outputString)
 	return IntValue(n), nil
 }
 
@@ -621,6 +1490,7 @@ func (c *Context) oakLs(args []Value) (Value, *runtimeError) {
 	dirPath, ok1 := args[0].(*StringValue)
 	if !ok1 {
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call ls(%s)", args[0]),
 		}
 	}
@@ -630,7 +1500,7 @@ func (c *Context) oakLs(args []Value) (Value, *runtimeError) {
 		return errObj(fmt.Sprintf("Could not list directory %s: %s", dirPath.stringContent(), err.Error())), nil
 	}
 
-	fileList := make(ListValue, len(fileInfos))
+	fileList := make([]Value, len(fileInfos))
 	for i, fi := range fileInfos {
 		fileList[i] = ObjectValue{
 			"name": MakeString(fi.Name()),
@@ -642,7 +1512,7 @@ func (c *Context) oakLs(args []Value) (Value, *runtimeError) {
 
 	return ObjectValue{
 		"type": AtomValue("data"),
-		"data": &fileList,
+		"data": MakeList(fileList...),
 	}, nil
 }
 
@@ -654,6 +1524,7 @@ func (c *Context) oakRm(args []Value) (Value, *runtimeError) {
 	rmPath, ok1 := args[0].(*StringValue)
 	if !ok1 {
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call rm(%s)", args[0]),
 		}
 	}
@@ -676,6 +1547,7 @@ func (c *Context) oakMkdir(args []Value) (Value, *runtimeError) {
 	dirPath, ok1 := args[0].(*StringValue)
 	if !ok1 {
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call mkdir(%s)", args[0]),
 		}
 	}
@@ -698,6 +1570,7 @@ func (c *Context) oakStat(args []Value) (Value, *runtimeError) {
 	statPath, ok1 := args[0].(*StringValue)
 	if !ok1 {
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call stat(%s)", args[0]),
 		}
 	}
@@ -744,6 +1617,7 @@ func (c *Context) oakOpen(args []Value) (Value, *runtimeError) {
 	permInt, ok3 := args[2].(IntValue)
 	if !ok1 || !ok2 || !ok3 {
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call open(%s, %s, %s)", args[0], args[1], args[2]),
 		}
 	}
@@ -760,6 +1634,7 @@ func (c *Context) oakOpen(args []Value) (Value, *runtimeError) {
 		flags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
 	default:
 		return nil, &runtimeError{
+			kind:   "valueError",
 			reason: fmt.Sprintf("Invalid flag for open(): %s", flagsAtom),
 		}
 	}
@@ -789,6 +1664,7 @@ func (c *Context) oakClose(args []Value) (Value, *runtimeError) {
 	fdInt, ok1 := args[0].(IntValue)
 	if !ok1 {
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call close(%s)", args[0]),
 		}
 	}
@@ -823,6 +1699,7 @@ func (c *Context) oakRead(args []Value) (Value, *runtimeError) {
 	lengthInt, ok3 := args[2].(IntValue)
 	if !ok1 || !ok2 || !ok3 {
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call read(%s, %s, %s)", args[0], args[1], args[2]),
 		}
 	}
@@ -843,11 +1720,23 @@ func (c *Context) oakRead(args []Value) (Value, *runtimeError) {
 		return errObj(fmt.Sprintf("Error reading file during seek: %s", err.Error())), nil
 	}
 
+	if length < 0 {
+		length = 0
+	}
+	// a read near the end of a file returns fewer bytes than asked for, so
+	// only what's read counts against the limits, but no more than one byte
+	// over the string length limit need be read to exceed it
+	if max := int64(c.eng.limits.MaxStringLen); max > 0 && length > max+1 {
+		length = max + 1
+	}
 	readBuf := make([]byte, length)
 	count, err := file.Read(readBuf)
 	if err != nil && err != io.EOF {
 		return errObj(fmt.Sprintf("Error reading file: %s", err.Error())), nil
 	}
+	if err := c.allocString(count, count); err != nil {
+		return nil, err
+	}
 
 	fileData := StringValue(readBuf[:count])
 	return ObjectValue{
@@ -866,6 +1755,7 @@ func (c *Context) oakWrite(args []Value) (Value, *runtimeError) {
 	dataString, ok3 := args[2].(*StringValue)
 	if !ok1 || !ok2 || !ok3 {
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call write(%s, %s, %s)", args[0], args[1], args[2]),
 		}
 	}
@@ -1007,10 +1897,23 @@ func (h oakHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// write values to response
 	// Content-Length is automatically set for us by Go
+	// a list of strings sets a header more than once, as for Set-Cookie
 	for k, v := range resHeaders {
-		if str, isStr := v.(*StringValue); isStr {
-			w.Header().Set(k, str.stringContent())
-		} else {
+		switch val := v.(type) {
+		case *StringValue:
+			w.Header().Set(k, val.stringContent())
+		case *ListValue:
+			for _, elem := range val.elems {
+				str, isStr := elem.(*StringValue)
+				if !isStr {
+					ctx.eng.reportErr(&runtimeError{
+						reason: fmt.Sprintf("Could not set response header, value %s was not a string", elem),
+					})
+					return
+				}
+				w.Header().Add(k, str.stringContent())
+			}
+		default:
 			ctx.eng.reportErr(&runtimeError{
 				reason: fmt.Sprintf("Could not set response header, value %s was not a string", v),
 			})
@@ -1045,19 +1948,138 @@ func (h oakHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// tlsOptString reads an optional string-valued TLS option from an options
+// object, returning "" if the option is not set.
+func tlsOptString(opts ObjectValue, key string) (string, *runtimeError) {
+	val, ok := opts[key]
+	if !ok {
+		return "", nil
+	}
+	switch v := val.(type) {
+	case NullValue:
+		return "", nil
+	case *StringValue:
+		return v.stringContent(), nil
+	default:
+		return "", &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("TLS option %s must be a string, got %s", key, val),
+		}
+	}
+}
+
+// tlsOptPath reads an optional TLS option naming a file, which like an import
+// path is relative to the root of the program if it isn't absolute.
+func (c *Context) tlsOptPath(opts ObjectValue, key string) (string, *runtimeError) {
+	filePath, err := tlsOptString(opts, key)
+	if err != nil || filePath == "" || filepath.IsAbs(filePath) {
+		return filePath, err
+	}
+	return filepath.Join(c.rootPath, filePath), nil
+}
+
+// clientTLSConfig constructs a client-side TLS configuration from an Oak
+// options object of the form { ca, cert, key, insecure }, where ca, cert, and
+// key are paths to PEM-encoded files.
+func (c *Context) clientTLSConfig(opts ObjectValue) (*tls.Config, error) {
+	caPath, rtErr := c.tlsOptPath(opts, "ca")
+	if rtErr != nil {
+		return nil, rtErr
+	}
+	certPath, rtErr := c.tlsOptPath(opts, "cert")
+	if rtErr != nil {
+		return nil, rtErr
+	}
+	keyPath, rtErr := c.tlsOptPath(opts, "key")
+	if rtErr != nil {
+		return nil, rtErr
+	}
+
+	config := &tls.Config{}
+	switch insecure := opts["insecure"].(type) {
+	case nil, NullValue:
+	case BoolValue:
+		config.InsecureSkipVerify = bool(insecure)
+	default:
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("TLS option insecure must be a bool, got %s", insecure),
+		}
+	}
+
+	if caPath != "" {
+		caPEM, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no valid certificates found in %s", caPath)
+		}
+		config.RootCAs = pool
+	}
+
+	if certPath != "" || keyPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
 func (ctx *Context) oakListen(args []Value) (Value, *runtimeError) {
 	if err := ctx.requireArgLen("listen", args, 2); err != nil {
 		return nil, err
 	}
 
+	// options arg is optional, and sits between the host and the callback so
+	// that `with listen(host, opts) fn(evt) ...` reads naturally
+	opts := ObjectValue{}
+	if len(args) >= 3 {
+		optsObj, ok := args[1].(ObjectValue)
+		if !ok {
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Mismatched types in call listen(%s, %s)", args[0], args[1]),
+			}
+		}
+		opts = optsObj
+		args = []Value{args[0], args[2]}
+	}
+
 	host, ok1 := args[0].(*StringValue)
 	cb, ok2 := args[1].(FnValue)
 	if !ok1 || !ok2 {
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call listen(%s)", args[0]),
 		}
 	}
 
+	certPath, err := ctx.tlsOptPath(opts, "cert")
+	if err != nil {
+		return nil, err
+	}
+	keyPath, err := ctx.tlsOptPath(opts, "key")
+	if err != nil {
+		return nil, err
+	}
+	if (certPath == "") != (keyPath == "") {
+		return nil, &runtimeError{
+			reason: "listen() requires both cert and key to serve HTTPS",
+		}
+	}
+	// certificates aren't obtained automatically over ACME, which would need
+	// a dependency on golang.org/x/crypto/acme/autocert
+	if _, ok := opts["autocert"]; ok {
+		return nil, &runtimeError{
+			reason: "listen() does not support autocert, pass cert and key files to serve HTTPS",
+		}
+	}
+
 	sendErr := func(msg string) {
 		ctx.Lock()
 		defer ctx.Unlock()
@@ -1079,7 +2101,13 @@ func (ctx *Context) oakListen(args []Value) (Value, *runtimeError) {
 	ctx.eng.Add(1)
 	go func() {
 		defer ctx.eng.Done()
-		err := server.ListenAndServe()
+
+		var err error
+		if certPath != "" {
+			err = server.ListenAndServeTLS(certPath, keyPath)
+		} else {
+			err = server.ListenAndServe()
+		}
 		if err != nil && err != http.ErrServerClosed {
 			sendErr(fmt.Sprintf("Error starting http server in listen(): %s", err.Error()))
 		}
@@ -1113,6 +2141,7 @@ func (c *Context) oakReq(args []Value) (Value, *runtimeError) {
 	}
 
 	argErr := runtimeError{
+		kind:   "typeError",
 		reason: fmt.Sprintf("Mismatched types in call req(%s)", args[0]),
 	}
 
@@ -1126,6 +2155,7 @@ func (c *Context) oakReq(args []Value) (Value, *runtimeError) {
 	urlVal, ok2 := data["url"]
 	headersVal, ok3 := data["headers"]
 	bodyVal, ok4 := data["body"]
+	tlsVal, hasTLS := data["tls"]
 
 	// default args
 	if !ok1 {
@@ -1160,6 +2190,25 @@ func (c *Context) oakReq(args []Value) (Value, *runtimeError) {
 		},
 	}
 
+	if hasTLS && tlsVal != null {
+		tlsOpts, ok := tlsVal.(ObjectValue)
+		if !ok {
+			return nil, &argErr
+		}
+
+		tlsConfig, err := c.clientTLSConfig(tlsOpts)
+		if err != nil {
+			if rtErr, ok := err.(*runtimeError); ok {
+				return nil, rtErr
+			}
+			return errObj(fmt.Sprintf("Could not configure TLS in req(): %s", err.Error())), nil
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client.Transport = transport
+	}
+
 	req, err := http.NewRequest(
 		method.stringContent(),
 		url.stringContent(),
@@ -1230,6 +2279,7 @@ func (c *Context) oakSin(args []Value) (Value, *runtimeError) {
 		val = float64(arg)
 	default:
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call sin(%s)", args[0]),
 		}
 	}
@@ -1250,6 +2300,7 @@ func (c *Context) oakCos(args []Value) (Value, *runtimeError) {
 		val = float64(arg)
 	default:
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call cos(%s)", args[0]),
 		}
 	}
@@ -1270,6 +2321,7 @@ func (c *Context) oakTan(args []Value) (Value, *runtimeError) {
 		val = float64(arg)
 	default:
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call tan(%s)", args[0]),
 		}
 	}
@@ -1290,12 +2342,14 @@ func (c *Context) oakAsin(args []Value) (Value, *runtimeError) {
 		val = float64(arg)
 	default:
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call asin(%s)", args[0]),
 		}
 	}
 
 	if val > 1 || val < -1 {
 		return nil, &runtimeError{
+			kind:   "valueError",
 			reason: fmt.Sprintf("asin() takes a number in range [-1, 1], got %f", val),
 		}
 	}
@@ -1316,12 +2370,14 @@ func (c *Context) oakAcos(args []Value) (Value, *runtimeError) {
 		val = float64(arg)
 	default:
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call acos(%s)", args[0]),
 		}
 	}
 
 	if val > 1 || val < -1 {
 		return nil, &runtimeError{
+			kind:   "valueError",
 			reason: fmt.Sprintf("acos() takes a number in range [-1, 1], got %f", val),
 		}
 	}
@@ -1342,6 +2398,7 @@ func (c *Context) oakAtan(args []Value) (Value, *runtimeError) {
 		val = float64(arg)
 	default:
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call atan(%s)", args[0]),
 		}
 	}
@@ -1357,6 +2414,7 @@ func (c *Context) oakPow(args []Value) (Value, *runtimeError) {
 	var base float64
 	var exp float64
 	err := runtimeError{
+		kind:   "typeError",
 		reason: fmt.Sprintf("Mismatched types in call pow(%s, %s)", args[0], args[1]),
 	}
 
@@ -1380,10 +2438,12 @@ func (c *Context) oakPow(args []Value) (Value, *runtimeError) {
 
 	if base == 0 && exp == 0 {
 		return nil, &runtimeError{
+			kind:   "valueError",
 			reason: fmt.Sprintf("pow(0, 0) is not defined"),
 		}
 	} else if base < 0 && float64(int64(exp)) != exp {
 		return nil, &runtimeError{
+			kind:   "valueError",
 			reason: fmt.Sprintf("pow() of negative number to fractional exponent is not defined"),
 		}
 	}
@@ -1399,6 +2459,7 @@ func (c *Context) oakLog(args []Value) (Value, *runtimeError) {
 	var base float64
 	var exp float64
 	err := runtimeError{
+		kind:   "typeError",
 		reason: fmt.Sprintf("Mismatched types in call log(%s, %s)", args[0], args[1]),
 	}
 
@@ -1422,10 +2483,12 @@ func (c *Context) oakLog(args []Value) (Value, *runtimeError) {
 
 	if base == 0 {
 		return nil, &runtimeError{
+			kind:   "valueError",
 			reason: fmt.Sprintf("log(0, _) is not defined"),
 		}
 	} else if exp == 0 {
 		return nil, &runtimeError{
+			kind:   "valueError",
 			reason: fmt.Sprintf("log(_, 0) is not defined"),
 		}
 	}
@@ -1451,6 +2514,7 @@ func (c *Context) rtLib(args []Value) (Value, *runtimeError) {
 		return null, nil
 	default:
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call ___runtime_lib(%s)", args[0]),
 		}
 	}
@@ -1469,6 +2533,7 @@ func (c *Context) rtIsLib(args []Value) (Value, *runtimeError) {
 		return BoolValue(ok), nil
 	default:
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Mismatched types in call ___runtime_lib?(%s)", args[0]),
 		}
 	}
@@ -1491,10 +2556,12 @@ func (c *Context) rtMem(_ []Value) (Value, *runtimeError) {
 		"frees":  IntValue(memStats.Frees),
 		"live":   IntValue(memStats.Mallocs - memStats.Frees),
 		// number of bytes
-		"heap": IntValue(memStats.HeapAlloc),
-		"virt": IntValue(memStats.HeapSys),
-		// total gc cycles count
-		"gcs": IntValue(memStats.NumGC),
+		"heap":  IntValue(memStats.HeapAlloc),
+		"virt":  IntValue(memStats.HeapSys),
+		"total": IntValue(memStats.TotalAlloc),
+		// total gc cycles count, and nanoseconds paused for them
+		"gcs":   IntValue(memStats.NumGC),
+		"pause": IntValue(memStats.PauseTotalNs),
 	}, nil
 }
 
@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"math/big"
 	"os"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // byte slice helpers from the Ink interpreter source code,
@@ -110,6 +113,8 @@ func (v IntValue) Eq(u Value) bool {
 		return v == w
 	} else if w, ok := u.(FloatValue); ok {
 		return FloatValue(v) == w
+	} else if w, ok := u.(DecimalValue); ok {
+		return w.Eq(v)
 	}
 
 	return false
@@ -129,6 +134,8 @@ func (v FloatValue) Eq(u Value) bool {
 		return v == w
 	} else if w, ok := u.(IntValue); ok {
 		return v == FloatValue(w)
+	} else if w, ok := u.(DecimalValue); ok {
+		return w.Eq(v)
 	}
 
 	return false
@@ -175,38 +182,55 @@ func (v AtomValue) Eq(u Value) bool {
 	return false
 }
 
-type ListValue []Value
+// ListValue is an Oak list. A list made by slicing another list shares the
+// other list's backing array rather than copying its elements, and either list
+// copies its elements before it first overwrites one of them. Lists only grow
+// at the end, and a slice's capacity ends where the slice does, so appending to
+// a list never writes to elements visible in another list.
+type ListValue struct {
+	elems []Value
+	// shared is true if elems may share a backing array with another list
+	shared bool
+}
 
 func MakeList(xs ...Value) *ListValue {
-	v := ListValue(xs)
-	return &v
+	return &ListValue{elems: xs}
 }
 func (v *ListValue) String() string {
-	valStrings := make([]string, len(*v))
-	for i, val := range *v {
-		valStrings[i] = val.String()
-	}
-	return "[" + strings.Join(valStrings, ", ") + "]"
+	return stringify(v, map[uintptr]bool{})
 }
 func (v *ListValue) Eq(u Value) bool {
-	if _, ok := u.(EmptyValue); ok {
-		return true
-	}
+	return deepEq(v, u, map[[2]uintptr]bool{})
+}
 
-	if w, ok := u.(*ListValue); ok {
-		if len(*v) != len(*w) {
-			return false
-		}
+// push appends x to the end of the list in amortized constant time.
+func (v *ListValue) push(xs ...Value) {
+	if len(v.elems)+len(xs) > cap(v.elems) {
+		// append will move elems to a new backing array of its own
+		v.shared = false
+	}
+	v.elems = append(v.elems, xs...)
+}
 
-		for i, el := range *v {
-			if !el.Eq((*w)[i]) {
-				return false
-			}
-		}
-		return true
+// set overwrites the element at index i, which must be within the list.
+func (v *ListValue) set(i int, x Value) {
+	if v.shared {
+		elems := make([]Value, len(v.elems))
+		copy(elems, v.elems)
+		v.elems = elems
+		v.shared = false
 	}
+	v.elems[i] = x
+}
 
-	return false
+// slice returns the list of elements from index min up to but not including
+// max, without copying them.
+func (v *ListValue) slice(min, max int) *ListValue {
+	v.shared = true
+	return &ListValue{
+		elems:  v.elems[min:max:max],
+		shared: true,
+	}
 }
 
 type ObjectValue map[string]Value
@@ -218,59 +242,155 @@ type serializedObjEntry struct {
 }
 
 func (v ObjectValue) String() string {
-	// TODO: fix how this deals with circular references
-	entries := make([]serializedObjEntry, len(v))
+	return stringify(v, map[uintptr]bool{})
+}
+func (v ObjectValue) Eq(u Value) bool {
+	return deepEq(v, u, map[[2]uintptr]bool{})
+}
 
-	i := 0
-	for key, val := range v {
-		entries[i] = serializedObjEntry{
-			key:  key,
-			full: key + ": " + val.String(),
-		}
-		i++
+// containerID identifies a list, object, or map, so that values that contain
+// themselves can be detected while descending into them.
+func containerID(v Value) (uintptr, bool) {
+	switch v.(type) {
+	case *ListValue, ObjectValue, *MapValue:
+		return reflect.ValueOf(v).Pointer(), true
 	}
+	return 0, false
+}
 
-	// sort entries lexicographically for easier debugging use
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].key < entries[j].key
-	})
+// stringify returns the string representation of v. parents holds the lists
+// and objects that contain v, and a list or object that contains itself is
+// printed as [...] or {...} where it recurs.
+func stringify(v Value, parents map[uintptr]bool) string {
+	id, ok := containerID(v)
+	if !ok {
+		return v.String()
+	}
 
-	sb := strings.Builder{}
-	sb.WriteString("{")
-	for i, entry := range entries {
-		if i != 0 {
-			sb.WriteString(", ")
+	switch w := v.(type) {
+	case *ListValue:
+		if parents[id] {
+			return "[...]"
 		}
-		sb.WriteString(entry.full)
-	}
-	sb.WriteString("}")
+		parents[id] = true
+		defer delete(parents, id)
 
-	return sb.String()
+		valStrings := make([]string, len(w.elems))
+		for i, val := range w.elems {
+			valStrings[i] = stringify(val, parents)
+		}
+		return "[" + strings.Join(valStrings, ", ") + "]"
+	case ObjectValue:
+		if parents[id] {
+			return "{...}"
+		}
+		parents[id] = true
+		defer delete(parents, id)
+
+		entries := make([]serializedObjEntry, len(w))
+		i := 0
+		for key, val := range w {
+			entries[i] = serializedObjEntry{
+				key:  key,
+				full: key + ": " + stringify(val, parents),
+			}
+			i++
+		}
+
+		// sort entries lexicographically for easier debugging use
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].key < entries[j].key
+		})
+
+		sb := strings.Builder{}
+		sb.WriteString("{")
+		for i, entry := range entries {
+			if i != 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(entry.full)
+		}
+		sb.WriteString("}")
+		return sb.String()
+	case *MapValue:
+		if parents[id] {
+			return "map(...)"
+		}
+		parents[id] = true
+		defer delete(parents, id)
+
+		entries := make([]string, 0, w.len())
+		w.each(func(key, val Value) {
+			entries = append(entries, "["+stringify(key, parents)+", "+stringify(val, parents)+"]")
+		})
+		return "map([" + strings.Join(entries, ", ") + "])"
+	}
+	panic("unreachable")
 }
-func (v ObjectValue) Eq(u Value) bool {
+
+// deepEq reports whether v and u are equal. comparing holds the pairs of lists
+// and objects that have been compared in the process, and a pair that is
+// reached again is assumed to be equal, because any difference between them
+// will be found by the comparison already in progress. This lets deepEq
+// compare lists and objects that contain themselves.
+func deepEq(v, u Value, comparing map[[2]uintptr]bool) bool {
+	vID, ok := containerID(v)
+	if !ok {
+		return v.Eq(u)
+	}
 	if _, ok := u.(EmptyValue); ok {
 		return true
 	}
+	if uID, ok := containerID(u); ok {
+		pair := [2]uintptr{vID, uID}
+		if comparing[pair] {
+			return true
+		}
+		comparing[pair] = true
+	}
 
-	if w, ok := u.(ObjectValue); ok {
-		if len(v) != len(w) {
-			return false
+	switch w := v.(type) {
+	case *ListValue:
+		if arr, ok := u.(numArray); ok {
+			return arr.Eq(w)
 		}
 
-		for key, val := range v {
-			if wVal, ok := w[key]; ok {
-				if !val.Eq(wVal) {
-					return false
-				}
-			} else {
+		x, ok := u.(*ListValue)
+		if !ok || len(w.elems) != len(x.elems) {
+			return false
+		}
+		for i, el := range w.elems {
+			if !deepEq(el, x.elems[i], comparing) {
+				return false
+			}
+		}
+		return true
+	case ObjectValue:
+		x, ok := u.(ObjectValue)
+		if !ok || len(w) != len(x) {
+			return false
+		}
+		for key, val := range w {
+			xVal, ok := x[key]
+			if !ok || !deepEq(val, xVal, comparing) {
 				return false
 			}
 		}
-
 		return true
+	case *MapValue:
+		x, ok := u.(*MapValue)
+		if !ok || w.len() != x.len() {
+			return false
+		}
+		eq := true
+		w.each(func(key, val Value) {
+			if xVal, ok := x.get(key); eq && (!ok || !deepEq(val, xVal, comparing)) {
+				eq = false
+			}
+		})
+		return eq
 	}
-
-	return false
+	panic("unreachable")
 }
 
 type FnValue struct {
@@ -305,7 +425,20 @@ func (v thunkValue) Eq(u Value) bool {
 	panic("Illegal to compare thunk values!")
 }
 func (c *Context) unwrapThunk(thunk thunkValue) (v Value, err *runtimeError) {
+	defer c.exitCall()
+	if err = c.enterCall(); err != nil {
+		err.stackTrace = append(err.stackTrace, stackEntry{
+			name: thunk.defn.name,
+			pos:  thunk.defn.pos(),
+		})
+		return
+	}
+
+	var call string
 	for isThunk := true; isThunk; thunk, isThunk = v.(thunkValue) {
+		if c.eng.trace != nil {
+			call = c.traceEnter(thunk)
+		}
 		v, err = c.evalExprWithOpt(thunk.defn.body, thunk.scope, true)
 		if err != nil {
 			err.stackTrace = append(err.stackTrace, stackEntry{
@@ -315,6 +448,9 @@ func (c *Context) unwrapThunk(thunk thunkValue) (v Value, err *runtimeError) {
 			return
 		}
 	}
+	if call != "" {
+		c.traceExit(call, v)
+	}
 
 	return
 }
@@ -322,21 +458,66 @@ func (c *Context) unwrapThunk(thunk thunkValue) (v Value, err *runtimeError) {
 type scope struct {
 	parent *scope
 	vars   map[string]Value
+	// scopes created by resolved functions and blocks keep their variables in
+	// slots laid out by frame instead of in vars, which is then nil. A nil
+	// slot is a variable that has not been defined yet.
+	frame *frame
+	slots []Value
+}
+
+// newScope returns a child scope of parent for a function call or block with
+// the given frame, which is nil if the function or block wasn't resolved.
+func newScope(parent *scope, f *frame) scope {
+	if f == nil {
+		return scope{
+			parent: parent,
+			vars:   map[string]Value{},
+		}
+	}
+	return scope{
+		parent: parent,
+		frame:  f,
+		slots:  make([]Value, len(f.names)),
+	}
+}
+
+func (sc *scope) slot(name string) (int, bool) {
+	if sc.frame == nil {
+		return 0, false
+	}
+	i, ok := sc.frame.index[name]
+	return i, ok
+}
+
+func (sc *scope) ancestor(depth int) *scope {
+	for ; depth > 0; depth-- {
+		sc = sc.parent
+	}
+	return sc
 }
 
 func (sc *scope) get(name string) (Value, *runtimeError) {
 	if v, ok := sc.vars[name]; ok {
 		return v, nil
 	}
+	if i, ok := sc.slot(name); ok && sc.slots[i] != nil {
+		return sc.slots[i], nil
+	}
 	if sc.parent != nil {
 		return sc.parent.get(name)
 	}
 	return nil, &runtimeError{
+		kind:   "nameError",
 		reason: fmt.Sprintf("%s is undefined", name),
+		data:   ObjectValue{"name": MakeString(name)},
 	}
 }
 
 func (sc *scope) put(name string, v Value) {
+	if i, ok := sc.slot(name); ok {
+		sc.slots[i] = v
+		return
+	}
 	sc.vars[name] = v
 }
 
@@ -345,26 +526,109 @@ func (sc *scope) update(name string, v Value) *runtimeError {
 		sc.vars[name] = v
 		return nil
 	}
+	if i, ok := sc.slot(name); ok && sc.slots[i] != nil {
+		sc.slots[i] = v
+		return nil
+	}
 	if sc.parent != nil {
 		return sc.parent.update(name, v)
 	}
 	return &runtimeError{
+		kind:   "nameError",
 		reason: fmt.Sprintf("%s is undefined", name),
+		data:   ObjectValue{"name": MakeString(name)},
+	}
+}
+
+// getVar reads the variable named by n, going directly to its slot if the
+// identifier was resolved.
+func (sc *scope) getVar(n identifierNode) (Value, *runtimeError) {
+	if n.ref == nil {
+		return sc.get(n.payload)
+	}
+
+	target := sc.ancestor(n.ref.depth)
+	if n.ref.slot < 0 {
+		return target.get(n.payload)
+	}
+	if v := target.slots[n.ref.slot]; v != nil {
+		return v, nil
+	}
+	if target.parent != nil {
+		return target.parent.get(n.payload)
+	}
+	return nil, &runtimeError{
+		kind:   "nameError",
+		reason: fmt.Sprintf("%s is undefined", n.payload),
+		data:   ObjectValue{"name": MakeString(n.payload)},
+	}
+}
+
+// updateVar assigns to the existing variable named by n, as with the <-
+// operator, going directly to its slot if the identifier was resolved.
+func (sc *scope) updateVar(n identifierNode, v Value) *runtimeError {
+	if n.ref == nil {
+		return sc.update(n.payload, v)
+	}
+
+	target := sc.ancestor(n.ref.depth)
+	if n.ref.slot < 0 {
+		return target.update(n.payload, v)
+	}
+	if target.slots[n.ref.slot] != nil {
+		target.slots[n.ref.slot] = v
+		return nil
+	}
+	if target.parent != nil {
+		return target.parent.update(n.payload, v)
+	}
+	return &runtimeError{
+		kind:   "nameError",
+		reason: fmt.Sprintf("%s is undefined", n.payload),
+		data:   ObjectValue{"name": MakeString(n.payload)},
 	}
 }
 
 type engine struct {
+	// bytes allocated by the program, see limits.go, which comes first so that
+	// it's aligned for atomic operations on 32-bit platforms
+	allocated int64
 	// interpreter lock to ensure lack of data races
 	sync.Mutex
 	// interpreter event loop waitgroup
 	sync.WaitGroup
 	// for deduplicating imports
 	importMap map[string]scope
+	// directory of the oak.lock that pins remote imports, see remote.go
+	lockDir string
 	// file fd -> Go's File map
 	fileMap map[uintptr]*os.File
 	fdLock  sync.Mutex
 	// log async error streams through this
 	reportErr func(error)
+	// set to 1 by Cancel, and read atomically by every function call
+	cancelled uint32
+	// resource limits and usage, see limits.go
+	limits    Limits
+	callDepth int
+	// function calls are traced if set, see trace.go
+	trace *tracer
+	// top-level scope of the program run by this interpreter, which isn't in
+	// importMap, for ___runtime_heap
+	mainScope scope
+	// results channel of the innermost running generator, which is the only
+	// one whose yield() may be called, see generator.go
+	yielding chan genResult
+	// calls into JavaScript in progress in WebAssembly, see interop_js.go
+	jsCallDepth int
+	// watchers and subscribers of objects by their addresses, see observe.go
+	watchers map[uintptr]*objWatchers
+	watchID  int
+	// callbacks of settled tasks waiting to run, and rejected tasks to report
+	// if no callback handles them, see task.go
+	jobs        []func()
+	runningJobs bool
+	rejected    []*task
 }
 
 type Context struct {
@@ -385,13 +649,14 @@ func NewContext(rootPath string) Context {
 			fmt.Println(err)
 		},
 	}
+	eng.mainScope = scope{
+		parent: nil,
+		vars:   map[string]Value{},
+	}
 	return Context{
 		eng:      &eng,
 		rootPath: rootPath,
-		scope: scope{
-			parent: nil,
-			vars:   map[string]Value{},
-		},
+		scope:    eng.mainScope,
 	}
 }
 
@@ -432,6 +697,22 @@ func (c *Context) Unlock() {
 
 func (c *Context) Wait() {
 	c.eng.Wait()
+	flushStdStreams()
+	restoreTerminal()
+}
+
+// Cancel stops evaluation in this context and every context sharing its
+// interpreter, such as those of imported modules. Any function call made after
+// Cancel returns a runtime error, so running programs, including infinite
+// loops, stop at their next function call. Cancel may be called from any
+// goroutine, and cancellation is permanent. Builtins that block, like wait()
+// and input(), are not interrupted.
+func (c *Context) Cancel() {
+	atomic.StoreUint32(&c.eng.cancelled, 1)
+}
+
+func (c *Context) isCancelled() bool {
+	return atomic.LoadUint32(&c.eng.cancelled) == 1
 }
 
 type stackEntry struct {
@@ -446,12 +727,55 @@ func (e stackEntry) String() string {
 	return fmt.Sprintf("  in anonymous fn %s", e.pos)
 }
 
+// runtimeError is an error that stops the evaluation of an Oak program. Its
+// kind is the name of an atom that classifies the error, like "typeError" or
+// "indexError", so that programs that recover from errors with try() can
+// branch on it. data holds any other details about the error, like the name of
+// an undefined variable.
 type runtimeError struct {
+	kind   string
 	reason string
+	data   ObjectValue
 	pos
 	stackTrace []stackEntry
 }
 
+func indexErrorData(index, length int) ObjectValue {
+	return ObjectValue{
+		"index":  IntValue(index),
+		"length": IntValue(length),
+	}
+}
+
+// errKind returns the kind of the error, which defaults to "runtimeError".
+func (e *runtimeError) errKind() string {
+	if e.kind == "" {
+		return "runtimeError"
+	}
+	return e.kind
+}
+
+// value returns the error as an Oak error object, which has the same type and
+// error fields as the error objects returned by builtins like open() and
+// req(), and additionally the kind, position, and data of the error.
+func (e *runtimeError) value() ObjectValue {
+	data := e.data
+	if data == nil {
+		data = ObjectValue{}
+	}
+	return ObjectValue{
+		"type":  AtomValue("error"),
+		"kind":  AtomValue(e.errKind()),
+		"error": MakeString(e.reason),
+		"pos": ObjectValue{
+			"file": MakeString(e.pos.fileName),
+			"line": IntValue(e.pos.line),
+			"col":  IntValue(e.pos.col),
+		},
+		"data": data,
+	}
+}
+
 func (e *runtimeError) Error() string {
 	trace := make([]string, len(e.stackTrace))
 	for i, entry := range e.stackTrace {
@@ -464,29 +788,56 @@ func (c *Context) Eval(programReader io.Reader) (Value, error) {
 	c.Lock()
 	defer c.Unlock()
 
-	program, err := io.ReadAll(programReader)
+	// the program is tokenized and parsed as it is read, so only the syntax
+	// tree (and not the source text or token list) is held in memory in full
+	tokenizer := newReaderTokenizer(programReader)
+	parser := newStreamingParser(&tokenizer)
+	nodes, err := parser.parse()
+	if tokenizer.err != nil {
+		return nil, tokenizer.err
+	}
 	if err != nil {
 		return nil, err
 	}
+	return c.evalParsed(nodes)
+}
 
-	tokenizer := newTokenizer(string(program))
-	tokens := tokenizer.tokenize()
+// EvalSource evaluates a program like Eval, but loads its syntax tree from the
+// cache of parsed modules if it's there, as for imported modules. See
+// astcache.go.
+func (c *Context) EvalSource(src []byte) (Value, error) {
+	c.Lock()
+	defer c.Unlock()
 
-	parser := newParser(tokens)
-	nodes, err := parser.parse()
+	nodes, err := parseCached(src)
 	if err != nil {
 		return nil, err
 	}
+	return c.evalParsed(nodes)
+}
+
+func (c *Context) evalParsed(nodes []astNode) (Value, error) {
+	nodes = resolveNodes(nodes)
 
 	val, runtimeErr := c.evalNodes(nodes)
 	if runtimeErr == nil {
 		return val, nil
 	}
+	// output written before the error should appear before it's reported, in
+	// a terminal that's no longer in raw mode
+	flushStdStreams()
+	restoreTerminal()
 	return val, runtimeErr
-
 }
 
 func (c *Context) EvalFnValue(maybeFn Value, thunkable bool, args ...Value) (Value, *runtimeError) {
+	if c.isCancelled() {
+		return nil, &runtimeError{
+			kind:   "cancelled",
+			reason: "Evaluation cancelled",
+		}
+	}
+
 	if fn, ok := maybeFn.(FnValue); ok {
 		// if not enough arguments, fill them with nulls
 		difference := len(fn.defn.args) - len(args)
@@ -494,10 +845,7 @@ func (c *Context) EvalFnValue(maybeFn Value, thunkable bool, args ...Value) (Val
 			args = append(args, null)
 		}
 
-		fnScope := scope{
-			parent: &fn.scope,
-			vars:   map[string]Value{},
-		}
+		fnScope := newScope(&fn.scope, fn.defn.frame)
 		for i, argName := range fn.defn.args {
 			if argName != "" {
 				fnScope.put(argName, args[i])
@@ -505,13 +853,13 @@ func (c *Context) EvalFnValue(maybeFn Value, thunkable bool, args ...Value) (Val
 		}
 
 		if fn.defn.restArg != "" {
-			var restList ListValue
+			var restList *ListValue
 			if len(args) > len(fn.defn.args) {
-				restList = ListValue(args[len(fn.defn.args):])
+				restList = MakeList(args[len(fn.defn.args):]...)
 			} else {
-				restList = ListValue{}
+				restList = MakeList()
 			}
-			fnScope.put(fn.defn.restArg, &restList)
+			fnScope.put(fn.defn.restArg, restList)
 		}
 
 		thunk := thunkValue{
@@ -528,6 +876,7 @@ func (c *Context) EvalFnValue(maybeFn Value, thunkable bool, args ...Value) (Val
 	}
 
 	return nil, &runtimeError{
+		kind:   "typeError",
 		reason: fmt.Sprintf("%s is not a function and cannot be called", maybeFn),
 	}
 }
@@ -544,10 +893,6 @@ func (c *Context) evalNodes(nodes []astNode) (Value, *runtimeError) {
 	return returnVal, nil
 }
 
-var divisionByZeroErr = runtimeError{
-	reason: fmt.Sprintf("Division by zero"),
-}
-
 func intBinaryOp(op tokKind, left, right IntValue) (Value, *runtimeError) {
 	switch op {
 	case plus:
@@ -558,14 +903,25 @@ func intBinaryOp(op tokKind, left, right IntValue) (Value, *runtimeError) {
 		return IntValue(left * right), nil
 	case divide:
 		if right == 0 {
-			return nil, &divisionByZeroErr
+			return nil, &runtimeError{
+				kind:   "zeroDivisionError",
+				reason: "Division by zero",
+			}
 		}
 		return FloatValue(FloatValue(left) / FloatValue(right)), nil
 	case modulus:
 		if right == 0 {
-			return nil, &divisionByZeroErr
+			return nil, &runtimeError{
+				kind:   "zeroDivisionError",
+				reason: "Division by zero",
+			}
 		}
 		return IntValue(left % right), nil
+	case power:
+		if right < 0 {
+			return FloatValue(math.Pow(float64(left), float64(right))), nil
+		}
+		return intPow(left, right), nil
 	case xor:
 		return IntValue(left ^ right), nil
 	case and:
@@ -582,10 +938,25 @@ func intBinaryOp(op tokKind, left, right IntValue) (Value, *runtimeError) {
 		return BoolValue(left <= right), nil
 	}
 	return nil, &runtimeError{
+		kind:   "typeError",
 		reason: fmt.Sprintf("Invalid binary operator %s for ints %s, %s", token{kind: op}, left, right),
 	}
 }
 
+// intPow raises an int to a non-negative int power by repeated squaring,
+// overflowing like multiplication of ints.
+func intPow(base, exp IntValue) IntValue {
+	result := IntValue(1)
+	for exp > 0 {
+		if exp&1 == 1 {
+			result *= base
+		}
+		base *= base
+		exp >>= 1
+	}
+	return result
+}
+
 func floatBinaryOp(op tokKind, left, right FloatValue) (Value, *runtimeError) {
 	switch op {
 	case plus:
@@ -596,14 +967,22 @@ func floatBinaryOp(op tokKind, left, right FloatValue) (Value, *runtimeError) {
 		return FloatValue(left * right), nil
 	case divide:
 		if right == 0 {
-			return nil, &divisionByZeroErr
+			return nil, &runtimeError{
+				kind:   "zeroDivisionError",
+				reason: "Division by zero",
+			}
 		}
 		return FloatValue(left / right), nil
 	case modulus:
 		if right == 0 {
-			return nil, &divisionByZeroErr
+			return nil, &runtimeError{
+				kind:   "zeroDivisionError",
+				reason: "Division by zero",
+			}
 		}
 		return FloatValue(math.Mod(float64(left), float64(right))), nil
+	case power:
+		return FloatValue(math.Pow(float64(left), float64(right))), nil
 	case greater:
 		return BoolValue(left > right), nil
 	case less:
@@ -614,6 +993,7 @@ func floatBinaryOp(op tokKind, left, right FloatValue) (Value, *runtimeError) {
 		return BoolValue(left <= right), nil
 	}
 	return nil, &runtimeError{
+		kind:   "typeError",
 		reason: fmt.Sprintf("Invalid binary operator %s for floats %s, %s", token{kind: op}, left, right),
 	}
 }
@@ -632,6 +1012,7 @@ func (c *Context) evalExpr(node astNode, sc scope) (Value, *runtimeError) {
 
 func incompatibleError(op tokKind, left, right Value, position pos) *runtimeError {
 	return &runtimeError{
+		kind: "typeError",
 		reason: fmt.Sprintf("Cannot %s incompatible values %s, %s",
 			token{kind: op}, left, right),
 		pos: position,
@@ -645,6 +1026,11 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 	case nullNode:
 		return null, nil
 	case stringNode:
+		if err := c.allocString(len(n.payload), len(n.payload)); err != nil {
+			err.pos = n.pos()
+			return nil, err
+		}
+
 		payload := make([]byte, len(n.payload), len(n.payload))
 		copy(payload, n.payload)
 		v := StringValue(payload)
@@ -658,17 +1044,45 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 	case atomNode:
 		return AtomValue(n.payload), nil
 	case listNode:
-		var err *runtimeError
-		elems := make([]Value, len(n.elems))
-		for i, elNode := range n.elems {
-			elems[i], err = c.evalExpr(elNode, sc)
+		elems := make([]Value, 0, len(n.elems))
+		for _, elNode := range n.elems {
+			if spread, ok := elNode.(spreadNode); ok {
+				rest, err := c.evalExpr(spread.elem, sc)
+				if err != nil {
+					return nil, err
+				}
+
+				restList, ok := asList(rest)
+				if !ok {
+					return nil, &runtimeError{
+						kind:   "typeError",
+						reason: fmt.Sprintf("Cannot spread a non-list value %s in a list literal %s", rest, n),
+						pos:    spread.pos(),
+					}
+				}
+
+				elems = append(elems, restList.elems...)
+				continue
+			}
+
+			el, err := c.evalExpr(elNode, sc)
 			if err != nil {
 				return nil, err
 			}
+			elems = append(elems, el)
 		}
-		list := ListValue(elems)
-		return &list, nil
+
+		if err := c.allocList(len(elems), len(elems)); err != nil {
+			err.pos = n.pos()
+			return nil, err
+		}
+		return MakeList(elems...), nil
 	case objectNode:
+		if err := c.alloc(len(n.entries) * entryAllocSize); err != nil {
+			err.pos = n.pos()
+			return nil, err
+		}
+
 		obj := ObjectValue{}
 		for _, entry := range n.entries {
 			var keyString string
@@ -690,7 +1104,7 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 				case FloatValue:
 					keyString = typedKey.String()
 				default:
-					return nil, &runtimeError{reason: fmt.Sprintf("Expected a string, atom, or number as object key, got %s", key.String()),
+					return nil, &runtimeError{kind: "typeError", reason: fmt.Sprintf("Expected a string, atom, or number as object key, got %s", key.String()),
 						pos: entry.key.pos(),
 					}
 				}
@@ -714,7 +1128,7 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 		}
 		return fn, nil
 	case identifierNode:
-		val, err := sc.get(n.payload)
+		val, err := sc.getVar(n)
 		if err != nil {
 			err.pos = n.pos()
 		}
@@ -730,7 +1144,7 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 			if n.isLocal {
 				sc.put(left.payload, assignedValue)
 			} else {
-				err := sc.update(left.payload, assignedValue)
+				err := sc.updateVar(left, assignedValue)
 				if err != nil {
 					err.pos = n.pos()
 					return nil, err
@@ -738,9 +1152,10 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 			}
 			return assignedValue, nil
 		case listNode:
-			assignedList, ok := assignedValue.(*ListValue)
+			assignedList, ok := asList(assignedValue)
 			if !ok {
 				return nil, &runtimeError{
+					kind:   "typeError",
 					reason: fmt.Sprintf("right side %s of list destructuring is not a list", n.right),
 					pos:    n.pos(),
 				}
@@ -760,8 +1175,8 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 				}
 
 				var destructuredEl Value
-				if i < len(*assignedList) {
-					destructuredEl = (*assignedList)[i]
+				if i < len(assignedList.elems) {
+					destructuredEl = assignedList.elems[i]
 				} else {
 					destructuredEl = null
 				}
@@ -769,7 +1184,7 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 				if n.isLocal {
 					sc.put(ident.payload, destructuredEl)
 				} else {
-					err := sc.update(ident.payload, destructuredEl)
+					err := sc.updateVar(ident, destructuredEl)
 					if err != nil {
 						return nil, err
 					}
@@ -780,6 +1195,7 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 			assignedObj, ok := assignedValue.(ObjectValue)
 			if !ok {
 				return nil, &runtimeError{
+					kind:   "typeError",
 					reason: fmt.Sprintf("right side %s of object destructuring is not an object", n.right),
 					pos:    n.pos(),
 				}
@@ -823,7 +1239,7 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 				if n.isLocal {
 					sc.put(ident.payload, destructuredEl)
 				} else {
-					err := sc.update(ident.payload, destructuredEl)
+					err := sc.updateVar(ident, destructuredEl)
 					if err != nil {
 						return nil, err
 					}
@@ -832,6 +1248,12 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 			return assignedValue, nil
 		case propertyAccessNode:
 			assign := left
+			if assign.optional {
+				return nil, &runtimeError{
+					reason: fmt.Sprintf("Cannot assign to optional property access %s", assign),
+					pos:    n.pos(),
+				}
+			}
 
 			assignLeft, err := c.evalExpr(assign.left, sc)
 			if err != nil {
@@ -848,6 +1270,7 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 				assignedString, ok := assignedValue.(*StringValue)
 				if !ok {
 					return nil, &runtimeError{
+						kind:   "typeError",
 						reason: fmt.Sprintf("Cannot assign non-string value %s to string in %s", assignedValue, assign),
 						pos:    n.pos(),
 					}
@@ -856,6 +1279,7 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 				byteIndexVal, ok := assignRight.(IntValue)
 				if !ok {
 					return nil, &runtimeError{
+						kind:   "typeError",
 						reason: fmt.Sprintf("Cannot index into string with non-integer index %s", assignRight),
 						pos:    n.pos(),
 					}
@@ -864,11 +1288,20 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 
 				if byteIndex < 0 || byteIndex > len(*target) {
 					return nil, &runtimeError{
+						kind:   "indexError",
 						reason: fmt.Sprintf("String assignment index %d out of range in %s", byteIndex, n),
+						data:   indexErrorData(byteIndex, len(*target)),
 						pos:    n.pos(),
 					}
 				}
 
+				if grownLen := byteIndex + len(*assignedString); grownLen > len(*target) {
+					if err := c.allocString(grownLen, grownLen-len(*target)); err != nil {
+						err.pos = n.pos()
+						return nil, err
+					}
+				}
+
 				if byteIndex == len(*target) {
 					// append
 					*target = append(*target, *assignedString...)
@@ -885,23 +1318,57 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 				listIndexVal, ok := assignRight.(IntValue)
 				if !ok {
 					return nil, &runtimeError{
+						kind:   "typeError",
 						reason: fmt.Sprintf("Cannot index into list with non-integer index %s", assignRight),
 						pos:    n.pos(),
 					}
 				}
 				listIndex := int(listIndexVal)
 
-				if listIndex < 0 || listIndex > len(*target) {
+				if listIndex < 0 || listIndex > len(target.elems) {
 					return nil, &runtimeError{
+						kind:   "indexError",
 						reason: fmt.Sprintf("List assignment index %d out of range in %s", listIndex, n),
+						data:   indexErrorData(listIndex, len(target.elems)),
 						pos:    n.pos(),
 					}
 				}
 
-				if listIndex == len(*target) {
-					*target = append(*target, assignedValue)
+				if listIndex == len(target.elems) {
+					if err := c.allocList(listIndex+1, 1); err != nil {
+						err.pos = n.pos()
+						return nil, err
+					}
+					target.push(assignedValue)
 				} else {
-					(*target)[listIndex] = assignedValue
+					target.set(listIndex, assignedValue)
+				}
+			case numArray:
+				listIndexVal, ok := assignRight.(IntValue)
+				if !ok {
+					return nil, &runtimeError{
+						kind:   "typeError",
+						reason: fmt.Sprintf("Cannot index into list with non-integer index %s", assignRight),
+						pos:    n.pos(),
+					}
+				}
+				listIndex := int(listIndexVal)
+
+				if listIndex < 0 || listIndex > target.length() {
+					return nil, &runtimeError{
+						kind:   "indexError",
+						reason: fmt.Sprintf("List assignment index %d out of range in %s", listIndex, n),
+						data:   indexErrorData(listIndex, target.length()),
+						pos:    n.pos(),
+					}
+				}
+
+				if !target.store(listIndex, assignedValue) {
+					return nil, &runtimeError{
+						kind:   "typeError",
+						reason: fmt.Sprintf("Cannot assign non-number value %s to numeric array in %s", assignedValue, assign),
+						pos:    n.pos(),
+					}
 				}
 			case ObjectValue:
 				var objKeyString string
@@ -913,13 +1380,30 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 					objKeyString = assignRight.String()
 				}
 
+				ws := c.watchersOf(target)
+				var old Value = null
+				if ws != nil {
+					if val, ok := target[objKeyString]; ok {
+						old = val
+					}
+				}
+
+				var newVal Value = assignedValue
 				if _, ok := assignedValue.(EmptyValue); ok {
 					delete(target, objKeyString)
+					newVal = null
 				} else {
 					target[objKeyString] = assignedValue
 				}
+
+				if ws != nil {
+					if err := c.notifyWatchers(ws, objKeyString, newVal, old); err != nil {
+						return nil, err
+					}
+				}
 			default:
 				return nil, &runtimeError{
+					kind:   "typeError",
 					reason: fmt.Sprintf("Expected string, list, or object in left-hand side of property assignment, got %s", left.String()),
 					pos:    n.pos(),
 				}
@@ -938,6 +1422,10 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 			return nil, err
 		}
 
+		if _, ok := left.(NullValue); ok && n.optional {
+			return null, nil
+		}
+
 		right, err := c.evalAsObjKey(n.right, sc)
 		if err != nil {
 			return nil, err
@@ -948,6 +1436,7 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 			byteIndex, ok := right.(IntValue)
 			if !ok {
 				return nil, &runtimeError{
+					kind:   "typeError",
 					reason: fmt.Sprintf("Cannot index into string with non-integer index %s", right),
 					pos:    n.pos(),
 				}
@@ -963,16 +1452,32 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 			listIndex, ok := right.(IntValue)
 			if !ok {
 				return nil, &runtimeError{
+					kind:   "typeError",
+					reason: fmt.Sprintf("Cannot index into list with non-integer index %s", right),
+					pos:    n.pos(),
+				}
+			}
+
+			if listIndex < 0 || int64(listIndex) >= int64(len(target.elems)) {
+				return null, nil
+			}
+
+			return target.elems[listIndex], nil
+		case numArray:
+			listIndex, ok := right.(IntValue)
+			if !ok {
+				return nil, &runtimeError{
+					kind:   "typeError",
 					reason: fmt.Sprintf("Cannot index into list with non-integer index %s", right),
 					pos:    n.pos(),
 				}
 			}
 
-			if listIndex < 0 || int64(listIndex) >= int64(len(*target)) {
+			if listIndex < 0 || int64(listIndex) >= int64(target.length()) {
 				return null, nil
 			}
 
-			return (*target)[listIndex], nil
+			return target.at(int(listIndex)), nil
 		case ObjectValue:
 			var objKeyString string
 			if objKey, ok := right.(*StringValue); ok {
@@ -987,10 +1492,11 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 				return val, nil
 			}
 
-			return null, nil
+			return c.protoProperty(target, objKeyString), nil
 		}
 
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("Expected string, list, or object in left-hand side of property access, got %s", left.String()),
 			pos:    n.pos(),
 		}
@@ -1015,6 +1521,13 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 			case minus:
 				return -right, nil
 			}
+		case DecimalValue:
+			switch n.op {
+			case plus:
+				return right, nil
+			case minus:
+				return makeDecimal(new(big.Rat).Neg(right.rat)), nil
+			}
 		case BoolValue:
 			switch n.op {
 			case exclam:
@@ -1022,10 +1535,15 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 			}
 		}
 		return nil, &runtimeError{
+			kind:   "typeError",
 			reason: fmt.Sprintf("%s is not a valid unary operator for %s", token{kind: n.op}, rightComputed),
 			pos:    n.pos(),
 		}
 	case binaryNode:
+		if chain, ok := comparisonChain(n); ok {
+			return c.evalComparisonChain(chain, sc)
+		}
+
 		leftComputed, err := c.evalExpr(n.left, sc)
 		if err != nil {
 			return nil, err
@@ -1044,144 +1562,17 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 			return nil, err
 		}
 
-		if n.op == eq {
-			return BoolValue(leftComputed.Eq(rightComputed)), nil
-		} else if n.op == neq {
-			return BoolValue(!leftComputed.Eq(rightComputed)), nil
-		}
-
-		switch left := leftComputed.(type) {
-		case IntValue:
-			right, ok := rightComputed.(IntValue)
-			if !ok {
-				rightFloat, ok := rightComputed.(FloatValue)
-				if !ok {
-					return nil, incompatibleError(n.op, leftComputed, rightComputed, n.pos())
-				}
-
-				leftFloat := FloatValue(float64(int64(left)))
-				val, err := floatBinaryOp(n.op, leftFloat, rightFloat)
-				if err != nil {
-					err.pos = n.pos()
-				}
-				return val, err
-			}
-
-			val, err := intBinaryOp(n.op, left, right)
-			if err != nil {
-				err.pos = n.pos()
-			}
-			return val, err
-		case FloatValue:
-			right, ok := rightComputed.(FloatValue)
-			if !ok {
-				rightInt, ok := rightComputed.(IntValue)
-				if !ok {
-					return nil, incompatibleError(n.op, leftComputed, rightComputed, n.pos())
-				}
-
-				right = FloatValue(float64(int64(rightInt)))
-				val, err := floatBinaryOp(n.op, left, right)
-				if err != nil {
-					err.pos = n.pos()
-				}
-				return val, err
-			}
-
-			val, err := floatBinaryOp(n.op, left, right)
-			if err != nil {
-				err.pos = n.pos()
-			}
-			return val, err
-		case *StringValue:
-			right, ok := rightComputed.(*StringValue)
-			if !ok {
-				return nil, incompatibleError(n.op, leftComputed, rightComputed, n.pos())
-			}
-
-			switch n.op {
-			case plus:
-				base := make([]byte, 0, len(*left)+len(*right))
-				base = append(base, *left...)
-				base = append(base, *right...)
-				baseStr := StringValue(base)
-				return &baseStr, nil
-			case xor:
-				max := maxLen(*left, *right)
-
-				ls, rs := zeroExtend(*left, max), zeroExtend(*right, max)
-				res := make([]byte, max)
-				for i := range res {
-					res[i] = ls[i] ^ rs[i]
-				}
-				resStr := StringValue(res)
-				return &resStr, nil
-			case and:
-				max := maxLen(*left, *right)
-
-				ls, rs := zeroExtend(*left, max), zeroExtend(*right, max)
-				res := make([]byte, max)
-				for i := range res {
-					res[i] = ls[i] & rs[i]
-				}
-				resStr := StringValue(res)
-				return &resStr, nil
-			case or:
-				max := maxLen(*left, *right)
-
-				ls, rs := zeroExtend(*left, max), zeroExtend(*right, max)
-				res := make([]byte, max)
-				for i := range res {
-					res[i] = ls[i] | rs[i]
-				}
-				resStr := StringValue(res)
-				return &resStr, nil
-			case pushArrow:
-				*left = append(*left, *right...)
-				return left, nil
-			case greater:
-				return BoolValue(bytes.Compare(*left, *right) > 0), nil
-			case less:
-				return BoolValue(bytes.Compare(*left, *right) < 0), nil
-			case geq:
-				return BoolValue(bytes.Compare(*left, *right) >= 0), nil
-			case leq:
-				return BoolValue(bytes.Compare(*left, *right) <= 0), nil
-			}
-			return nil, incompatibleError(n.op, leftComputed, rightComputed, n.pos())
-		case BoolValue:
-			right, ok := rightComputed.(BoolValue)
-			if !ok {
-				return nil, incompatibleError(n.op, leftComputed, rightComputed, n.pos())
-			}
-
-			switch n.op {
-			case plus, or:
-				return BoolValue(left || right), nil
-			case times, and:
-				return BoolValue(left && right), nil
-			case xor:
-				return BoolValue(left != right), nil
-			}
-		case *ListValue:
-			switch n.op {
-			case pushArrow:
-				*left = append(*left, rightComputed)
-				return left, nil
-			}
-			return nil, incompatibleError(n.op, leftComputed, rightComputed, n.pos())
-		}
-		return nil, &runtimeError{
-			reason: fmt.Sprintf("Binary operator %s is not defined for values %s, %s",
-				token{kind: n.op}, leftComputed, rightComputed),
-			pos: n.pos(),
-		}
+		return c.evalBinaryValues(n, leftComputed, rightComputed)
 	case fnCallNode:
 		maybeFn, err := c.evalExpr(n.fn, sc)
 		if err != nil {
 			return nil, err
 		}
 
+		if builtin, ok := maybeFn.(BuiltinFnValue); ok && builtin.name == "assert" && len(n.args) > 0 {
+			return c.evalAssert(n, sc)
+		}
+
 		args := make([]Value, len(n.args))
 		for i, argNode := range n.args {
 			args[i], err = c.evalExpr(argNode, sc)
@@ -1195,15 +1586,16 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 				return nil, err
 			}
 
-			restList, ok := rest.(*ListValue)
+			restList, ok := asList(rest)
 			if !ok {
 				return nil, &runtimeError{
+					kind:   "typeError",
 					reason: fmt.Sprintf("Cannot spread a non-list value %s in a function call %s", rest, n),
 					pos:    n.pos(),
 				}
 			}
 
-			args = append(args, *restList...)
+			args = append(args, restList.elems...)
 		}
 
 		val, err := c.EvalFnValue(maybeFn, thunkable, args...)
@@ -1226,9 +1618,29 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 				return nil, err
 			}
 
-			if cond.Eq(target) {
-				return c.evalExprWithOpt(branch.body, sc, thunkable)
+			if !cond.Eq(target) {
+				continue
 			}
+
+			if branch.guard != nil {
+				guard, err := c.evalExpr(branch.guard, sc)
+				if err != nil {
+					return nil, err
+				}
+				guardBool, ok := guard.(BoolValue)
+				if !ok {
+					return nil, &runtimeError{
+						kind:   "typeError",
+						reason: fmt.Sprintf("Guard clause %s in if expression should be a bool, got %s", branch.guard, guard),
+						pos:    branch.guard.pos(),
+					}
+				}
+				if !guardBool {
+					continue
+				}
+			}
+
+			return c.evalExprWithOpt(branch.body, sc, thunkable)
 		}
 		return null, nil
 	case blockNode:
@@ -1237,10 +1649,7 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 			return null, nil
 		}
 
-		blockScope := scope{
-			parent: &sc,
-			vars:   map[string]Value{},
-		}
+		blockScope := newScope(&sc, n.frame)
 
 		last := len(n.exprs) - 1
 		for _, expr := range n.exprs[:last] {
@@ -1255,3 +1664,329 @@ func (c *Context) evalExprWithOpt(node astNode, sc scope, thunkable bool) (Value
 
 	panic(fmt.Sprintf("Unexpected astNode type: %s", node))
 }
+
+func orderingOp(op tokKind) bool {
+	switch op {
+	case greater, less, geq, leq:
+		return true
+	}
+	return false
+}
+
+// comparisonChain returns the comparisons in a chain of ordering comparisons
+// like 0 <= x < 10 from left to right, if n ends one. A parenthesized
+// comparison is a block, so (a < b) < c is not a chain.
+func comparisonChain(n binaryNode) ([]binaryNode, bool) {
+	if !orderingOp(n.op) {
+		return nil, false
+	}
+	if left, ok := n.left.(binaryNode); !ok || !orderingOp(left.op) {
+		return nil, false
+	}
+
+	chain := []binaryNode{n}
+	for {
+		left, ok := chain[0].left.(binaryNode)
+		if !ok || !orderingOp(left.op) {
+			return chain, true
+		}
+		chain = append([]binaryNode{left}, chain...)
+	}
+}
+
+// evalComparisonChain evaluates a chain of comparisons like a < b < c as
+// a < b & b < c, except that each operand is evaluated only once, and none
+// after the first comparison that's false.
+func (c *Context) evalComparisonChain(chain []binaryNode, sc scope) (Value, *runtimeError) {
+	left, err := c.evalExpr(chain[0].left, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cmp := range chain {
+		right, err := c.evalExpr(cmp.right, sc)
+		if err != nil {
+			return nil, err
+		}
+		result, err := c.evalBinaryValues(cmp, left, right)
+		if err != nil {
+			return nil, err
+		}
+		if !result.(BoolValue) {
+			return oakFalse, nil
+		}
+		left = right
+	}
+	return oakTrue, nil
+}
+
+// evalBinaryValues computes the result of the binary expression n given the
+// already-evaluated values of its operands.
+func (c *Context) evalBinaryValues(n binaryNode, leftComputed, rightComputed Value) (Value, *runtimeError) {
+	_, leftObj := leftComputed.(ObjectValue)
+	_, rightObj := rightComputed.(ObjectValue)
+	if leftObj || rightObj {
+		if val, ok, err := c.evalOverloadedOp(n.op, leftComputed, rightComputed); ok {
+			if err != nil && err.pos.line == 0 {
+				err.pos = n.pos()
+			}
+			return val, err
+		}
+	}
+
+	if n.op == eq {
+		return BoolValue(leftComputed.Eq(rightComputed)), nil
+	} else if n.op == neq {
+		return BoolValue(!leftComputed.Eq(rightComputed)), nil
+	}
+
+	switch left := leftComputed.(type) {
+	case IntValue:
+		right, ok := rightComputed.(IntValue)
+		if !ok {
+			if rightDecimal, ok := rightComputed.(DecimalValue); ok {
+				leftRat, _ := decimalOperand(left)
+				val, err := decimalBinaryOp(n.op, leftRat, rightDecimal.rat)
+				if err != nil {
+					err.pos = n.pos()
+				}
+				return val, err
+			}
+
+			rightFloat, ok := rightComputed.(FloatValue)
+			if !ok {
+				return nil, incompatibleError(n.op, leftComputed, rightComputed, n.pos())
+			}
+
+			leftFloat := FloatValue(float64(int64(left)))
+			val, err := floatBinaryOp(n.op, leftFloat, rightFloat)
+			if err != nil {
+				err.pos = n.pos()
+			}
+			return val, err
+		}
+
+		val, err := intBinaryOp(n.op, left, right)
+		if err != nil {
+			err.pos = n.pos()
+		}
+		return val, err
+	case FloatValue:
+		right, ok := rightComputed.(FloatValue)
+		if !ok {
+			rightInt, ok := rightComputed.(IntValue)
+			if !ok {
+				return nil, incompatibleError(n.op, leftComputed, rightComputed, n.pos())
+			}
+
+			right = FloatValue(float64(int64(rightInt)))
+			val, err := floatBinaryOp(n.op, left, right)
+			if err != nil {
+				err.pos = n.pos()
+			}
+			return val, err
+		}
+
+		val, err := floatBinaryOp(n.op, left, right)
+		if err != nil {
+			err.pos = n.pos()
+		}
+		return val, err
+	case DecimalValue:
+		right, ok := decimalOperand(rightComputed)
+		if !ok {
+			return nil, incompatibleError(n.op, leftComputed, rightComputed, n.pos())
+		}
+
+		val, err := decimalBinaryOp(n.op, left.rat, right)
+		if err != nil {
+			err.pos = n.pos()
+		}
+		return val, err
+	case *StringValue:
+		right, ok := rightComputed.(*StringValue)
+		if !ok {
+			return nil, incompatibleError(n.op, leftComputed, rightComputed, n.pos())
+		}
+
+		switch n.op {
+		case plus:
+			if err := c.allocString(len(*left)+len(*right), len(*left)+len(*right)); err != nil {
+				err.pos = n.pos()
+				return nil, err
+			}
+
+			base := make([]byte, 0, len(*left)+len(*right))
+			base = append(base, *left...)
+			base = append(base, *right...)
+			baseStr := StringValue(base)
+			return &baseStr, nil
+		case xor:
+			max := maxLen(*left, *right)
+
+			ls, rs := zeroExtend(*left, max), zeroExtend(*right, max)
+			res := make([]byte, max)
+			for i := range res {
+				res[i] = ls[i] ^ rs[i]
+			}
+			resStr := StringValue(res)
+			return &resStr, nil
+		case and:
+			max := maxLen(*left, *right)
+
+			ls, rs := zeroExtend(*left, max), zeroExtend(*right, max)
+			res := make([]byte, max)
+			for i := range res {
+				res[i] = ls[i] & rs[i]
+			}
+			resStr := StringValue(res)
+			return &resStr, nil
+		case or:
+			max := maxLen(*left, *right)
+
+			ls, rs := zeroExtend(*left, max), zeroExtend(*right, max)
+			res := make([]byte, max)
+			for i := range res {
+				res[i] = ls[i] | rs[i]
+			}
+			resStr := StringValue(res)
+			return &resStr, nil
+		case pushArrow:
+			if err := c.allocString(len(*left)+len(*right), len(*right)); err != nil {
+				err.pos = n.pos()
+				return nil, err
+			}
+
+			*left = append(*left, *right...)
+			return left, nil
+		case greater:
+			return BoolValue(bytes.Compare(*left, *right) > 0), nil
+		case less:
+			return BoolValue(bytes.Compare(*left, *right) < 0), nil
+		case geq:
+			return BoolValue(bytes.Compare(*left, *right) >= 0), nil
+		case leq:
+			return BoolValue(bytes.Compare(*left, *right) <= 0), nil
+		}
+		return nil, incompatibleError(n.op, leftComputed, rightComputed, n.pos())
+	case BoolValue:
+		right, ok := rightComputed.(BoolValue)
+		if !ok {
+			return nil, incompatibleError(n.op, leftComputed, rightComputed, n.pos())
+		}
+
+		switch n.op {
+		case plus, or:
+			return BoolValue(left || right), nil
+		case times, and:
+			return BoolValue(left && right), nil
+		case xor:
+			return BoolValue(left != right), nil
+		}
+	case *ListValue:
+		switch n.op {
+		case pushArrow:
+			if err := c.allocList(len(left.elems)+1, 1); err != nil {
+				err.pos = n.pos()
+				return nil, err
+			}
+
+			left.push(rightComputed)
+			return left, nil
+		}
+		return nil, incompatibleError(n.op, leftComputed, rightComputed, n.pos())
+	case numArray:
+		switch n.op {
+		case pushArrow:
+			if !left.store(left.length(), rightComputed) {
+				return nil, &runtimeError{
+					kind:   "typeError",
+					reason: fmt.Sprintf("Cannot push non-number value %s to numeric array %s", rightComputed, left),
+					pos:    n.pos(),
+				}
+			}
+			return left, nil
+		}
+		return nil, incompatibleError(n.op, leftComputed, rightComputed, n.pos())
+	}
+	return nil, &runtimeError{
+		kind: "typeError",
+		reason: fmt.Sprintf("Binary operator %s is not defined for values %s, %s",
+			token{kind: n.op}, leftComputed, rightComputed),
+		pos: n.pos(),
+	}
+}
+
+// evalAssert evaluates a direct call to the assert builtin. Unlike other
+// builtins, a failing assert reports the source of its condition expression
+// and, for comparisons, the values of both operands.
+func (c *Context) evalAssert(n fnCallNode, sc scope) (Value, *runtimeError) {
+	condNode := n.args[0]
+
+	var cond Value
+	var err *runtimeError
+	operands := ""
+	if bin, ok := condNode.(binaryNode); ok && isComparisonOp(bin.op) {
+		left, err := c.evalExpr(bin.left, sc)
+		if err != nil {
+			return nil, err
+		}
+		right, err := c.evalExpr(bin.right, sc)
+		if err != nil {
+			return nil, err
+		}
+		cond, err = c.evalBinaryValues(bin, left, right)
+		if err != nil {
+			return nil, err
+		}
+		operands = fmt.Sprintf(" (left: %s, right: %s)", left, right)
+	} else {
+		cond, err = c.evalExpr(condNode, sc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	args := []Value{cond}
+	for _, argNode := range n.args[1:] {
+		arg, err := c.evalExpr(argNode, sc)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if n.restArg != nil {
+		rest, err := c.evalExpr(n.restArg, sc)
+		if err != nil {
+			return nil, err
+		}
+
+		restList, ok := asList(rest)
+		if !ok {
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Cannot spread a non-list value %s in a function call %s", rest, sourceString(n)),
+				pos:    n.pos(),
+			}
+		}
+		args = append(args, restList.elems...)
+	}
+
+	val, err := c.oakAssert(args)
+	if err != nil {
+		if _, isBool := cond.(BoolValue); isBool {
+			err.reason = fmt.Sprintf("%s: %s%s", err.reason, sourceString(condNode), operands)
+		}
+		err.pos = n.pos()
+	}
+	return val, err
+}
+
+func isComparisonOp(op tokKind) bool {
+	switch op {
+	case eq, neq, greater, less, geq, leq:
+		return true
+	default:
+		return false
+	}
+}
@@ -1,10 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func expectProgramToReturn(t *testing.T, program string, expected Value) {
@@ -45,6 +63,63 @@ func TestIdentifierAfterComment(t *testing.T) {
 	expectProgramToReturn(t, "x := 10 // this is a comment\nx + x", IntValue(20))
 }
 
+func TestBlockComment(t *testing.T) {
+	expectProgramToReturn(t, "/* this is a comment */", null)
+	expectProgramToReturn(t, "1 + /* inline */ 2", IntValue(3))
+	expectProgramToReturn(t, "x := 10 /* spanning\nlines */\nx + x", IntValue(20))
+	expectProgramToReturn(t, "1 /* unterminated", IntValue(1))
+}
+
+func TestNestedBlockComment(t *testing.T) {
+	expectProgramToReturn(t, "/* outer /* inner */ still a comment */ 42", IntValue(42))
+}
+
+func TestDocComment(t *testing.T) {
+	tokenizer := newTokenizer(`
+	/// adds two numbers
+	/// together
+	fn add(a, b) a + b
+	// not a doc comment
+	x := 1
+	/// the answer
+	answer := 42
+	//// a banner, not a doc comment
+	fn f {}
+	`)
+	parser := newParser(tokenizer.tokenize())
+	nodes, err := parser.parse()
+	if err != nil {
+		t.Fatalf("Could not parse program with doc comments: %s", err)
+	}
+
+	if doc := nodes[0].(fnNode).doc; doc != "adds two numbers\ntogether" {
+		t.Errorf("Expected doc comment on fn, got %q", doc)
+	}
+	if doc := nodes[1].(assignmentNode).doc; doc != "" {
+		t.Errorf("Expected no doc comment on x, got %q", doc)
+	}
+	if doc := nodes[2].(assignmentNode).doc; doc != "the answer" {
+		t.Errorf("Expected doc comment on assignment, got %q", doc)
+	}
+	if doc := nodes[3].(fnNode).doc; doc != "" {
+		t.Errorf("Expected no doc comment on f, got %q", doc)
+	}
+}
+
+func TestShebangLine(t *testing.T) {
+	expectProgramToReturn(t, "#!/usr/bin/env oak", null)
+	expectProgramToReturn(t, "#!/usr/bin/env oak\n1 + 2", IntValue(3))
+	expectProgramToReturn(t, "#!/usr/bin/env oak\r\n1 + 2", IntValue(3))
+}
+
+func TestShebangOnlyOnFirstLine(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	if _, err := ctx.Eval(strings.NewReader("1\n#!/usr/bin/env oak")); err == nil {
+		t.Errorf("Expected shebang line after the first line to be a syntax error")
+	}
+}
+
 func TestEmptyLiteral(t *testing.T) {
 	expectProgramToReturn(t, "_", empty)
 }
@@ -69,6 +144,21 @@ func TestStringLiteralOverflow(t *testing.T) {
 	expectProgramToReturn(t, "'\\x1g'", MakeString("x1g"))
 }
 
+func TestRawStringLiteral(t *testing.T) {
+	expectProgramToReturn(t, "`C:\\dir\\n'x'`", MakeString("C:\\dir\\n'x'"))
+}
+
+func TestRawStringLiteralMultiline(t *testing.T) {
+	expectProgramToReturn(t, "s := `a\n\tb`, [s, len(s)]", MakeList(
+		MakeString("a\n\tb"),
+		IntValue(4),
+	))
+}
+
+func TestRawStringLiteralOverflow(t *testing.T) {
+	expectProgramToReturn(t, "`abc", MakeString("abc"))
+}
+
 func TestHexStringLiteral(t *testing.T) {
 	expectProgramToReturn(t, "'a\\x!'", MakeString("ax!"))
 	expectProgramToReturn(t, "'a\\x1!'", MakeString("ax1!"))
@@ -89,6 +179,35 @@ func TestFloatLiteral(t *testing.T) {
 	expectProgramToReturn(t, "3.141592", FloatValue(3.141592))
 }
 
+func TestFloatLiteralWithExponent(t *testing.T) {
+	expectProgramToReturn(t, "6.022e23", FloatValue(6.022e23))
+	expectProgramToReturn(t, "1e-9", FloatValue(1e-9))
+	expectProgramToReturn(t, "2E+3", FloatValue(2000))
+	expectProgramToReturn(t, "1.5e2 + 1", FloatValue(151))
+}
+
+func TestFloatLiteralStringRoundTrip(t *testing.T) {
+	for _, source := range []string{"6.022e23", "1e-9", "100.0", "0.5"} {
+		tokenizer := newTokenizer(source)
+		parser := newParser(tokenizer.tokenize())
+		nodes, err := parser.parse()
+		if err != nil {
+			t.Fatalf("Could not parse %s: %s", source, err)
+		}
+
+		printed := nodes[0].String()
+		tokenizer = newTokenizer(printed)
+		parser = newParser(tokenizer.tokenize())
+		reparsed, err := parser.parse()
+		if err != nil {
+			t.Fatalf("Could not re-parse %s printed as %s: %s", source, printed, err)
+		}
+		if f, ok := reparsed[0].(floatNode); !ok || f.payload != nodes[0].(floatNode).payload {
+			t.Errorf("Float literal %s printed as %s did not round-trip, got %s", source, printed, reparsed[0])
+		}
+	}
+}
+
 func TestAtomLiteral(t *testing.T) {
 	atomNames := []string{
 		"_?", "if", "fn", "with", "true", "false", "_if", "not_found_404",
@@ -379,6 +498,371 @@ func TestBinaryExprWithinComplexTermsWithinBinaryExpr(t *testing.T) {
 	`, IntValue(16))
 }
 
+func TestBinaryExprLeftAssociativity(t *testing.T) {
+	expectProgramToReturn(t, `[10 - 3 - 2, 64 / 4 / 2, 7 % 3 * 2]`, MakeList(
+		IntValue(5),
+		IntValue(8),
+		IntValue(2),
+	))
+}
+
+func TestComparisonAndLogicalPrecedence(t *testing.T) {
+	expectProgramToReturn(t, `[
+		2 + 3 * 4 = 14
+		1 < 2 & 3 > 4 | true
+		true | false & false
+		false ^ true & true
+	]`, MakeList(
+		BoolValue(true),
+		BoolValue(true),
+		BoolValue(true),
+		BoolValue(true),
+	))
+}
+
+func TestPowerOperator(t *testing.T) {
+	expectProgramToReturn(t, `[
+		2 ** 10
+		2 ** 3 ** 2
+		-2 ** 2
+		2 * 3 ** 2 % 5
+		2 ** -2
+		9.0 ** 0.5
+		string(decimal('1.5') ** 2)
+		string(2 ** decimal(-1))
+	]`, MakeList(
+		IntValue(1024),
+		IntValue(512),
+		IntValue(4),
+		IntValue(8),
+		FloatValue(0.25),
+		FloatValue(3),
+		MakeString("2.25"),
+		MakeString("0.5"),
+	))
+}
+
+func TestDivmod(t *testing.T) {
+	expectProgramToReturn(t, `[
+		divmod(10, 4)
+		divmod(-7, 2)
+		divmod(7, -2)
+		divmod(-7.5, 2)
+		divmod(decimal('7.5'), 2) |> string()
+		try(fn() divmod(1, 0)).kind
+		try(fn() divmod(decimal(1), 0.5)).kind
+	]`, MakeList(
+		MakeList(IntValue(2), IntValue(2)),
+		MakeList(IntValue(-4), IntValue(1)),
+		MakeList(IntValue(-4), IntValue(-1)),
+		MakeList(FloatValue(-4), FloatValue(0.5)),
+		MakeString("[3, 1.5]"),
+		AtomValue("zeroDivisionError"),
+		AtomValue("typeError"),
+	))
+}
+
+func TestComparisonChain(t *testing.T) {
+	expectProgramToReturn(t, `
+	calls := []
+	fn f(x) {
+		calls << x
+		x
+	}
+	[
+		0 <= 5 < 10
+		10 > 5 >= 5 > 6
+		f(1) < f(2) <= f(2)
+		f(3) > f(4) > f(0)
+		calls
+		try(fn() (1 < 2) < 3).kind
+		1 < 2 = true
+	]
+	`, MakeList(
+		oakTrue,
+		oakFalse,
+		oakTrue,
+		oakFalse,
+		MakeList(IntValue(1), IntValue(2), IntValue(2), IntValue(3), IntValue(4)),
+		AtomValue("typeError"),
+		oakTrue,
+	))
+}
+
+func TestOverloadedOperators(t *testing.T) {
+	expectProgramToReturn(t, `
+	fn money(cents) {
+		cents: cents
+		__add: fn(a, b) money(a.cents + b.cents)
+		__eq: fn(a, b) a.cents = b.cents
+		__cmp: fn(a, b) a.cents - b.cents
+		__string: fn(m) '$' + string(m.cents / 100, '.2f')
+	}
+	total := money(150) + money(275)
+	[
+		string(total)
+		total = money(425)
+		total != money(425)
+		money(1) < money(2)
+		money(3) <= money(2)
+		total = ?
+	]
+	`, MakeList(
+		MakeString("$4.25"),
+		BoolValue(true),
+		BoolValue(false),
+		BoolValue(true),
+		BoolValue(false),
+		BoolValue(false),
+	))
+	expectProgramToReturn(t, `
+	x := { __eq: fn(a, b) :yes }
+	try(fn() x = 1).kind
+	`, AtomValue("typeError"))
+}
+
+func TestPrototypes(t *testing.T) {
+	expectProgramToReturn(t, `
+	Counter := {
+		step: 1
+		next: fn(c) c.n <- c.n + c.step
+	}
+	a := { __proto: Counter, n: 0 }
+	b := { __proto: Counter, n: 10, step: 5 }
+	a.next()
+	a.next()
+	b.next()
+	[a.n, b.n, a.step, a.missing]
+	`, MakeList(
+		IntValue(2),
+		IntValue(15),
+		IntValue(1),
+		null,
+	))
+}
+
+func TestTypeAnnotations(t *testing.T) {
+	expectProgramToReturn(t, `
+	fn apply(f: fn(int) -> int, xs...: [int]) -> [int] xs |> std.map(f)
+	std := import('std')
+	offset: int := 10
+	apply(fn(x: int) x + offset, 1, 2)
+	`, MakeList(IntValue(11), IntValue(12)))
+
+	for _, prog := range []string{
+		"fn(a: ) a",
+		"fn(a: 1) a",
+		"fn(a: { k }) a",
+		"n: int",
+	} {
+		tokenizer := newTokenizer(prog)
+		parser := newParser(tokenizer.tokenize())
+		if _, err := parser.parse(); err == nil {
+			t.Errorf("Expected %q not to parse", prog)
+		}
+	}
+}
+
+func TestForExpression(t *testing.T) {
+	expectProgramToReturn(t, `
+	sum := 0
+	last := for x in [1, 2, 3] sum <- sum + x
+	[
+		sum
+		last
+		for i, x in [10, 20] collect i + x
+		for k, v in { b: 2, a: 1 } collect k << string(v)
+		for c in 'ab' collect c << c
+		for i, n in seq(5, 7) collect [i, n]
+		for x in range(3) collect x * x
+		for _, v in map([[:a, 1]]) collect v
+		for x in [] x
+		for x in [] collect x
+		try(fn() for x in 3 x).kind
+	]
+	`, MakeList(
+		IntValue(6),
+		IntValue(6),
+		MakeList(IntValue(10), IntValue(21)),
+		MakeList(MakeString("a1"), MakeString("b2")),
+		MakeList(MakeString("aa"), MakeString("bb")),
+		MakeList(MakeList(IntValue(0), IntValue(5)), MakeList(IntValue(1), IntValue(6))),
+		MakeList(IntValue(0), IntValue(1), IntValue(4)),
+		MakeList(IntValue(1)),
+		null,
+		MakeList(),
+		AtomValue("typeError"),
+	))
+
+	// for begins a for expression only when followed by names and in
+	expectProgramToReturn(t, "{ for: 1 }.for", IntValue(1))
+	expectProgramToReturn(t, `
+	for := 2
+	fn inc(for) for + 1
+	[inc(for), :for, { for: 3 }.for]
+	`, MakeList(
+		IntValue(3),
+		AtomValue("for"),
+		IntValue(3),
+	))
+}
+
+func TestSlice(t *testing.T) {
+	expectProgramToReturn(t, `
+	s := 'hello world'
+	xs := [1, 2, 3, 4, 5]
+	n := 2
+	obj := { name: 'oak' }
+	x := ?
+	[
+		s.(0:5)
+		s.(-5:)
+		xs.(n:)
+		xs.(0:n)
+		xs.(1:-1)
+		xs.(:)
+		xs.(4:1)
+		xs.(-10:10)
+		range(4).(1:3)
+		obj.(:name)
+		x?.(0:1)
+		try(fn() x.(0:1)).kind
+		try(fn() xs.(0.5:1)).kind
+	]
+	`, MakeList(
+		MakeString("hello"),
+		MakeString("world"),
+		MakeList(IntValue(3), IntValue(4), IntValue(5)),
+		MakeList(IntValue(1), IntValue(2)),
+		MakeList(IntValue(2), IntValue(3), IntValue(4)),
+		MakeList(IntValue(1), IntValue(2), IntValue(3), IntValue(4), IntValue(5)),
+		MakeList(),
+		MakeList(IntValue(1), IntValue(2), IntValue(3), IntValue(4), IntValue(5)),
+		MakeList(IntValue(1), IntValue(2)),
+		MakeString("oak"),
+		null,
+		AtomValue("typeError"),
+		AtomValue("typeError"),
+	))
+}
+
+func TestDestructuringNames(t *testing.T) {
+	expectProgramToReturn(t, `
+	fn pair(a, b) [a, b]
+	[q, r] := pair(3, 1)
+	[_, s] := pair(4, 5)
+	[q, r] <- [r, q]
+	[q, r, s]
+	`, MakeList(
+		IntValue(1),
+		IntValue(3),
+		IntValue(5),
+	))
+
+	// names separated by commas are separate expressions, as in a program
+	// printed onto one line by oak build
+	expectProgramToReturn(t, "x := 10, x, y := 2, [x, y]", MakeList(
+		IntValue(10),
+		IntValue(2),
+	))
+	expectProgramToReturn(t, "x := 10, (x, y := 1)", IntValue(1))
+}
+
+func TestKeywordArguments(t *testing.T) {
+	expectProgramToReturn(t, `
+	fn render(template, opts) [template, opts.escape, opts.width]
+	fn options(opts...) opts
+	[
+		render('page', escape: true, width: 80)
+		options(
+			a: 1
+			b: 2
+		)
+		options(1, y: 3).0
+	]
+	`, MakeList(
+		MakeList(MakeString("page"), BoolValue(true), IntValue(80)),
+		MakeList(ObjectValue{
+			"a": IntValue(1),
+			"b": IntValue(2),
+		}),
+		IntValue(1),
+	))
+}
+
+func TestPipePlaceholder(t *testing.T) {
+	expectProgramToReturn(t, `
+	fn triple(a, b, c) [a, b, c]
+	[
+		1 |> triple(2, ^, 3)
+		1 |> triple(2, 3) |> triple(^, 4, 5)
+		1 |> triple(
+			2
+			3
+			^
+		)
+	]
+	`, MakeList(
+		MakeList(IntValue(2), IntValue(1), IntValue(3)),
+		MakeList(
+			MakeList(IntValue(1), IntValue(2), IntValue(3)),
+			IntValue(4),
+			IntValue(5),
+		),
+		MakeList(IntValue(2), IntValue(3), IntValue(1)),
+	))
+
+	// a _ argument after |> is passed as _ after the piped value, as it
+	// always has been
+	expectProgramToReturn(t, `
+	fn count(args...) len(args)
+	fn default(x, base) if x {
+		? -> base
+		_ -> x
+	}
+	[
+		1 |> count(_)
+		type(? |> default(_))
+	]
+	`, MakeList(
+		IntValue(2),
+		AtomValue("empty"),
+	))
+
+	for _, program := range []string{
+		"1 |> f(^, ^)",
+		"f(^)",
+		"1 |> f(g(^))",
+		"1 |> f(^).g",
+	} {
+		ctx := NewContext("/tmp")
+		ctx.LoadBuiltins()
+		_, err := ctx.Eval(strings.NewReader(program))
+		if err == nil || !strings.Contains(err.Error(), "placeholder") {
+			t.Errorf("Expected placeholder error from %q, got %v", program, err)
+		}
+	}
+}
+
+func TestUnaryBindsLooserThanPropertyAccessAndCall(t *testing.T) {
+	expectProgramToReturn(t, `
+	x := { a: 3, b: true, f: fn() 5 }
+	[-x.a, -x.f() + 1, !x.b = false]
+	`, MakeList(
+		IntValue(-3),
+		IntValue(-4),
+		BoolValue(true),
+	))
+}
+
+func TestPushArrowBindsLoosest(t *testing.T) {
+	expectProgramToReturn(t, `
+	s := 'a'
+	s << 'b' + 'c' << 'd'
+	s
+	`, MakeString("abcd"))
+}
+
 func TestStringCompare(t *testing.T) {
 	expectProgramToReturn(t, `
 	[
@@ -571,6 +1055,47 @@ func TestComplexIfExprTarget(t *testing.T) {
 	))
 }
 
+func TestIfExprWithGuard(t *testing.T) {
+	expectProgramToReturn(t, `
+	fn classify(n) if n {
+		0 -> :zero
+		_ if n > 3 -> :big
+		_ if n < 0 -> :negative
+		_ -> :small
+	}
+	[classify(0), classify(10), classify(-2), classify(2)]
+	`, MakeList(AtomValue("zero"), AtomValue("big"), AtomValue("negative"), AtomValue("small")))
+}
+
+func TestIfExprWithGuardOnMultiTarget(t *testing.T) {
+	expectProgramToReturn(t, `
+	fn check(x, ok?) if x {
+		1, 2 if ok? -> :matched
+		_ -> :unmatched
+	}
+	[check(1, true), check(2, true), check(2, false), check(3, true)]
+	`, MakeList(AtomValue("matched"), AtomValue("matched"), AtomValue("unmatched"), AtomValue("unmatched")))
+}
+
+func TestIfExprGuardOnlyEvaluatedOnMatch(t *testing.T) {
+	expectProgramToReturn(t, `
+	count := 0
+	if 2 {
+		1 if { count <- count + 1, true } -> :one
+		2 if { count <- count + 1, true } -> :two
+	}
+	count
+	`, IntValue(1))
+}
+
+func TestIfExprWithNonBoolGuard(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	if _, err := ctx.Eval(strings.NewReader("if 1 { _ if 2 -> 3 }")); err == nil {
+		t.Errorf("Expected non-bool guard clause to be a runtime error")
+	}
+}
+
 func TestBasicWithExpr(t *testing.T) {
 	expectProgramToReturn(t, `fn add(a, b) { a + b }, with add(10) 40`, IntValue(50))
 }
@@ -579,6 +1104,25 @@ func TestWithExprWithCallback(t *testing.T) {
 	expectProgramToReturn(t, `fn applyThrice(x, f) f(f(f(x))), with applyThrice(10) fn(n) n + 1`, IntValue(13))
 }
 
+func TestWithExprOnPipedCall(t *testing.T) {
+	expectProgramToReturn(t, `
+	fn apply(x, f) f(x)
+	fn add(a, b) a + b
+	[
+		with 10 |> apply() fn(n) n * 3
+		with 10 |> add(2) |> apply() fn(n) n + 1
+	]
+	`, MakeList(IntValue(30), IntValue(13)))
+}
+
+func TestWithExprRequiresFnCall(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	if _, err := ctx.Eval(strings.NewReader("with 10 fn(n) n")); err == nil {
+		t.Errorf("Expected with expression on a non-call to be a syntax error")
+	}
+}
+
 func TestRecursiveFunction(t *testing.T) {
 	expectProgramToReturn(t, `
 	fn times(n, f) {
@@ -770,6 +1314,57 @@ func TestObjectAccess(t *testing.T) {
 	))
 }
 
+func TestOptionalPropertyAccess(t *testing.T) {
+	expectProgramToReturn(t, `
+	resp := { body: { user: { name: 'oak' } } }
+	nothing := ?
+	[
+		resp?.body?.user?.name
+		resp?.headers?.host
+		nothing?.body?.user
+		[1, 2]?.1
+	]
+	`, MakeList(
+		MakeString("oak"),
+		null,
+		null,
+		IntValue(2),
+	))
+}
+
+func TestOptionalPropertyAccessShortCircuits(t *testing.T) {
+	expectProgramToReturn(t, `
+	evaluated := false
+	fn key {
+		evaluated <- true
+		:a
+	}
+	nothing := ?
+	nothing?.(key())
+	evaluated
+	`, BoolValue(false))
+}
+
+func TestPropertyAccessOnQmarkIdentifier(t *testing.T) {
+	// empty?.a parses as an optional access on empty, so accessing a property
+	// on an identifier ending in ? requires parentheses
+	expectProgramToReturn(t, `
+	empty? := { a: 1 }
+	[empty?, (empty?).a]
+	`, MakeList(
+		ObjectValue{"a": IntValue(1)},
+		IntValue(1),
+	))
+}
+
+func TestOptionalPropertyAssign(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	if _, err := ctx.Eval(strings.NewReader("obj := {}, obj?.a := 1")); err == nil {
+		t.Errorf("Expected assignment to an optional property access to be an error")
+	}
+}
+
 func TestObjectAssign(t *testing.T) {
 	expectProgramToReturn(t, `
 	obj := {
@@ -883,6 +1478,45 @@ func TestPipeWithExpr(t *testing.T) {
 	`, IntValue(100))
 }
 
+func TestSpreadArgsInCall(t *testing.T) {
+	expectProgramToReturn(t, `
+	fn add3(a, b, c) a + b + c
+	xs := [2, 3]
+	add3(1, xs...)
+	`, IntValue(6))
+}
+
+func TestSpreadInListLiteral(t *testing.T) {
+	expectProgramToReturn(t, `
+	xs := [2, 3]
+	[1, xs..., 4, []..., [5, 6]...]
+	`, MakeList(
+		IntValue(1),
+		IntValue(2),
+		IntValue(3),
+		IntValue(4),
+		IntValue(5),
+		IntValue(6),
+	))
+}
+
+func TestSpreadInListLiteralCopies(t *testing.T) {
+	expectProgramToReturn(t, `
+	xs := [1, 2]
+	ys := [xs...]
+	ys << 3
+	[len(xs), len(ys)]
+	`, MakeList(IntValue(2), IntValue(3)))
+}
+
+func TestSpreadNonListInListLiteral(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	if _, err := ctx.Eval(strings.NewReader("[1, 'two'...]")); err == nil {
+		t.Errorf("Expected spreading a non-list value in a list literal to be a runtime error")
+	}
+}
+
 func TestExtraArgs(t *testing.T) {
 	expectProgramToReturn(t, `
 	fn getExtra(a, b, c) {
@@ -905,3 +1539,3043 @@ func TestRestArgs(t *testing.T) {
 		IntValue(5),
 	))
 }
+
+func TestAssertPasses(t *testing.T) {
+	expectProgramToReturn(t, `
+	x := 2
+	[assert(x = 2), assert(x > 1, 'x is big')]
+	`, MakeList(BoolValue(true), BoolValue(true)))
+}
+
+func TestAssertFailureReportsSource(t *testing.T) {
+	for _, tc := range []struct {
+		program string
+		reason  string
+	}{
+		{
+			"xs := [1, 2], assert(len(xs) = 3, 'three items')",
+			"Assertion failed (three items): len(xs) = 3 (left: 2, right: 3)",
+		},
+		{
+			"xs := [1, 2], assert(xs.0 + xs.(1) * 2 > 10)",
+			"Assertion failed: xs.0 + xs.(1) * 2 > 10 (left: 5, right: 10)",
+		},
+		{
+			"a := true, o := {}, assert(!a & (a | o?.x = 'y'))",
+			"Assertion failed: !a & (a | o?.x = 'y')",
+		},
+		{
+			"xs := [1, 2], assert(xs |> len() = 3, ['spread message']...)",
+			"Assertion failed (spread message): len(xs) = 3 (left: 2, right: 3)",
+		},
+		{
+			"assert([1 = 2, 'only spread']...)",
+			"Assertion failed (only spread)",
+		},
+	} {
+		ctx := NewContext("/tmp")
+		ctx.LoadBuiltins()
+		_, err := ctx.Eval(strings.NewReader(tc.program))
+		runtimeErr, ok := err.(*runtimeError)
+		if !ok {
+			t.Errorf("Expected %s to fail with a runtime error, got %v", tc.program, err)
+			continue
+		}
+		if runtimeErr.reason != tc.reason {
+			t.Errorf("Expected %s to fail with %q, got %q", tc.program, tc.reason, runtimeErr.reason)
+		}
+	}
+}
+
+func TestAssertNonBool(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	if _, err := ctx.Eval(strings.NewReader("assert(1)")); err == nil {
+		t.Errorf("Expected assert on a non-bool value to be a runtime error")
+	}
+}
+
+func TestTokenPositions(t *testing.T) {
+	tokens, err := Tokenize(strings.NewReader("a := 'é'\n\tb + 1"))
+	if err != nil {
+		t.Fatalf("Could not tokenize program: %s", err)
+	}
+
+	expected := []pos{
+		{offset: 0, line: 1, col: 1},  // a
+		{offset: 2, line: 1, col: 3},  // :=
+		{offset: 5, line: 1, col: 6},  // 'é'
+		{offset: 9, line: 1, col: 9},  // inserted comma
+		{offset: 11, line: 2, col: 2}, // b
+		{offset: 13, line: 2, col: 4}, // +
+		{offset: 15, line: 2, col: 6}, // 1
+		{offset: 16, line: 2, col: 7}, // trailing comma
+	}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %v", len(expected), tokens)
+	}
+	for i, tok := range tokens {
+		if got := tok.pos; got.offset != expected[i].offset || got.line != expected[i].line || got.col != expected[i].col {
+			t.Errorf("Token %s: expected position %#v, got %#v", tok, expected[i], tok.pos)
+		}
+	}
+}
+
+func TestTokenizeCRLF(t *testing.T) {
+	tokens, err := Tokenize(strings.NewReader("x := 1\r\ny := 2\r\n"))
+	if err != nil {
+		t.Fatalf("Could not tokenize program: %s", err)
+	}
+
+	for _, tok := range tokens {
+		if tok.kind == identifier && tok.payload == "y" {
+			if tok.line != 2 || tok.col != 1 || tok.offset != 8 {
+				t.Errorf("Expected y at 2:1 (offset 8), got %#v", tok.pos)
+			}
+		}
+	}
+
+	expectProgramToReturn(t, "x := 1\r\ny := x + 2\r\ny\r\n", IntValue(3))
+}
+
+func TestStreamingParser(t *testing.T) {
+	var prog strings.Builder
+	prog.WriteString("x := 0\n")
+	for i := 0; i < 10000; i++ {
+		prog.WriteString("x <- x + 1 // increment\n")
+	}
+
+	tokenizer := newReaderTokenizer(iotest.HalfReader(strings.NewReader(prog.String())))
+	parser := newStreamingParser(&tokenizer)
+	count := 0
+	for {
+		_, err := parser.parseNext()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Could not parse streamed program: %s", err)
+		}
+		count++
+
+		if len(tokenizer.source) > 2*minDiscardRunes || len(parser.tokens) > 16 {
+			t.Fatalf("Streaming parser held %d runes and %d tokens after %d nodes",
+				len(tokenizer.source), len(parser.tokens), count)
+		}
+	}
+
+	if count != 10001 {
+		t.Errorf("Expected 10001 top-level nodes, got %d", count)
+	}
+
+	expectProgramToReturn(t, prog.String()+"x", IntValue(10000))
+}
+
+func TestEvalReaderError(t *testing.T) {
+	ctx := NewContext("/tmp")
+	readErr := errors.New("read failed")
+	if _, err := ctx.Eval(iotest.ErrReader(readErr)); err != readErr {
+		t.Errorf("Expected Eval to return the reader's error, got %v", err)
+	}
+}
+
+func TestResolverAssignsSlots(t *testing.T) {
+	tokenizer := newTokenizer("fn f(a) { b := a, g }")
+	parser := newParser(tokenizer.tokenize())
+	nodes, err := parser.parse()
+	if err != nil {
+		t.Fatalf("Could not parse program: %s", err)
+	}
+
+	fn := resolveNodes(nodes)[0].(fnNode)
+	if fn.frame == nil || fn.frame.index["a"] != 0 {
+		t.Fatalf("Expected fn frame to hold argument a, got %#v", fn.frame)
+	}
+
+	block := fn.body.(blockNode)
+	if block.frame == nil || block.frame.index["b"] != 0 {
+		t.Fatalf("Expected block frame to hold variable b, got %#v", block.frame)
+	}
+
+	a := block.exprs[0].(assignmentNode).right.(identifierNode)
+	if *a.ref != (varRef{depth: 1, slot: 0}) {
+		t.Errorf("Expected a to resolve to the fn frame, got %#v", a.ref)
+	}
+	g := block.exprs[1].(identifierNode)
+	if *g.ref != (varRef{depth: 2, slot: -1}) {
+		t.Errorf("Expected g to resolve to the top-level scope, got %#v", g.ref)
+	}
+}
+
+func TestResolvedReadBeforeDefinition(t *testing.T) {
+	expectProgramToReturn(t, `
+	x := 'global'
+	fn f {
+		a := x
+		x := 'local'
+		[a, x]
+	}
+	f()
+	`, MakeList(MakeString("global"), MakeString("local")))
+}
+
+func TestResolvedClosureSeesLaterDefinition(t *testing.T) {
+	expectProgramToReturn(t, `
+	x := 'global'
+	fn f {
+		g := fn() x
+		first := g()
+		x := 'shadow'
+		[first, g()]
+	}
+	f()
+	`, MakeList(MakeString("global"), MakeString("shadow")))
+}
+
+func TestResolvedConditionalDefinition(t *testing.T) {
+	expectProgramToReturn(t, `
+	x := 'global'
+	fn f(c) {
+		if c -> x := 'local'
+		x
+	}
+	[f(true), f(false)]
+	`, MakeList(MakeString("local"), MakeString("global")))
+}
+
+func TestResolvedNonlocalAssignment(t *testing.T) {
+	expectProgramToReturn(t, `
+	total := 0
+	fn counter {
+		n := 0
+		inc := fn() n <- n + 1
+		inc(), inc()
+		[a, b] := [n, 10]
+		[a, b] <- [b, a]
+		total <- a + b
+		n
+	}
+	[counter(), total]
+	`, MakeList(IntValue(2), IntValue(12)))
+}
+
+func TestSublistSharesUntilWrite(t *testing.T) {
+	expectProgramToReturn(t, `
+	xs := [1, 2, 3, 4, 5]
+	ys := sublist(xs, 1, 4)
+	zs := sublist(ys, -10, 10)
+	xs << 6
+	ys << 7
+	ys.0 := :a
+	xs.2 := :b
+	[xs, ys, zs, sublist(xs, 4, 2)]
+	`, MakeList(
+		MakeList(IntValue(1), IntValue(2), AtomValue("b"), IntValue(4), IntValue(5), IntValue(6)),
+		MakeList(AtomValue("a"), IntValue(3), IntValue(4), IntValue(7)),
+		MakeList(IntValue(2), IntValue(3), IntValue(4)),
+		MakeList(),
+	))
+}
+
+func TestJoinBuiltin(t *testing.T) {
+	expectProgramToReturn(t, `
+	parts := ['a', 'b', 'c']
+	[join(parts), join(parts, ', '), join([], '-'), parts]
+	`, MakeList(
+		MakeString("abc"),
+		MakeString("a, b, c"),
+		MakeString(""),
+		MakeList(MakeString("a"), MakeString("b"), MakeString("c")),
+	))
+}
+
+func TestJoinBuiltinNonString(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	if _, err := ctx.Eval(strings.NewReader("join(['a', 1])")); err == nil {
+		t.Errorf("Expected join of a non-string element to be a runtime error")
+	}
+}
+
+func TestNumericArrays(t *testing.T) {
+	expectProgramToReturn(t, `
+	xs := ints(3)
+	xs.1 := 2.7
+	xs << 5
+	ys := floats([1, 2.5, 3, 4])
+	[xs, type(ys), len(ys), xs = [0, 2, 0, 5], [ys...]]
+	`, MakeList(
+		MakeList(IntValue(0), IntValue(2), IntValue(0), IntValue(5)),
+		AtomValue("list"),
+		IntValue(4),
+		BoolValue(true),
+		MakeList(FloatValue(1), FloatValue(2.5), FloatValue(3), FloatValue(4)),
+	))
+}
+
+func TestNumericArrayOps(t *testing.T) {
+	expectProgramToReturn(t, `
+	xs := ints([1, 2, 3])
+	ys := floats([0.5, 1, 1.5])
+	[vadd(xs, xs), vadd(xs, ys), vscale(xs, 2), vscale(xs, 0.5), vsum(xs), vdot(xs, ys)]
+	`, MakeList(
+		MakeList(IntValue(2), IntValue(4), IntValue(6)),
+		MakeList(FloatValue(1.5), FloatValue(3), FloatValue(4.5)),
+		MakeList(IntValue(2), IntValue(4), IntValue(6)),
+		MakeList(FloatValue(0.5), FloatValue(1), FloatValue(1.5)),
+		IntValue(6),
+		FloatValue(7),
+	))
+}
+
+func TestNumericArrayErrors(t *testing.T) {
+	for _, prog := range []string{
+		"xs := floats(2), xs.0 := 'a'",
+		"ints(2) << :a",
+		"ints(['a'])",
+		"vadd(ints(2), ints(3))",
+		"vdot([1, 2], [3, 4])",
+	} {
+		ctx := NewContext("/tmp")
+		ctx.LoadBuiltins()
+		if _, err := ctx.Eval(strings.NewReader(prog)); err == nil {
+			t.Errorf("Expected %q to be a runtime error", prog)
+		}
+	}
+}
+
+func TestCancelStopsInfiniteLoop(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	time.AfterFunc(20*time.Millisecond, ctx.Cancel)
+
+	_, err := ctx.Eval(strings.NewReader("fn loop(n) loop(n + 1), loop(0)"))
+	if err == nil || !strings.Contains(err.Error(), "Evaluation cancelled") {
+		t.Errorf("Expected cancelled evaluation to return an error, got %v", err)
+	}
+
+	if _, err := ctx.Eval(strings.NewReader("fn f 1, f()")); err == nil {
+		t.Errorf("Expected function calls after Cancel to return an error")
+	}
+}
+
+func expectLimitError(t *testing.T, limits Limits, program, reason string) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	ctx.SetLimits(limits)
+
+	_, err := ctx.Eval(strings.NewReader(program))
+	if err == nil || !strings.Contains(err.Error(), reason) {
+		t.Errorf("Expected error %q from %q, got %v", reason, program, err)
+	}
+}
+
+func TestCallDepthLimit(t *testing.T) {
+	expectLimitError(t, Limits{MaxCallDepth: 100}, `
+	fn sum(n) if n {
+		0 -> 0
+		_ -> n + sum(n - 1)
+	}
+	sum(1000)
+	`, "Call depth limit of 100 exceeded")
+
+	// tail calls do not nest
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	ctx.SetLimits(Limits{MaxCallDepth: 100})
+	val, err := ctx.Eval(strings.NewReader(`
+	fn count(n, acc) if n {
+		0 -> acc
+		_ -> count(n - 1, acc + 1)
+	}
+	count(1000, 0)
+	`))
+	if err != nil || !val.Eq(IntValue(1000)) {
+		t.Errorf("Expected tail-recursive loop within call depth limit, got %v, %v", val, err)
+	}
+}
+
+func TestAllocLimit(t *testing.T) {
+	expectLimitError(t, Limits{MaxAllocBytes: 10000}, `
+	fn grow(xs) grow(xs << 'abcdefghij')
+	grow([])
+	`, "Memory limit of 10000 bytes exceeded")
+}
+
+func TestStringAndListLengthLimits(t *testing.T) {
+	expectLimitError(t, Limits{MaxStringLen: 8}, `
+	s := 'abcd'
+	s << 'efgh'
+	s << 'i'
+	`, "String length limit of 8 bytes exceeded")
+	expectLimitError(t, Limits{MaxStringLen: 8}, "'abcde' + 'fghij'", "String length limit")
+	expectLimitError(t, Limits{MaxListLen: 3}, "xs := [1, 2, 3], xs.3 := 4", "List length limit of 3 exceeded")
+	expectLimitError(t, Limits{MaxListLen: 3}, "[1, 2, 3, 4]", "List length limit")
+}
+
+func TestBuiltinLimits(t *testing.T) {
+	listLimit := Limits{MaxListLen: 1000}
+	expectLimitError(t, listLimit, "ints(1000000)", "List length limit of 1000 exceeded")
+	expectLimitError(t, listLimit, "floats(1001)", "List length limit")
+	expectLimitError(t, listLimit, "range(2000)", "List length limit")
+	expectLimitError(t, Limits{MaxListLen: 10}, "keys('abcdefghijk')", "List length limit")
+	expectLimitError(t, Limits{MaxListLen: 10}, "___str_split('abcdefghijk', '')", "List length limit")
+
+	stringLimit := Limits{MaxStringLen: 1000}
+	expectLimitError(t, stringLimit, "string(ints(1000))", "String length limit of 1000 bytes exceeded")
+	expectLimitError(t, stringLimit, "string(1, '2000')", "String length limit")
+	expectLimitError(t, stringLimit, "format('{0:2000}', 1)", "String length limit")
+	expectLimitError(t, stringLimit, "join(___str_split('"+strings.Repeat("a", 900)+"', ''), ', ')", "String length limit")
+	expectLimitError(t, stringLimit, "___str_pad_start('', 2000, 'ab')", "String length limit")
+	expectLimitError(t, stringLimit, "___str_replace('"+strings.Repeat("a", 100)+"', 'a', 'bbbbbbbbbbbbbbbbbbbb')", "String length limit")
+
+	allocLimit := Limits{MaxAllocBytes: 10000}
+	expectLimitError(t, allocLimit, "___str_upper('"+strings.Repeat("a", 6000)+"')", "Memory limit of 10000 bytes exceeded")
+	expectLimitError(t, allocLimit, "fn grow(xs) grow(vadd(xs, xs)), grow(ints(100))", "Memory limit")
+	expectLimitError(t, allocLimit, "___yaml_parse('["+strings.Repeat("1, ", 999)+"1]')", "Memory limit")
+	expectLimitError(t, allocLimit, "___toml_parse('a = ["+strings.Repeat("1, ", 999)+"1]')", "Memory limit")
+
+	// a read asking for more than the file holds counts only what's read
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	ctx.SetLimits(Limits{MaxStringLen: 1000})
+	val, err := ctx.Eval(strings.NewReader(`
+	f := open('` + filepath.Join(t.TempDir(), "small.txt") + `')
+	write(f.fd, 0, 'hello')
+	evt := read(f.fd, 0, 4096)
+	close(f.fd)
+	evt.data
+	`))
+	if err != nil {
+		t.Fatalf("Did not expect error reading a small file, got %s", err)
+	}
+	if !val.Eq(MakeString("hello")) {
+		t.Errorf("Expected %q from read, got %s", "hello", val)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+
+	_, err := ctx.Eval(strings.NewReader(fmt.Sprintf(`
+	std := import('std')
+	root := '%s'
+	received := []
+	stop := watch(root, { interval: 5 }, fn(evt) {
+		received << [evt.event, evt.path |> std.slice(len(root) + 1)]
+		if evt.event = :remove -> stop()
+	})
+	`, filepath.ToSlash(dir))))
+	if err != nil {
+		t.Fatalf("Did not expect watch() to return an error: %s", err.Error())
+	}
+
+	// each change must be seen by a poll before the next is made
+	file := filepath.Join(dir, "watched.txt")
+	steps := []func() error{
+		func() error { return os.WriteFile(file, []byte("a"), 0644) },
+		func() error { return os.WriteFile(file, []byte("abc"), 0644) },
+		func() error { return os.Remove(file) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Wait returns only once the handler has stopped the watcher
+	done := make(chan struct{})
+	go func() {
+		ctx.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Watch handler did not run and stop")
+	}
+
+	received, _ := ctx.scope.get("received")
+	expected := MakeList(
+		MakeList(AtomValue("create"), MakeString("watched.txt")),
+		MakeList(AtomValue("write"), MakeString("watched.txt")),
+		MakeList(AtomValue("remove"), MakeString("watched.txt")),
+	)
+	if !received.Eq(expected) {
+		t.Errorf("Expected handler to receive %s, got %s", expected, received)
+	}
+}
+
+func TestSpawn(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+
+	_, err := ctx.Eval(strings.NewReader(`
+	events := []
+	p := spawn('sh', ['-c', 'cat; echo oops >&2; exit 2'], fn(evt) events << evt)
+	p.write('hello')
+	timedOut := p.wait(0.05)
+	p.closeStdin()
+	ended := p.wait()
+
+	sleeper := spawn('sleep', ['10'])
+	killed := [sleeper.kill(), sleeper.wait().type, sleeper.kill(:kill)]
+	`))
+	if err != nil {
+		t.Fatalf("Did not expect spawn() to return an error: %s", err.Error())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ctx.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Spawned processes did not exit")
+	}
+
+	for name, expected := range map[string]Value{
+		"timedOut": null,
+		"ended":    ObjectValue{"type": AtomValue("end"), "status": IntValue(2)},
+		"killed":   MakeList(oakTrue, AtomValue("end"), oakFalse),
+		"events": MakeList(
+			ObjectValue{"type": AtomValue("stdout"), "data": MakeString("hello")},
+			ObjectValue{"type": AtomValue("stderr"), "data": MakeString("oops\n")},
+			ObjectValue{"type": AtomValue("end"), "status": IntValue(2)},
+		),
+	} {
+		val, _ := ctx.scope.get(name)
+		if !val.Eq(expected) {
+			t.Errorf("Expected %s to be %s, got %s", name, expected, val)
+		}
+	}
+}
+
+func TestSignalUnknown(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+
+	_, err := ctx.Eval(strings.NewReader("signal(:nope, fn {})"))
+	if err == nil || !strings.Contains(err.Error(), "Unknown signal :nope") {
+		t.Errorf("Expected unknown signal to return an error, got %v", err)
+	}
+}
+
+func TestTryReturnsOkValue(t *testing.T) {
+	expectProgramToReturn(t, "try(fn() 1 + 2)", ObjectValue{
+		"type": AtomValue("ok"),
+		"ok":   IntValue(3),
+	})
+}
+
+func TestTryRecoversErrorKinds(t *testing.T) {
+	expectProgramToReturn(t, `
+	fn kindOf(f) try(f).kind
+	[
+		kindOf(fn() 1 + :a)
+		kindOf(fn() notDefined)
+		kindOf(fn() [1, 2].5 := 3)
+		kindOf(fn() 1 / 0)
+		kindOf(fn() len())
+		kindOf(fn() import('not-a-module'))
+		kindOf(fn() assert(false))
+		kindOf(fn() raise(:custom, 'oops'))
+	]
+	`, MakeList(
+		AtomValue("typeError"),
+		AtomValue("nameError"),
+		AtomValue("indexError"),
+		AtomValue("zeroDivisionError"),
+		AtomValue("argumentError"),
+		AtomValue("importError"),
+		AtomValue("assertionError"),
+		AtomValue("custom"),
+	))
+}
+
+func TestTryErrorData(t *testing.T) {
+	expectProgramToReturn(t, `
+	xs := [1, 2]
+	err := try(fn() {
+		xs.5 := 3
+	})
+	[err.type, err.error, err.pos.line, err.data]
+	`, MakeList(
+		AtomValue("error"),
+		MakeString("List assignment index 5 out of range in (xs.5) := 3"),
+		IntValue(4),
+		ObjectValue{
+			"index":  IntValue(5),
+			"length": IntValue(2),
+		},
+	))
+	expectProgramToReturn(t, "try(fn() notDefined).data.name", MakeString("notDefined"))
+	expectProgramToReturn(t, "try(fn() raise(:custom, 'oops', { code: 42 })).data.code", IntValue(42))
+}
+
+func TestRecoveredErrorsKeepOwnStackTrace(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+
+	_, err := ctx.Eval(strings.NewReader(`
+	fn f(n) 1 / n
+	fn g(n) f(n) + 1
+	try(fn() g(0))
+	try(fn() g(0))
+	try(fn() 1.5 % 0)
+	try(fn() divmod(1, 0))
+	g(0)
+	`))
+	if err == nil {
+		t.Fatal("Expected division by zero to stop the program")
+	}
+	if count := strings.Count(err.Error(), "in fn f"); count != 1 {
+		t.Errorf("Expected stack trace to contain one call to f, got %d in\n%s", count, err.Error())
+	}
+}
+
+func TestRaiseStopsProgram(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+
+	_, err := ctx.Eval(strings.NewReader("raise(:custom, 'oops'), 10"))
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("Expected raise() to stop the program with an error, got %v", err)
+	}
+}
+
+func TestComposeAndPipe(t *testing.T) {
+	expectProgramToReturn(t, `
+	fn inc(x) x + 1
+	fn double(x) x * 2
+	[
+		compose(inc, double)(5)
+		pipe(inc, double)(5)
+		pipe(fn(a, b) a + b, string)(1, 2)
+		compose(len, keys)({ a: 1, b: 2 })
+		try(fn() pipe(inc, ?)).kind
+	]
+	`, MakeList(
+		IntValue(11),
+		IntValue(12),
+		MakeString("3"),
+		IntValue(2),
+		AtomValue("typeError"),
+	))
+}
+
+func TestConform(t *testing.T) {
+	expectProgramToReturn(t, `
+	std := import('std')
+	schema := {
+		type: :object
+		required: ['id']
+		keys: {
+			id: { type: :int, min: 1 }
+			items: { type: :list, items: { enum: ['a', 'b'] } }
+		}
+	}
+	[
+		conform({ id: 1, items: ['a'] }, schema)
+		conform({ items: ['a', 'c'] }, schema) |> std.map(fn(p) [p.path, p.kind])
+		conform('x', schema).(0).message
+	]
+	`, MakeList(
+		MakeList(),
+		MakeList(
+			MakeList(MakeList(MakeString("id")), AtomValue("required")),
+			MakeList(MakeList(MakeString("items"), IntValue(1)), AtomValue("enum")),
+		),
+		MakeString("expected object, got string"),
+	))
+}
+
+func TestDebugWatch(t *testing.T) {
+	expectProgramToReturn(t, `
+	debug := import('debug')
+	state := { count: 0 }
+	changes := []
+	unwatch := debug.watch(state, 'count', fn(value, old) changes << [value, old])
+	state.count := 1
+	state.other := 2
+	state.count := _
+	unwatch()
+	state.count := 3
+	changes
+	`, MakeList(
+		MakeList(IntValue(1), IntValue(0)),
+		MakeList(null, IntValue(1)),
+	))
+}
+
+func TestReactiveBatchesChanges(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	batches, err := ctx.Eval(strings.NewReader(`
+	reactive := import('reactive')
+	state := { n: 0 }
+	batches := []
+	reactive.subscribe(state, fn(changes) batches << changes)
+	state.n := 1
+	state.n := 2
+	wait(0.01, fn {
+		state.n := 3
+	})
+	batches
+	`))
+	if err != nil {
+		t.Fatalf("Did not expect program to exit with error: %s", err.Error())
+	}
+	ctx.Wait()
+
+	expected := MakeList(
+		MakeList(ObjectValue{"key": MakeString("n"), "value": IntValue(2), "old": IntValue(0)}),
+		MakeList(ObjectValue{"key": MakeString("n"), "value": IntValue(3), "old": IntValue(2)}),
+	)
+	if !batches.Eq(expected) {
+		t.Errorf("Expected changes %s, got %s", expected, batches)
+	}
+}
+
+func TestEmitterQueuesHandlers(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	calls, err := ctx.Eval(strings.NewReader(`
+	em := emitter()
+	calls := []
+	em.on(:msg, fn(n) {
+		calls << n
+		if n = 1 -> em.emit(:msg, 3)
+	})
+	em.once(:msg, fn(n) calls << 'once')
+	em.emit(:msg, 1)
+	em.emit(:msg, 2)
+	calls << 0
+	`))
+	if err != nil {
+		t.Fatalf("Did not expect program to exit with error: %s", err.Error())
+	}
+	ctx.Wait()
+
+	expected := MakeList(IntValue(0), IntValue(1), MakeString("once"), IntValue(2), IntValue(3))
+	if !calls.Eq(expected) {
+		t.Errorf("Expected handler calls %s, got %s", expected, calls)
+	}
+}
+
+func TestTasks(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	results, err := ctx.Eval(strings.NewReader(`
+	tasks := import('task')
+	results := {}
+	task(fn(resolve) wait(0.01, fn() resolve(1))).
+		then(fn(x) x + 1).
+		then(fn(x) task(fn(resolve) resolve(x * 10))).
+		then(fn(x) results.chained := x)
+	task(fn() raise(:oops, 'failed')).
+		then(fn() results.skipped := true).
+		catch(fn(err) results.caught := err.kind)
+	tasks.all([tasks.delay(0.01).then(fn() :slow), 2]).then(fn(xs) results.all := xs)
+	tasks.race([tasks.delay(0.02).then(fn() :slow), tasks.resolve(:fast)]).then(fn(x) results.race := x)
+	results.sync := len(results)
+	results
+	`))
+	if err != nil {
+		t.Fatalf("Did not expect program to exit with error: %s", err.Error())
+	}
+	ctx.Wait()
+
+	expected := ObjectValue{
+		"sync":    IntValue(0),
+		"chained": IntValue(20),
+		"caught":  AtomValue("oops"),
+		"all":     MakeList(AtomValue("slow"), IntValue(2)),
+		"race":    AtomValue("fast"),
+	}
+	if !results.Eq(expected) {
+		t.Errorf("Expected task results %s, got %s", expected, results)
+	}
+}
+
+func TestAsyncAwait(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	results, err := ctx.Eval(strings.NewReader(`
+	{ delay: delay } := import('task')
+	results := {}
+	async fn add(a, b) {
+		x := await delay(0.01)
+		y := await task(fn(resolve) resolve(a))
+		results.steps := [x, y]
+		await delay(0.01)
+		y + b
+	}
+	add(1, 2).then(fn(sum) results.sum := sum)
+	async fn fails() {
+		await delay(0.01)
+		raise(:oops, 'failed')
+		results.unreachable := true
+	}
+	fails().catch(fn(err) results.caught := err.kind)
+	async fn rethrows() {
+		await task(fn(_, reject) reject(:rejected))
+		results.unreachable := true
+	}
+	rethrows().catch(fn(err) results.rejected := err)
+	async fn double(n) n * 2
+	async fn last() await double(15)
+	last().then(fn(sum) results.last := sum)
+	results.sync := len(results)
+	results
+	`))
+	if err != nil {
+		t.Fatalf("Did not expect program to exit with error: %s", err.Error())
+	}
+	ctx.Wait()
+
+	expected := ObjectValue{
+		"sync":     IntValue(0),
+		"steps":    MakeList(null, IntValue(1)),
+		"sum":      IntValue(3),
+		"caught":   AtomValue("oops"),
+		"rejected": AtomValue("rejected"),
+		"last":     IntValue(30),
+	}
+	if !results.Eq(expected) {
+		t.Errorf("Expected async results %s, got %s", expected, results)
+	}
+}
+
+func TestAsyncAwaitParseErrors(t *testing.T) {
+	for _, prog := range []string{
+		"async fn() f(await x)",
+		"async fn() { if x -> await y }",
+		"async fn() { each(xs, fn(x) await x) }",
+	} {
+		ctx := NewContext("/tmp")
+		ctx.LoadBuiltins()
+		if _, err := ctx.Eval(strings.NewReader(prog)); err == nil {
+			t.Errorf("Expected a parse error for misplaced await in %s", prog)
+		}
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	results, err := ctx.Eval(strings.NewReader(`
+	std := import('std')
+	results := {}
+	pool := workers(3)
+	fn fib(n) if n < 2 {
+		true -> n
+		_ -> fib(n - 1) + fib(n - 2)
+	}
+	scale := 10
+	pool.map([10, 15, 20], fn(n, i) fib(n) * scale + i).then(fn(xs) results.map := xs)
+	data := { xs: [1, 2] }
+	pool.run(fn(d) { d.xs << 3, d }, data).then(fn(d) results.copied := [d, data])
+	pool.run(fn() std.map([1, 2], fn(x) x * 2)).then(fn(xs) results.imported := xs)
+	pool.run(fn() raise(:oops, 'failed')).catch(fn(err) results.caught := err.kind)
+	results.native := try(fn() pool.run(fn(t) t, task(fn {}))).kind
+	results.size := pool.size
+	pool.close()
+	results.closed := try(fn() pool.run(fn() 1)).type
+	results
+	`))
+	if err != nil {
+		t.Fatalf("Did not expect program to exit with error: %s", err.Error())
+	}
+	ctx.Wait()
+
+	expected := ObjectValue{
+		"map": MakeList(IntValue(550), IntValue(6101), IntValue(67652)),
+		"copied": MakeList(
+			ObjectValue{"xs": MakeList(IntValue(1), IntValue(2), IntValue(3))},
+			ObjectValue{"xs": MakeList(IntValue(1), IntValue(2))},
+		),
+		"imported": MakeList(IntValue(2), IntValue(4)),
+		"caught":   AtomValue("oops"),
+		"native":   AtomValue("typeError"),
+		"size":     IntValue(3),
+		"closed":   AtomValue("error"),
+	}
+	if !results.Eq(expected) {
+		t.Errorf("Expected worker results %s, got %s", expected, results)
+	}
+}
+
+func TestIPC(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "build.sock")
+
+	// a socket file left behind by a listener that's gone
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Could not create socket file: %s", err.Error())
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	results, evalErr := ctx.Eval(strings.NewReader(strings.ReplaceAll(`
+	ipc := import('ipc')
+	results := { server: [], client: [] }
+	server := ipc.listen('SOCKET', {
+		connect: fn(conn) results.server << [:connect, conn.id]
+		message: fn(msg, conn) {
+			results.server << [:message, msg]
+			conn.send({ built: msg.changed })
+		}
+		end: fn(conn) {
+			results.server << [:end, conn.id, len(server.conns())]
+			server.close()
+		}
+	})
+	client := ipc.connect('SOCKET', {
+		message: fn(msg) {
+			results.client << msg
+			client.close()
+		}
+		end: fn() results.client << :end
+	})
+	client.send({ changed: ['a.oak', 'b.oak'], at: 1.5 })
+	results.unsendable := try(fn() client.send(fn {})).kind
+	results.missing := ipc.connect('SOCKET.missing', {}).type
+	results
+	`, "SOCKET", path)))
+	if evalErr != nil {
+		t.Fatalf("Did not expect program to exit with error: %s", evalErr.Error())
+	}
+	ctx.Wait()
+
+	changed := MakeList(MakeString("a.oak"), MakeString("b.oak"))
+	expected := ObjectValue{
+		"server": MakeList(
+			MakeList(AtomValue("connect"), IntValue(1)),
+			MakeList(AtomValue("message"), ObjectValue{"changed": changed, "at": FloatValue(1.5)}),
+			MakeList(AtomValue("end"), IntValue(1), IntValue(0)),
+		),
+		"client":     MakeList(ObjectValue{"built": changed}),
+		"unsendable": AtomValue("typeError"),
+		"missing":    AtomValue("error"),
+	}
+	if !results.Eq(expected) {
+		t.Errorf("Expected ipc results %s, got %s", expected, results)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected closing the server to remove its socket file")
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	expectProgramToReturn(t, `
+	fn naturals(yield) {
+		fn sub(n) {
+			yield(n)
+			sub(n + 1)
+		}
+		sub(0)
+	}
+	g := generator(naturals)
+	[g.next().value, g.next().value, g.next().value]
+	`, MakeList(IntValue(0), IntValue(1), IntValue(2)))
+
+	expectProgramToReturn(t, `
+	g := generator(fn(yield) {
+		yield(:a)
+		:end
+	})
+	[g.next(), g.next(), g.next()]
+	`, MakeList(
+		ObjectValue{"done": oakFalse, "value": AtomValue("a")},
+		ObjectValue{"done": oakTrue, "value": AtomValue("end")},
+		ObjectValue{"done": oakTrue, "value": null},
+	))
+}
+
+func TestGeneratorErrors(t *testing.T) {
+	expectProgramToReturn(t, `
+	leaked := ?
+	g := generator(fn(yield) {
+		leaked <- yield
+		yield(1)
+		1 + :a
+	})
+	g.next()
+	[
+		try(fn() leaked(2)).error
+		try(fn() g.next()).kind
+		g.next().done
+	]
+	`, MakeList(
+		MakeString("yield() called outside of its generator"),
+		AtomValue("typeError"),
+		oakTrue,
+	))
+}
+
+func TestAbandonedGeneratorsExit(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	_, err := ctx.Eval(strings.NewReader(`
+	fn count(yield) {
+		fn sub(n) {
+			yield(n)
+			sub(n + 1)
+		}
+		sub(0)
+	}
+	fn start(i) if i < 100 -> {
+		generator(count).next()
+		start(i + 1)
+	}
+	start(0)
+	`))
+	if err != nil {
+		t.Fatalf("Did not expect program to exit with error: %s", err.Error())
+	}
+
+	for i := 0; i < 100 && runtime.NumGoroutine() > before+10; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before+10 {
+		t.Errorf("Expected abandoned generators to exit, but %d goroutines remain", n-before)
+	}
+
+	ctx.Lock()
+	defer ctx.Unlock()
+	if ctx.eng.callDepth != 0 {
+		t.Errorf("Expected call depth 0 after generators exit, got %d", ctx.eng.callDepth)
+	}
+}
+
+func TestSeqIterator(t *testing.T) {
+	expectProgramToReturn(t, `
+	it := seq(1, 3)
+	[it.next(), it.next(), it.next(), it.next()]
+	`, MakeList(
+		ObjectValue{"done": oakFalse, "value": IntValue(1)},
+		ObjectValue{"done": oakFalse, "value": IntValue(2)},
+		ObjectValue{"done": oakTrue, "value": null},
+		ObjectValue{"done": oakTrue, "value": null},
+	))
+	expectProgramToReturn(t, `
+	it := seq(1, ?, 0.5)
+	[it.next().value, it.next().value, it.next().value]
+	`, MakeList(FloatValue(1), FloatValue(1.5), FloatValue(2)))
+	expectProgramToReturn(t, "try(fn() seq('a')).kind", AtomValue("typeError"))
+}
+
+func TestLinesIterator(t *testing.T) {
+	file, err := os.CreateTemp("", "oak-lines-*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("first\r\nsecond\n\nlast")
+	file.Close()
+
+	expectProgramToReturn(t, fmt.Sprintf(`
+	it := lines('%s')
+	fn collect(acc) if r := it.next() {
+		_ -> if r.done {
+			true -> acc
+			_ -> collect(acc << r.value)
+		}
+	}
+	collect([])
+	`, file.Name()), MakeList(
+		MakeString("first"),
+		MakeString("second"),
+		MakeString(""),
+		MakeString("last"),
+	))
+	expectProgramToReturn(t, "lines('/does/not/exist').type", AtomValue("error"))
+}
+
+func TestRangeBuiltin(t *testing.T) {
+	ints := IntArrayValue{0, 2, 4}
+	expectProgramToReturn(t, "range(0, 5, 2)", &ints)
+	expectProgramToReturn(t, "range(3)", MakeList(IntValue(0), IntValue(1), IntValue(2)))
+	expectProgramToReturn(t, "range(5, 0, -2)", MakeList(IntValue(5), IntValue(3), IntValue(1)))
+	expectProgramToReturn(t, "len(range(0, 0.3, 0.1))", IntValue(3))
+	expectProgramToReturn(t, "len(range(0, 1, 0.1))", IntValue(10))
+	expectProgramToReturn(t, "range(0, 1, 0.1).3", FloatValue(0.30000000000000004))
+	expectProgramToReturn(t, "range(1, 2, 0)", MakeList())
+	expectProgramToReturn(t, "try(fn() range(0, pow(10, 308) * 10)).kind", AtomValue("valueError"))
+	expectProgramToReturn(t, "try(fn() range('a')).kind", AtomValue("typeError"))
+}
+
+func TestCyclicValueString(t *testing.T) {
+	expectProgramToReturn(t, `
+	xs := [1, 2]
+	xs << xs
+	o := { name: 'o' }
+	o.self := o
+	o.list := xs
+	[string(xs), string(o)]
+	`, MakeList(
+		MakeString("[1, 2, [...]]"),
+		MakeString("{list: [1, 2, [...]], name: 'o', self: {...}}"),
+	))
+}
+
+func TestCyclicValueEq(t *testing.T) {
+	expectProgramToReturn(t, `
+	xs := [1, 2]
+	xs << xs
+	ys := [1, 2]
+	ys << [1, 2, ys]
+	zs := [1, 3]
+	zs << zs
+	o := {}
+	o.self := o
+	p := {}
+	p.self := p
+	[xs = ys, xs = zs, o = p, o = { self: {} }]
+	`, MakeList(oakTrue, oakFalse, oakTrue, oakFalse))
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	expectProgramToReturn(t, `
+	x := {
+		a: [1, -2, 3.5, 'hi', :atom, ?, _, true, false]
+		b: { nested: range(3), floats: range(0, 1, 0.5) }
+		'c d': -12345678901
+	}
+	[unmarshal(marshal(x)) = x, marshal({ a: 1, b: 2 }) = marshal({ b: 2, a: 1 })]
+	`, MakeList(oakTrue, oakTrue))
+}
+
+func TestMapKeys(t *testing.T) {
+	expectProgramToReturn(t, `
+	m := map()
+	m |> mapSet(1, :int)
+	m |> mapSet(1.0, :float)
+	m |> mapSet(1.5, :half)
+	m |> mapSet('1', :string)
+	m |> mapSet([1, '1'], :list)
+	m |> mapSet(fn() 1, :fn)
+	[len(m), mapGet(m, 1), mapGet(m, [1.0, '1']), mapGet(m, ['1', 1]), mapGet(m, 1.5)]
+	`, MakeList(IntValue(5), AtomValue("float"), AtomValue("list"), null, AtomValue("half")))
+}
+
+func TestMapDeleteCompacts(t *testing.T) {
+	expectProgramToReturn(t, `
+	{ each: each, slice: slice } := import('std')
+	m := map()
+	range(100) |> each(fn(i) m |> mapSet(i, i * i))
+	range(90) |> each(fn(i) m |> mapDelete(i))
+	m |> mapSet(0, :zero)
+	[len(m), keys(m) |> slice(0, 3), mapGet(m, 95), mapGet(m, 5)]
+	`, MakeList(
+		IntValue(11),
+		MakeList(IntValue(90), IntValue(91), IntValue(92)),
+		IntValue(9025),
+		null,
+	))
+}
+
+func TestMarshalMap(t *testing.T) {
+	expectProgramToReturn(t, `
+	m := map([[[1, 2], :pair], ['k', map([[:nested, 1]])], [3, ?]])
+	back := unmarshal(marshal(m))
+	[back = m, keys(back)]
+	`, MakeList(oakTrue, MakeList(MakeList(IntValue(1), IntValue(2)), MakeString("k"), IntValue(3))))
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	expectProgramToReturn(t, `
+	price := decimal('19.99')
+	third := decimal(1) / 3
+	[
+		string(price * 3 + decimal('0.03'))
+		decimal('0.1') + decimal('0.2') = decimal('0.3')
+		string(third)
+		third * 3 = 1
+		string(1 - price)
+		string(-price % 5)
+		price > 19
+		[decimal('0.5') = 0.5, decimal(0.1) = 0.1, decimal('x')]
+		type(price)
+	]
+	`, MakeList(
+		MakeString("60"),
+		oakTrue,
+		MakeString("1/3"),
+		oakTrue,
+		MakeString("-18.99"),
+		MakeString("-4.99"),
+		oakTrue,
+		MakeList(oakTrue, oakFalse, null),
+		AtomValue("decimal"),
+	))
+}
+
+func TestDecimalRound(t *testing.T) {
+	expectProgramToReturn(t, `
+	fn r(s, places, mode) string(decimalRound(decimal(s), places, mode))
+	[
+		r('2.5'), r('3.5'), r('-2.5', 0, :halfUp), r('2.5', 0, :halfDown)
+		r('1.231', 2, :up), r('-1.239', 2, :down), r('-1.231', 2, :ceil), r('-1.231', 2, :floor)
+		r('1250', -2), r('1/3', 4)
+	]
+	`, MakeList(
+		MakeString("2"), MakeString("4"), MakeString("-3"), MakeString("2"),
+		MakeString("1.24"), MakeString("-1.23"), MakeString("-1.23"), MakeString("-1.24"),
+		MakeString("1200"), MakeString("0.3333"),
+	))
+}
+
+func TestDecimalFormat(t *testing.T) {
+	expectProgramToReturn(t, `
+	[
+		string(decimal('1234567.125'), ',.2f')
+		format('{:.1%}', decimal('0.0625'))
+		string(decimal(2) / 3, '.3')
+		int(decimal('-2.5'))
+		float(decimal('2.5'))
+	]
+	`, MakeList(
+		MakeString("1,234,567.13"),
+		MakeString("6.3%"),
+		MakeString("0.667"),
+		IntValue(-3),
+		FloatValue(2.5),
+	))
+}
+
+func TestDecimalKeysAndMarshal(t *testing.T) {
+	expectProgramToReturn(t, `
+	m := map([[0.5, :half], [decimal(1) / 3, :third]])
+	x := [decimal('19.99'), decimal(-1) / 7]
+	[mapGet(m, decimal('1/2')), mapGet(m, decimal('2/6')), unmarshal(marshal(x)) = x]
+	`, MakeList(AtomValue("half"), AtomValue("third"), oakTrue))
+}
+
+func TestDecimalErrors(t *testing.T) {
+	expectProgramToReturn(t, `
+	[
+		try(fn() decimal(1) + 1.5).kind
+		try(fn() decimal(1) / 0).kind
+		try(fn() decimalRound(decimal(1), 0, :sideways)).kind
+		try(fn() decimalRound(1.5)).kind
+	]
+	`, MakeList(
+		AtomValue("typeError"),
+		AtomValue("zeroDivisionError"),
+		AtomValue("valueError"),
+		AtomValue("typeError"),
+	))
+}
+
+func TestMarshalErrors(t *testing.T) {
+	expectProgramToReturn(t, `
+	xs := [1]
+	xs << xs
+	[
+		try(fn() marshal(fn() 1)).kind
+		try(fn() marshal(xs)).kind
+		try(fn() unmarshal('')).kind
+		try(fn() unmarshal(char(1) + char(8) + char(3))).kind
+		try(fn() unmarshal(marshal(1) << 'x')).kind
+		try(fn() unmarshal(1)).kind
+	]
+	`, MakeList(
+		AtomValue("typeError"),
+		AtomValue("valueError"),
+		AtomValue("valueError"),
+		AtomValue("valueError"),
+		AtomValue("valueError"),
+		AtomValue("typeError"),
+	))
+}
+
+func TestMsgpackSerialize(t *testing.T) {
+	expectProgramToReturn(t, `
+	msgpack := import('msgpack')
+	fn bytes(s) {
+		fn sub(i, acc) if i {
+			len(s) -> acc
+			_ -> sub(i + 1, acc << codepoint(s.(i)))
+		}
+		sub(0, [])
+	}
+	[
+		bytes(msgpack.serialize([?, true, false]))
+		bytes(msgpack.serialize([1, -1, 200, -200]))
+		bytes(msgpack.serialize(1.5))
+		bytes(msgpack.serialize({ b: 'x', a: :y }))
+		bytes(msgpack.serialize(char(255)))
+	]
+	`, MakeList(
+		MakeList(IntValue(0x93), IntValue(0xc0), IntValue(0xc3), IntValue(0xc2)),
+		MakeList(IntValue(0x94), IntValue(0x01), IntValue(0xff), IntValue(0xcc), IntValue(200), IntValue(0xd1), IntValue(0xff), IntValue(0x38)),
+		MakeList(IntValue(0xcb), IntValue(0x3f), IntValue(0xf8), IntValue(0), IntValue(0), IntValue(0), IntValue(0), IntValue(0), IntValue(0)),
+		MakeList(IntValue(0x82), IntValue(0xa1), IntValue('a'), IntValue(0xa1), IntValue('y'), IntValue(0xa1), IntValue('b'), IntValue(0xa1), IntValue('x')),
+		MakeList(IntValue(0xc4), IntValue(1), IntValue(0xff)),
+	))
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	expectProgramToReturn(t, `
+	msgpack := import('msgpack')
+	x := {
+		ints: [0, 127, 128, -32, -33, 70000, -70000, 5000000000, -5000000000]
+		floats: [1.0, -2.5, 0.1]
+		strings: ['', 'hello', 'こんにちは', char(0) + char(255)]
+		nested: { list: range(20), empty: {} }
+	}
+	msgpack.parse(msgpack.serialize(x)) = x
+	`, oakTrue)
+}
+
+func TestMsgpackParse(t *testing.T) {
+	expectProgramToReturn(t, `
+	msgpack := import('msgpack')
+	xs := [1]
+	xs << xs
+	[
+		// map with int and boolean keys
+		msgpack.parse(char(130) + char(1) + char(161) + 'a' + char(195) + char(161) + 'b')
+		// float32
+		msgpack.parse(char(202) + char(63) + char(192) + char(0) + char(0))
+		// str8
+		msgpack.parse(char(217) + char(2) + 'hi')
+		// map with a list key
+		msgpack.parse(char(129) + char(144) + char(1))
+		// truncated and trailing data
+		msgpack.parse(char(146) + char(1))
+		msgpack.parse(char(1) + char(2))
+		// extension type
+		msgpack.parse(char(212) + char(1) + char(0))
+		msgpack.parse('')
+		try(fn() msgpack.serialize(fn() 1)).kind
+		try(fn() msgpack.serialize(xs)).kind
+	]
+	`, MakeList(
+		ObjectValue{"1": MakeString("a"), "true": MakeString("b")},
+		FloatValue(1.5),
+		MakeString("hi"),
+		AtomValue("error"),
+		AtomValue("error"),
+		AtomValue("error"),
+		AtomValue("error"),
+		AtomValue("error"),
+		AtomValue("typeError"),
+		AtomValue("valueError"),
+	))
+}
+
+func TestYamlParse(t *testing.T) {
+	expectProgramToReturn(t, `
+	yaml := import('yaml')
+	yaml.parse('
+# comment
+name: "app" # trailing comment
+version: 1.5
+enabled: yes
+port: 0x1F
+base: &base
+  host: localhost
+  user: root
+dev:
+  <<: *base
+  host: devhost
+items:
+- a
+- key: v
+  n: ~
+- [1, { b: c }]
+text: |
+  line one
+    indented
+folded: >-
+  one
+  two
+')
+	`, ObjectValue{
+		"name":    MakeString("app"),
+		"version": FloatValue(1.5),
+		"enabled": MakeString("yes"),
+		"port":    IntValue(31),
+		"base":    ObjectValue{"host": MakeString("localhost"), "user": MakeString("root")},
+		"dev":     ObjectValue{"host": MakeString("devhost"), "user": MakeString("root")},
+		"items": MakeList(
+			MakeString("a"),
+			ObjectValue{"key": MakeString("v"), "n": null},
+			MakeList(IntValue(1), ObjectValue{"b": MakeString("c")}),
+		),
+		"text":   MakeString("line one\n  indented\n"),
+		"folded": MakeString("one two"),
+	})
+}
+
+func TestYamlDocumentsAndErrors(t *testing.T) {
+	expectProgramToReturn(t, `
+	yaml := import('yaml')
+	[
+		yaml.parseAll('a: 1\n---\n- b\n--- 3\n')
+		yaml.parse('a: 1\n---\nb: 2\n')
+		yaml.parse('a: [1, 2\n')
+		yaml.parse('a: 1\na: 2\n')
+		yaml.parse('a: *missing\n')
+		yaml.parse('a:\n  b: 1\n   c: 2\n')
+		yaml.parse('')
+	]
+	`, MakeList(
+		MakeList(ObjectValue{"a": IntValue(1)}, MakeList(MakeString("b")), IntValue(3)),
+		AtomValue("error"),
+		AtomValue("error"),
+		AtomValue("error"),
+		AtomValue("error"),
+		AtomValue("error"),
+		null,
+	))
+}
+
+func TestYamlSerialize(t *testing.T) {
+	expectProgramToReturn(t, `
+	yaml := import('yaml')
+	x := {
+		list: [1, [2, 3], { k: 'v' }, [], {}]
+		strings: ['plain', 'true', '12', '', 'a: b', 'no', 'two\nlines']
+		floats: [1.0, 2.5]
+		none: ?
+	}
+	[yaml.serialize(x), yaml.parse(yaml.serialize(x)) = x]
+	`, MakeList(MakeString(`floats:
+  - 1.0
+  - 2.5
+list:
+  - 1
+  - - 2
+    - 3
+  - k: v
+  - []
+  - {}
+none: null
+strings:
+  - plain
+  - "true"
+  - "12"
+  - ""
+  - "a: b"
+  - "no"
+  - "two\nlines"
+`), oakTrue))
+}
+
+func TestTomlParse(t *testing.T) {
+	expectProgramToReturn(t, `
+	toml := import('toml')
+	toml.parse('
+title = "example" # comment
+site."example.com" = true
+ints = [1_000, 0xff, 0o7, 0b11, -2]
+floats = [1.5, 1e3, -0.5]
+date = 1979-05-27T07:32:00Z
+literal = \'C:\\dir\'
+multi = """
+one \\
+  two"""
+inline = { a = 1, b.c = [] }
+
+[server]
+host = "localhost"
+
+[[users]]
+name = "a"
+
+[[users]]
+name = "b"
+[users.meta]
+admin = true
+')
+	`, ObjectValue{
+		"title":   MakeString("example"),
+		"site":    ObjectValue{"example.com": oakTrue},
+		"ints":    MakeList(IntValue(1000), IntValue(255), IntValue(7), IntValue(3), IntValue(-2)),
+		"floats":  MakeList(FloatValue(1.5), FloatValue(1000), FloatValue(-0.5)),
+		"date":    MakeString("1979-05-27T07:32:00Z"),
+		"literal": MakeString(`C:\dir`),
+		"multi":   MakeString("one two"),
+		"inline":  ObjectValue{"a": IntValue(1), "b": ObjectValue{"c": MakeList()}},
+		"server":  ObjectValue{"host": MakeString("localhost")},
+		"users": MakeList(
+			ObjectValue{"name": MakeString("a")},
+			ObjectValue{"name": MakeString("b"), "meta": ObjectValue{"admin": oakTrue}},
+		),
+	})
+}
+
+func TestTomlErrors(t *testing.T) {
+	expectProgramToReturn(t, `
+	std := import('std')
+	toml := import('toml')
+	[
+		'a = 1\na = 2'
+		'[a]\n[a]'
+		'a = { b = 1 }\n[a]'
+		'a = [1]\n[[a]]'
+		'a.b = 1\n[a.b]'
+		'a = 01'
+		'a = "unterminated'
+		'a = 1 b = 2'
+		'a = 9223372036854775808'
+	] |> with std.map() fn(s) toml.parse(s)
+	`, MakeList(
+		AtomValue("error"), AtomValue("error"), AtomValue("error"),
+		AtomValue("error"), AtomValue("error"), AtomValue("error"),
+		AtomValue("error"), AtomValue("error"), AtomValue("error"),
+	))
+}
+
+func TestTomlSerialize(t *testing.T) {
+	expectProgramToReturn(t, `
+	toml := import('toml')
+	x := {
+		name: 'app'
+		none: ?
+		ratio: 1.0
+		ports: [80, 443]
+		server: { host: 'localhost', tls: { cert: 'a.pem' } }
+		users: [{ name: 'a' }, { name: 'b' }]
+	}
+	[toml.serialize(x), try(fn() toml.serialize([1])).kind]
+	`, MakeList(MakeString(`name = "app"
+ports = [80, 443]
+ratio = 1.0
+
+[server]
+host = "localhost"
+
+[server.tls]
+cert = "a.pem"
+
+[[users]]
+name = "a"
+
+[[users]]
+name = "b"
+`), AtomValue("typeError")))
+}
+
+func TestTemplateRender(t *testing.T) {
+	expectProgramToReturn(t, `
+	template := import('template')
+	render := template.compile('{{# greeting }}Hello, {{ user.name }}!
+{{ if user.admin }}admin{{ else if not user.active }}inactive{{ else }}user{{ end }}
+{{ each i, x in items }}{{ i }}:{{ x }} {{ else }}none{{ end }}
+{{ each k, v in user.tags }}{{ k }}={{ v }};{{ end }}{{ missing.path }}')
+	[
+		render({ user: { name: 'Ann', admin: true, tags: { b: 2, a: 1 } }, items: ['x', 2, ?] })
+		render({ user: { name: 'Bo', active: false }, items: [] })
+	]
+	`, MakeList(
+		MakeString("Hello, Ann!\nadmin\n0:x 1:2 2: \na=1;b=2;"),
+		MakeString("Hello, Bo!\ninactive\nnone\n"),
+	))
+}
+
+func TestTemplateHTML(t *testing.T) {
+	expectProgramToReturn(t, `
+	template := import('template')
+	template.renderHTML('<p title="{{ title }}">{{ body }}</p>{{ raw html }}', {
+		title: 'a "quoted" title'
+		body: 'Tom & Jerry <3'
+		html: '<br>'
+	})
+	`, MakeString(`<p title="a &quot;quoted&quot; title">Tom &amp; Jerry &lt;3</p><br>`))
+}
+
+func TestTemplateErrors(t *testing.T) {
+	expectProgramToReturn(t, `
+	std := import('std')
+	template := import('template')
+	[
+		'{{ if x }}'
+		'{{ end }}'
+		'line\n{{ foo bar }}'
+		'{{ x'
+		'{{ each x of xs }}{{ end }}'
+	] |> with std.map() fn(s) try(fn() template.compile(s)).error
+	`, MakeList(
+		MakeString("Invalid template at line 1: unclosed {{ if }}"),
+		MakeString("Invalid template at line 1: unexpected {{ end }}"),
+		MakeString("Invalid template at line 2: unknown action {{ foo bar }}"),
+		MakeString("Invalid template at line 1: unclosed action"),
+		MakeString("Invalid template at line 1: invalid loop {{ each x of xs }}"),
+	))
+}
+
+func TestMarkdownRender(t *testing.T) {
+	expectProgramToReturn(t, `
+	md := import('md')
+	md.render('## Notes #
+
+Some **bold** and _em_ text, a snake_case_name, and `+"`a < b`"+`.
+See [the site](https://example.com) or <https://oaklang.org>.
+
+3. three
+4. four
+   - nested
+
+`+"```oak"+`
+x := 1 & 2
+`+"```"+`
+
+> quoted
+>
+> > twice')
+	`, MakeString(`<h2>Notes</h2>`+
+		`<p>Some <strong>bold</strong> and <em>em</em> text, a snake_case_name, and <code>a &lt; b</code>. `+
+		`See <a href="https://example.com">the site</a> or <a href="https://oaklang.org">https://oaklang.org</a>.</p>`+
+		`<ol start="3"><li>three</li><li>four<ul><li>nested</li></ul></li></ol>`+
+		`<pre><code data-lang="oak">x := 1 &amp; 2</code></pre>`+
+		`<blockquote><p>quoted</p><blockquote><p>twice</p></blockquote></blockquote>`))
+}
+
+func TestMarkdownTable(t *testing.T) {
+	expectProgramToReturn(t, `
+	md := import('md')
+	md.render('| Name | Count |
+|:-----|------:|
+| a \\| b | *1* |
+| c |')
+	`, MakeString(`<table><thead><tr><th align="left">Name</th><th align="right">Count</th></tr></thead>`+
+		`<tbody><tr><td align="left">a | b</td><td align="right"><em>1</em></td></tr>`+
+		`<tr><td align="left">c</td><td align="right"></td></tr></tbody></table>`))
+}
+
+func TestPathMatchAndRel(t *testing.T) {
+	expectProgramToReturn(t, `
+	path := import('path')
+	[
+		path.match?('src/**/*.oak', 'src/main.oak')
+		path.match?('src/**/*.oak', 'src/lib/std.oak')
+		path.match?('src/*.oak', 'src/lib/std.oak')
+		path.match?('**', 'a/b/c')
+		path.match?('[a-c]?.md', 'b1.md')
+		path.rel('/home/oak', '/home/oak/src/../lib/std.oak')
+		path.rel('/home/oak/src', '/home/lib')
+		path.rel('/home', 'src')
+	]
+	`, MakeList(
+		oakTrue,
+		oakTrue,
+		oakFalse,
+		oakTrue,
+		oakTrue,
+		MakeString("lib/std.oak"),
+		MakeString("../../lib"),
+		null,
+	))
+}
+
+func TestPathGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"src/lib", "src/cmd"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"main.oak", "src/a.oak", "src/lib/b.oak", "src/lib/c.js", "src/cmd/d.oak"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := filepath.ToSlash(dir)
+	expectProgramToReturn(t, fmt.Sprintf(`
+	std := import('std')
+	path := import('path')
+	root := '%s'
+	fn glob(pattern) path.glob(root + pattern) |> std.map(fn(p) p |> std.slice(len(root)))
+	[
+		glob('/src/**/*.oak')
+		glob('/*/lib/*')
+		glob('/**/?.js')
+		glob('/missing/*.oak')
+	]
+	`, root), MakeList(
+		MakeList(MakeString("/src/a.oak"), MakeString("/src/cmd/d.oak"), MakeString("/src/lib/b.oak")),
+		MakeList(MakeString("/src/lib/b.oak"), MakeString("/src/lib/c.js")),
+		MakeList(MakeString("/src/lib/c.js")),
+		MakeList(),
+	))
+}
+
+func TestWalk(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"src/lib", ".git"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"main.oak", "src/a.oak", "src/lib/b.oak", ".git/HEAD"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("oak"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := filepath.ToSlash(dir)
+	expectProgramToReturn(t, fmt.Sprintf(`
+	std := import('std')
+	root := '%s'
+	fn walked(options, action) {
+		entries := []
+		walk(root, options, fn(entry) {
+			// directory sizes depend on the file system
+			size := if entry.type {
+				:file -> entry.len
+			}
+			entries << [entry.path |> std.slice(len(root) + 1), entry.type, size]
+			action(entry)
+		})
+		entries
+	}
+	[
+		walked({}, fn(entry) ?)
+		walked({ hidden: false }, fn(entry) if entry.name {
+			'lib' -> :skip
+		})
+		walked({}, fn(entry) if entry.name {
+			'a.oak' -> :stop
+		})
+		walk(root + '/main.oak', fn(entry) ?).type
+	]
+	`, root), MakeList(
+		MakeList(
+			MakeList(MakeString(".git"), AtomValue("dir"), null),
+			MakeList(MakeString(".git/HEAD"), AtomValue("file"), IntValue(3)),
+			MakeList(MakeString("main.oak"), AtomValue("file"), IntValue(3)),
+			MakeList(MakeString("src"), AtomValue("dir"), null),
+			MakeList(MakeString("src/a.oak"), AtomValue("file"), IntValue(3)),
+			MakeList(MakeString("src/lib"), AtomValue("dir"), null),
+			MakeList(MakeString("src/lib/b.oak"), AtomValue("file"), IntValue(3)),
+		),
+		MakeList(
+			MakeList(MakeString("main.oak"), AtomValue("file"), IntValue(3)),
+			MakeList(MakeString("src"), AtomValue("dir"), null),
+			MakeList(MakeString("src/a.oak"), AtomValue("file"), IntValue(3)),
+			MakeList(MakeString("src/lib"), AtomValue("dir"), null),
+		),
+		MakeList(
+			MakeList(MakeString(".git"), AtomValue("dir"), null),
+			MakeList(MakeString(".git/HEAD"), AtomValue("file"), IntValue(3)),
+			MakeList(MakeString("main.oak"), AtomValue("file"), IntValue(3)),
+			MakeList(MakeString("src"), AtomValue("dir"), null),
+			MakeList(MakeString("src/a.oak"), AtomValue("file"), IntValue(3)),
+		),
+		AtomValue("error"),
+	))
+}
+
+func TestStdioBuffering(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(s *outStream) { stdoutStream = s }(stdoutStream)
+	stdoutStream = &outStream{file: w}
+
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	if _, err := ctx.Eval(strings.NewReader(`
+	out := stdio().out
+	out.buffer(64)
+	print('buffered, ')
+	out.write('then flushed')
+	`)); err != nil {
+		t.Fatalf("Did not expect program to exit with error: %s", err.Error())
+	}
+
+	// nothing has been written yet, so this comes first
+	w.Write([]byte("unbuffered, "))
+	if _, err := ctx.Eval(strings.NewReader(`
+	out.flush()
+	out.buffer(0)
+	print('!')
+	`)); err != nil {
+		t.Fatalf("Did not expect program to exit with error: %s", err.Error())
+	}
+	w.Close()
+
+	output, _ := io.ReadAll(r)
+	if string(output) != "unbuffered, buffered, then flushed!" {
+		t.Errorf("Unexpected output %s", strconv.Quote(string(output)))
+	}
+}
+
+func TestStdioErrors(t *testing.T) {
+	expectProgramToReturn(t, `
+	{ in: in, out: out } := stdio()
+	[
+		[in.name, out.name, stdio().err.name]
+		try(fn() out.buffer(-1)).error
+		try(fn() in.read(0)).error
+		try(fn() out.write(42)).kind
+	]
+	`, MakeList(
+		MakeList(AtomValue("stdin"), AtomValue("stdout"), AtomValue("stderr")),
+		MakeString("Invalid buffer size -1"),
+		MakeString("Cannot read 0 bytes"),
+		AtomValue("typeError"),
+	))
+}
+
+func TestTermKey(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("aé\r\x7f\x1b[A\x1bOD\x1b[3~\x1b[5~\x03\x1bx\x1b[Z\x1b"))
+	expected := []Value{
+		MakeString("a"),
+		MakeString("é"),
+		AtomValue("enter"),
+		AtomValue("backspace"),
+		AtomValue("up"),
+		AtomValue("left"),
+		AtomValue("delete"),
+		AtomValue("pageUp"),
+		MakeString("\x03"),
+		MakeString("\x1bx"),
+		MakeString("\x1b[Z"),
+		AtomValue("escape"),
+	}
+	for _, expect := range expected {
+		key, err := termKey(r)
+		if err != nil {
+			t.Fatalf("Did not expect error reading key: %s", err.Error())
+		}
+		if !key.Eq(expect) {
+			t.Errorf("Expected key %s, got %s", expect, key)
+		}
+	}
+	if _, err := termKey(r); err != io.EOF {
+		t.Errorf("Expected EOF after last key, got %v", err)
+	}
+}
+
+func TestInputPrompt(t *testing.T) {
+	inputReaderInit.Do(initInputReader)
+	defer func(r *bufio.Reader) { inputReader = r }(inputReader)
+	inputReader = bufio.NewReader(strings.NewReader("Ann\nsecret"))
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(s *outStream) { stdoutStream = s }(stdoutStream)
+	stdoutStream = &outStream{file: w}
+
+	// the standard input of tests isn't a terminal, so prompts are printed
+	expectProgramToReturn(t, `
+	[
+		input('name: ')
+		input('password: ', { mask: true })
+		try(fn() input(:prompt)).kind
+	]
+	`, MakeList(
+		ObjectValue{"type": AtomValue("data"), "data": MakeString("Ann")},
+		ObjectValue{"type": AtomValue("error"), "error": MakeString("EOF"), "data": MakeString("secret")},
+		AtomValue("typeError"),
+	))
+	w.Close()
+
+	output, _ := io.ReadAll(r)
+	if string(output) != "name: password: " {
+		t.Errorf("Unexpected output %s", strconv.Quote(string(output)))
+	}
+}
+
+func TestNet(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	// only loopback addresses are used, so the test runs without a network
+	expectProgramToReturn(t, `
+	{
+		lookup: lookup
+		interfaces: interfaces
+		addrs: addrs
+		reachable?: reachable?
+	} := import('net')
+	std := import('std')
+	[
+		lookup('127.0.0.1')
+		interfaces() |> std.some(fn(iface) iface.loopback? & iface.addrs |> std.contains?('127.0.0.1/8'))
+		addrs(true) |> std.contains?('127.0.0.1')
+		addrs() |> std.contains?('127.0.0.1')
+		reachable?('127.0.0.1', `+strconv.Itoa(port)+`, 0.5)
+	]
+	`, MakeList(
+		MakeList(MakeString("127.0.0.1")),
+		oakTrue,
+		oakTrue,
+		oakFalse,
+		oakFalse,
+	))
+
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port = listener.Addr().(*net.TCPAddr).Port
+
+	expectProgramToReturn(t, `
+	net := import('net')
+	[
+		type(net.hostname())
+		type(net.ping('127.0.0.1', `+strconv.Itoa(port)+`))
+		try(fn() net.ping('127.0.0.1', 'http')).kind
+	]
+	`, MakeList(AtomValue("string"), AtomValue("float"), AtomValue("typeError")))
+}
+
+func TestUDP(t *testing.T) {
+	freePort := func() int {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	serverAddr := fmt.Sprintf("127.0.0.1:%d", freePort())
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+
+	_, err = ctx.Eval(strings.NewReader(fmt.Sprintf(`
+	received := []
+	close := udpListen('%s', fn(evt) if evt.type {
+		:data -> {
+			received << evt.data
+			evt.reply('ack ' + evt.data)
+			if evt.data = 'bye' -> close()
+		}
+	})
+	sent := udpSend('%s', 'hello')
+	failed := udpListen('%s', fn {}).type
+	`, serverAddr, peer.LocalAddr(), serverAddr)))
+	if err != nil {
+		t.Fatalf("Did not expect udpListen() to return an error: %s", err.Error())
+	}
+
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, _, err := peer.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("Expected udpSend() to send hello, got %s (%v)", strconv.Quote(string(buf[:n])), err)
+	}
+
+	server, _ := net.ResolveUDPAddr("udp", serverAddr)
+	for _, msg := range []string{"one", "bye"} {
+		peer.WriteTo([]byte(msg), server)
+		n, _, err := peer.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != "ack "+msg {
+			t.Errorf("Expected reply to %s, got %s (%v)", msg, strconv.Quote(string(buf[:n])), err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ctx.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("UDP socket was not closed")
+	}
+
+	for name, expected := range map[string]Value{
+		"received": MakeList(MakeString("one"), MakeString("bye")),
+		"sent":     ObjectValue{"type": AtomValue("end")},
+		"failed":   AtomValue("error"),
+	} {
+		val, _ := ctx.scope.get(name)
+		if !val.Eq(expected) {
+			t.Errorf("Expected %s to be %s, got %s", name, expected, val)
+		}
+	}
+}
+
+func TestMailSend(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	// a minimal SMTP server, which accepts one message without TLS or AUTH
+	type delivery struct {
+		from string
+		rcpt []string
+		data string
+	}
+	delivered := make(chan delivery, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var d delivery
+		r := bufio.NewReader(conn)
+		reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+		reply("220 localhost")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250 localhost")
+			case strings.HasPrefix(line, "MAIL FROM:"):
+				d.from = strings.TrimPrefix(line, "MAIL FROM:")
+				reply("250 OK")
+			case strings.HasPrefix(line, "RCPT TO:"):
+				d.rcpt = append(d.rcpt, strings.TrimPrefix(line, "RCPT TO:"))
+				reply("250 OK")
+			case line == "DATA":
+				reply("354 Go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				d.data = data.String()
+				reply("250 OK")
+			case line == "QUIT":
+				reply("221 Bye")
+				delivered <- d
+				return
+			default:
+				reply("500 Unknown command")
+			}
+		}
+	}()
+
+	expectProgramToReturn(t, fmt.Sprintf(`
+	mail := import('mail')
+	mail.send({
+		host: '127.0.0.1'
+		port: %d
+		from: 'Alerts <alerts@example.com>'
+		to: 'ops@example.com'
+		bcc: ['audit@example.com']
+		subject: 'Disk usage ⚠'
+		body: 'See the attached report.'
+		attachments: [{ name: 'report.csv', data: 'host,used\nweb1,93%%\n', type: 'text/csv' }]
+	})
+	`, port), ObjectValue{"type": AtomValue("end")})
+
+	var d delivery
+	select {
+	case d = <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Mail was not delivered")
+	}
+
+	if d.from != "<alerts@example.com>" {
+		t.Errorf("Unexpected sender %s", d.from)
+	}
+	if strings.Join(d.rcpt, " ") != "<ops@example.com> <audit@example.com>" {
+		t.Errorf("Unexpected recipients %v", d.rcpt)
+	}
+	for _, expected := range []string{
+		"From: Alerts <alerts@example.com>\r\n",
+		"To: ops@example.com\r\n",
+		"Subject: =?utf-8?q?Disk_usage_=E2=9A=A0?=\r\n",
+		"Content-Type: multipart/mixed; boundary=",
+		"See the attached report.",
+		`Content-Disposition: attachment; filename=report.csv`,
+		"Content-Type: text/csv\r\n",
+		"aG9zdCx1c2VkCndlYjEsOTMlCg==",
+	} {
+		if !strings.Contains(d.data, expected) {
+			t.Errorf("Expected message to contain %s, got\n%s", strconv.Quote(expected), d.data)
+		}
+	}
+	if strings.Contains(d.data, "audit@example.com") {
+		t.Errorf("Expected Bcc to be left out of message, got\n%s", d.data)
+	}
+}
+
+func TestMailErrors(t *testing.T) {
+	expectProgramToReturn(t, `
+	mail := import('mail')
+	[
+		try(fn() mail.message({ from: 'a@example.com', subject: 'hi' })).kind
+		try(fn() mail.message({ from: 'a@example.com', to: [1] })).kind
+		try(fn() mail.message({ from: 'a@example.com', to: 'b@example.com', attachments: ['/nonexistent'] })).kind
+		mail.send({ host: '127.0.0.1', port: 1, from: 'a@example.com', to: 'b@example.com' }).type
+		mail.send({ host: '127.0.0.1', port: 1, from: 'not an address', to: 'b@example.com' }).type
+	]
+	`, MakeList(
+		AtomValue("valueError"),
+		AtomValue("typeError"),
+		AtomValue("ioError"),
+		AtomValue("error"),
+		AtomValue("error"),
+	))
+}
+
+func TestCryptoHMAC(t *testing.T) {
+	expectProgramToReturn(t, `
+	std := import('std')
+	str := import('str')
+	crypto := import('crypto')
+	fn hex(s) s |> std.map(fn(c) std.toHex(codepoint(c)) |> str.padStart(2, '0'))
+	msg := 'The quick brown fox jumps over the lazy dog'
+	[
+		hex(crypto.hmac('key', msg))
+		hex(crypto.hmac('key', msg, :sha1))
+		crypto.equal?('abc', 'abc')
+		crypto.equal?('abc', 'abd')
+		crypto.equal?('abc', 'ab')
+		try(fn() crypto.hmac('key', msg, :md5)).kind
+	]
+	`, MakeList(
+		MakeString("f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"),
+		MakeString("de7c9b85b8b78aa6bc8a7a36f70a90701c9db4d9"),
+		oakTrue,
+		oakFalse,
+		oakFalse,
+		AtomValue("valueError"),
+	))
+}
+
+func TestHTTPS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "client certs: %d", len(r.TLS.PeerCertificates))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	// the test server's certificate, for 127.0.0.1, doubles as the CA that
+	// signed it and as a client certificate
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	cert := server.TLS.Certificates[0]
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("Could not marshal test server key: %s", err.Error())
+	}
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	program := func(source string) string {
+		return strings.NewReplacer(
+			"URL", server.URL,
+			"CERT", certPath,
+			"KEY", keyPath,
+		).Replace(source)
+	}
+
+	// relative paths to certificates are relative to the program's root
+	ctx := NewContext(dir)
+	ctx.LoadBuiltins()
+	val, rtErr := ctx.Eval(strings.NewReader(program(`[
+		req({ url: 'URL' }).type
+		req({ url: 'URL', tls: { ca: 'CERT' } }).resp.body
+		req({ url: 'URL', tls: { insecure: true } }).resp.body
+		req({ url: 'URL', tls: { ca: 'cert.pem', cert: 'CERT', key: 'key.pem' } }).resp.body
+		req({ url: 'URL', tls: { ca: 'CERT', cert: 'CERT' } }).type
+		try(fn() req({ url: 'URL', tls: { insecure: 'yes' } })).kind
+	]`)))
+	if rtErr != nil {
+		t.Fatalf("Did not expect req to return an error: %s", rtErr.Error())
+	}
+	expected := MakeList(
+		AtomValue("error"),
+		MakeString("client certs: 0"),
+		MakeString("client certs: 0"),
+		MakeString("client certs: 1"),
+		AtomValue("error"),
+		AtomValue("typeError"),
+	)
+	if !val.Eq(expected) {
+		t.Errorf("Expected %s from HTTPS requests, got %s", expected, val)
+	}
+
+	// serving HTTPS with listen()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not find a free port: %s", err.Error())
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	if _, rtErr := ctx.Eval(strings.NewReader(program(strings.ReplaceAll(`
+	results := {}
+	close := listen('ADDR', { cert: 'cert.pem', key: 'KEY' }, fn(evt) if evt.type {
+		:req -> evt.end({ status: 200, headers: {}, body: 'served ' + evt.req.url })
+	})
+	`, "ADDR", addr)))); rtErr != nil {
+		t.Fatalf("Did not expect listen to return an error: %s", rtErr.Error())
+	}
+	for i := 0; ; i++ {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("HTTPS server did not start: %s", err.Error())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, rtErr := ctx.Eval(strings.NewReader(program(strings.ReplaceAll(`
+	req({ url: 'https://ADDR/hello', tls: { ca: 'CERT' } }, fn(evt) {
+		results.served := evt.resp.body
+		close()
+	})
+	`, "ADDR", addr)))); rtErr != nil {
+		t.Fatalf("Did not expect req to return an error: %s", rtErr.Error())
+	}
+	ctx.Wait()
+
+	results, rtErr := ctx.Eval(strings.NewReader(`results`))
+	if rtErr != nil {
+		t.Fatalf("Did not expect program to return an error: %s", rtErr.Error())
+	}
+	served := ObjectValue{"served": MakeString("served /hello")}
+	if !results.Eq(served) {
+		t.Errorf("Expected %s from HTTPS server, got %s", served, results)
+	}
+
+	_, rtErr = ctx.Eval(strings.NewReader(`listen('127.0.0.1:0', { autocert: 'certs' }, fn {})`))
+	if rtErr == nil || !strings.Contains(rtErr.Error(), "does not support autocert") {
+		t.Errorf("Expected listen() to reject autocert, got %v", rtErr)
+	}
+}
+
+func TestHTTPSessions(t *testing.T) {
+	expectProgramToReturn(t, `
+	std := import('std')
+	str := import('str')
+	http := import('http')
+
+	// the cookie a response sets, as a request would send it back
+	fn request(resp) {
+		header := resp.headers.('Set-Cookie')
+		{ headers: { Cookie: header |> str.cut(';') |> std.first() } }
+	}
+
+	sessions := http.Sessions('secret')
+	saved := sessions.save({ status: 200 }, { user: 'ann' })
+	req := request(saved)
+	tampered := { headers: { Cookie: req.headers.Cookie |> str.replace('ann', 'bob') } }
+	expired := request(http.Sessions('secret', { maxAge: -10 }).save({}, { user: 'ann' }))
+	[
+		sessions.load(req)
+		http.Sessions('other secret').load(req)
+		sessions.load(tampered)
+		sessions.load(expired)
+		sessions.load({ headers: { Cookie: 'session=nonsense' } })
+		sessions.load({ headers: {} })
+		sessions.clear({}).headers.('Set-Cookie')
+	]
+	`, MakeList(
+		ObjectValue{"user": MakeString("ann")},
+		null,
+		null,
+		null,
+		null,
+		null,
+		MakeString("session=; Path=/; Max-Age=0; HttpOnly; SameSite=Lax"),
+	))
+}
+
+func TestHTTPParseForm(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("name", "Ann")
+	mw.WriteField("tag", "a")
+	mw.WriteField("tag", "b")
+	small, _ := mw.CreateFormFile("avatar", "me.png")
+	small.Write([]byte("\x89PNG"))
+	large, _ := mw.CreateFormFile("log", "server.log")
+	large.Write([]byte(strings.Repeat("line\n", 10)))
+	mw.Close()
+
+	dir := t.TempDir()
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	ctx.scope.put("body", MakeString(body.String()))
+	ctx.scope.put("contentType", MakeString(mw.FormDataContentType()))
+	ctx.scope.put("dir", MakeString(dir))
+
+	val, err := ctx.Eval(strings.NewReader(`
+	http := import('http')
+	form := http.parseForm({
+		headers: { 'Content-Type': contentType }
+		body: body
+	}, { maxMemory: 16, dir: dir })
+	logFile := form.files.log
+	form.files.log := ?
+	[
+		form
+		logFile.filename
+		logFile.size
+		logFile.data
+		http.parseForm({
+			headers: { 'Content-Type': 'application/x-www-form-urlencoded' }
+			body: 'q=oak+lang&page=2&page=3'
+		})
+		http.parseForm({ headers: { 'Content-Type': 'text/plain' }, body: 'q=1' })
+		http.parseForm({ headers: { 'Content-Type': contentType }, body: 'oops' })
+	]
+	`))
+	if err != nil {
+		t.Fatalf("Did not expect parseForm() to return an error: %s", err.Error())
+	}
+
+	expected := MakeList(
+		ObjectValue{
+			"fields": ObjectValue{
+				"name": MakeString("Ann"),
+				"tag":  MakeList(MakeString("a"), MakeString("b")),
+			},
+			"files": ObjectValue{
+				"avatar": ObjectValue{
+					"filename": MakeString("me.png"),
+					"type":     MakeString("application/octet-stream"),
+					"size":     IntValue(4),
+					"data":     MakeString("\x89PNG"),
+				},
+				"log": null,
+			},
+		},
+		MakeString("server.log"),
+		IntValue(50),
+		null,
+		ObjectValue{
+			"fields": ObjectValue{
+				"q":    MakeString("oak lang"),
+				"page": MakeList(MakeString("2"), MakeString("3")),
+			},
+			"files": ObjectValue{},
+		},
+		null,
+		null,
+	)
+	if !val.Eq(expected) {
+		t.Errorf("Expected %s, got %s", expected, val)
+	}
+
+	// large files are written to temporary files in the given directory
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("Expected one temporary file, got %d", len(entries))
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	if string(data) != strings.Repeat("line\n", 10) {
+		t.Errorf("Unexpected temporary file contents %s", strconv.Quote(string(data)))
+	}
+}
+
+func TestGetPackages(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	// a package repository with two tagged versions
+	repo := t.TempDir()
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", repo,
+			"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s failed: %s", strings.Join(args, " "), out)
+		}
+	}
+	git("init", "--quiet")
+	os.WriteFile(filepath.Join(repo, "main.oak"), []byte("helper := import('./helper')\nfn greet(name) helper.prefix + name\n"), 0644)
+	os.WriteFile(filepath.Join(repo, "helper.oak"), []byte("prefix := 'hello, '\n"), 0644)
+	git("add", ".")
+	git("commit", "--quiet", "-m", "v1")
+	git("tag", "v1.0.0")
+	os.WriteFile(filepath.Join(repo, "helper.oak"), []byte("prefix := 'hi, '\n"), 0644)
+	git("commit", "--quiet", "-am", "v2")
+	git("tag", "v2.0.0")
+
+	defer func(f func(string) string) { pkgRepoURL = f }(pkgRepoURL)
+	pkgRepoURL = func(modPath string) string {
+		if modPath == "example.com/user/greeter" {
+			return repo
+		}
+		return filepath.Join(repo, "nonexistent")
+	}
+
+	project := t.TempDir()
+	var logs []string
+	log := func(msg string) { logs = append(logs, msg) }
+	if err := getPackages(project, []string{"example.com/user/greeter@v1.0.0"}, log); err != nil {
+		t.Fatalf("Could not get package: %s", err)
+	}
+
+	manifest, _ := os.ReadFile(filepath.Join(project, "oak.pkg"))
+	if !strings.Contains(string(manifest), "\nexample.com/user/greeter v1.0.0\n") {
+		t.Errorf("Unexpected manifest %s", manifest)
+	}
+	if _, err := os.Stat(filepath.Join(project, "libs/example.com/user/greeter/.git")); err == nil {
+		t.Errorf("Expected package to be fetched without its git directory")
+	}
+
+	// packages are imported by name or module path, from anywhere under the
+	// manifest, and can import their own files
+	os.MkdirAll(filepath.Join(project, "src"), 0755)
+	ctx := NewContext(filepath.Join(project, "src"))
+	ctx.LoadBuiltins()
+	val, err := ctx.Eval(strings.NewReader(`[
+		import('greeter').greet('Ann')
+		import('example.com/user/greeter').greet('Bob')
+		try(fn() import('nothing')).kind
+	]`))
+	if err != nil {
+		t.Fatalf("Could not import package: %s", err)
+	}
+	expected := MakeList(MakeString("hello, Ann"), MakeString("hello, Bob"), AtomValue("importError"))
+	if !val.Eq(expected) {
+		t.Errorf("Expected %s, got %s", expected, val)
+	}
+
+	// a changed version of the same package doesn't match the lockfile
+	git("tag", "-f", "v1.0.0")
+	os.RemoveAll(filepath.Join(project, "libs"))
+	if err := getPackages(project, nil, log); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Expected a checksum mismatch, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(project, "libs/example.com/user/greeter")); err == nil {
+		t.Errorf("Expected a package with a checksum mismatch not to be installed")
+	}
+
+	if err := getPackages(project, []string{"example.com/user/greeter@v2.0.0"}, log); err != nil {
+		t.Fatalf("Could not update package: %s", err)
+	}
+	lock, _ := os.ReadFile(filepath.Join(project, "oak.lock"))
+	if strings.Contains(string(lock), "v1.0.0") || !strings.Contains(string(lock), "example.com/user/greeter v2.0.0 sha256:") {
+		t.Errorf("Unexpected lockfile %s", lock)
+	}
+
+	for _, bad := range []string{"example.com/user/greeter", "greeter@v1", "example.com/../x@v1", "example.com/user/missing@v1"} {
+		if err := getPackages(project, []string{bad}, log); err == nil {
+			t.Errorf("Expected oak get %s to fail", bad)
+		}
+	}
+}
+
+func TestReadPkgManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "oak.pkg")
+	os.WriteFile(manifest, []byte("# packages\nexample.com/user/lib v1.0.0\n\nexample.com/other v2\n"), 0644)
+	reqs, err := readPkgManifest(dir)
+	if err != nil {
+		t.Fatalf("Could not read manifest: %s", err)
+	}
+	if len(reqs) != 2 || reqs[0].String() != "example.com/user/lib@v1.0.0" || reqs[1].String() != "example.com/other@v2" {
+		t.Errorf("Unexpected requirements %v", reqs)
+	}
+
+	for _, bad := range []string{
+		"../../etc v1",
+		"example.com/../../x v1",
+		"example.com/user/.. v1",
+		"/abs/path v1",
+		"example.com//lib v1",
+		"example.com/./lib v1",
+		"lib v1",
+		`example.com\..\x v1`,
+		"C:/x/y v1",
+		"example.com/lib",
+	} {
+		os.WriteFile(manifest, []byte(bad+"\n"), 0644)
+		if _, err := readPkgManifest(dir); err == nil {
+			t.Errorf("Expected manifest line %q to be invalid", bad)
+		}
+	}
+}
+
+func TestRemoteImports(t *testing.T) {
+	modules := map[string]string{
+		"/lib/greet.oak":  "helper := import('./helper')\nfn greet(name) helper.prefix + name\n",
+		"/lib/helper.oak": "prefix := 'hello, '\n",
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		source, ok := modules[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(source))
+	}))
+	defer server.Close()
+
+	t.Setenv("OAK_CACHE_DIR", t.TempDir())
+	project := t.TempDir()
+	os.WriteFile(filepath.Join(project, "oak.lock"), nil, 0644)
+
+	importGreet := func() (Value, error) {
+		ctx := NewContext(project)
+		ctx.LoadBuiltins()
+		return ctx.Eval(strings.NewReader(`[
+			import('` + server.URL + `/lib/greet.oak').greet('Ann')
+			try(fn() import('` + server.URL + `/lib/missing.oak')).kind
+		]`))
+	}
+
+	// remote modules and their relative imports are fetched, and pinned in
+	// the lockfile
+	val, err := importGreet()
+	if err != nil {
+		t.Fatalf("Could not import remote module: %s", err)
+	}
+	expected := MakeList(MakeString("hello, Ann"), AtomValue("importError"))
+	if !val.Eq(expected) {
+		t.Errorf("Expected %s, got %s", expected, val)
+	}
+	lock, _ := os.ReadFile(filepath.Join(project, "oak.lock"))
+	if !strings.Contains(string(lock), server.URL+"/lib/greet.oak sha256:") ||
+		!strings.Contains(string(lock), server.URL+"/lib/helper.oak sha256:") {
+		t.Errorf("Unexpected lockfile %s", lock)
+	}
+
+	// cached modules are imported offline
+	defer func() { remoteOffline = false }()
+	remoteOffline = true
+	requests = 0
+	if val, err = importGreet(); err != nil || !val.Eq(expected) {
+		t.Errorf("Expected %s offline, got %s, %v", expected, val, err)
+	}
+	if requests != 0 {
+		t.Errorf("Expected no requests offline, got %d", requests)
+	}
+	remoteOffline = false
+
+	// a module that changed on the server doesn't match the lockfile
+	t.Setenv("OAK_CACHE_DIR", t.TempDir())
+	modules["/lib/helper.oak"] = "prefix := 'hi, '\n"
+	if _, err := importGreet(); err == nil || !strings.Contains(err.Error(), "integrity check failed") {
+		t.Errorf("Expected an integrity check failure, got %v", err)
+	}
+}
+
+func TestModuleExports(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "private.oak"), []byte("fn helper(x) x * 2\nfn double(x) helper(x)\nexport := { double: double }\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "public.oak"), []byte("fn helper(x) x * 2\nfn double(x) helper(x)\n"), 0644)
+
+	ctx := NewContext(dir)
+	ctx.LoadBuiltins()
+	val, err := ctx.Eval(strings.NewReader(`
+	priv := import('private')
+	pub := import('public')
+	[priv.double(2), priv.helper, keys(import('private')), pub.helper(3)]
+	`))
+	if err != nil {
+		t.Fatalf("Could not import modules: %s", err)
+	}
+	expected := MakeList(IntValue(4), null, MakeList(MakeString("double")), IntValue(6))
+	if !val.Eq(expected) {
+		t.Errorf("Expected %s, got %s", expected, val)
+	}
+}
+
+func TestImportResolution(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"app/main.oak":         "",
+		"app/lib.oak":          "name := 'lib'\n",
+		"app/both/main.oak":    "name := 'both/main'\n",
+		"app/both/index.oak":   "name := 'both/index'\n",
+		"app/index/index.oak":  "name := 'index'\n",
+		"shared/util.oak":      "name := 'util'\n",
+		"shared/nested/up.oak": "name := import('../util').name + '/up'\n",
+	}
+	for name, source := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		os.WriteFile(filepath.Join(dir, name), []byte(source), 0644)
+	}
+
+	ctx := NewContext(filepath.Join(dir, "app"))
+	ctx.LoadBuiltins()
+	ctx.scope.put("abs", MakeString(filepath.Join(dir, "shared", "util")))
+	val, err := ctx.Eval(strings.NewReader(`[
+		import('lib').name
+		import('./lib').name
+		import('./both').name
+		import('index').name
+		import('../shared/nested/up').name
+		import(abs).name
+	]`))
+	if err != nil {
+		t.Fatalf("Could not import modules: %s", err)
+	}
+	expected := MakeList(
+		MakeString("lib"),
+		MakeString("lib"),
+		MakeString("both/main"),
+		MakeString("index"),
+		MakeString("util/up"),
+		MakeString("util"),
+	)
+	if !val.Eq(expected) {
+		t.Errorf("Expected %s, got %s", expected, val)
+	}
+
+	// a module that can't be found is reported with every path tried
+	val, err = ctx.Eval(strings.NewReader(`try(fn() import('./missing'))`))
+	if err != nil {
+		t.Fatalf("Could not evaluate import: %s", err)
+	}
+	result := val.(ObjectValue)
+	missing := filepath.Join(dir, "app", "missing")
+	tried := MakeList(
+		MakeString(missing+".oak"),
+		MakeString(filepath.Join(missing, "main.oak")),
+		MakeString(filepath.Join(missing, "index.oak")),
+	)
+	if !result["kind"].Eq(AtomValue("importError")) || !result["data"].(ObjectValue)["tried"].Eq(tried) {
+		t.Errorf("Expected an import error trying %s, got %s", tried, val)
+	}
+	if message := result["error"].(*StringValue).stringContent(); !strings.Contains(message, "Could not find module ./missing") {
+		t.Errorf("Unexpected error message %s", message)
+	}
+}
+
+func TestLazyImport(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "heavy.oak"), []byte("fn work() 'done'\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "broken.oak"), []byte("raise(:valueError, 'broken')\n"), 0644)
+
+	ctx := NewContext(dir)
+	ctx.LoadBuiltins()
+	if _, err := ctx.Eval(strings.NewReader(`heavy := lazyImport('./heavy')`)); err != nil {
+		t.Fatalf("Could not evaluate lazy import: %s", err)
+	}
+	if _, ok := ctx.eng.importMap[filepath.Join(dir, "heavy.oak")]; ok {
+		t.Errorf("Expected lazy import not to load the module before it's called")
+	}
+
+	val, err := ctx.Eval(strings.NewReader(`
+	name := 'heav' + 'y'
+	[heavy().work(), heavy() = import('./' + name), lazyImport('./sqlite')()]
+	`))
+	if err != nil {
+		t.Fatalf("Could not evaluate lazy imports: %s", err)
+	}
+	expected := MakeList(MakeString("done"), BoolValue(true), null)
+	if !val.Eq(expected) {
+		t.Errorf("Expected %s, got %s", expected, val)
+	}
+
+	// errors other than missing modules aren't hidden
+	val, err = ctx.Eval(strings.NewReader(`try(fn() lazyImport('./broken')()).kind`))
+	if err != nil {
+		t.Fatalf("Could not evaluate lazy import: %s", err)
+	}
+	if !val.Eq(AtomValue("valueError")) {
+		t.Errorf("Expected a valueError from a broken module, got %s", val)
+	}
+}
+
+func TestASTCache(t *testing.T) {
+	for name, program := range stdlibs {
+		tokenizer := newTokenizer(program)
+		parser := newParser(tokenizer.tokenize())
+		nodes, err := parser.parse()
+		if err != nil {
+			t.Fatalf("Could not parse %s: %s", name, err)
+		}
+		encoded := appendNodes(nil, nodes)
+		d := astDecoder{data: encoded}
+		decoded, err := d.nodes()
+		if err != nil {
+			t.Fatalf("Could not decode syntax tree of %s: %s", name, err)
+		}
+		// nodes only keep the positions of their tokens, so trees are compared
+		// by their source and their encodings, which include positions
+		if fmt.Sprint(decoded) != fmt.Sprint(nodes) || !bytes.Equal(appendNodes(nil, decoded), encoded) {
+			t.Errorf("Decoded syntax tree of %s does not match the parsed one", name)
+		}
+	}
+
+	cacheDir := t.TempDir()
+	t.Setenv("OAK_CACHE_DIR", cacheDir)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "big.oak"), []byte(strings.Repeat("// padding\n", 100)+"fn answer() 6 * 7\n"), 0644)
+
+	importAnswer := func() {
+		t.Helper()
+		ctx := NewContext(dir)
+		ctx.LoadBuiltins()
+		val, err := ctx.Eval(strings.NewReader(`import('./big').answer()`))
+		if err != nil {
+			t.Fatalf("Could not import cached module: %s", err)
+		}
+		if !val.Eq(IntValue(42)) {
+			t.Errorf("Expected 42 from cached module, got %s", val)
+		}
+	}
+	cacheFiles := func() []string {
+		t.Helper()
+		files, _ := filepath.Glob(filepath.Join(cacheDir, "oakc", "*.oakc"))
+		return files
+	}
+
+	importAnswer()
+	files := cacheFiles()
+	if len(files) != 1 {
+		t.Fatalf("Expected one cached module, got %d", len(files))
+	}
+	importAnswer()
+
+	// a corrupted cache file is parsed again and replaced
+	os.WriteFile(files[0], []byte{astCacheVersion, astFnCall, 0xff}, 0644)
+	importAnswer()
+	if _, ok := readASTCache(files[0]); !ok {
+		t.Errorf("Expected corrupted cache file to be replaced")
+	}
+
+	os.RemoveAll(filepath.Join(cacheDir, "oakc"))
+	astCacheDisabled = true
+	defer func() { astCacheDisabled = false }()
+	importAnswer()
+	if files := cacheFiles(); len(files) != 0 {
+		t.Errorf("Expected no cached modules with the cache disabled, got %d", len(files))
+	}
+}
+
+func TestPruneASTCache(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	write := func(name string, age time.Duration) {
+		filePath := filepath.Join(dir, name)
+		os.WriteFile(filePath, nil, 0644)
+		os.Chtimes(filePath, now.Add(-age), now.Add(-age))
+	}
+	for i := 0; i < astCacheMaxFiles+2; i++ {
+		write(fmt.Sprintf("%d.oakc", i), time.Duration(i)*time.Minute)
+	}
+	write("stale.oakc", astCacheMaxAge+time.Hour)
+
+	pruneASTCache(dir)
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != astCacheMaxFiles {
+		t.Errorf("Expected %d cache files to be kept, got %d", astCacheMaxFiles, len(entries))
+	}
+	for _, name := range []string{fmt.Sprintf("%d.oakc", astCacheMaxFiles), "stale.oakc"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("Expected %s to be pruned", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "0.oakc")); err != nil {
+		t.Errorf("Expected the newest cache file to be kept")
+	}
+}
+
+func TestCrossRuntime(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test uses a shell script in place of go")
+	}
+
+	exe, _ := os.Executable()
+	if interp, err := crossRuntime("", ""); err != nil || interp != exe {
+		t.Errorf("Expected running interpreter %s for this platform, got %s, %v", exe, interp, err)
+	}
+
+	// a stand-in for the go command, which records how it was run
+	binDir := t.TempDir()
+	os.WriteFile(filepath.Join(binDir, "go"), []byte(`#!/bin/sh
+case "$1" in
+env) echo "$HOME/modcache" ;;
+install)
+	if [ "$GOOS" = "nope" ]; then
+		echo "unsupported GOOS/GOARCH pair nope/$GOARCH"
+		exit 2
+	fi
+	mkdir -p "$GOPATH/bin/${GOOS}_$GOARCH"
+	echo "$GOOS $GOARCH $2 $CGO_ENABLED" > "$GOPATH/bin/${GOOS}_$GOARCH/oak"
+	;;
+esac
+`), 0755)
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	cacheDir := t.TempDir()
+	t.Setenv("OAK_CACHE_DIR", cacheDir)
+
+	interp, err := crossRuntime("plan9", "arm")
+	if err != nil {
+		t.Fatalf("Could not build interpreter: %s", err)
+	}
+	if filepath.Dir(interp) != filepath.Join(cacheDir, "runtimes") {
+		t.Errorf("Expected interpreter to be cached, got %s", interp)
+	}
+	modPath, version := oakBuildVersion()
+	content, _ := os.ReadFile(interp)
+	if expected := fmt.Sprintf("plan9 arm %s@%s 0\n", modPath, version); string(content) != expected {
+		t.Errorf("Expected interpreter built as %q, got %q", expected, content)
+	}
+
+	if _, err := crossRuntime("nope", "arm"); err == nil || !strings.Contains(err.Error(), "unsupported GOOS/GOARCH pair") {
+		t.Errorf("Expected error from go for an unsupported platform, got %v", err)
+	}
+}
+
+func TestWasmBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Building for WebAssembly is slow")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("Building for WebAssembly requires go")
+	}
+
+	// code that only runs on native platforms must be kept out of the
+	// WebAssembly build with build tags
+	cmd := exec.Command("go", "build", "-o", filepath.Join(t.TempDir(), "oak.wasm"), ".")
+	cmd.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Could not build for WebAssembly: %s\n%s", err, out)
+	}
+}
+
+func TestDomUnavailable(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+
+	_, err := ctx.Eval(strings.NewReader(`
+	dom := import('dom')
+	dom.query('#app')
+	`))
+	if err == nil || !strings.Contains(err.Error(), "only available in JavaScript and WebAssembly") {
+		t.Errorf("Expected dom to be unavailable natively, got %v", err)
+	}
+}
+
+func TestFFI(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+
+	_, err := ctx.Eval(strings.NewReader(`ffi := import('ffi'), libc := ffi.open(?)`))
+	if err != nil {
+		if !strings.Contains(err.Error(), "built with -tags ffi") {
+			t.Errorf("Expected ffi to need -tags ffi, got %s", err.Error())
+		}
+		return
+	}
+
+	val, err := ctx.Eval(strings.NewReader(`
+	strlen := ffi.bind(libc, 'strlen', :int, [:string])
+	abs := ffi.bind(libc, 'abs', :int32, [:int32])
+	malloc := ffi.bind(libc, 'malloc', :pointer, [:int])
+	free := ffi.bind(libc, 'free', :void, [:pointer])
+	buf := malloc(8)
+	[strlen('hello'), abs(-42), type(buf), free(buf)]
+	`))
+	if err != nil {
+		t.Fatalf("Did not expect C calls to return an error: %s", err.Error())
+	}
+	expected := MakeList(IntValue(5), IntValue(42), AtomValue("pointer"), null)
+	if !val.Eq(expected) {
+		t.Errorf("Expected %s from C calls, got %s", expected, val)
+	}
+
+	_, err = ctx.Eval(strings.NewReader(`strlen(5)`))
+	if err == nil || !strings.Contains(err.Error(), "expected string for argument 0") {
+		t.Errorf("Expected type error calling C, got %v", err)
+	}
+}
+
+func TestRPCServer(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+
+	val, err := ctx.Eval(strings.NewReader(`
+	rpc := import('rpc')
+	results := []
+	server := rpc.serve('127.0.0.1:9918', {
+		add: fn(a, b) a + b
+		fail: fn { raise(:rpc, 'bad', { code: 42 }) }
+	})
+	client := rpc.connect('127.0.0.1:9918')
+	client.call('add', [40, 2], fn(res) {
+		results << res
+		client.call('fail', [], fn(res) {
+			results << [res.code, res.error]
+			client.close()
+			server()
+		})
+	})
+	results
+	`))
+	if err != nil {
+		t.Fatalf("Did not expect rpc to return an error: %s", err.Error())
+	}
+	ctx.Wait()
+
+	expected := MakeList(
+		ObjectValue{"type": AtomValue("result"), "result": IntValue(42)},
+		MakeList(IntValue(42), MakeString("bad")),
+	)
+	if !val.Eq(expected) {
+		t.Errorf("Expected %s from rpc calls, got %s", expected, val)
+	}
+}
+
+func TestTransformNode(t *testing.T) {
+	tokenizer := newTokenizer("a := 2\nb := 3\n[a + a, { a: a }, (fn { a })(), if a { 3 -> a }]")
+	parser := newParser(tokenizer.tokenize())
+	nodes, err := parser.parse()
+	if err != nil {
+		t.Fatalf("Did not expect parse error: %s", err.Error())
+	}
+
+	// every reference to a, but not its definition or the key in the object,
+	// becomes a reference to b
+	for i, node := range nodes[2:] {
+		nodes[i+2] = transformNode(node, func(node astNode) astNode {
+			if ident, ok := node.(identifierNode); ok && ident.payload == "a" {
+				ident.payload = "b"
+				return ident
+			}
+			if obj, ok := node.(objectNode); ok {
+				obj.entries[0].key = identifierNode{payload: "a", tok: obj.tok}
+				return obj
+			}
+			return nil
+		})
+	}
+
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	val, err := ctx.evalParsed(nodes)
+	if err != nil {
+		t.Fatalf("Did not expect runtime error: %s", err.Error())
+	}
+	expected := MakeList(
+		IntValue(6),
+		ObjectValue{"a": IntValue(3)},
+		IntValue(3),
+		IntValue(3),
+	)
+	if !val.Eq(expected) {
+		t.Errorf("Expected transformed program to return %s, got %s", expected, val)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	program := `
+fn fib(n) if n < 2 {
+	true -> n
+	_ -> fib(n - 1) + fib(n - 2)
+}
+fn count(i) if i > 0 -> count(i - 1)
+fib(2)
+count(2)
+(fn(xs...) len(xs))(1, 2)
+`
+	out := bytes.Buffer{}
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	ctx.SetTrace(&out, nil)
+	if _, err := ctx.Eval(strings.NewReader(program)); err != nil {
+		t.Fatalf("Did not expect program to return an error: %s", err.Error())
+	}
+
+	expected := `> fib(2)
+  > fib(1)
+  < fib(1) = 1
+  > fib(0)
+  < fib(0) = 0
+< fib(2) = 1
+> count(2)
+> count(1)
+> count(0)
+< count(0) = ?
+> fn [9:2](1, 2)
+< fn [9:2](1, 2) = 2
+`
+	if out.String() != expected {
+		t.Errorf("Expected trace\n%s\ngot\n%s", expected, out.String())
+	}
+
+	// a pattern traces only the functions it matches
+	out.Reset()
+	ctx.SetTrace(&out, regexp.MustCompile("^co"))
+	if _, err := ctx.Eval(strings.NewReader("fib(1), count(0)")); err != nil {
+		t.Fatalf("Did not expect program to return an error: %s", err.Error())
+	}
+	if expected := "> count(0)\n< count(0) = ?\n"; out.String() != expected {
+		t.Errorf("Expected trace\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+func TestRuntimeHeap(t *testing.T) {
+	ctx := NewContext("/tmp")
+	ctx.LoadBuiltins()
+	program := `
+before := ___runtime_heap()
+names := ['ada', 'grace', 'ada']
+names << names.0
+person := { name: names.1, tags: names }
+fn greet() 'hello, ' + person.name
+stats := import('runtime').stats()
+[before, stats]
+`
+	val, err := ctx.Eval(strings.NewReader(program))
+	if err != nil {
+		t.Fatalf("Did not expect program to return an error: %s", err.Error())
+	}
+	results := val.(*ListValue).elems
+	before, after := results[0].(ObjectValue), results[1].(ObjectValue)
+
+	count := func(stats ObjectValue, kind string) int {
+		return int(stats[kind].(ObjectValue)["count"].(IntValue))
+	}
+	// objects include before and the objects in it, and functions include
+	// those of the runtime module
+	for kind, added := range map[string]int{
+		"strings":   3,
+		"lists":     1,
+		"objects":   7,
+		"functions": 3,
+	} {
+		if got := count(after, kind) - count(before, kind); got != added {
+			t.Errorf("Expected %d more %s, got %d", added, kind, got)
+		}
+	}
+	if _, ok := after["gc"].(ObjectValue)["heap"].(IntValue); !ok {
+		t.Errorf("Expected Go memory statistics in gc, got %s", after["gc"])
+	}
+}
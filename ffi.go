@@ -0,0 +1,279 @@
+//go:build ffi && cgo && !js
+// +build ffi,cgo,!js
+
+package main
+
+/*
+#cgo pkg-config: libffi
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdint.h>
+#include <stdlib.h>
+#include <ffi.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Calls to C functions in shared libraries through libffi, for the ffi
+// standard library. Since this links the interpreter against libffi and the C
+// library, it's only built with -tags ffi. See ffi_disabled.go.
+
+// ffiPointer is a C pointer, which Oak programs can only pass back to C.
+type ffiPointer struct {
+	ptr unsafe.Pointer
+}
+
+func (p ffiPointer) String() string {
+	return fmt.Sprintf("<pointer %p>", p.ptr)
+}
+
+func (p ffiPointer) Eq(u Value) bool {
+	switch q := u.(type) {
+	case EmptyValue:
+		return true
+	case ffiPointer:
+		return p == q
+	}
+	return false
+}
+
+func (p ffiPointer) hostType() string {
+	return "pointer"
+}
+
+func ffiPointerValue(ptr unsafe.Pointer) Value {
+	if ptr == nil {
+		return null
+	}
+	return ffiPointer{ptr: ptr}
+}
+
+// ffiTypes maps the atoms that name C types in function signatures to libffi
+// types. Strings are passed as char *.
+var ffiTypes = map[string]*C.ffi_type{
+	"void":    &C.ffi_type_void,
+	"int":     &C.ffi_type_sint64,
+	"int32":   &C.ffi_type_sint32,
+	"float":   &C.ffi_type_double,
+	"float32": &C.ffi_type_float,
+	"string":  &C.ffi_type_pointer,
+	"pointer": &C.ffi_type_pointer,
+}
+
+// ffiFunc is a C function bound with a signature. Its call interface is kept
+// in C memory, since libffi holds on to the types it points to.
+type ffiFunc struct {
+	name   string
+	sym    unsafe.Pointer
+	cif    *C.ffi_cif
+	ret    string
+	params []string
+}
+
+func (c *Context) oakFfiOpen(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___ffi_open", args, 1); err != nil {
+		return nil, err
+	}
+
+	var path *C.char
+	switch libPath := args[0].(type) {
+	case NullValue:
+		// the program itself, and the libraries it's linked against
+	case *StringValue:
+		path = C.CString(string(*libPath))
+		defer C.free(unsafe.Pointer(path))
+	default:
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___ffi_open(%s)", args[0]),
+		}
+	}
+
+	handle := C.dlopen(path, C.RTLD_NOW)
+	if handle == nil {
+		return nil, &runtimeError{
+			kind:   "ioError",
+			reason: fmt.Sprintf("Could not open library %s: %s", args[0], C.GoString(C.dlerror())),
+		}
+	}
+	return ffiPointer{ptr: handle}, nil
+}
+
+func (c *Context) oakFfiFn(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___ffi_fn", args, 4); err != nil {
+		return nil, err
+	}
+
+	lib, ok1 := args[0].(ffiPointer)
+	name, ok2 := args[1].(*StringValue)
+	ret, ok3 := args[2].(AtomValue)
+	params, ok4 := args[3].(*ListValue)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___ffi_fn(%s, %s, %s, %s)", args[0], args[1], args[2], args[3]),
+		}
+	}
+
+	fn := &ffiFunc{
+		name:   string(*name),
+		ret:    string(ret),
+		params: make([]string, len(params.elems)),
+	}
+	if _, ok := ffiTypes[fn.ret]; !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Unknown C type %s for the result of %s", args[2], fn.name),
+		}
+	}
+	for i, param := range params.elems {
+		paramType, ok := param.(AtomValue)
+		if _, known := ffiTypes[string(paramType)]; !ok || !known || paramType == "void" {
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Unknown C type %s for argument %d of %s", param, i, fn.name),
+			}
+		}
+		fn.params[i] = string(paramType)
+	}
+
+	cName := C.CString(fn.name)
+	defer C.free(unsafe.Pointer(cName))
+	C.dlerror()
+	fn.sym = C.dlsym(lib.ptr, cName)
+	if fn.sym == nil {
+		return nil, &runtimeError{
+			kind:   "ioError",
+			reason: fmt.Sprintf("Could not find %s in library: %s", fn.name, C.GoString(C.dlerror())),
+		}
+	}
+
+	// the call interface lives as long as the function, which may be called
+	// at any time, so it's never freed
+	fn.cif = (*C.ffi_cif)(C.malloc(C.size_t(unsafe.Sizeof(C.ffi_cif{}))))
+	var argTypes **C.ffi_type
+	if len(fn.params) > 0 {
+		argTypes = (**C.ffi_type)(C.malloc(C.size_t(len(fn.params)) * C.size_t(unsafe.Sizeof(argTypes))))
+		argTypeSlice := (*[1 << 20]*C.ffi_type)(unsafe.Pointer(argTypes))[:len(fn.params):len(fn.params)]
+		for i, paramType := range fn.params {
+			argTypeSlice[i] = ffiTypes[paramType]
+		}
+	}
+	if status := C.ffi_prep_cif(fn.cif, C.FFI_DEFAULT_ABI, C.uint(len(fn.params)), ffiTypes[fn.ret], argTypes); status != C.FFI_OK {
+		return nil, &runtimeError{
+			kind:   "ioError",
+			reason: fmt.Sprintf("Could not prepare a call to %s", fn.name),
+		}
+	}
+
+	return BuiltinFnValue{
+		name: fn.name,
+		fn:   fn.call,
+	}, nil
+}
+
+func (fn *ffiFunc) call(args []Value) (Value, *runtimeError) {
+	if len(args) != len(fn.params) {
+		return nil, &runtimeError{
+			kind:   "argumentError",
+			reason: fmt.Sprintf("%s requires %d arguments, got %d", fn.name, len(fn.params), len(args)),
+		}
+	}
+
+	// every argument and the result get an 8-byte slot in C memory, which
+	// fits any of the supported types
+	n := len(args)
+	slots := (*[1 << 20]C.uint64_t)(C.calloc(C.size_t(n+1), 8))[: n+1 : n+1]
+	defer C.free(unsafe.Pointer(&slots[0]))
+	var argValues *unsafe.Pointer
+	var argValueSlice []unsafe.Pointer
+	if n > 0 {
+		argValues = (*unsafe.Pointer)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(unsafe.Pointer(nil)))))
+		defer C.free(unsafe.Pointer(argValues))
+		argValueSlice = (*[1 << 20]unsafe.Pointer)(unsafe.Pointer(argValues))[:n:n]
+	}
+
+	for i, arg := range args {
+		slot := unsafe.Pointer(&slots[i])
+		argValueSlice[i] = slot
+
+		ok := true
+		switch fn.params[i] {
+		case "int", "int32":
+			n, isInt := arg.(IntValue)
+			ok = isInt
+			if fn.params[i] == "int" {
+				*(*C.int64_t)(slot) = C.int64_t(n)
+			} else {
+				*(*C.int32_t)(slot) = C.int32_t(n)
+			}
+		case "float", "float32":
+			var f float64
+			switch num := arg.(type) {
+			case IntValue:
+				f = float64(num)
+			case FloatValue:
+				f = float64(num)
+			default:
+				ok = false
+			}
+			if fn.params[i] == "float" {
+				*(*C.double)(slot) = C.double(f)
+			} else {
+				*(*C.float)(slot) = C.float(f)
+			}
+		case "string":
+			switch s := arg.(type) {
+			case NullValue:
+			case *StringValue:
+				str := C.CString(string(*s))
+				defer C.free(unsafe.Pointer(str))
+				*(**C.char)(slot) = str
+			default:
+				ok = false
+			}
+		case "pointer":
+			switch ptr := arg.(type) {
+			case NullValue:
+			case ffiPointer:
+				*(*unsafe.Pointer)(slot) = ptr.ptr
+			default:
+				ok = false
+			}
+		}
+		if !ok {
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Mismatched types in call %s, expected %s for argument %d but got %s", fn.name, fn.params[i], i, arg),
+			}
+		}
+	}
+
+	result := unsafe.Pointer(&slots[n])
+	C.ffi_call(fn.cif, (*[0]byte)(fn.sym), result, argValues)
+
+	switch fn.ret {
+	case "int":
+		return IntValue(*(*C.int64_t)(result)), nil
+	case "int32":
+		// libffi widens integer results to the size of a register
+		return IntValue(int32(*(*C.ffi_sarg)(result))), nil
+	case "float":
+		return FloatValue(*(*C.double)(result)), nil
+	case "float32":
+		return FloatValue(*(*C.float)(result)), nil
+	case "string":
+		str := *(**C.char)(result)
+		if str == nil {
+			return null, nil
+		}
+		return MakeString(C.GoString(str)), nil
+	case "pointer":
+		return ffiPointerValue(*(*unsafe.Pointer)(result)), nil
+	}
+	return null, nil
+}
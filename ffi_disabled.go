@@ -0,0 +1,22 @@
+//go:build !ffi || !cgo || js
+// +build !ffi !cgo js
+
+package main
+
+// The ffi standard library needs an interpreter built with -tags ffi, which
+// links against libffi. See ffi.go.
+
+func ffiUnavailable() *runtimeError {
+	return &runtimeError{
+		kind:   "ioError",
+		reason: "C functions can only be called from Oak built with -tags ffi",
+	}
+}
+
+func (c *Context) oakFfiOpen(_ []Value) (Value, *runtimeError) {
+	return nil, ffiUnavailable()
+}
+
+func (c *Context) oakFfiFn(_ []Value) (Value, *runtimeError) {
+	return nil, ffiUnavailable()
+}
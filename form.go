@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Parsing form bodies of HTTP requests, for the http standard library.
+
+// defaultFormMaxMemory is the size of an uploaded file above which it's
+// written to a temporary file rather than kept in memory, as in Go's
+// http.Request.ParseMultipartForm.
+const defaultFormMaxMemory = 32 << 20
+
+// formAdd adds a value to a form object, collecting repeated names into a list
+// in the order they appear.
+func formAdd(obj ObjectValue, name string, v Value) {
+	switch existing := obj[name].(type) {
+	case nil:
+		obj[name] = v
+	case *ListValue:
+		existing.elems = append(existing.elems, v)
+	default:
+		obj[name] = MakeList(existing, v)
+	}
+}
+
+// formFile reads an uploaded file, keeping it in memory if it's no larger than
+// maxMemory and writing it to a temporary file in dir otherwise.
+func formFile(part *multipart.Part, maxMemory int64, dir string) (ObjectValue, error) {
+	file := ObjectValue{
+		"filename": MakeString(part.FileName()),
+		"type":     MakeString(part.Header.Get("Content-Type")),
+	}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, part, maxMemory+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n <= maxMemory {
+		file["size"] = IntValue(n)
+		file["data"] = MakeString(buf.String())
+		return file, nil
+	}
+
+	tmp, err := os.CreateTemp(dir, "oak-upload-")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+	size, err := io.Copy(tmp, io.MultiReader(&buf, part))
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	file["size"] = IntValue(size)
+	file["path"] = MakeString(tmp.Name())
+	return file, nil
+}
+
+func parseMultipartForm(body string, boundary string, maxMemory int64, dir string) (ObjectValue, ObjectValue, error) {
+	fields := ObjectValue{}
+	files := ObjectValue{}
+	// paths of temporary files, removed if the form turns out to be malformed
+	var tmpPaths []string
+	fail := func(err error) (ObjectValue, ObjectValue, error) {
+		for _, path := range tmpPaths {
+			os.Remove(path)
+		}
+		return nil, nil, err
+	}
+
+	r := multipart.NewReader(strings.NewReader(body), boundary)
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(part)
+			if err != nil {
+				return fail(err)
+			}
+			formAdd(fields, name, MakeString(string(value)))
+			continue
+		}
+
+		file, err := formFile(part, maxMemory, dir)
+		if err != nil {
+			return fail(err)
+		}
+		if path, ok := file["path"].(*StringValue); ok {
+			tmpPaths = append(tmpPaths, path.stringContent())
+		}
+		formAdd(files, name, file)
+	}
+	return fields, files, nil
+}
+
+func (c *Context) oakHTTPForm(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___http_form", args, 3); err != nil {
+		return nil, err
+	}
+
+	contentType, ok1 := args[0].(*StringValue)
+	body, ok2 := args[1].(*StringValue)
+	opts, ok3 := args[2].(ObjectValue)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___http_form(%s, %s, %s)", args[0], args[1], args[2]),
+		}
+	}
+
+	maxMemory := int64(defaultFormMaxMemory)
+	switch v := opts["maxMemory"].(type) {
+	case nil, NullValue:
+	case IntValue:
+		maxMemory = int64(v)
+	default:
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Form option maxMemory must be an int, got %s", v),
+		}
+	}
+	dir := ""
+	switch v := opts["dir"].(type) {
+	case nil, NullValue:
+	case *StringValue:
+		dir = v.stringContent()
+	default:
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Form option dir must be a string, got %s", v),
+		}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType.stringContent())
+	if err != nil {
+		return errObj(fmt.Sprintf("Could not parse form: %s", err.Error())), nil
+	}
+
+	var fields, files ObjectValue
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(body.stringContent())
+		if err != nil {
+			return errObj(fmt.Sprintf("Could not parse form: %s", err.Error())), nil
+		}
+		fields = ObjectValue{}
+		files = ObjectValue{}
+		for name, vals := range values {
+			for _, val := range vals {
+				formAdd(fields, name, MakeString(val))
+			}
+		}
+	case "multipart/form-data":
+		if params["boundary"] == "" {
+			return errObj("Could not parse form: no multipart boundary"), nil
+		}
+		fields, files, err = parseMultipartForm(body.stringContent(), params["boundary"], maxMemory, dir)
+		if err != nil {
+			return errObj(fmt.Sprintf("Could not parse form: %s", err.Error())), nil
+		}
+	default:
+		return errObj(fmt.Sprintf("Could not parse form: unsupported content type %s", mediaType)), nil
+	}
+
+	return ObjectValue{
+		"type": AtomValue("data"),
+		"data": ObjectValue{
+			"fields": fields,
+			"files":  files,
+		},
+	}, nil
+}
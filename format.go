@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The format language of format() and string(x, spec). A format string like
+// 'pi = {:.3f}' holds replacement fields in braces, each of which may name an
+// argument by its index and give a spec after a colon. Fields without an
+// index take the arguments in order. A spec has the form
+//
+//	[[fill]align][sign][0][width][,][.precision][verb]
+//
+// where align is < (left), > (right), or ^ (center), sign is + or a space to
+// show the sign of positive numbers, 0 pads numbers with zeroes after their
+// sign, a comma separates thousands in decimal numbers, and verb is one of
+//
+//	d        integer in decimal
+//	x X o b  integer in hexadecimal, octal, or binary
+//	f e g    number in fixed-point, exponent, or the shorter of the two
+//	%        number multiplied by 100 in fixed-point, followed by %
+//	s        any value as string() prints it
+//
+// Without a verb, values are printed as by string(), except that a precision
+// gives a number that many decimal places, and truncates a string.
+
+func formatError(format string, args ...interface{}) *runtimeError {
+	return &runtimeError{
+		kind:   "valueError",
+		reason: fmt.Sprintf(format, args...),
+	}
+}
+
+type formatSpec struct {
+	fill  rune
+	align byte
+	sign  byte
+	zero  bool
+	width int
+	group bool
+	// precision is -1 if not given
+	precision int
+	verb      byte
+}
+
+func parseFormatSpec(spec string) (formatSpec, *runtimeError) {
+	s := formatSpec{fill: ' ', precision: -1}
+	isAlign := func(b byte) bool {
+		return b == '<' || b == '>' || b == '^'
+	}
+
+	rest := spec
+	if r, size := utf8.DecodeRuneInString(rest); size > 0 && len(rest) > size && isAlign(rest[size]) {
+		s.fill, s.align = r, rest[size]
+		rest = rest[size+1:]
+	} else if len(rest) > 0 && isAlign(rest[0]) {
+		s.align = rest[0]
+		rest = rest[1:]
+	}
+	if len(rest) > 0 && (rest[0] == '+' || rest[0] == ' ') {
+		s.sign = rest[0]
+		rest = rest[1:]
+	}
+	if len(rest) > 0 && rest[0] == '0' {
+		s.zero = true
+		rest = rest[1:]
+	}
+
+	digits := func() (int, bool) {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		if i == 0 {
+			return 0, false
+		}
+		n, err := strconv.Atoi(rest[:i])
+		rest = rest[i:]
+		return n, err == nil
+	}
+	if n, ok := digits(); ok {
+		s.width = n
+	}
+	if len(rest) > 0 && rest[0] == ',' {
+		s.group = true
+		rest = rest[1:]
+	}
+	if len(rest) > 0 && rest[0] == '.' {
+		rest = rest[1:]
+		n, ok := digits()
+		if !ok {
+			return s, formatError("Missing precision after . in format spec %q", spec)
+		}
+		s.precision = n
+	}
+	if len(rest) > 0 {
+		s.verb = rest[0]
+		rest = rest[1:]
+		if !strings.ContainsRune("dxXobfeg%s", rune(s.verb)) {
+			return s, formatError("Unknown verb %c in format spec %q", s.verb, spec)
+		}
+	}
+	if rest != "" {
+		return s, formatError("Invalid format spec %q", spec)
+	}
+	if s.group && strings.ContainsRune("xXobs", rune(s.verb)) {
+		return s, formatError("Cannot separate thousands with verb %c in format spec %q", s.verb, spec)
+	}
+	return s, nil
+}
+
+func formatNumber(v Value) (float64, bool) {
+	switch n := v.(type) {
+	case IntValue:
+		return float64(n), true
+	case FloatValue:
+		return float64(n), true
+	case DecimalValue:
+		f, _ := n.rat.Float64()
+		return f, true
+	}
+	return 0, false
+}
+
+// formatFixed formats the number v, whose float value is n, times scale with
+// prec decimal places. Decimals are formatted exactly, with halves rounded away
+// from zero.
+func formatFixed(v Value, n float64, scale int64, prec int) string {
+	if d, ok := v.(DecimalValue); ok {
+		return new(big.Rat).Mul(d.rat, big.NewRat(scale, 1)).FloatString(prec)
+	}
+	return strconv.FormatFloat(n*float64(scale), 'f', prec, 64)
+}
+
+// format returns v formatted by the spec.
+func (s formatSpec) format(v Value) (string, *runtimeError) {
+	var body string
+	numeric := false
+	mismatch := func() *runtimeError {
+		return &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Cannot format %s with verb %c", v, s.verb),
+		}
+	}
+
+	switch s.verb {
+	case 'd', 'x', 'X', 'o', 'b':
+		n, ok := v.(IntValue)
+		if !ok {
+			return "", mismatch()
+		}
+		base := map[byte]int{'d': 10, 'x': 16, 'X': 16, 'o': 8, 'b': 2}[s.verb]
+		body = strconv.FormatInt(int64(n), base)
+		if s.verb == 'X' {
+			body = strings.ToUpper(body)
+		}
+		numeric = true
+	case 'f', 'e', 'g', '%':
+		n, ok := formatNumber(v)
+		if !ok {
+			return "", mismatch()
+		}
+		prec := s.precision
+		if prec < 0 && s.verb != 'g' {
+			prec = 6
+		}
+		switch s.verb {
+		case '%':
+			body = formatFixed(v, n, 100, prec) + "%"
+		case 'f':
+			body = formatFixed(v, n, 1, prec)
+		default:
+			body = strconv.FormatFloat(n, s.verb, prec, 64)
+		}
+		numeric = true
+	case 's':
+		body = formatPlain(v)
+	default:
+		if n, ok := formatNumber(v); ok {
+			if s.precision >= 0 {
+				body = formatFixed(v, n, 1, s.precision)
+			} else {
+				body = v.String()
+			}
+			numeric = true
+		} else {
+			body = formatPlain(v)
+		}
+	}
+
+	if s.precision >= 0 && !numeric {
+		if runes := []rune(body); len(runes) > s.precision {
+			body = string(runes[:s.precision])
+		}
+	}
+
+	sign := ""
+	if numeric {
+		if strings.HasPrefix(body, "-") {
+			sign, body = "-", body[1:]
+		} else if s.sign != 0 {
+			sign = string(s.sign)
+		}
+		if s.group {
+			body = groupThousands(body)
+		}
+	}
+
+	pad := s.width - utf8.RuneCountInString(sign+body)
+	if pad <= 0 {
+		return sign + body, nil
+	}
+	if numeric && s.zero && s.align == 0 {
+		return sign + strings.Repeat("0", pad) + body, nil
+	}
+
+	align := s.align
+	if align == 0 {
+		if numeric {
+			align = '>'
+		} else {
+			align = '<'
+		}
+	}
+	fill := string(s.fill)
+	switch align {
+	case '<':
+		return sign + body + strings.Repeat(fill, pad), nil
+	case '^':
+		left := pad / 2
+		return strings.Repeat(fill, left) + sign + body + strings.Repeat(fill, pad-left), nil
+	default:
+		return strings.Repeat(fill, pad) + sign + body, nil
+	}
+}
+
+// groupThousands separates the thousands of the leading digits of a
+// formatted number with commas.
+func groupThousands(num string) string {
+	end := 0
+	for end < len(num) && num[end] >= '0' && num[end] <= '9' {
+		end++
+	}
+
+	sb := strings.Builder{}
+	for i := 0; i < end; i++ {
+		if i > 0 && (end-i)%3 == 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteByte(num[i])
+	}
+	sb.WriteString(num[end:])
+	return sb.String()
+}
+
+// formatPlain returns a value as string() would.
+func formatPlain(v Value) string {
+	switch val := v.(type) {
+	case *StringValue:
+		return val.stringContent()
+	case AtomValue:
+		return string(val)
+	}
+	return v.String()
+}
+
+// formatTemplate replaces each field in braces in tmpl with an argument
+// formatted by its spec. {{ and }} stand for literal braces.
+func (c *Context) formatTemplate(tmpl string, args []Value) (string, *runtimeError) {
+	sb := strings.Builder{}
+	next := 0
+	for i := 0; i < len(tmpl); i++ {
+		ch := tmpl[i]
+		if ch == '}' {
+			if i+1 < len(tmpl) && tmpl[i+1] == '}' {
+				sb.WriteByte('}')
+				i++
+				continue
+			}
+			return "", formatError("Unmatched } at %d in format string", i)
+		}
+		if ch != '{' {
+			sb.WriteByte(ch)
+			continue
+		}
+		if i+1 < len(tmpl) && tmpl[i+1] == '{' {
+			sb.WriteByte('{')
+			i++
+			continue
+		}
+
+		end := strings.IndexByte(tmpl[i:], '}')
+		if end < 0 {
+			return "", formatError("Unmatched { at %d in format string", i)
+		}
+		field := tmpl[i+1 : i+end]
+		i += end
+
+		name, spec := field, ""
+		if colon := strings.IndexByte(field, ':'); colon >= 0 {
+			name, spec = field[:colon], field[colon+1:]
+		}
+		index := next
+		if name != "" {
+			n, err := strconv.Atoi(name)
+			if err != nil || n < 0 {
+				return "", formatError("Invalid argument index %q in format string", name)
+			}
+			index = n
+		} else {
+			next++
+		}
+		if index >= len(args) {
+			return "", &runtimeError{
+				kind:   "argumentError",
+				reason: fmt.Sprintf("Format string refers to argument %d, but got %d arguments", index, len(args)),
+			}
+		}
+
+		s, err := parseFormatSpec(spec)
+		if err != nil {
+			return "", err
+		}
+		// checked before padding to the width allocates it
+		if err := c.allocString(s.width, 0); err != nil {
+			return "", err
+		}
+		formatted, err := s.format(args[index])
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(formatted)
+	}
+	return sb.String(), nil
+}
+
+func (c *Context) oakFormat(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("format", args, 1); err != nil {
+		return nil, err
+	}
+
+	tmpl, ok := args[0].(*StringValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("format string to format() must be a string, got %s", args[0]),
+		}
+	}
+
+	// objects with a __string method are formatted as that string
+	vals := make([]Value, len(args)-1)
+	for i, arg := range args[1:] {
+		val, err := c.stringMethod(arg)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = val
+	}
+
+	formatted, err := c.formatTemplate(tmpl.stringContent(), vals)
+	if err != nil {
+		return nil, err
+	}
+	return c.makeString(formatted)
+}
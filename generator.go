@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// A generator runs an Oak function lazily, suspending it each time it yields
+// a value until the next value is requested with next(). Because the
+// evaluator keeps Oak call frames on the Go stack, each generator's function
+// runs in a goroutine of its own. Only one of the generator's goroutine and
+// the goroutine that called next() runs at a time, so the generator evaluates
+// under the interpreter lock held by its caller.
+type generator struct {
+	// resume starts or resumes the generator. It carries the call depth of
+	// the caller of next(), and is closed when the generator is garbage
+	// collected, to let its goroutine exit.
+	resume chan int
+	// results carries values yielded or returned by the generator
+	results chan genResult
+	// depth is the number of calls the suspended generator is nested in
+	depth   int
+	running bool
+	done    bool
+}
+
+type genResult struct {
+	value Value
+	depth int
+	done  bool
+	err   *runtimeError
+}
+
+func (c *Context) newGenerator(fn Value) *generator {
+	resume := make(chan int)
+	results := make(chan genResult)
+
+	// the goroutine must not refer to the generator itself, so that an
+	// abandoned generator can be garbage collected and close resume
+	go func() {
+		base, ok := <-resume
+		if !ok {
+			return
+		}
+
+		closed := false
+		yield := func(args []Value) (Value, *runtimeError) {
+			if c.eng.yielding != results {
+				return nil, &runtimeError{
+					reason: "yield() called outside of its generator",
+				}
+			}
+
+			var v Value = null
+			if len(args) > 0 {
+				v = args[0]
+			}
+
+			depth := c.eng.callDepth - base
+			results <- genResult{value: v, depth: depth}
+			base, ok = <-resume
+			if !ok {
+				// unwind the generator's calls exclusively of other Oak
+				// evaluation, with an error that try() can't recover
+				closed = true
+				c.Lock()
+				base = c.eng.callDepth
+				c.eng.callDepth += depth
+				return nil, &runtimeError{
+					kind:   "cancelled",
+					reason: "Generator was closed",
+				}
+			}
+			return null, nil
+		}
+
+		v, err := c.EvalFnValue(fn, false, BuiltinFnValue{
+			name: "yield",
+			fn:   yield,
+		})
+		if closed {
+			c.eng.callDepth = base
+			c.Unlock()
+			return
+		}
+		results <- genResult{value: v, depth: c.eng.callDepth - base, done: true, err: err}
+	}()
+
+	g := &generator{
+		resume:  resume,
+		results: results,
+	}
+	runtime.SetFinalizer(g, func(g *generator) {
+		close(g.resume)
+	})
+	return g
+}
+
+// next resumes the generator until it yields or returns a value.
+func (c *Context) next(g *generator) (Value, *runtimeError) {
+	if g.done {
+		return iterResult(true, null), nil
+	}
+	if g.running {
+		return nil, &runtimeError{
+			reason: "Cannot resume a generator that is already running",
+		}
+	}
+
+	base, yielding := c.eng.callDepth, c.eng.yielding
+	c.eng.callDepth += g.depth
+	c.eng.yielding = g.results
+	g.running = true
+	g.resume <- base
+	result := <-g.results
+	g.running = false
+	g.depth = result.depth
+	c.eng.callDepth, c.eng.yielding = base, yielding
+
+	if result.done {
+		g.done = true
+		if result.err != nil {
+			return nil, result.err
+		}
+	}
+	return iterResult(result.done, result.value), nil
+}
+
+func (c *Context) oakGenerator(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("generator", args, 1); err != nil {
+		return nil, err
+	}
+
+	if _, ok := args[0].(FnValue); !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call generator(%s)", args[0]),
+		}
+	}
+
+	g := c.newGenerator(args[0])
+	return ObjectValue{
+		"next": BuiltinFnValue{
+			name: "next",
+			fn: func(_ []Value) (Value, *runtimeError) {
+				return c.next(g)
+			},
+		},
+	}, nil
+}
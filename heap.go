@@ -0,0 +1,169 @@
+package main
+
+import "reflect"
+
+// heapStats counts the values of one kind reachable by a program, and
+// estimates the bytes they take.
+type heapStats struct {
+	count int
+	bytes int64
+}
+
+func (s heapStats) value() Value {
+	return ObjectValue{
+		"count": IntValue(s.count),
+		"bytes": IntValue(s.bytes),
+	}
+}
+
+// heapWalker visits each value reachable from the scopes of a program once,
+// tallying them by kind. Sizes are estimated like those of MaxAllocBytes, and
+// a function's size includes the variables of any scope it closes over that
+// hasn't already been counted.
+type heapWalker struct {
+	seen      map[uintptr]bool
+	seenFns   map[[2]uintptr]bool
+	strings   heapStats
+	lists     heapStats
+	objects   heapStats
+	functions heapStats
+	arrays    heapStats
+}
+
+// fnAllocSize is the estimated size of a function value, apart from the scope
+// it closes over.
+const fnAllocSize = 32
+
+func scopeID(sc *scope) uintptr {
+	if sc.vars != nil {
+		return reflect.ValueOf(sc.vars).Pointer()
+	}
+	if len(sc.slots) > 0 {
+		return reflect.ValueOf(sc.slots).Pointer()
+	}
+	return 0
+}
+
+// walkScope walks the variables of the scope closed over by a function and
+// its parents, up to the top-level scope of a module.
+func (w *heapWalker) walkScope(sc *scope) {
+	for ; sc != nil; sc = sc.parent {
+		id := scopeID(sc)
+		if id == 0 {
+			continue
+		}
+		if w.seen[id] {
+			return
+		}
+		w.seen[id] = true
+		w.functions.bytes += int64((len(sc.vars) + len(sc.slots)) * entryAllocSize)
+		w.walkVars(sc)
+	}
+}
+
+func (w *heapWalker) walkVars(sc *scope) {
+	for _, v := range sc.vars {
+		w.walk(v)
+	}
+	for _, v := range sc.slots {
+		if v != nil {
+			w.walk(v)
+		}
+	}
+}
+
+func (w *heapWalker) walk(v Value) {
+	switch val := v.(type) {
+	case *StringValue:
+		id := reflect.ValueOf(val).Pointer()
+		if w.seen[id] {
+			return
+		}
+		w.seen[id] = true
+		w.strings.count++
+		w.strings.bytes += int64(len(*val))
+	case *ListValue:
+		id := reflect.ValueOf(val).Pointer()
+		if w.seen[id] {
+			return
+		}
+		w.seen[id] = true
+		w.lists.count++
+		w.lists.bytes += int64(len(val.elems) * valueAllocSize)
+		for _, el := range val.elems {
+			w.walk(el)
+		}
+	case ObjectValue:
+		id := reflect.ValueOf(val).Pointer()
+		if w.seen[id] {
+			return
+		}
+		w.seen[id] = true
+		w.objects.count++
+		for key, el := range val {
+			w.objects.bytes += int64(entryAllocSize + len(key))
+			w.walk(el)
+		}
+	case *MapValue:
+		id := reflect.ValueOf(val).Pointer()
+		if w.seen[id] {
+			return
+		}
+		w.seen[id] = true
+		w.objects.count++
+		val.each(func(key, el Value) {
+			w.objects.bytes += entryAllocSize
+			w.walk(key)
+			w.walk(el)
+		})
+	case *IntArrayValue, *FloatArrayValue:
+		id := reflect.ValueOf(val).Pointer()
+		if w.seen[id] {
+			return
+		}
+		w.seen[id] = true
+		w.arrays.count++
+		w.arrays.bytes += int64(val.(numArray).length() * 8)
+	case FnValue:
+		id := [2]uintptr{reflect.ValueOf(val.defn).Pointer(), scopeID(&val.scope)}
+		if w.seenFns[id] {
+			return
+		}
+		w.seenFns[id] = true
+		w.functions.count++
+		w.functions.bytes += fnAllocSize
+		w.walkScope(&val.scope)
+	}
+}
+
+// ___runtime_heap reports the number and estimated size in bytes of strings,
+// lists, objects, functions, and numeric arrays reachable from the top-level
+// scope of the program and of every module it has imported.
+func (c *Context) rtHeap(_ []Value) (Value, *runtimeError) {
+	w := heapWalker{
+		seen:    map[uintptr]bool{},
+		seenFns: map[[2]uintptr]bool{},
+	}
+	// top-level scopes are marked seen before any function that closes over
+	// them is walked
+	roots := []scope{c.eng.mainScope, c.scope}
+	for _, sc := range c.eng.importMap {
+		roots = append(roots, sc)
+	}
+	for _, sc := range roots {
+		if id := scopeID(&sc); id != 0 {
+			w.seen[id] = true
+		}
+	}
+	for _, sc := range roots {
+		w.walkVars(&sc)
+	}
+
+	return ObjectValue{
+		"strings":   w.strings.value(),
+		"lists":     w.lists.value(),
+		"objects":   w.objects.value(),
+		"functions": w.functions.value(),
+		"arrays":    w.arrays.value(),
+	}, nil
+}
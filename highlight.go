@@ -0,0 +1,154 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The REPL colors Oak source as it's typed, with the same colors as oak cat,
+// and highlights the bracket that matches the one at the cursor.
+
+const (
+	ansiReset   = "\x1b[0;0m"
+	ansiMatched = "\x1b[1;4m"
+)
+
+// highlightColor returns the ANSI color code for a kind of token, or 0 if the
+// token is not colored.
+func highlightColor(kind tokKind, atom bool) int {
+	switch kind {
+	case comment, docComment:
+		return 90 // gray
+	case assign, nonlocalAssign, branchArrow, pushArrow, exclam,
+		plus, minus, times, divide, modulus, power, xor, and, or,
+		greater, less, eq, geq, leq, neq, ifKeyword:
+		return 31 // red
+	case pipeArrow, ellipsis, fnKeyword:
+		return 34 // blue
+	case withKeyword, numberLiteral:
+		return 36 // cyan
+	case qmark, underscore, trueLiteral, falseLiteral:
+		return 35 // magenta
+	case stringLiteral, rawStringLiteral:
+		return 33 // yellow
+	case colon, identifier:
+		if atom {
+			return 35
+		}
+	}
+	return 0
+}
+
+type highlightSpan struct {
+	kind       tokKind
+	start, end int
+}
+
+// highlightSpans tokenizes a line of Oak source, which may be incomplete, and
+// returns the rune indexes where each token starts and ends.
+func highlightSpans(line []rune) []highlightSpan {
+	t := newTokenizer(string(line))
+	spans := []highlightSpan{}
+	for {
+		for !t.isEOF() && unicode.IsSpace(t.peek()) {
+			t.next()
+		}
+		if t.isEOF() {
+			return spans
+		}
+
+		start := t.index
+		tok := t.nextToken()
+		spans = append(spans, highlightSpan{kind: tok.kind, start: start, end: t.index})
+	}
+}
+
+// matchingBracket returns the span index of the bracket matching the one in
+// spans[i], or -1 if it's not a bracket or has no match.
+func matchingBracket(spans []highlightSpan, i int) int {
+	step, open, close := 1, spans[i].kind, spans[i].kind
+	switch spans[i].kind {
+	case leftParen:
+		close = rightParen
+	case leftBracket:
+		close = rightBracket
+	case leftBrace:
+		close = rightBrace
+	case rightParen:
+		step, open = -1, leftParen
+	case rightBracket:
+		step, open = -1, leftBracket
+	case rightBrace:
+		step, open = -1, leftBrace
+	default:
+		return -1
+	}
+
+	depth := 0
+	for j := i; j >= 0 && j < len(spans); j += step {
+		switch spans[j].kind {
+		case open:
+			depth++
+		case close:
+			depth--
+		}
+		if depth == 0 {
+			return j
+		}
+	}
+	return -1
+}
+
+// replPainter implements readline.Painter.
+type replPainter struct{}
+
+func (replPainter) Paint(line []rune, cursor int) []rune {
+	spans := highlightSpans(line)
+
+	// a bracket right before the cursor is matched, as in most editors, or
+	// else the one under the cursor
+	matched := map[int]bool{}
+	for _, at := range []int{cursor - 1, cursor} {
+		for i, span := range spans {
+			if span.start == at {
+				if j := matchingBracket(spans, i); j >= 0 {
+					matched[i], matched[j] = true, true
+				}
+			}
+		}
+		if len(matched) > 0 {
+			break
+		}
+	}
+
+	// an atom is a colon followed immediately by a name
+	atoms := map[int]bool{}
+	for i := 1; i < len(spans); i++ {
+		if spans[i].kind == identifier && spans[i-1].kind == colon && spans[i-1].end == spans[i].start {
+			atoms[i-1], atoms[i] = true, true
+		}
+	}
+
+	painted := strings.Builder{}
+	last := 0
+	for i, span := range spans {
+		painted.WriteString(string(line[last:span.start]))
+		text := string(line[span.start:span.end])
+		last = span.end
+
+		switch color := highlightColor(span.kind, atoms[i]); {
+		case matched[i]:
+			painted.WriteString(ansiMatched + text + ansiReset)
+		case color != 0:
+			painted.WriteString("\x1b[0;" + strconv.Itoa(color) + "m" + text + ansiReset)
+		default:
+			painted.WriteString(text)
+		}
+	}
+	painted.WriteString(string(line[last:]))
+	return []rune(painted.String())
+}
@@ -0,0 +1,132 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+)
+
+// replHistoryLimit is the number of lines of history the REPL keeps, in
+// memory and in its history file.
+const replHistoryLimit = 1000
+
+// replHistory keeps the history of the REPL in a file shared by every REPL
+// session. Each line entered is appended to the file, rather than the file
+// being rewritten, so concurrent sessions don't overwrite each other's
+// history, and each session merges lines the others have added into its own
+// history before reading the next line, so reverse search (Ctrl-R) finds
+// them.
+type replHistory struct {
+	path string
+	// offset is how much of the history file has been read into history
+	offset int64
+	// last is the most recent line of history, which isn't repeated
+	last string
+	// add adds a line to the in-memory history of the REPL
+	add func(line string)
+}
+
+func openReplHistory(path string, add func(line string)) *replHistory {
+	h := &replHistory{path: path, add: add}
+	if path != "" {
+		h.compact()
+		h.merge()
+	}
+	return h
+}
+
+func (h *replHistory) push(line string) {
+	if line == "" || line == h.last {
+		return
+	}
+	h.last = line
+	h.add(line)
+}
+
+// compact rewrites the history file with its last replHistoryLimit lines if
+// it has grown past twice that, without consecutive duplicates. If another
+// session writes to the file in the meantime, compacting is left for later.
+func (h *replHistory) compact() {
+	data, err := os.ReadFile(h.path)
+	if err != nil || bytes.Count(data, []byte{'\n'}) <= 2*replHistoryLimit {
+		return
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" && (len(lines) == 0 || line != lines[len(lines)-1]) {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > replHistoryLimit {
+		lines = lines[len(lines)-replHistoryLimit:]
+	}
+
+	tmpPath := h.path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return
+	}
+	if info, err := os.Stat(h.path); err != nil || info.Size() != int64(len(data)) {
+		os.Remove(tmpPath)
+		return
+	}
+	if err := os.Rename(tmpPath, h.path); err != nil {
+		os.Remove(tmpPath)
+	}
+}
+
+// merge adds the lines written to the history file since it was last read,
+// by this session or any other, to the history.
+func (h *replHistory) merge() {
+	file, err := os.Open(h.path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	// a file that's shrunk has been compacted by another session, and is
+	// read again from the start
+	if info, err := file.Stat(); err == nil && info.Size() < h.offset {
+		h.offset = 0
+	}
+	if _, err := file.Seek(h.offset, io.SeekStart); err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		// a line without a newline is still being written
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		h.offset += int64(len(line))
+		h.push(strings.TrimSpace(line))
+	}
+}
+
+// save adds a line entered in the REPL to the history.
+func (h *replHistory) save(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line == h.last {
+		return
+	}
+
+	if h.path != "" {
+		file, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = file.WriteString(line + "\n")
+			file.Close()
+		}
+		if err == nil {
+			h.merge()
+			return
+		}
+	}
+	h.push(line)
+}
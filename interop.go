@@ -0,0 +1,38 @@
+//go:build !js
+// +build !js
+
+package main
+
+import "fmt"
+
+// The ___js_* builtins behind the dom standard library only exist in
+// JavaScript bundles and in WebAssembly. See interop_js.go.
+
+func jsUnavailable(name string) builtinFn {
+	return func(_ []Value) (Value, *runtimeError) {
+		return nil, &runtimeError{
+			kind:   "ioError",
+			reason: fmt.Sprintf("%s() is only available in JavaScript and WebAssembly", name),
+		}
+	}
+}
+
+func (c *Context) jsGlobal(args []Value) (Value, *runtimeError) {
+	return jsUnavailable("___js_global")(args)
+}
+
+func (c *Context) jsGet(args []Value) (Value, *runtimeError) {
+	return jsUnavailable("___js_get")(args)
+}
+
+func (c *Context) jsSet(args []Value) (Value, *runtimeError) {
+	return jsUnavailable("___js_set")(args)
+}
+
+func (c *Context) jsCall(args []Value) (Value, *runtimeError) {
+	return jsUnavailable("___js_call")(args)
+}
+
+func (c *Context) jsFunc(args []Value) (Value, *runtimeError) {
+	return jsUnavailable("___js_func")(args)
+}
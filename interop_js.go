@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+)
+
+// JavaScript interop for the dom standard library in WebAssembly, through the
+// same ___js_* builtins that JavaScript bundles define in their runtime.
+//
+// JavaScript objects and functions are passed to Oak as opaque jsValues, and
+// primitive values are converted to Oak values. Oak values passed to
+// JavaScript are converted like the results of Oak.eval.
+
+// jsValue is a JavaScript object, like a DOM element or event.
+type jsValue struct {
+	v js.Value
+}
+
+func (j jsValue) String() string {
+	return js.Global().Call("String", j.v).String()
+}
+
+func (j jsValue) Eq(u Value) bool {
+	switch k := u.(type) {
+	case EmptyValue:
+		return true
+	case jsValue:
+		return j.v.Equal(k.v)
+	}
+	return false
+}
+
+func (j jsValue) hostType() string {
+	return "object"
+}
+
+// jsToHandle converts a JavaScript value to Oak, keeping objects as jsValues.
+func jsToHandle(v js.Value) Value {
+	switch v.Type() {
+	case js.TypeUndefined, js.TypeNull:
+		return null
+	case js.TypeBoolean, js.TypeNumber, js.TypeString:
+		return jsToValue(v)
+	}
+	return jsValue{v: v}
+}
+
+// jsInvoke makes a call into JavaScript, raising exceptions it throws as
+// hostErrors. It counts the calls in progress, because JavaScript is
+// single-threaded, so a function called back from JavaScript during one was
+// called by it, and is already running under the interpreter lock.
+func (c *Context) jsInvoke(name string, call func() js.Value) (result js.Value, rtErr *runtimeError) {
+	c.eng.jsCallDepth++
+	defer func() {
+		c.eng.jsCallDepth--
+		if r := recover(); r != nil {
+			result, rtErr = js.Undefined(), &runtimeError{
+				kind:   "hostError",
+				reason: fmt.Sprintf("Error in %s: %v", name, r),
+			}
+		}
+	}()
+	return call(), nil
+}
+
+// jsHandleInvoke is jsInvoke for builtins that return JavaScript objects to
+// Oak as jsValues.
+func (c *Context) jsHandleInvoke(name string, call func() js.Value) (Value, *runtimeError) {
+	result, err := c.jsInvoke(name, call)
+	if err != nil {
+		return nil, err
+	}
+	return jsToHandle(result), nil
+}
+
+func (c *Context) jsTarget(name string, v Value) (js.Value, *runtimeError) {
+	if j, ok := v.(jsValue); ok {
+		return j.v, nil
+	}
+	return js.Value{}, &runtimeError{
+		kind:   "typeError",
+		reason: fmt.Sprintf("Mismatched types in call %s(%s), expected a JavaScript object", name, v),
+	}
+}
+
+func jsKey(v Value) (interface{}, bool) {
+	switch k := v.(type) {
+	case *StringValue:
+		return string(*k), true
+	case AtomValue:
+		return string(k), true
+	case IntValue:
+		return int64(k), true
+	}
+	return nil, false
+}
+
+func (c *Context) jsGlobal(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___js_global", args, 1); err != nil {
+		return nil, err
+	}
+
+	name, ok := jsKey(args[0])
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___js_global(%s)", args[0]),
+		}
+	}
+	return jsToHandle(js.Global().Get(fmt.Sprint(name))), nil
+}
+
+func (c *Context) jsGet(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___js_get", args, 2); err != nil {
+		return nil, err
+	}
+
+	target, err := c.jsTarget("___js_get", args[0])
+	if err != nil {
+		return nil, err
+	}
+	switch key := args[1].(type) {
+	case IntValue:
+		return c.jsHandleInvoke("___js_get", func() js.Value { return target.Index(int(key)) })
+	case *StringValue, AtomValue:
+		name, _ := jsKey(key)
+		return c.jsHandleInvoke("___js_get", func() js.Value { return target.Get(name.(string)) })
+	}
+	return nil, &runtimeError{
+		kind:   "typeError",
+		reason: fmt.Sprintf("Mismatched types in call ___js_get(%s, %s)", args[0], args[1]),
+	}
+}
+
+func (c *Context) jsSet(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___js_set", args, 3); err != nil {
+		return nil, err
+	}
+
+	target, err := c.jsTarget("___js_set", args[0])
+	if err != nil {
+		return nil, err
+	}
+	val := valueToJS(args[2], map[uintptr]bool{})
+	switch key := args[1].(type) {
+	case IntValue:
+		return c.jsHandleInvoke("___js_set", func() js.Value {
+			target.SetIndex(int(key), val)
+			return target
+		})
+	case *StringValue, AtomValue:
+		name, _ := jsKey(key)
+		return c.jsHandleInvoke("___js_set", func() js.Value {
+			target.Set(name.(string), val)
+			return target
+		})
+	}
+	return nil, &runtimeError{
+		kind:   "typeError",
+		reason: fmt.Sprintf("Mismatched types in call ___js_set(%s, %s, %s)", args[0], args[1], args[2]),
+	}
+}
+
+func (c *Context) jsCall(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___js_call", args, 3); err != nil {
+		return nil, err
+	}
+
+	target, err := c.jsTarget("___js_call", args[0])
+	if err != nil {
+		return nil, err
+	}
+	method, ok1 := jsKey(args[1])
+	callArgs, ok2 := args[2].(*ListValue)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___js_call(%s, %s, %s)", args[0], args[1], args[2]),
+		}
+	}
+
+	jsArgs := make([]interface{}, len(callArgs.elems))
+	for i, arg := range callArgs.elems {
+		jsArgs[i] = valueToJS(arg, map[uintptr]bool{})
+	}
+	return c.jsHandleInvoke(fmt.Sprintf("%s()", method), func() js.Value {
+		return target.Call(fmt.Sprint(method), jsArgs...)
+	})
+}
+
+// jsFunc wraps an Oak function in a JavaScript function, like an event
+// listener. JavaScript functions made this way are never released, since
+// JavaScript may hold on to them for as long as the page is open.
+func (c *Context) jsFunc(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___js_func", args, 1); err != nil {
+		return nil, err
+	}
+
+	fn := args[0]
+	switch fn.(type) {
+	case FnValue, BuiltinFnValue:
+	default:
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___js_func(%s)", args[0]),
+		}
+	}
+
+	return jsValue{v: js.FuncOf(func(_ js.Value, jsArgs []js.Value) interface{} {
+		if c.eng.jsCallDepth == 0 {
+			c.Lock()
+			defer c.Unlock()
+		}
+
+		oakArgs := make([]Value, len(jsArgs))
+		for i, arg := range jsArgs {
+			oakArgs[i] = jsToHandle(arg)
+		}
+		result, err := c.EvalFnValue(fn, false, oakArgs...)
+		if err != nil {
+			c.eng.reportErr(err)
+			return nil
+		}
+		return valueToJS(result, map[uintptr]bool{})
+	}).Value}, nil
+}
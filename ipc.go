@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// Framed messages over Unix domain sockets for the ipc standard library, so
+// that cooperating Oak programs on one machine can send each other values.
+// Each message is a value encoded with marshal(), prefixed by the length of
+// the encoding as 4 bytes in big-endian order. ___ipc_listen() accepts
+// connections on a socket file and ___ipc_connect() opens one.
+
+// maxIPCMessage is the size in bytes of the largest message that can be sent
+// or received, so that a corrupt length can't make a reader allocate without
+// bound.
+const maxIPCMessage = 1 << 28
+
+// ipcConn is a connection that any number of handlers may send messages on.
+type ipcConn struct {
+	sync.Mutex
+	conn      net.Conn
+	obj       ObjectValue
+	closeOnce sync.Once
+	// closed when this end closes the connection, so that it isn't told the
+	// connection ended
+	stopped chan struct{}
+}
+
+func newIPCConn(conn net.Conn) *ipcConn {
+	ic := &ipcConn{conn: conn, stopped: make(chan struct{})}
+	ic.obj = ObjectValue{
+		"send": BuiltinFnValue{
+			name: "send",
+			fn:   ic.send,
+		},
+		"close": BuiltinFnValue{
+			name: "close",
+			fn: func(_ []Value) (Value, *runtimeError) {
+				ic.close()
+				return null, nil
+			},
+		},
+	}
+	return ic
+}
+
+func (ic *ipcConn) send(args []Value) (Value, *runtimeError) {
+	if len(args) < 1 {
+		return nil, &runtimeError{
+			kind:   "argumentError",
+			reason: fmt.Sprintf("send requires 1 arguments, got %d", len(args)),
+		}
+	}
+
+	// the length is filled in once the value is encoded after it
+	frame, err := marshalValue([]byte{0, 0, 0, 0, marshalVersion}, args[0], map[uintptr]bool{})
+	if err != nil {
+		return nil, err
+	}
+	size := len(frame) - 4
+	if size > maxIPCMessage {
+		return nil, &runtimeError{
+			kind:   "valueError",
+			reason: fmt.Sprintf("Message of %d bytes in send() exceeds the limit of %d bytes", size, maxIPCMessage),
+		}
+	}
+	binary.BigEndian.PutUint32(frame, uint32(size))
+
+	ic.Lock()
+	defer ic.Unlock()
+	if _, err := ic.conn.Write(frame); err != nil {
+		return errObj(fmt.Sprintf("Could not send in send(): %s", err.Error())), nil
+	}
+	return null, nil
+}
+
+func (ic *ipcConn) close() {
+	ic.closeOnce.Do(func() {
+		close(ic.stopped)
+		ic.conn.Close()
+	})
+}
+
+// closedHere reports whether this end closed the connection.
+func (ic *ipcConn) closedHere() bool {
+	select {
+	case <-ic.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// readMessages calls onMessage with each message read from ic, under the
+// interpreter lock, until the connection is closed. It returns an error if
+// the other end sends something that isn't a message, after which nothing
+// more can be read.
+func (c *Context) readMessages(ic *ipcConn, onMessage func(msg Value) *runtimeError) *runtimeError {
+	reader := bufio.NewReader(ic.conn)
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return nil
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > maxIPCMessage {
+			return &runtimeError{
+				kind:   "valueError",
+				reason: fmt.Sprintf("Received a message of %d bytes, over the limit of %d bytes", size, maxIPCMessage),
+			}
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return nil
+		}
+
+		c.Lock()
+		msg, err := c.unmarshal(payload)
+		if err != nil {
+			c.Unlock()
+			return err
+		}
+		evalErr := onMessage(msg)
+		c.Unlock()
+		if evalErr != nil {
+			c.eng.reportErr(evalErr)
+		}
+	}
+}
+
+// emitIPCEvent calls cb with the event evt under the interpreter lock.
+func (c *Context) emitIPCEvent(cb Value, evt ObjectValue) {
+	c.Lock()
+	_, err := c.EvalFnValue(cb, false, evt)
+	c.Unlock()
+	if err != nil {
+		c.eng.reportErr(err)
+	}
+}
+
+// serveIPCConn delivers the events of a connection to cb until it's closed.
+// Events of connections accepted by a listener carry the connection, and
+// those of a connection opened by the program don't.
+func (c *Context) serveIPCConn(ic *ipcConn, cb Value, accepted bool) {
+	event := func(typ string) ObjectValue {
+		evt := ObjectValue{"type": AtomValue(typ)}
+		if accepted {
+			evt["conn"] = ic.obj
+		}
+		return evt
+	}
+
+	if accepted {
+		c.emitIPCEvent(cb, event("connect"))
+	}
+	err := c.readMessages(ic, func(msg Value) *runtimeError {
+		evt := event("message")
+		evt["data"] = msg
+		_, err := c.EvalFnValue(cb, false, evt)
+		return err
+	})
+	if err != nil && !ic.closedHere() {
+		evt := event("error")
+		evt["error"] = MakeString(err.reason)
+		c.emitIPCEvent(cb, evt)
+	}
+	ic.conn.Close()
+
+	if !ic.closedHere() {
+		c.emitIPCEvent(cb, event("end"))
+	}
+}
+
+// staleSocket reports whether path is a socket file that nothing is listening
+// on, as one left behind by a program that didn't exit cleanly.
+func staleSocket(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return true
+	}
+	conn.Close()
+	return false
+}
+
+func (c *Context) oakIPCListen(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___ipc_listen", args, 2); err != nil {
+		return nil, err
+	}
+
+	path, ok1 := args[0].(*StringValue)
+	cb, ok2 := args[1].(FnValue)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___ipc_listen(%s, %s)", args[0], args[1]),
+		}
+	}
+
+	listener, err := net.Listen("unix", path.stringContent())
+	if err != nil && staleSocket(path.stringContent()) {
+		os.Remove(path.stringContent())
+		listener, err = net.Listen("unix", path.stringContent())
+	}
+	if err != nil {
+		return errObj(fmt.Sprintf("Could not listen in ___ipc_listen(): %s", err.Error())), nil
+	}
+
+	var closeOnce sync.Once
+	stopped := make(chan struct{})
+	var conns sync.Map
+
+	// a listening socket keeps the program running until it's closed
+	c.eng.Add(1)
+	go func() {
+		defer c.eng.Done()
+
+		for id := 1; ; id++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-stopped:
+				default:
+					c.emitIPCEvent(cb, errObj(fmt.Sprintf("Error accepting connection in ___ipc_listen(): %s", err.Error())))
+				}
+				return
+			}
+
+			ic := newIPCConn(conn)
+			ic.obj["id"] = IntValue(id)
+			conns.Store(ic, true)
+			// a connection accepted as the listener closed would otherwise
+			// be missed by close()
+			select {
+			case <-stopped:
+				ic.close()
+			default:
+			}
+			c.eng.Add(1)
+			go func() {
+				defer c.eng.Done()
+				defer conns.Delete(ic)
+				c.serveIPCConn(ic, cb, true)
+			}()
+		}
+	}()
+
+	return BuiltinFnValue{
+		name: "close",
+		fn: func(_ []Value) (Value, *runtimeError) {
+			closeOnce.Do(func() {
+				close(stopped)
+				// closing the listener also removes its socket file
+				listener.Close()
+				conns.Range(func(ic, _ interface{}) bool {
+					ic.(*ipcConn).close()
+					return true
+				})
+			})
+			return null, nil
+		},
+	}, nil
+}
+
+func (c *Context) oakIPCConnect(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___ipc_connect", args, 2); err != nil {
+		return nil, err
+	}
+
+	path, ok1 := args[0].(*StringValue)
+	cb, ok2 := args[1].(FnValue)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___ipc_connect(%s, %s)", args[0], args[1]),
+		}
+	}
+
+	conn, err := net.Dial("unix", path.stringContent())
+	if err != nil {
+		return errObj(fmt.Sprintf("Could not connect in ___ipc_connect(): %s", err.Error())), nil
+	}
+
+	ic := newIPCConn(conn)
+
+	// an open connection keeps the program running until either side closes
+	// it
+	c.eng.Add(1)
+	go func() {
+		defer c.eng.Done()
+		c.serveIPCConn(ic, cb, false)
+	}()
+
+	return ic.obj, nil
+}
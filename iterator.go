@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// An iterator is an object with a next function, which returns an object
+// { done: false, value: x } for each value x of a sequence, and after the end
+// of the sequence returns { done: true, value: y }, where y is null unless the
+// iterator says otherwise. The std library understands this protocol, so
+// iterators can be mapped, filtered, and consumed lazily.
+
+// iteratorNext returns the next function of an object if it's an iterator.
+func iteratorNext(obj ObjectValue) (Value, bool) {
+	switch next := obj["next"].(type) {
+	case FnValue, BuiltinFnValue:
+		return next, true
+	}
+	return nil, false
+}
+
+func iterResult(done bool, v Value) ObjectValue {
+	return ObjectValue{
+		"done":  BoolValue(done),
+		"value": v,
+	}
+}
+
+// nativeIterator returns an iterator whose values are produced by next, which
+// reports false when the sequence has ended.
+func nativeIterator(next func() (Value, bool, *runtimeError)) ObjectValue {
+	done := false
+	return ObjectValue{
+		"next": BuiltinFnValue{
+			name: "next",
+			fn: func(_ []Value) (Value, *runtimeError) {
+				if done {
+					return iterResult(true, null), nil
+				}
+
+				v, ok, err := next()
+				if err != nil || !ok {
+					done = true
+				}
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					return iterResult(true, null), nil
+				}
+				return iterResult(false, v), nil
+			},
+		},
+	}
+}
+
+func (c *Context) oakSeq(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("seq", args, 1); err != nil {
+		return nil, err
+	}
+
+	// seq(start), seq(start, end), seq(start, end, step)
+	var start, end, step Value = args[0], null, IntValue(1)
+	if len(args) > 1 {
+		end = args[1]
+	}
+	if len(args) > 2 {
+		step = args[2]
+	}
+
+	_, startIsInt := start.(IntValue)
+	_, stepIsInt := step.(IntValue)
+	startNum, ok1 := toFloat(start)
+	stepNum, ok2 := toFloat(step)
+	endNum, ok3 := toFloat(end)
+	if _, isNull := end.(NullValue); isNull {
+		ok3 = true
+	}
+	if !ok1 || !ok2 || !ok3 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call seq(%s, %s, %s)", start, end, step),
+		}
+	}
+
+	ints := startIsInt && stepIsInt
+	_, infinite := end.(NullValue)
+	i := 0
+	return nativeIterator(func() (Value, bool, *runtimeError) {
+		if stepNum == 0 {
+			return nil, false, nil
+		}
+
+		// computing each value from the start avoids accumulating rounding
+		// errors in float sequences
+		n := startNum + float64(i)*stepNum
+		if !infinite && (stepNum > 0 && n >= endNum || stepNum < 0 && n <= endNum) {
+			return nil, false, nil
+		}
+		i++
+
+		if ints {
+			return IntValue(int64(start.(IntValue)) + int64(i-1)*int64(step.(IntValue))), true, nil
+		}
+		return FloatValue(n), true, nil
+	}), nil
+}
+
+func (c *Context) oakLines(args []Value) (Value, *runtimeError) {
+	var reader *bufio.Reader
+	var file *os.File
+	if len(args) == 0 {
+		inputReaderInit.Do(initInputReader)
+		reader = inputReader
+	} else {
+		path, ok := args[0].(*StringValue)
+		if !ok {
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Mismatched types in call lines(%s)", args[0]),
+			}
+		}
+
+		var err error
+		file, err = os.Open(path.stringContent())
+		if err != nil {
+			return errObj(fmt.Sprintf("Could not open file: %s", err.Error())), nil
+		}
+		reader = bufio.NewReader(file)
+	}
+
+	return nativeIterator(func() (Value, bool, *runtimeError) {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			if file != nil {
+				file.Close()
+			}
+			return nil, false, nil
+		} else if err != nil && err != io.EOF {
+			if file != nil {
+				file.Close()
+			}
+			return nil, false, &runtimeError{
+				kind:   "ioError",
+				reason: fmt.Sprintf("Could not read line in lines(): %s", err.Error()),
+			}
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		line = strings.TrimSuffix(line, "\r")
+		return MakeString(line), true, nil
+	}), nil
+}
+
+// ___for is the builtin that for expressions desugar to. ___for(xs, f,
+// collect) calls f(key, value) with each index and element of a list or
+// string, key and value of an object or map, or index and value of an
+// iterator, and returns the last value of f, or a list of every value of f if
+// collect is true. Object keys are iterated in sorted order.
+func (c *Context) oakFor(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___for", args, 3); err != nil {
+		return nil, err
+	}
+
+	f, collect := args[1], args[2] == oakTrue
+	var last Value = null
+	results := []Value{}
+	body := func(key, val Value) *runtimeError {
+		v, err := c.EvalFnValue(f, false, key, val)
+		if err != nil {
+			return err
+		}
+		if collect {
+			if err := c.allocList(len(results)+1, 1); err != nil {
+				return err
+			}
+			results = append(results, v)
+		}
+		last = v
+		return nil
+	}
+
+	var err *runtimeError
+	switch xs := args[0].(type) {
+	case *StringValue:
+		for i := 0; i < len(*xs) && err == nil; i++ {
+			err = body(IntValue(i), MakeString(string((*xs)[i])))
+		}
+	case *ListValue:
+		for i := 0; i < len(xs.elems) && err == nil; i++ {
+			err = body(IntValue(i), xs.elems[i])
+		}
+	case numArray:
+		for i := 0; i < xs.length() && err == nil; i++ {
+			err = body(IntValue(i), xs.at(i))
+		}
+	case ObjectValue:
+		if next, ok := iteratorNext(xs); ok {
+			err = c.forIterator(next, body)
+			break
+		}
+
+		keys := make([]string, 0, len(xs))
+		for key := range xs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			// the body may delete keys that haven't been visited yet
+			if val, ok := xs[key]; ok {
+				if err = body(MakeString(key), val); err != nil {
+					break
+				}
+			}
+		}
+	case *MapValue:
+		entries := make([]*mapEntry, 0, xs.len())
+		xs.each(func(key, val Value) {
+			entries = append(entries, &mapEntry{key: key, val: val})
+		})
+		for _, entry := range entries {
+			if err = body(entry.key, entry.val); err != nil {
+				break
+			}
+		}
+	default:
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Cannot iterate over %s in a for expression", args[0]),
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if collect {
+		return MakeList(results...), nil
+	}
+	return last, nil
+}
+
+// forIterator calls body with the index and value of each value of the
+// iterator whose next function is next, until the iterator is done.
+func (c *Context) forIterator(next Value, body func(key, val Value) *runtimeError) *runtimeError {
+	for i := 0; ; i++ {
+		r, err := c.EvalFnValue(next, false)
+		if err != nil {
+			return err
+		}
+		result, ok := r.(ObjectValue)
+		if !ok {
+			return &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Iterator next() should return an object, got %s", r),
+			}
+		}
+		if result["done"] == oakTrue {
+			return nil
+		}
+		val, ok := result["value"]
+		if !ok {
+			val = null
+		}
+		if err := body(IntValue(i), val); err != nil {
+			return err
+		}
+	}
+}
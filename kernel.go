@@ -0,0 +1,701 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// oak kernel is a Jupyter kernel, which evaluates the cells of a notebook in
+// one persistent context, over the Jupyter messaging protocol. Jupyter starts
+// the kernel with a connection file naming the ports of five ZeroMQ sockets:
+// shell and control for requests, iopub to publish output and status, stdin
+// (unused, since programs can't read input from the notebook), and a
+// heartbeat. See https://jupyter-client.readthedocs.io/en/latest/messaging.html
+
+const kernelProtocolVersion = "5.3"
+
+// kernelOakVersion is the version of Oak reported to frontends, as printed by
+// oak version.
+const kernelOakVersion = "0.3"
+
+// kernelDelimiter separates the routing ids of a message from its parts.
+const kernelDelimiter = "<IDS|MSG>"
+
+type kernelConnection struct {
+	Transport       string `json:"transport"`
+	IP              string `json:"ip"`
+	ShellPort       int    `json:"shell_port"`
+	IOPubPort       int    `json:"iopub_port"`
+	StdinPort       int    `json:"stdin_port"`
+	ControlPort     int    `json:"control_port"`
+	HBPort          int    `json:"hb_port"`
+	Key             string `json:"key"`
+	SignatureScheme string `json:"signature_scheme"`
+}
+
+type kernelHeader struct {
+	MsgID    string `json:"msg_id"`
+	Session  string `json:"session"`
+	Username string `json:"username"`
+	Date     string `json:"date"`
+	MsgType  string `json:"msg_type"`
+	Version  string `json:"version"`
+}
+
+type kernelMessage struct {
+	ids      [][]byte
+	header   kernelHeader
+	parent   json.RawMessage
+	metadata json.RawMessage
+	content  json.RawMessage
+}
+
+type kernel struct {
+	key     []byte
+	session string
+	ctx     *Context
+
+	// guards execution, since requests may come from more than one frontend
+	execLock       sync.Mutex
+	executionCount int
+
+	iopubLock   sync.Mutex
+	subscribers map[*zmtpConn]bool
+	// output is published with the header of the request that printed it,
+	// or that ran last, if it's printed later from a callback
+	outputParent json.RawMessage
+
+	shutdown chan bool
+}
+
+func kernelID() string {
+	id := make([]byte, 16)
+	crand.Read(id)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+func (k *kernel) sign(parts ...[]byte) string {
+	if len(k.key) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, k.key)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseMessage reads a message from its frames, or returns an error if it's
+// malformed or its signature isn't valid.
+func (k *kernel) parseMessage(frames [][]byte) (kernelMessage, error) {
+	msg := kernelMessage{}
+	for i, frame := range frames {
+		if string(frame) != kernelDelimiter {
+			continue
+		}
+		if len(frames) < i+6 {
+			return msg, errors.New("message is missing parts")
+		}
+
+		msg.ids = frames[:i]
+		parts := frames[i+2 : i+6]
+		signature := string(frames[i+1])
+		if !hmac.Equal([]byte(signature), []byte(k.sign(parts...))) {
+			return msg, errors.New("message has an invalid signature")
+		}
+		if err := json.Unmarshal(parts[0], &msg.header); err != nil {
+			return msg, err
+		}
+		msg.parent, msg.metadata, msg.content = parts[1], parts[2], parts[3]
+		return msg, nil
+	}
+	return msg, errors.New("message has no delimiter")
+}
+
+// frames returns the frames of a new message of type msgType, sent to ids in
+// response to a message with the header parent.
+func (k *kernel) frames(ids [][]byte, parent json.RawMessage, msgType string, content interface{}) [][]byte {
+	header, _ := json.Marshal(kernelHeader{
+		MsgID:    kernelID(),
+		Session:  k.session,
+		Username: "kernel",
+		Date:     time.Now().UTC().Format(time.RFC3339Nano),
+		MsgType:  msgType,
+		Version:  kernelProtocolVersion,
+	})
+	if len(parent) == 0 {
+		parent = json.RawMessage("{}")
+	}
+	metadata := []byte("{}")
+	body, _ := json.Marshal(content)
+
+	frames := append([][]byte{}, ids...)
+	return append(frames,
+		[]byte(kernelDelimiter),
+		[]byte(k.sign(header, parent, metadata, body)),
+		header, parent, metadata, body,
+	)
+}
+
+func (k *kernel) reply(zc *zmtpConn, req kernelMessage, msgType string, content interface{}) {
+	zc.send(k.frames(req.ids, req.header.raw(), msgType, content))
+}
+
+func (h kernelHeader) raw() json.RawMessage {
+	raw, _ := json.Marshal(h)
+	return raw
+}
+
+// publish sends a message to every frontend subscribed to iopub.
+func (k *kernel) publish(parent json.RawMessage, msgType string, content interface{}) {
+	frames := k.frames([][]byte{[]byte("kernel." + k.session + "." + msgType)}, parent, msgType, content)
+
+	k.iopubLock.Lock()
+	defer k.iopubLock.Unlock()
+	for zc := range k.subscribers {
+		zc.send(frames)
+	}
+}
+
+func (k *kernel) setOutputParent(parent json.RawMessage) {
+	k.iopubLock.Lock()
+	defer k.iopubLock.Unlock()
+	k.outputParent = parent
+}
+
+// kernelOutput publishes output written to a stream to the notebook.
+type kernelOutput struct {
+	k      *kernel
+	stream string
+}
+
+func (o kernelOutput) Write(p []byte) (int, error) {
+	o.k.iopubLock.Lock()
+	parent := o.k.outputParent
+	o.k.iopubLock.Unlock()
+
+	o.k.publish(parent, "stream", map[string]string{
+		"name": o.stream,
+		"text": string(p),
+	})
+	return len(p), nil
+}
+
+// kernelDisplayData returns the representations of val shown in a notebook.
+// Objects and lists of objects or lists are also shown as HTML tables.
+func kernelDisplayData(val Value) map[string]string {
+	data := map[string]string{
+		"text/plain": val.String(),
+	}
+
+	cell := func(v Value) string {
+		if s, ok := v.(*StringValue); ok {
+			return html.EscapeString(s.stringContent())
+		}
+		return html.EscapeString(v.String())
+	}
+
+	var table strings.Builder
+	switch v := val.(type) {
+	case ObjectValue:
+		if len(v) == 0 {
+			return data
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		table.WriteString("<table>\n")
+		for _, key := range keys {
+			fmt.Fprintf(&table, "<tr><th>%s</th><td>%s</td></tr>\n", html.EscapeString(key), cell(v[key]))
+		}
+		table.WriteString("</table>")
+	case *ListValue:
+		if len(v.elems) == 0 {
+			return data
+		}
+
+		// every row must be an object, or every row must be a list
+		objects, lists := 0, 0
+		columnSet := map[string]bool{}
+		for _, elem := range v.elems {
+			switch row := elem.(type) {
+			case ObjectValue:
+				objects++
+				for key := range row {
+					columnSet[key] = true
+				}
+			case *ListValue:
+				lists++
+			}
+		}
+		if objects != len(v.elems) && lists != len(v.elems) {
+			return data
+		}
+		columns := make([]string, 0, len(columnSet))
+		for column := range columnSet {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+
+		table.WriteString("<table>\n")
+		if len(columns) > 0 {
+			table.WriteString("<tr>")
+			for _, column := range columns {
+				fmt.Fprintf(&table, "<th>%s</th>", html.EscapeString(column))
+			}
+			table.WriteString("</tr>\n")
+		}
+		for _, elem := range v.elems {
+			table.WriteString("<tr>")
+			switch row := elem.(type) {
+			case ObjectValue:
+				for _, column := range columns {
+					if v, ok := row[column]; ok {
+						fmt.Fprintf(&table, "<td>%s</td>", cell(v))
+					} else {
+						table.WriteString("<td></td>")
+					}
+				}
+			case *ListValue:
+				for _, v := range row.elems {
+					fmt.Fprintf(&table, "<td>%s</td>", cell(v))
+				}
+			}
+			table.WriteString("</tr>\n")
+		}
+		table.WriteString("</table>")
+	default:
+		return data
+	}
+
+	data["text/html"] = table.String()
+	return data
+}
+
+// kernelIsComplete reports whether code is ready to run, or whether the
+// frontend should let the user keep typing because a bracket is still open.
+func kernelIsComplete(code string) string {
+	tokens, err := Tokenize(strings.NewReader(code))
+	if err != nil {
+		return "invalid"
+	}
+
+	depth := 0
+	for _, tok := range tokens {
+		switch tok.kind {
+		case leftParen, leftBracket, leftBrace:
+			depth++
+		case rightParen, rightBracket, rightBrace:
+			depth--
+		}
+	}
+	if depth > 0 {
+		return "incomplete"
+	}
+	return "complete"
+}
+
+func (k *kernel) kernelInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"status":                 "ok",
+		"protocol_version":       kernelProtocolVersion,
+		"implementation":         "oak",
+		"implementation_version": kernelOakVersion,
+		"language_info": map[string]string{
+			"name":           "oak",
+			"version":        kernelOakVersion,
+			"mimetype":       "text/x-oak",
+			"file_extension": ".oak",
+		},
+		"banner":     "Oak v" + kernelOakVersion,
+		"help_links": []interface{}{},
+	}
+}
+
+func (k *kernel) execute(req kernelMessage) map[string]interface{} {
+	var content struct {
+		Code   string `json:"code"`
+		Silent bool   `json:"silent"`
+	}
+	json.Unmarshal(req.content, &content)
+
+	k.execLock.Lock()
+	defer k.execLock.Unlock()
+
+	parent := req.header.raw()
+	if !content.Silent {
+		k.executionCount++
+	}
+	count := k.executionCount
+	if !content.Silent {
+		k.publish(parent, "execute_input", map[string]interface{}{
+			"code":            content.Code,
+			"execution_count": count,
+		})
+	}
+
+	k.setOutputParent(parent)
+	val, err := k.ctx.Eval(strings.NewReader(content.Code))
+	stdoutStream.Flush()
+	stderrStream.Flush()
+
+	if err != nil {
+		ename := "error"
+		evalue := err.Error()
+		switch e := err.(type) {
+		case *runtimeError:
+			ename, evalue = e.errKind(), e.reason
+		case parseError:
+			ename, evalue = "parseError", e.reason
+		}
+		errContent := map[string]interface{}{
+			"ename":     ename,
+			"evalue":    evalue,
+			"traceback": strings.Split(strings.TrimSpace(err.Error()), "\n"),
+		}
+		k.publish(parent, "error", errContent)
+
+		errContent["status"] = "error"
+		errContent["execution_count"] = count
+		return errContent
+	}
+
+	k.ctx.Lock()
+	k.ctx.scope.put("__", val)
+	k.ctx.Unlock()
+	if _, isNull := val.(NullValue); !isNull && !content.Silent {
+		k.publish(parent, "execute_result", map[string]interface{}{
+			"execution_count": count,
+			"data":            kernelDisplayData(val),
+			"metadata":        map[string]interface{}{},
+		})
+	}
+
+	return map[string]interface{}{
+		"status":           "ok",
+		"execution_count":  count,
+		"user_expressions": map[string]interface{}{},
+		"payload":          []interface{}{},
+	}
+}
+
+// complete suggests names defined at the top level of the program that begin
+// with the identifier before the cursor.
+func (k *kernel) complete(req kernelMessage) map[string]interface{} {
+	var content struct {
+		Code      string `json:"code"`
+		CursorPos int    `json:"cursor_pos"`
+	}
+	json.Unmarshal(req.content, &content)
+
+	// the cursor position is counted in Unicode code points
+	code := []rune(content.Code)
+	end := content.CursorPos
+	if end < 0 || end > len(code) {
+		end = len(code)
+	}
+	start := end
+	for start > 0 {
+		c := code[start-1]
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' && c != '?' && c != '!' {
+			break
+		}
+		start--
+	}
+	prefix := string(code[start:end])
+
+	matches := []string{}
+	k.ctx.Lock()
+	for name := range k.ctx.scope.vars {
+		if strings.HasPrefix(name, prefix) {
+			matches = append(matches, name)
+		}
+	}
+	k.ctx.Unlock()
+	sort.Strings(matches)
+
+	return map[string]interface{}{
+		"status":       "ok",
+		"matches":      matches,
+		"cursor_start": start,
+		"cursor_end":   end,
+		"metadata":     map[string]interface{}{},
+	}
+}
+
+// handleRequests responds to requests from a frontend on the shell or control
+// socket.
+func (k *kernel) handleRequests(zc *zmtpConn) {
+	for {
+		frames, err := zc.receive()
+		if err != nil {
+			return
+		}
+		req, err := k.parseMessage(frames)
+		if err != nil {
+			continue
+		}
+
+		parent := req.header.raw()
+		k.publish(parent, "status", map[string]string{"execution_state": "busy"})
+
+		switch req.header.MsgType {
+		case "kernel_info_request":
+			k.reply(zc, req, "kernel_info_reply", k.kernelInfo())
+		case "execute_request":
+			k.reply(zc, req, "execute_reply", k.execute(req))
+		case "is_complete_request":
+			var content struct {
+				Code string `json:"code"`
+			}
+			json.Unmarshal(req.content, &content)
+			k.reply(zc, req, "is_complete_reply", map[string]string{
+				"status": kernelIsComplete(content.Code),
+			})
+		case "complete_request":
+			k.reply(zc, req, "complete_reply", k.complete(req))
+		case "inspect_request":
+			k.reply(zc, req, "inspect_reply", map[string]interface{}{
+				"status":   "ok",
+				"found":    false,
+				"data":     map[string]interface{}{},
+				"metadata": map[string]interface{}{},
+			})
+		case "history_request":
+			k.reply(zc, req, "history_reply", map[string]interface{}{
+				"status":  "ok",
+				"history": []interface{}{},
+			})
+		case "comm_info_request":
+			k.reply(zc, req, "comm_info_reply", map[string]interface{}{
+				"status": "ok",
+				"comms":  map[string]interface{}{},
+			})
+		case "interrupt_request":
+			// Oak programs can't be interrupted from another goroutine, so
+			// this only acknowledges the request
+			k.reply(zc, req, "interrupt_reply", map[string]string{"status": "ok"})
+		case "shutdown_request":
+			var content struct {
+				Restart bool `json:"restart"`
+			}
+			json.Unmarshal(req.content, &content)
+			k.reply(zc, req, "shutdown_reply", map[string]interface{}{
+				"status":  "ok",
+				"restart": content.Restart,
+			})
+			k.publish(parent, "status", map[string]string{"execution_state": "idle"})
+			k.shutdown <- true
+			return
+		}
+
+		k.publish(parent, "status", map[string]string{"execution_state": "idle"})
+	}
+}
+
+func (k *kernel) subscribe(zc *zmtpConn) {
+	k.iopubLock.Lock()
+	k.subscribers[zc] = true
+	k.iopubLock.Unlock()
+
+	// subscriptions aren't filtered, since frontends subscribe to every
+	// message, so incoming messages are only read to notice when the
+	// frontend goes away
+	for {
+		if _, err := zc.receive(); err != nil {
+			break
+		}
+	}
+
+	k.iopubLock.Lock()
+	delete(k.subscribers, zc)
+	k.iopubLock.Unlock()
+}
+
+// startKernel listens on the sockets in conn, and returns the kernel and a
+// function that stops it.
+func startKernel(conn kernelConnection) (*kernel, func(), error) {
+	if conn.Transport != "" && conn.Transport != "tcp" {
+		return nil, nil, fmt.Errorf("unsupported transport %s", conn.Transport)
+	}
+	if conn.SignatureScheme != "" && conn.SignatureScheme != "hmac-sha256" {
+		return nil, nil, fmt.Errorf("unsupported signature scheme %s", conn.SignatureScheme)
+	}
+
+	ctx := NewContextWithCwd()
+	k := &kernel{
+		key:         []byte(conn.Key),
+		session:     kernelID(),
+		ctx:         &ctx,
+		subscribers: map[*zmtpConn]bool{},
+		shutdown:    make(chan bool, 1),
+	}
+
+	sockets := []struct {
+		port       int
+		socketType string
+		handle     func(zc *zmtpConn)
+	}{
+		{conn.ShellPort, "ROUTER", k.handleRequests},
+		{conn.ControlPort, "ROUTER", k.handleRequests},
+		{conn.IOPubPort, "PUB", k.subscribe},
+		{conn.StdinPort, "ROUTER", func(zc *zmtpConn) {
+			for {
+				if _, err := zc.receive(); err != nil {
+					return
+				}
+			}
+		}},
+		{conn.HBPort, "REP", func(zc *zmtpConn) {
+			for {
+				frames, err := zc.receive()
+				if err != nil {
+					return
+				}
+				zc.send(frames)
+			}
+		}},
+	}
+
+	listeners := []net.Listener{}
+	stop := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	for _, socket := range sockets {
+		listener, err := net.Listen("tcp", net.JoinHostPort(conn.IP, fmt.Sprint(socket.port)))
+		if err != nil {
+			stop()
+			return nil, nil, err
+		}
+		listeners = append(listeners, listener)
+		go zmtpListen(listener, socket.socketType, socket.handle)
+	}
+
+	ctx.LoadBuiltins()
+	ctx.LoadPlugins()
+	ctx.mustLoadAllLibs()
+	ctx.eng.reportErr = func(err error) {
+		k.iopubLock.Lock()
+		parent := k.outputParent
+		k.iopubLock.Unlock()
+		k.publish(parent, "stream", map[string]string{
+			"name": "stderr",
+			"text": err.Error() + "\n",
+		})
+	}
+
+	stdoutStream.Lock()
+	stdoutStream.out = kernelOutput{k: k, stream: "stdout"}
+	stdoutStream.Unlock()
+	stderrStream.Lock()
+	stderrStream.out = kernelOutput{k: k, stream: "stderr"}
+	stderrStream.Unlock()
+
+	return k, stop, nil
+}
+
+// jupyterDataDir returns the directory where Jupyter looks for kernels
+// installed by the user.
+func jupyterDataDir() (string, error) {
+	if dir := os.Getenv("JUPYTER_DATA_DIR"); dir != "" {
+		return dir, nil
+	}
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(os.Getenv("APPDATA"), "jupyter"), nil
+	case "darwin":
+		homeDir, err := os.UserHomeDir()
+		return filepath.Join(homeDir, "Library", "Jupyter"), err
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "jupyter"), nil
+	}
+	homeDir, err := os.UserHomeDir()
+	return filepath.Join(homeDir, ".local", "share", "jupyter"), err
+}
+
+// installKernel writes a kernel spec that runs this interpreter, so Oak shows
+// up as a kernel in Jupyter, and returns its path.
+func installKernel() (string, error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	dataDir, err := jupyterDataDir()
+	if err != nil {
+		return "", err
+	}
+
+	spec, _ := json.MarshalIndent(map[string]interface{}{
+		"argv":         []string{exePath, "kernel", "{connection_file}"},
+		"display_name": "Oak",
+		"language":     "oak",
+	}, "", "  ")
+	specDir := filepath.Join(dataDir, "kernels", "oak")
+	if err := os.MkdirAll(specDir, 0755); err != nil {
+		return "", err
+	}
+	specPath := filepath.Join(specDir, "kernel.json")
+	return specPath, os.WriteFile(specPath, append(spec, '\n'), 0644)
+}
+
+func runKernel(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: oak kernel <connection-file>, or oak kernel install")
+		os.Exit(1)
+	}
+
+	if args[0] == "install" {
+		specPath, err := installKernel()
+		if err != nil {
+			fmt.Printf("[oak kernel] Could not install kernel: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("[oak kernel] Installed kernel spec at %s\n", specPath)
+		return
+	}
+
+	connFile, err := os.ReadFile(args[0])
+	if err != nil {
+		fmt.Printf("[oak kernel] Could not read connection file: %s\n", err)
+		os.Exit(1)
+	}
+	var conn kernelConnection
+	if err := json.Unmarshal(connFile, &conn); err != nil {
+		fmt.Printf("[oak kernel] Invalid connection file: %s\n", err)
+		os.Exit(1)
+	}
+
+	k, stop, err := startKernel(conn)
+	if err != nil {
+		fmt.Printf("[oak kernel] Could not start kernel: %s\n", err)
+		os.Exit(1)
+	}
+	k.publish(nil, "status", map[string]string{"execution_state": "starting"})
+
+	<-k.shutdown
+	stop()
+}
@@ -58,6 +58,63 @@ var libcrypto string
 //go:embed lib/syntax.oak
 var libsyntax string
 
+//go:embed lib/msgpack.oak
+var libmsgpack string
+
+//go:embed lib/yaml.oak
+var libyaml string
+
+//go:embed lib/toml.oak
+var libtoml string
+
+//go:embed lib/template.oak
+var libtemplate string
+
+//go:embed lib/term.oak
+var libterm string
+
+//go:embed lib/log.oak
+var liblog string
+
+//go:embed lib/net.oak
+var libnet string
+
+//go:embed lib/mail.oak
+var libmail string
+
+//go:embed lib/assets.oak
+var libassets string
+
+//go:embed lib/dom.oak
+var libdom string
+
+//go:embed lib/ffi.oak
+var libffi string
+
+//go:embed lib/rpc.oak
+var librpc string
+
+//go:embed lib/bench.oak
+var libbench string
+
+//go:embed lib/runtime.oak
+var libruntime string
+
+//go:embed lib/locale.oak
+var liblocale string
+
+//go:embed lib/bits.oak
+var libbits string
+
+//go:embed lib/reactive.oak
+var libreactive string
+
+//go:embed lib/task.oak
+var libtask string
+
+//go:embed lib/ipc.oak
+var libipc string
+
 var stdlibs = map[string]string{
 	"std":      libstd,
 	"str":      libstr,
@@ -76,6 +133,25 @@ var stdlibs = map[string]string{
 	"md":       libmd,
 	"crypto":   libcrypto,
 	"syntax":   libsyntax,
+	"msgpack":  libmsgpack,
+	"yaml":     libyaml,
+	"toml":     libtoml,
+	"template": libtemplate,
+	"term":     libterm,
+	"log":      liblog,
+	"net":      libnet,
+	"mail":     libmail,
+	"assets":   libassets,
+	"dom":      libdom,
+	"ffi":      libffi,
+	"rpc":      librpc,
+	"bench":    libbench,
+	"runtime":  libruntime,
+	"locale":   liblocale,
+	"bits":     libbits,
+	"reactive": libreactive,
+	"task":     libtask,
+	"ipc":      libipc,
 }
 
 func isStdLib(name string) bool {
@@ -87,32 +163,36 @@ func (c *Context) LoadLib(name string) (Value, *runtimeError) {
 	program, ok := stdlibs[name]
 	if !ok {
 		return nil, &runtimeError{
+			kind:   "importError",
 			reason: fmt.Sprintf("%s is not a valid standard library; could not import", name),
+			data:   ObjectValue{"path": MakeString(name)},
 		}
 	}
 
 	if imported, ok := c.eng.importMap[name]; ok {
-		return ObjectValue(imported.vars), nil
+		return moduleExports(imported), nil
 	}
 
 	ctx := c.ChildContext(c.rootPath)
 	ctx.LoadBuiltins()
 
 	ctx.Unlock()
-	_, err := ctx.Eval(strings.NewReader(program))
+	_, err := ctx.EvalSource([]byte(program))
 	ctx.Lock()
 	if err != nil {
 		if runtimeErr, ok := err.(*runtimeError); ok {
 			return nil, runtimeErr
 		} else {
 			return nil, &runtimeError{
+				kind:   "importError",
 				reason: fmt.Sprintf("Error loading %s: %s", name, err.Error()),
+				data:   ObjectValue{"path": MakeString(name)},
 			}
 		}
 	}
 
 	c.eng.importMap[name] = ctx.scope
-	return ObjectValue(ctx.scope.vars), nil
+	return moduleExports(ctx.scope), nil
 }
 
 func (c *Context) loadAllLibs() error {
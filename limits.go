@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Limits bounds the resources a program may use in a Context, for running
+// untrusted Oak programs. A zero field means no limit. When a program exceeds
+// a limit, evaluation stops with a runtime error.
+type Limits struct {
+	// MaxCallDepth is the maximum number of nested function calls. Tail calls
+	// do not nest, so tail-recursive loops are not limited by it.
+	MaxCallDepth int
+	// MaxAllocBytes is the maximum number of bytes of strings, lists, and
+	// objects created by a program over its whole run. This is an estimate
+	// that counts each list element or object entry as a fixed size.
+	MaxAllocBytes int64
+	// MaxStringLen is the maximum length in bytes of a string built by a
+	// string literal, concatenation, push, or builtin.
+	MaxStringLen int
+	// MaxListLen is the maximum length of a list built by a list literal,
+	// push, or builtin.
+	MaxListLen int
+}
+
+const (
+	// estimated sizes of a list element and an object entry, for MaxAllocBytes
+	valueAllocSize = 16
+	entryAllocSize = 48
+)
+
+// SetLimits sets the resource limits of this context and every context that
+// shares its interpreter, such as those of imported modules. It should be
+// called before evaluating any programs.
+func (c *Context) SetLimits(limits Limits) {
+	c.eng.limits = limits
+}
+
+// alloc records that the program allocated n bytes. It's safe to call from
+// builtins that run off the interpreter lock, like read() given a callback.
+func (c *Context) alloc(n int) *runtimeError {
+	max := c.eng.limits.MaxAllocBytes
+	if max <= 0 {
+		return nil
+	}
+
+	if atomic.AddInt64(&c.eng.allocated, int64(n)) > max {
+		return &runtimeError{
+			kind:   "limitError",
+			reason: fmt.Sprintf("Memory limit of %d bytes exceeded", max),
+		}
+	}
+	return nil
+}
+
+// allocString records the allocation of added bytes in a string that will have
+// length n, and checks it against the string length limit.
+func (c *Context) allocString(n, added int) *runtimeError {
+	if max := c.eng.limits.MaxStringLen; max > 0 && n > max {
+		return &runtimeError{
+			kind:   "limitError",
+			reason: fmt.Sprintf("String length limit of %d bytes exceeded", max),
+		}
+	}
+	return c.alloc(added)
+}
+
+// allocList records the allocation of added list elements in a list that will
+// have length n, and checks it against the list length limit.
+func (c *Context) allocList(n, added int) *runtimeError {
+	if max := c.eng.limits.MaxListLen; max > 0 && n > max {
+		return &runtimeError{
+			kind:   "limitError",
+			reason: fmt.Sprintf("List length limit of %d exceeded", max),
+		}
+	}
+	return c.alloc(added * valueAllocSize)
+}
+
+// makeString returns s as a string value built by a builtin, once its
+// allocation is checked against the limits.
+func (c *Context) makeString(s string) (Value, *runtimeError) {
+	if err := c.allocString(len(s), len(s)); err != nil {
+		return nil, err
+	}
+	return MakeString(s), nil
+}
+
+// makeList returns a list of elems built by a builtin, once its allocation is
+// checked against the limits.
+func (c *Context) makeList(elems ...Value) (Value, *runtimeError) {
+	if err := c.allocList(len(elems), len(elems)); err != nil {
+		return nil, err
+	}
+	return MakeList(elems...), nil
+}
+
+// allocValue records the allocation of v, a value a builtin has just built
+// like a parsed document, and of every string, list, and object in it. Lists
+// and objects reachable more than once, as through a YAML alias, are counted
+// once.
+func (c *Context) allocValue(v Value, seen map[uintptr]bool) *runtimeError {
+	if id, ok := containerID(v); ok {
+		if seen[id] {
+			return nil
+		}
+		seen[id] = true
+	}
+
+	switch val := v.(type) {
+	case *StringValue:
+		return c.allocString(len(*val), len(*val))
+	case numArray:
+		return c.allocList(val.length(), val.length())
+	case *ListValue:
+		if err := c.allocList(len(val.elems), len(val.elems)); err != nil {
+			return err
+		}
+		for _, elem := range val.elems {
+			if err := c.allocValue(elem, seen); err != nil {
+				return err
+			}
+		}
+	case ObjectValue:
+		if err := c.alloc(len(val) * entryAllocSize); err != nil {
+			return err
+		}
+		for key, elem := range val {
+			if err := c.allocString(len(key), len(key)); err != nil {
+				return err
+			}
+			if err := c.allocValue(elem, seen); err != nil {
+				return err
+			}
+		}
+	case *MapValue:
+		if err := c.alloc(val.len() * entryAllocSize); err != nil {
+			return err
+		}
+		var err *runtimeError
+		val.each(func(key, elem Value) {
+			if err == nil {
+				err = c.allocValue(key, seen)
+			}
+			if err == nil {
+				err = c.allocValue(elem, seen)
+			}
+		})
+		return err
+	}
+	return nil
+}
+
+// enterCall records that a function call has started, and checks it against
+// the call depth limit. Each call to enterCall must be followed by a call to
+// exitCall.
+func (c *Context) enterCall() *runtimeError {
+	c.eng.callDepth++
+	if max := c.eng.limits.MaxCallDepth; max > 0 && c.eng.callDepth > max {
+		return &runtimeError{
+			kind:   "limitError",
+			reason: fmt.Sprintf("Call depth limit of %d exceeded", max),
+		}
+	}
+	return nil
+}
+
+func (c *Context) exitCall() {
+	c.eng.callDepth--
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sending email over SMTP, for the mail standard library.
+
+const mailDialTimeout = 30 * time.Second
+
+type mailAttachment struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+type mailMessage struct {
+	from        string
+	to          []string
+	cc          []string
+	bcc         []string
+	subject     string
+	body        string
+	html        bool
+	attachments []mailAttachment
+}
+
+// mailOptString reads an optional string from a mail options object, returning
+// "" if it's not set.
+func mailOptString(opts ObjectValue, key string) (string, *runtimeError) {
+	switch v := opts[key].(type) {
+	case nil, NullValue:
+		return "", nil
+	case *StringValue:
+		return v.stringContent(), nil
+	default:
+		return "", &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mail option %s must be a string, got %s", key, v),
+		}
+	}
+}
+
+// mailOptAddrs reads a list of addresses from a mail options object, which may
+// be given as one string or a list of strings.
+func mailOptAddrs(opts ObjectValue, key string) ([]string, *runtimeError) {
+	switch v := opts[key].(type) {
+	case nil, NullValue:
+		return nil, nil
+	case *StringValue:
+		return []string{v.stringContent()}, nil
+	case *ListValue:
+		addrs := make([]string, len(v.elems))
+		for i, elem := range v.elems {
+			addr, ok := elem.(*StringValue)
+			if !ok {
+				return nil, &runtimeError{
+					kind:   "typeError",
+					reason: fmt.Sprintf("Mail option %s must contain strings, got %s", key, elem),
+				}
+			}
+			addrs[i] = addr.stringContent()
+		}
+		return addrs, nil
+	default:
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mail option %s must be a string or list, got %s", key, v),
+		}
+	}
+}
+
+func parseMailMessage(opts ObjectValue) (*mailMessage, *runtimeError) {
+	var msg mailMessage
+	var err *runtimeError
+	if msg.from, err = mailOptString(opts, "from"); err != nil {
+		return nil, err
+	}
+	if msg.to, err = mailOptAddrs(opts, "to"); err != nil {
+		return nil, err
+	}
+	if msg.cc, err = mailOptAddrs(opts, "cc"); err != nil {
+		return nil, err
+	}
+	if msg.bcc, err = mailOptAddrs(opts, "bcc"); err != nil {
+		return nil, err
+	}
+	if msg.subject, err = mailOptString(opts, "subject"); err != nil {
+		return nil, err
+	}
+	if msg.body, err = mailOptString(opts, "body"); err != nil {
+		return nil, err
+	}
+	if html, ok := opts["html?"].(BoolValue); ok {
+		msg.html = bool(html)
+	}
+
+	if msg.from == "" || len(msg.to)+len(msg.cc)+len(msg.bcc) == 0 {
+		return nil, &runtimeError{
+			kind:   "valueError",
+			reason: "Mail message must have a sender and at least one recipient",
+		}
+	}
+
+	var attachments []Value
+	switch v := opts["attachments"].(type) {
+	case nil, NullValue:
+	case *ListValue:
+		attachments = v.elems
+	default:
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mail option attachments must be a list, got %s", v),
+		}
+	}
+	for _, attachment := range attachments {
+		var a mailAttachment
+		switch v := attachment.(type) {
+		case *StringValue:
+			// a string is a path to a file to attach
+			path := v.stringContent()
+			data, readErr := os.ReadFile(path)
+			if readErr != nil {
+				return nil, &runtimeError{
+					kind:   "ioError",
+					reason: fmt.Sprintf("Could not read attachment: %s", readErr.Error()),
+				}
+			}
+			a.name = filepath.Base(path)
+			a.data = data
+		case ObjectValue:
+			if a.name, err = mailOptString(v, "name"); err != nil {
+				return nil, err
+			}
+			if a.contentType, err = mailOptString(v, "type"); err != nil {
+				return nil, err
+			}
+			data, ok := v["data"].(*StringValue)
+			if !ok || a.name == "" {
+				return nil, &runtimeError{
+					kind:   "typeError",
+					reason: fmt.Sprintf("Mail attachment must have a name and string data, got %s", v),
+				}
+			}
+			a.data = *data
+		default:
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Mail attachment must be a path or an object, got %s", attachment),
+			}
+		}
+		if a.contentType == "" {
+			a.contentType = mime.TypeByExtension(filepath.Ext(a.name))
+		}
+		if a.contentType == "" {
+			a.contentType = "application/octet-stream"
+		}
+		msg.attachments = append(msg.attachments, a)
+	}
+
+	return &msg, nil
+}
+
+// recipients returns the addresses the message is delivered to, without
+// display names.
+func (msg *mailMessage) recipients() ([]string, error) {
+	var rcpts []string
+	for _, list := range [][]string{msg.to, msg.cc, msg.bcc} {
+		for _, addr := range list {
+			parsed, err := mail.ParseAddress(addr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %s: %s", strconv.Quote(addr), err.Error())
+			}
+			rcpts = append(rcpts, parsed.Address)
+		}
+	}
+	return rcpts, nil
+}
+
+// writeBase64 writes data in base64, wrapped at 76 characters as MIME
+// requires.
+func writeBase64(buf *bytes.Buffer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+}
+
+// bytes returns the message in MIME format. The Bcc header is left out, so
+// that blind copies stay blind.
+func (msg *mailMessage) bytes(date time.Time) []byte {
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		buf.WriteString(key + ": " + value + "\r\n")
+	}
+
+	header("From", msg.from)
+	if len(msg.to) > 0 {
+		header("To", strings.Join(msg.to, ", "))
+	}
+	if len(msg.cc) > 0 {
+		header("Cc", strings.Join(msg.cc, ", "))
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.subject))
+	header("Date", date.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+
+	bodyType := "text/plain; charset=utf-8"
+	if msg.html {
+		bodyType = "text/html; charset=utf-8"
+	}
+	writeBody := func() {
+		qp := quotedprintable.NewWriter(&buf)
+		qp.Write([]byte(msg.body))
+		qp.Close()
+		buf.WriteString("\r\n")
+	}
+
+	if len(msg.attachments) == 0 {
+		header("Content-Type", bodyType)
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		writeBody()
+		return buf.Bytes()
+	}
+
+	mw := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	buf.WriteString("\r\n")
+
+	mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {bodyType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	writeBody()
+	for _, a := range msg.attachments {
+		mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.name})},
+		})
+		writeBase64(&buf, a.data)
+	}
+	mw.Close()
+	return buf.Bytes()
+}
+
+func (c *Context) mailMessageArg(name string, args []Value) (*mailMessage, ObjectValue, *runtimeError) {
+	if err := c.requireArgLen(name, args, 1); err != nil {
+		return nil, nil, err
+	}
+	opts, ok := args[0].(ObjectValue)
+	if !ok {
+		return nil, nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call %s(%s)", name, args[0]),
+		}
+	}
+	msg, err := parseMailMessage(opts)
+	return msg, opts, err
+}
+
+func (c *Context) oakMailMessage(args []Value) (Value, *runtimeError) {
+	msg, _, err := c.mailMessageArg("___mail_message", args)
+	if err != nil {
+		return nil, err
+	}
+	return MakeString(string(msg.bytes(time.Now()))), nil
+}
+
+func (c *Context) oakMailSend(args []Value) (Value, *runtimeError) {
+	msg, opts, err := c.mailMessageArg("___mail_send", args)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := mailOptString(opts, "host")
+	if err != nil {
+		return nil, err
+	}
+	user, err := mailOptString(opts, "user")
+	if err != nil {
+		return nil, err
+	}
+	password, err := mailOptString(opts, "password")
+	if err != nil {
+		return nil, err
+	}
+	implicitTLS := false
+	if tlsOpt, ok := opts["tls?"].(BoolValue); ok {
+		implicitTLS = bool(tlsOpt)
+	}
+	port := 587
+	if implicitTLS {
+		port = 465
+	}
+	switch v := opts["port"].(type) {
+	case nil, NullValue:
+	case IntValue:
+		port = int(v)
+	default:
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mail option port must be an int, got %s", v),
+		}
+	}
+	if host == "" {
+		return nil, &runtimeError{
+			kind:   "valueError",
+			reason: "Mail option host is required to send a message",
+		}
+	}
+
+	tlsConfig := &tls.Config{ServerName: host}
+	if insecure, ok := opts["insecure?"].(BoolValue); ok {
+		tlsConfig.InsecureSkipVerify = bool(insecure)
+	}
+
+	sendErr := func(e error) (Value, *runtimeError) {
+		return errObj(fmt.Sprintf("Could not send mail: %s", e.Error())), nil
+	}
+
+	sender, parseErr := mail.ParseAddress(msg.from)
+	if parseErr != nil {
+		return sendErr(fmt.Errorf("invalid address %s: %s", strconv.Quote(msg.from), parseErr.Error()))
+	}
+	rcpts, rcptErr := msg.recipients()
+	if rcptErr != nil {
+		return sendErr(rcptErr)
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	var conn net.Conn
+	var dialErr error
+	if implicitTLS {
+		conn, dialErr = tls.DialWithDialer(&net.Dialer{Timeout: mailDialTimeout}, "tcp", addr, tlsConfig)
+	} else {
+		conn, dialErr = net.DialTimeout("tcp", addr, mailDialTimeout)
+	}
+	if dialErr != nil {
+		return sendErr(dialErr)
+	}
+
+	client, smtpErr := smtp.NewClient(conn, host)
+	if smtpErr != nil {
+		conn.Close()
+		return sendErr(smtpErr)
+	}
+	defer client.Close()
+
+	if !implicitTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return sendErr(err)
+			}
+		}
+	}
+	if user != "" {
+		// PlainAuth refuses to send a password over an unencrypted connection,
+		// except to localhost
+		if err := client.Auth(smtp.PlainAuth("", user, password, host)); err != nil {
+			return sendErr(err)
+		}
+	}
+
+	if err := client.Mail(sender.Address); err != nil {
+		return sendErr(err)
+	}
+	for _, rcpt := range rcpts {
+		if err := client.Rcpt(rcpt); err != nil {
+			return sendErr(err)
+		}
+	}
+	w, dataErr := client.Data()
+	if dataErr != nil {
+		return sendErr(dataErr)
+	}
+	if _, err := w.Write(msg.bytes(time.Now())); err != nil {
+		return sendErr(err)
+	}
+	if err := w.Close(); err != nil {
+		return sendErr(err)
+	}
+	if err := client.Quit(); err != nil {
+		return sendErr(err)
+	}
+
+	return ObjectValue{
+		"type": AtomValue("end"),
+	}, nil
+}
@@ -1,3 +1,6 @@
+//go:build !js
+// +build !js
+
 package main
 
 import "os"
@@ -20,5 +23,5 @@ func main() {
 		return
 	}
 
-	runRepl()
+	runRepl(nil)
 }
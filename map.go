@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MapValue is an Oak map, made by the map() builtin. Unlike an object, whose
+// keys are all strings, a map's keys may be any values, and keys are the same
+// if they are equal by =, so 1 and '1' are different keys, but two lists of
+// the same elements are the same key. Keys are compared by their value when
+// they're set, so a list or object changed after it's used as a key won't be
+// found by its new value.
+//
+// A map keeps its entries in the order their keys were first set, and keys()
+// and mapEntries() return them in that order.
+type MapValue struct {
+	// index maps the hash of each key to its entry in entries
+	index map[string]int
+	// entries are nil where an entry has been deleted, until they're
+	// compacted
+	entries []*mapEntry
+}
+
+type mapEntry struct {
+	key Value
+	val Value
+}
+
+func makeMap() *MapValue {
+	return &MapValue{index: map[string]int{}}
+}
+
+func (v *MapValue) String() string {
+	return stringify(v, map[uintptr]bool{})
+}
+func (v *MapValue) Eq(u Value) bool {
+	return deepEq(v, u, map[[2]uintptr]bool{})
+}
+
+func (v *MapValue) len() int {
+	return len(v.index)
+}
+
+func (v *MapValue) get(key Value) (Value, bool) {
+	i, ok := v.index[hashKey(key)]
+	if !ok {
+		return nil, false
+	}
+	return v.entries[i].val, true
+}
+
+// set sets the value of key, keeping its place in the map if it's already set.
+func (v *MapValue) set(key, val Value) {
+	hash := hashKey(key)
+	if i, ok := v.index[hash]; ok {
+		v.entries[i].val = val
+		return
+	}
+	v.index[hash] = len(v.entries)
+	v.entries = append(v.entries, &mapEntry{key: key, val: val})
+}
+
+func (v *MapValue) delete(key Value) {
+	hash := hashKey(key)
+	i, ok := v.index[hash]
+	if !ok {
+		return
+	}
+	delete(v.index, hash)
+	v.entries[i] = nil
+
+	// compact entries once most of them are deleted
+	if len(v.entries) > 8 && len(v.index) < len(v.entries)/2 {
+		entries := make([]*mapEntry, 0, len(v.index))
+		for _, entry := range v.entries {
+			if entry != nil {
+				v.index[hashKey(entry.key)] = len(entries)
+				entries = append(entries, entry)
+			}
+		}
+		v.entries = entries
+	}
+}
+
+// each calls f with each entry of the map in order.
+func (v *MapValue) each(f func(key, val Value)) {
+	for _, entry := range v.entries {
+		if entry != nil {
+			f(entry.key, entry.val)
+		}
+	}
+}
+
+// hashKey returns a string that's the same for two values if and only if
+// they're equal by =, for looking up keys of a map. The empty value _, which
+// is equal to everything, is only the same key as itself.
+func hashKey(v Value) string {
+	sb := strings.Builder{}
+	writeHashKey(&sb, v, map[uintptr]bool{})
+	return sb.String()
+}
+
+func writeHashKey(sb *strings.Builder, v Value, parents map[uintptr]bool) {
+	// strings and names are prefixed by their length, and numbers end with ;,
+	// so that the hashes of the elements of a list can't run together
+	writeSized := func(tag byte, s string) {
+		sb.WriteByte(tag)
+		sb.WriteString(strconv.Itoa(len(s)))
+		sb.WriteByte(':')
+		sb.WriteString(s)
+	}
+
+	if id, ok := containerID(v); ok {
+		if parents[id] {
+			sb.WriteByte('^')
+			return
+		}
+		parents[id] = true
+		defer delete(parents, id)
+	}
+
+	switch val := v.(type) {
+	case NullValue:
+		sb.WriteByte('?')
+	case EmptyValue:
+		sb.WriteByte('_')
+	case BoolValue:
+		if val {
+			sb.WriteByte('T')
+		} else {
+			sb.WriteByte('F')
+		}
+	case IntValue:
+		sb.WriteByte('i')
+		sb.WriteString(strconv.FormatInt(int64(val), 10))
+		sb.WriteByte(';')
+	case FloatValue:
+		// floats equal to ints are the same key as the int
+		if f := float64(val); f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			writeHashKey(sb, IntValue(f), parents)
+			return
+		}
+		sb.WriteByte('f')
+		sb.WriteString(strconv.FormatFloat(float64(val), 'g', -1, 64))
+		sb.WriteByte(';')
+	case DecimalValue:
+		// decimals equal to floats or ints are the same key as the number
+		if f, exact := val.rat.Float64(); exact {
+			writeHashKey(sb, FloatValue(f), parents)
+			return
+		}
+		writeSized('d', val.rat.RatString())
+	case *StringValue:
+		writeSized('s', string(*val))
+	case AtomValue:
+		writeSized(':', string(val))
+	case *ListValue:
+		sb.WriteByte('[')
+		for _, el := range val.elems {
+			writeHashKey(sb, el, parents)
+		}
+		sb.WriteByte(']')
+	case numArray:
+		sb.WriteByte('[')
+		for i := 0; i < val.length(); i++ {
+			writeHashKey(sb, val.at(i), parents)
+		}
+		sb.WriteByte(']')
+	case ObjectValue:
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		sb.WriteByte('{')
+		for _, key := range keys {
+			writeSized('s', key)
+			writeHashKey(sb, val[key], parents)
+		}
+		sb.WriteByte('}')
+	case *MapValue:
+		entries := make([]string, 0, val.len())
+		val.each(func(key, el Value) {
+			entry := strings.Builder{}
+			writeHashKey(&entry, key, parents)
+			writeHashKey(&entry, el, parents)
+			entries = append(entries, entry.String())
+		})
+		sort.Strings(entries)
+		sb.WriteString("m(")
+		for _, entry := range entries {
+			writeSized('e', entry)
+		}
+		sb.WriteByte(')')
+	case FnValue:
+		// functions are equal if they're made by the same definition
+		writeSized('F', fmt.Sprintf("%p", val.defn))
+	case BuiltinFnValue:
+		writeSized('B', val.name)
+	default:
+		writeSized('H', v.String())
+	}
+}
+
+// asMap returns the map argument at index i of a call to the builtin name.
+func asMap(name string, args []Value, i int) (*MapValue, *runtimeError) {
+	m, ok := args[i].(*MapValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("%s takes a map, but got %s", name, args[i]),
+		}
+	}
+	return m, nil
+}
+
+// map(entries?) returns a new map with the [key, value] pairs in the list
+// entries, or the keys and values of an object.
+func (c *Context) oakMap(args []Value) (Value, *runtimeError) {
+	m := makeMap()
+	if len(args) == 0 {
+		return m, nil
+	}
+
+	switch entries := args[0].(type) {
+	case NullValue:
+	case ObjectValue:
+		keys := make([]string, 0, len(entries))
+		for key := range entries {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			m.set(MakeString(key), entries[key])
+		}
+	case *MapValue:
+		entries.each(m.set)
+	case *ListValue:
+		for _, entry := range entries.elems {
+			pair, ok := entry.(*ListValue)
+			if !ok || len(pair.elems) != 2 {
+				return nil, &runtimeError{
+					kind:   "typeError",
+					reason: fmt.Sprintf("Entries of a map must be [key, value] pairs, got %s", entry),
+				}
+			}
+			m.set(pair.elems[0], pair.elems[1])
+		}
+	default:
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("map() takes a list of entries or an object, but got %s", args[0]),
+		}
+	}
+	return m, nil
+}
+
+// mapGet(m, key, default?) returns the value of key in m, or default if it's
+// not set.
+func (c *Context) oakMapGet(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("mapGet", args, 2); err != nil {
+		return nil, err
+	}
+	m, err := asMap("mapGet", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if val, ok := m.get(args[1]); ok {
+		return val, nil
+	}
+	if len(args) > 2 {
+		return args[2], nil
+	}
+	return null, nil
+}
+
+func (c *Context) oakMapSet(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("mapSet", args, 3); err != nil {
+		return nil, err
+	}
+	m, err := asMap("mapSet", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := m.get(args[1]); !ok {
+		if err := c.alloc(entryAllocSize); err != nil {
+			return nil, err
+		}
+	}
+	m.set(args[1], args[2])
+	return m, nil
+}
+
+func (c *Context) oakMapDelete(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("mapDelete", args, 2); err != nil {
+		return nil, err
+	}
+	m, err := asMap("mapDelete", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	m.delete(args[1])
+	return m, nil
+}
+
+func (c *Context) oakMapHas(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("mapHas?", args, 2); err != nil {
+		return nil, err
+	}
+	m, err := asMap("mapHas?", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	_, ok := m.get(args[1])
+	return BoolValue(ok), nil
+}
+
+// mapEntries(m) returns the entries of m as a list of [key, value] pairs, in
+// the order their keys were first set.
+func (c *Context) oakMapEntries(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("mapEntries", args, 1); err != nil {
+		return nil, err
+	}
+	m, err := asMap("mapEntries", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.allocList(m.len(), m.len()*3); err != nil {
+		return nil, err
+	}
+	entries := make([]Value, 0, m.len())
+	m.each(func(key, val Value) {
+		entries = append(entries, MakeList(key, val))
+	})
+	return MakeList(entries...), nil
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A native Markdown renderer, for md.render in the md standard library. It
+// renders the same Markdown dialect and HTML as md.transform, with a few
+// additions documented in lib/md.oak, such as tables.
+
+var (
+	mdHeadingRE   = regexp.MustCompile(`^(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdRuleRE      = regexp.MustCompile(`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdListItemRE  = regexp.MustCompile(`^([ \t]*)([-*+]|\d{1,9}[.)])(?:[ \t]+(.*))?$`)
+	mdTableSepRE  = regexp.MustCompile(`^[ \t]*\|?[ \t]*:?-+:?[ \t]*(\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+	mdFenceRE     = regexp.MustCompile("^[ \t]*(```+|~~~+)[ \t]*(.*)$")
+	mdAutolinkRE  = regexp.MustCompile(`^<([a-zA-Z][a-zA-Z0-9+.-]*:[^\s<>]*)>`)
+	mdTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;")
+	mdAttrEscaper = strings.NewReplacer("<", "&lt;", "'", "&apos;", `"`, "&quot;")
+)
+
+type mdRenderer struct {
+	b strings.Builder
+}
+
+func mdBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// mdTableStart reports whether a table begins at lines[i], which must be a
+// header row followed by a delimiter row.
+func mdTableStart(lines []string, i int) bool {
+	return i+1 < len(lines) && strings.Contains(lines[i], "|") &&
+		strings.Contains(lines[i+1], "-") && mdTableSepRE.MatchString(lines[i+1])
+}
+
+// mdBlockStart reports whether lines[i] begins a block other than a
+// paragraph, and so ends a paragraph or list item before it.
+func mdBlockStart(lines []string, i int) bool {
+	line := lines[i]
+	trimmed := strings.TrimLeft(line, " \t")
+	return mdHeadingRE.MatchString(line) || mdRuleRE.MatchString(line) ||
+		mdFenceRE.MatchString(line) || strings.HasPrefix(trimmed, ">") ||
+		strings.HasPrefix(line, "!html") || mdListItemRE.MatchString(line) ||
+		mdTableStart(lines, i)
+}
+
+func (r *mdRenderer) blocks(lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case mdBlank(line):
+			i++
+		case mdFenceRE.MatchString(line):
+			i = r.codeBlock(lines, i)
+		case mdHeadingRE.MatchString(line):
+			m := mdHeadingRE.FindStringSubmatch(line)
+			tag := fmt.Sprintf("h%d", len(m[1]))
+			r.b.WriteString("<" + tag + ">" + mdInline(m[2]) + "</" + tag + ">")
+			i++
+		case mdRuleRE.MatchString(line):
+			r.b.WriteString("<hr/>")
+			i++
+		case strings.HasPrefix(strings.TrimLeft(line, " \t"), ">"):
+			i = r.blockQuote(lines, i)
+		case strings.HasPrefix(line, "!html"):
+			i = r.rawHTML(lines, i)
+		case mdListItemRE.MatchString(line):
+			i = r.list(lines, i)
+		case mdTableStart(lines, i):
+			i = r.table(lines, i)
+		default:
+			i = r.paragraph(lines, i)
+		}
+	}
+}
+
+func (r *mdRenderer) codeBlock(lines []string, i int) int {
+	m := mdFenceRE.FindStringSubmatch(lines[i])
+	fence, lang := m[1], strings.TrimSpace(m[2])
+
+	var code []string
+	for i++; i < len(lines); i++ {
+		trimmed := strings.TrimLeft(lines[i], " \t")
+		if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]+" \t") == "" {
+			i++
+			break
+		}
+		code = append(code, lines[i])
+	}
+
+	if lang == "" {
+		r.b.WriteString("<pre><code>")
+	} else {
+		r.b.WriteString(`<pre><code data-lang="` + mdAttrEscaper.Replace(lang) + `">`)
+	}
+	r.b.WriteString(mdTextEscaper.Replace(strings.Join(code, "\n")))
+	r.b.WriteString("</code></pre>")
+	return i
+}
+
+func (r *mdRenderer) blockQuote(lines []string, i int) int {
+	var quoted []string
+	for ; i < len(lines); i++ {
+		trimmed := strings.TrimLeft(lines[i], " \t")
+		if !strings.HasPrefix(trimmed, ">") {
+			break
+		}
+		trimmed = trimmed[1:]
+		if strings.HasPrefix(trimmed, " ") {
+			trimmed = trimmed[1:]
+		}
+		quoted = append(quoted, trimmed)
+	}
+
+	r.b.WriteString("<blockquote>")
+	r.blocks(quoted)
+	r.b.WriteString("</blockquote>")
+	return i
+}
+
+// rawHTML renders the lines from a line beginning with "!html" to the next
+// empty line as they are.
+func (r *mdRenderer) rawHTML(lines []string, i int) int {
+	html := []string{strings.TrimPrefix(strings.TrimPrefix(lines[i], "!html"), " ")}
+	for i++; i < len(lines) && !mdBlank(lines[i]); i++ {
+		html = append(html, lines[i])
+	}
+	r.b.WriteString(strings.Join(html, "\n"))
+	return i
+}
+
+func mdIndent(s string) int {
+	return len(s) - len(strings.TrimLeft(s, " \t"))
+}
+
+func mdOrdered(marker string) bool {
+	return marker[0] >= '0' && marker[0] <= '9'
+}
+
+// list renders a list whose items are at the indentation of lines[i]. Items
+// indented further begin a nested list in the item before them.
+func (r *mdRenderer) list(lines []string, i int) int {
+	first := mdListItemRE.FindStringSubmatch(lines[i])
+	indent, ordered := len(first[1]), mdOrdered(first[2])
+
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+		if start, _ := strconv.Atoi(strings.TrimRight(first[2], ".)")); start != 1 {
+			r.b.WriteString(fmt.Sprintf(`<ol start="%d">`, start))
+		} else {
+			r.b.WriteString("<ol>")
+		}
+	} else {
+		r.b.WriteString("<ul>")
+	}
+
+	open := false
+	for i < len(lines) {
+		m := mdListItemRE.FindStringSubmatch(lines[i])
+		if m == nil || mdRuleRE.MatchString(lines[i]) {
+			break
+		}
+		if len(m[1]) > indent && open {
+			i = r.list(lines, i)
+			continue
+		}
+		if len(m[1]) != indent || mdOrdered(m[2]) != ordered {
+			break
+		}
+
+		if open {
+			r.b.WriteString("</li>")
+		}
+		text := m[3]
+		// lines indented under the item continue its text
+		for i++; i < len(lines) && !mdBlank(lines[i]) && mdIndent(lines[i]) > indent &&
+			!mdBlockStart(lines, i); i++ {
+			text += " " + strings.TrimSpace(lines[i])
+		}
+		r.b.WriteString("<li>" + mdInline(text))
+		open = true
+	}
+	if open {
+		r.b.WriteString("</li>")
+	}
+
+	r.b.WriteString("</" + tag + ">")
+	return i
+}
+
+// mdTableCells splits a table row into its cells, at pipes that are not
+// escaped with a backslash.
+func mdTableCells(row string) []string {
+	row = strings.TrimSpace(row)
+	row = strings.TrimPrefix(row, "|")
+	if strings.HasSuffix(row, "|") && !strings.HasSuffix(row, `\|`) {
+		row = row[:len(row)-1]
+	}
+
+	var cells []string
+	var cell strings.Builder
+	for j := 0; j < len(row); j++ {
+		switch {
+		case row[j] == '\\' && j+1 < len(row) && row[j+1] == '|':
+			cell.WriteByte('|')
+			j++
+		case row[j] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(row[j])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+func (r *mdRenderer) table(lines []string, i int) int {
+	header := mdTableCells(lines[i])
+	var aligns []string
+	for _, sep := range mdTableCells(lines[i+1]) {
+		left, right := strings.HasPrefix(sep, ":"), strings.HasSuffix(sep, ":")
+		switch {
+		case left && right:
+			aligns = append(aligns, ` align="center"`)
+		case left:
+			aligns = append(aligns, ` align="left"`)
+		case right:
+			aligns = append(aligns, ` align="right"`)
+		default:
+			aligns = append(aligns, "")
+		}
+	}
+
+	// every row has as many cells as the header
+	row := func(cells []string, tag string) {
+		r.b.WriteString("<tr>")
+		for j := range header {
+			cell, align := "", ""
+			if j < len(cells) {
+				cell = cells[j]
+			}
+			if j < len(aligns) {
+				align = aligns[j]
+			}
+			r.b.WriteString("<" + tag + align + ">" + mdInline(cell) + "</" + tag + ">")
+		}
+		r.b.WriteString("</tr>")
+	}
+
+	r.b.WriteString("<table><thead>")
+	row(header, "th")
+	r.b.WriteString("</thead>")
+
+	i += 2
+	if i < len(lines) && !mdBlank(lines[i]) && strings.Contains(lines[i], "|") {
+		r.b.WriteString("<tbody>")
+		for ; i < len(lines) && !mdBlank(lines[i]) && strings.Contains(lines[i], "|"); i++ {
+			row(mdTableCells(lines[i]), "td")
+		}
+		r.b.WriteString("</tbody>")
+	}
+	r.b.WriteString("</table>")
+	return i
+}
+
+func (r *mdRenderer) paragraph(lines []string, i int) int {
+	r.b.WriteString("<p>")
+	for start := i; i < len(lines) && !mdBlank(lines[i]) && (i == start || !mdBlockStart(lines, i)); i++ {
+		line := strings.TrimLeft(lines[i], " \t")
+		if i > start {
+			r.b.WriteByte(' ')
+		}
+
+		// two trailing spaces or a backslash end the line with a break
+		switch {
+		case strings.HasSuffix(line, "  "):
+			r.b.WriteString(mdInline(strings.TrimRight(line, " ")) + "<br/>")
+		case strings.HasSuffix(line, `\`) && !strings.HasSuffix(line, `\\`):
+			r.b.WriteString(mdInline(line[:len(line)-1]) + "<br/>")
+		default:
+			r.b.WriteString(mdInline(line))
+		}
+	}
+	r.b.WriteString("</p>")
+	return i
+}
+
+// mdSanitizeURL removes URLs with the javascript: and data: schemes, which
+// may run scripts.
+func mdSanitizeURL(u string) string {
+	decoded, err := url.PathUnescape(u)
+	if err != nil {
+		decoded = u
+	}
+	scheme := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '/' || r == ':' {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, decoded)
+	if strings.HasPrefix(scheme, "javascript:") || strings.HasPrefix(scheme, "data:") {
+		return ""
+	}
+	return mdAttrEscaper.Replace(u)
+}
+
+// mdMatching returns the index of the delimiter that closes the one at s[i],
+// accounting for nesting, or -1 if it is not closed.
+func mdMatching(s string, i int, open, close byte) int {
+	depth := 0
+	for j := i; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// mdLink parses a [label](destination) at s[i], and returns the label,
+// destination, and the index after the link.
+func mdLink(s string, i int) (label, dest string, end int, ok bool) {
+	labelEnd := mdMatching(s, i, '[', ']')
+	if labelEnd < 0 || labelEnd+1 >= len(s) || s[labelEnd+1] != '(' {
+		return "", "", 0, false
+	}
+	destEnd := mdMatching(s, labelEnd+1, '(', ')')
+	if destEnd < 0 {
+		return "", "", 0, false
+	}
+	return s[i+1 : labelEnd], s[labelEnd+2 : destEnd], destEnd + 1, true
+}
+
+func mdWordByte(s string, i int, before bool) bool {
+	var r rune
+	if before {
+		if i <= 0 {
+			return false
+		}
+		r, _ = utf8.DecodeLastRuneInString(s[:i])
+	} else {
+		if i >= len(s) {
+			return false
+		}
+		r, _ = utf8.DecodeRuneInString(s[i:])
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// mdInline renders inline Markdown: emphasis, code spans, links, images,
+// checkboxes, and escaped characters.
+func mdInline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch c {
+		case '\\':
+			if i+1 < len(s) && strings.IndexByte("\\`*_{}[]()#+-.!|~<>\"'", s[i+1]) >= 0 {
+				b.WriteString(mdTextEscaper.Replace(s[i+1 : i+2]))
+				i += 2
+				continue
+			}
+		case '`':
+			run := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+			delim := s[i : i+run]
+			if end := strings.Index(s[i+run:], delim); end >= 0 {
+				code := s[i+run : i+run+end]
+				b.WriteString("<code>" + mdTextEscaper.Replace(code) + "</code>")
+				i += 2*run + end
+				continue
+			}
+			b.WriteString(delim)
+			i += run
+			continue
+		case '!':
+			if i+1 == len(s) || s[i+1] != '[' {
+				break
+			}
+			if label, dest, end, ok := mdLink(s, i+1); ok {
+				b.WriteString(`<img alt="` + mdAttrEscaper.Replace(label) + `" src="` + mdSanitizeURL(dest) + `"/>`)
+				i = end
+				continue
+			}
+		case '[':
+			if strings.HasPrefix(s[i:], "[ ]") || strings.HasPrefix(s[i:], "[x]") {
+				if s[i+1] == 'x' {
+					b.WriteString(`<input type="checkbox" checked/>`)
+				} else {
+					b.WriteString(`<input type="checkbox" />`)
+				}
+				i += 3
+				continue
+			}
+			if label, dest, end, ok := mdLink(s, i); ok {
+				b.WriteString(`<a href="` + mdSanitizeURL(dest) + `">` + mdInline(label) + "</a>")
+				i = end
+				continue
+			}
+		case '<':
+			if m := mdAutolinkRE.FindStringSubmatch(s[i:]); m != nil {
+				b.WriteString(`<a href="` + mdSanitizeURL(m[1]) + `">` + mdTextEscaper.Replace(m[1]) + "</a>")
+				i += len(m[0])
+				continue
+			}
+		case '*', '_', '~':
+			run := 1
+			if i+1 < len(s) && s[i+1] == c {
+				run = 2
+			}
+			delim := s[i : i+run]
+			// underscores within words, as in snake_case, are not emphasis
+			if c == '_' && mdWordByte(s, i, true) {
+				break
+			}
+			end := -1
+			for j := i + run; j+run <= len(s); j++ {
+				if s[j] == '\\' {
+					j++
+					continue
+				}
+				if s[j:j+run] == delim && j > i+run && (c != '_' || !mdWordByte(s, j+run, false)) {
+					end = j
+					break
+				}
+			}
+			if end < 0 {
+				break
+			}
+
+			tag := map[string]string{
+				"*": "em", "_": "em", "**": "strong", "__": "strong", "~": "strike", "~~": "strike",
+			}[delim]
+			b.WriteString("<" + tag + ">" + mdInline(s[i+run:end]) + "</" + tag + ">")
+			i = end + run
+			continue
+		}
+
+		b.WriteString(mdTextEscaper.Replace(s[i : i+1]))
+		i++
+	}
+	return b.String()
+}
+
+func (c *Context) oakMdRender(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___md_render", args, 1); err != nil {
+		return nil, err
+	}
+
+	text, ok := args[0].(*StringValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___md_render(%s)", args[0]),
+		}
+	}
+
+	var r mdRenderer
+	lines := strings.Split(strings.ReplaceAll(string(*text), "\r\n", "\n"), "\n")
+	r.blocks(lines)
+	html := r.b.String()
+	if err := c.allocString(len(html), len(html)); err != nil {
+		return nil, err
+	}
+	return MakeString(html), nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+)
+
+// marshal() encodes an Oak value to a compact binary string that unmarshal()
+// decodes back to an equal value. Objects are encoded with their keys in
+// sorted order, so equal values always encode to the same string, except for
+// maps, which keep the order of their entries.
+//
+// The encoding starts with a version byte, followed by the value. Each value
+// is a tag byte followed by its contents. Ints are zigzag varints, floats are
+// 8 bytes in big-endian order, decimals are fractions like 1/3 stored as
+// strings, and lengths are unsigned varints.
+const marshalVersion = 1
+
+const (
+	marshalNull byte = iota
+	marshalEmpty
+	marshalFalse
+	marshalTrue
+	marshalInt
+	marshalFloat
+	marshalString
+	marshalAtom
+	marshalList
+	marshalObject
+	marshalIntArray
+	marshalFloatArray
+	marshalMap
+	marshalDecimal
+)
+
+func appendVarint(buf []byte, n int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], n)]...)
+}
+
+func appendUvarint(buf []byte, n uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], n)]...)
+}
+
+func appendFloat(buf []byte, f float64) []byte {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], math.Float64bits(f))
+	return append(buf, tmp[:]...)
+}
+
+func marshalValue(buf []byte, v Value, parents map[uintptr]bool) ([]byte, *runtimeError) {
+	if id, ok := containerID(v); ok {
+		if parents[id] {
+			return nil, &runtimeError{
+				kind:   "valueError",
+				reason: "Cannot marshal a value that contains itself",
+			}
+		}
+		parents[id] = true
+		defer delete(parents, id)
+	}
+
+	switch val := v.(type) {
+	case NullValue:
+		return append(buf, marshalNull), nil
+	case EmptyValue:
+		return append(buf, marshalEmpty), nil
+	case BoolValue:
+		if val {
+			return append(buf, marshalTrue), nil
+		}
+		return append(buf, marshalFalse), nil
+	case IntValue:
+		buf = append(buf, marshalInt)
+		return appendVarint(buf, int64(val)), nil
+	case FloatValue:
+		buf = append(buf, marshalFloat)
+		return appendFloat(buf, float64(val)), nil
+	case DecimalValue:
+		rat := val.rat.RatString()
+		buf = append(buf, marshalDecimal)
+		buf = appendUvarint(buf, uint64(len(rat)))
+		return append(buf, rat...), nil
+	case *StringValue:
+		buf = append(buf, marshalString)
+		buf = appendUvarint(buf, uint64(len(*val)))
+		return append(buf, *val...), nil
+	case AtomValue:
+		buf = append(buf, marshalAtom)
+		buf = appendUvarint(buf, uint64(len(val)))
+		return append(buf, val...), nil
+	case *IntArrayValue:
+		buf = append(buf, marshalIntArray)
+		buf = appendUvarint(buf, uint64(len(*val)))
+		for _, n := range *val {
+			buf = appendVarint(buf, n)
+		}
+		return buf, nil
+	case *FloatArrayValue:
+		buf = append(buf, marshalFloatArray)
+		buf = appendUvarint(buf, uint64(len(*val)))
+		for _, n := range *val {
+			buf = appendFloat(buf, n)
+		}
+		return buf, nil
+	case *ListValue:
+		buf = append(buf, marshalList)
+		buf = appendUvarint(buf, uint64(len(val.elems)))
+		for _, el := range val.elems {
+			var err *runtimeError
+			if buf, err = marshalValue(buf, el, parents); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case ObjectValue:
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf = append(buf, marshalObject)
+		buf = appendUvarint(buf, uint64(len(keys)))
+		for _, key := range keys {
+			buf = appendUvarint(buf, uint64(len(key)))
+			buf = append(buf, key...)
+
+			var err *runtimeError
+			if buf, err = marshalValue(buf, val[key], parents); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case *MapValue:
+		buf = append(buf, marshalMap)
+		buf = appendUvarint(buf, uint64(val.len()))
+
+		var err *runtimeError
+		val.each(func(key, el Value) {
+			if err == nil {
+				buf, err = marshalValue(buf, key, parents)
+			}
+			if err == nil {
+				buf, err = marshalValue(buf, el, parents)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+
+	return nil, &runtimeError{
+		kind:   "typeError",
+		reason: fmt.Sprintf("Cannot marshal %s", v),
+	}
+}
+
+// unmarshaler decodes a value encoded by marshalValue.
+type unmarshaler struct {
+	c    *Context
+	data []byte
+	i    int
+}
+
+func (u *unmarshaler) errorf(format string, args ...interface{}) *runtimeError {
+	return &runtimeError{
+		kind:   "valueError",
+		reason: fmt.Sprintf("Invalid marshaled value at byte %d: ", u.i) + fmt.Sprintf(format, args...),
+	}
+}
+
+func (u *unmarshaler) varint() (int64, *runtimeError) {
+	n, size := binary.Varint(u.data[u.i:])
+	if size <= 0 {
+		return 0, u.errorf("bad varint")
+	}
+	u.i += size
+	return n, nil
+}
+
+// length reads a length prefix, which can't be greater than the number of
+// bytes left, since every element takes at least one byte.
+func (u *unmarshaler) length() (int, *runtimeError) {
+	n, size := binary.Uvarint(u.data[u.i:])
+	if size <= 0 {
+		return 0, u.errorf("bad length")
+	}
+	u.i += size
+	if n > uint64(len(u.data)-u.i) {
+		return 0, u.errorf("length %d exceeds remaining data", n)
+	}
+	return int(n), nil
+}
+
+func (u *unmarshaler) bytes() ([]byte, *runtimeError) {
+	n, err := u.length()
+	if err != nil {
+		return nil, err
+	}
+	b := u.data[u.i : u.i+n]
+	u.i += n
+	return b, nil
+}
+
+func (u *unmarshaler) float() (float64, *runtimeError) {
+	if len(u.data)-u.i < 8 {
+		return 0, u.errorf("truncated float")
+	}
+	bits := binary.BigEndian.Uint64(u.data[u.i:])
+	u.i += 8
+	return math.Float64frombits(bits), nil
+}
+
+func (u *unmarshaler) value() (Value, *runtimeError) {
+	if u.i >= len(u.data) {
+		return nil, u.errorf("unexpected end of data")
+	}
+	tag := u.data[u.i]
+	u.i++
+
+	switch tag {
+	case marshalNull:
+		return null, nil
+	case marshalEmpty:
+		return empty, nil
+	case marshalFalse:
+		return oakFalse, nil
+	case marshalTrue:
+		return oakTrue, nil
+	case marshalInt:
+		n, err := u.varint()
+		if err != nil {
+			return nil, err
+		}
+		return IntValue(n), nil
+	case marshalFloat:
+		f, err := u.float()
+		if err != nil {
+			return nil, err
+		}
+		return FloatValue(f), nil
+	case marshalString:
+		b, err := u.bytes()
+		if err != nil {
+			return nil, err
+		}
+		if err := u.c.allocString(len(b), len(b)); err != nil {
+			return nil, err
+		}
+		return MakeString(string(b)), nil
+	case marshalAtom:
+		b, err := u.bytes()
+		if err != nil {
+			return nil, err
+		}
+		return AtomValue(b), nil
+	case marshalDecimal:
+		b, err := u.bytes()
+		if err != nil {
+			return nil, err
+		}
+		rat, ok := new(big.Rat).SetString(string(b))
+		if !ok {
+			return nil, u.errorf("invalid decimal %q", b)
+		}
+		return makeDecimal(rat), nil
+	case marshalIntArray, marshalFloatArray:
+		n, err := u.length()
+		if err != nil {
+			return nil, err
+		}
+		if err := u.c.allocList(n, n); err != nil {
+			return nil, err
+		}
+
+		if tag == marshalIntArray {
+			arr := make(IntArrayValue, n)
+			for i := range arr {
+				if arr[i], err = u.varint(); err != nil {
+					return nil, err
+				}
+			}
+			return &arr, nil
+		}
+		arr := make(FloatArrayValue, n)
+		for i := range arr {
+			if arr[i], err = u.float(); err != nil {
+				return nil, err
+			}
+		}
+		return &arr, nil
+	case marshalList:
+		n, err := u.length()
+		if err != nil {
+			return nil, err
+		}
+		if err := u.c.allocList(n, n); err != nil {
+			return nil, err
+		}
+
+		elems := make([]Value, n)
+		for i := range elems {
+			if elems[i], err = u.value(); err != nil {
+				return nil, err
+			}
+		}
+		return MakeList(elems...), nil
+	case marshalObject:
+		n, err := u.length()
+		if err != nil {
+			return nil, err
+		}
+		if err := u.c.alloc(n * entryAllocSize); err != nil {
+			return nil, err
+		}
+
+		obj := make(ObjectValue, n)
+		for i := 0; i < n; i++ {
+			key, err := u.bytes()
+			if err != nil {
+				return nil, err
+			}
+			if obj[string(key)], err = u.value(); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	case marshalMap:
+		n, err := u.length()
+		if err != nil {
+			return nil, err
+		}
+		if err := u.c.alloc(n * entryAllocSize); err != nil {
+			return nil, err
+		}
+
+		m := makeMap()
+		for i := 0; i < n; i++ {
+			key, err := u.value()
+			if err != nil {
+				return nil, err
+			}
+			val, err := u.value()
+			if err != nil {
+				return nil, err
+			}
+			m.set(key, val)
+		}
+		return m, nil
+	}
+
+	u.i--
+	return nil, u.errorf("unknown tag %d", tag)
+}
+
+func (c *Context) oakMarshal(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("marshal", args, 1); err != nil {
+		return nil, err
+	}
+
+	buf, err := marshalValue([]byte{marshalVersion}, args[0], map[uintptr]bool{})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.allocString(len(buf), len(buf)); err != nil {
+		return nil, err
+	}
+	return MakeString(string(buf)), nil
+}
+
+func (c *Context) oakUnmarshal(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("unmarshal", args, 1); err != nil {
+		return nil, err
+	}
+
+	data, ok := args[0].(*StringValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call unmarshal(%s)", args[0]),
+		}
+	}
+
+	return c.unmarshal(*data)
+}
+
+// unmarshal decodes data encoded by marshal() into the value it encodes.
+func (c *Context) unmarshal(data []byte) (Value, *runtimeError) {
+	u := unmarshaler{c: c, data: data}
+	if len(u.data) == 0 || u.data[0] != marshalVersion {
+		return nil, u.errorf("unsupported version")
+	}
+	u.i = 1
+
+	v, err := u.value()
+	if err != nil {
+		return nil, err
+	}
+	if u.i != len(u.data) {
+		return nil, u.errorf("unexpected data after value")
+	}
+	return v, nil
+}
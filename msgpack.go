@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf8"
+)
+
+// MessagePack encoding and decoding, for the msgpack standard library.
+//
+// Ints are encoded in the smallest format that holds them, and floats always
+// as 64-bit floats, so ints and floats keep their types across a round trip.
+// Strings that are valid UTF-8 are encoded as MessagePack strings, and other
+// strings as binary data. Atoms are encoded as strings. Both strings and binary
+// data decode to Oak strings.
+//
+// MessagePack maps may have keys of any type, but Oak objects only have string
+// keys, so when decoding, integer, float, and boolean keys are converted to
+// strings as string() would. Other keys are an error.
+
+func msgpackUint(buf []byte, tag byte, n uint64, size int) []byte {
+	buf = append(buf, tag)
+	for i := size - 1; i >= 0; i-- {
+		buf = append(buf, byte(n>>(8*i)))
+	}
+	return buf
+}
+
+// msgpackHeader appends the header of a string, binary, array, or map value
+// of length n, given the tag and maximum length of its fix format, and the tags
+// of its 8, 16, and 32-bit length formats. A 0 tag means the format does not
+// exist.
+func msgpackHeader(buf []byte, n int, fix byte, fixMax int, tag8, tag16, tag32 byte) []byte {
+	switch {
+	case fix != 0 && n <= fixMax:
+		return append(buf, fix|byte(n))
+	case tag8 != 0 && n <= math.MaxUint8:
+		return msgpackUint(buf, tag8, uint64(n), 1)
+	case n <= math.MaxUint16:
+		return msgpackUint(buf, tag16, uint64(n), 2)
+	}
+	return msgpackUint(buf, tag32, uint64(n), 4)
+}
+
+func msgpackInt(buf []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(buf, byte(n))
+	case n < 0 && n >= -32:
+		return append(buf, byte(n))
+	case n >= 0 && n <= math.MaxUint8:
+		return msgpackUint(buf, 0xcc, uint64(n), 1)
+	case n >= 0 && n <= math.MaxUint16:
+		return msgpackUint(buf, 0xcd, uint64(n), 2)
+	case n >= 0 && n <= math.MaxUint32:
+		return msgpackUint(buf, 0xce, uint64(n), 4)
+	case n >= 0:
+		return msgpackUint(buf, 0xcf, uint64(n), 8)
+	case n >= math.MinInt8:
+		return msgpackUint(buf, 0xd0, uint64(n), 1)
+	case n >= math.MinInt16:
+		return msgpackUint(buf, 0xd1, uint64(n), 2)
+	case n >= math.MinInt32:
+		return msgpackUint(buf, 0xd2, uint64(n), 4)
+	}
+	return msgpackUint(buf, 0xd3, uint64(n), 8)
+}
+
+func msgpackString(buf []byte, s string) []byte {
+	if utf8.ValidString(s) {
+		buf = msgpackHeader(buf, len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	} else {
+		buf = msgpackHeader(buf, len(s), 0, 0, 0xc4, 0xc5, 0xc6)
+	}
+	return append(buf, s...)
+}
+
+func msgpackValue(buf []byte, v Value, parents map[uintptr]bool) ([]byte, *runtimeError) {
+	if id, ok := containerID(v); ok {
+		if parents[id] {
+			return nil, &runtimeError{
+				kind:   "valueError",
+				reason: "Cannot serialize a value that contains itself",
+			}
+		}
+		parents[id] = true
+		defer delete(parents, id)
+	}
+
+	switch val := v.(type) {
+	case NullValue, EmptyValue:
+		return append(buf, 0xc0), nil
+	case BoolValue:
+		if val {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case IntValue:
+		return msgpackInt(buf, int64(val)), nil
+	case FloatValue:
+		return msgpackUint(buf, 0xcb, math.Float64bits(float64(val)), 8), nil
+	case *StringValue:
+		return msgpackString(buf, string(*val)), nil
+	case AtomValue:
+		return msgpackString(buf, string(val)), nil
+	case *IntArrayValue:
+		buf = msgpackHeader(buf, len(*val), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, n := range *val {
+			buf = msgpackInt(buf, n)
+		}
+		return buf, nil
+	case *FloatArrayValue:
+		buf = msgpackHeader(buf, len(*val), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, n := range *val {
+			buf = msgpackUint(buf, 0xcb, math.Float64bits(n), 8)
+		}
+		return buf, nil
+	case *ListValue:
+		buf = msgpackHeader(buf, len(val.elems), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, el := range val.elems {
+			var err *runtimeError
+			if buf, err = msgpackValue(buf, el, parents); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case ObjectValue:
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf = msgpackHeader(buf, len(keys), 0x80, 15, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			buf = msgpackString(buf, key)
+
+			var err *runtimeError
+			if buf, err = msgpackValue(buf, val[key], parents); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+
+	return nil, &runtimeError{
+		kind:   "typeError",
+		reason: fmt.Sprintf("Cannot serialize %s to msgpack", v),
+	}
+}
+
+// msgpackDecoder decodes a MessagePack value.
+type msgpackDecoder struct {
+	c    *Context
+	data []byte
+	i    int
+}
+
+func (d *msgpackDecoder) errorf(format string, args ...interface{}) *runtimeError {
+	return &runtimeError{
+		kind:   "valueError",
+		reason: fmt.Sprintf("Invalid msgpack data at byte %d: ", d.i) + fmt.Sprintf(format, args...),
+	}
+}
+
+func (d *msgpackDecoder) uint(size int) (uint64, *runtimeError) {
+	if len(d.data)-d.i < size {
+		return 0, d.errorf("unexpected end of data")
+	}
+	var n uint64
+	for _, b := range d.data[d.i : d.i+size] {
+		n = n<<8 | uint64(b)
+	}
+	d.i += size
+	return n, nil
+}
+
+// length reads a length prefix of the given size, which can't be greater
+// than the number of bytes left, since every element takes at least one byte.
+func (d *msgpackDecoder) length(size int) (int, *runtimeError) {
+	n, err := d.uint(size)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)-d.i) {
+		return 0, d.errorf("length %d exceeds remaining data", n)
+	}
+	return int(n), nil
+}
+
+func (d *msgpackDecoder) str(n int) (Value, *runtimeError) {
+	if err := d.c.allocString(n, n); err != nil {
+		return nil, err
+	}
+	s := MakeString(string(d.data[d.i : d.i+n]))
+	d.i += n
+	return s, nil
+}
+
+func (d *msgpackDecoder) array(n int) (Value, *runtimeError) {
+	if err := d.c.allocList(n, n); err != nil {
+		return nil, err
+	}
+
+	elems := make([]Value, n)
+	for i := range elems {
+		var err *runtimeError
+		if elems[i], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return MakeList(elems...), nil
+}
+
+func (d *msgpackDecoder) object(n int) (Value, *runtimeError) {
+	if err := d.c.alloc(n * entryAllocSize); err != nil {
+		return nil, err
+	}
+
+	obj := make(ObjectValue, n)
+	for i := 0; i < n; i++ {
+		keyStart := d.i
+		key, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+
+		var k string
+		switch key := key.(type) {
+		case *StringValue:
+			k = string(*key)
+		case IntValue, FloatValue, BoolValue:
+			k = key.String()
+		default:
+			d.i = keyStart
+			return nil, d.errorf("unsupported map key %s", key)
+		}
+
+		if obj[k], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+func (d *msgpackDecoder) value() (Value, *runtimeError) {
+	if d.i >= len(d.data) {
+		return nil, d.errorf("unexpected end of data")
+	}
+	tag := d.data[d.i]
+	d.i++
+
+	switch {
+	case tag <= 0x7f:
+		return IntValue(tag), nil
+	case tag >= 0xe0:
+		return IntValue(int8(tag)), nil
+	case tag >= 0x80 && tag <= 0x8f:
+		return d.object(int(tag & 0x0f))
+	case tag >= 0x90 && tag <= 0x9f:
+		return d.array(int(tag & 0x0f))
+	case tag >= 0xa0 && tag <= 0xbf:
+		n := int(tag & 0x1f)
+		if n > len(d.data)-d.i {
+			return nil, d.errorf("length %d exceeds remaining data", n)
+		}
+		return d.str(n)
+	}
+
+	switch tag {
+	case 0xc0:
+		return null, nil
+	case 0xc2:
+		return oakFalse, nil
+	case 0xc3:
+		return oakTrue, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(1 << (tag - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(n)
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (tag - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(n)
+	case 0xca:
+		n, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return FloatValue(math.Float32frombits(uint32(n))), nil
+	case 0xcb:
+		n, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return FloatValue(math.Float64frombits(n)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (tag - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		// uint64s too large for an Oak int lose precision, but keep their
+		// magnitude as floats
+		if n > math.MaxInt64 {
+			return FloatValue(float64(n)), nil
+		}
+		return IntValue(n), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (tag - 0xd0)
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// sign-extend from the size of the encoded int
+		shift := 64 - 8*size
+		return IntValue(int64(n<<shift) >> shift), nil
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (tag - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(n)
+	case 0xde, 0xdf:
+		n, err := d.length(2 << (tag - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.object(n)
+	}
+
+	d.i--
+	if tag == 0xc1 {
+		return nil, d.errorf("unused type 0xc1")
+	}
+	return nil, d.errorf("unsupported extension type 0x%x", tag)
+}
+
+func (c *Context) oakMsgpackSerialize(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___msgpack_serialize", args, 1); err != nil {
+		return nil, err
+	}
+
+	buf, err := msgpackValue(nil, args[0], map[uintptr]bool{})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.allocString(len(buf), len(buf)); err != nil {
+		return nil, err
+	}
+	return MakeString(string(buf)), nil
+}
+
+func (c *Context) oakMsgpackParse(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___msgpack_parse", args, 1); err != nil {
+		return nil, err
+	}
+
+	data, ok := args[0].(*StringValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___msgpack_parse(%s)", args[0]),
+		}
+	}
+
+	d := msgpackDecoder{c: c, data: *data}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.i != len(d.data) {
+		return nil, d.errorf("unexpected data after value")
+	}
+	return v, nil
+}
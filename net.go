@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNS and network information, for the net standard library. These builtins
+// return ? when a lookup fails, rather than reporting why.
+
+func stringList(strs []string) *ListValue {
+	elems := make([]Value, len(strs))
+	for i, s := range strs {
+		elems[i] = MakeString(s)
+	}
+	return MakeList(elems...)
+}
+
+func (c *Context) netStringArg(name string, args []Value) (string, *runtimeError) {
+	if err := c.requireArgLen(name, args, 1); err != nil {
+		return "", err
+	}
+	s, ok := args[0].(*StringValue)
+	if !ok {
+		return "", &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call %s(%s)", name, args[0]),
+		}
+	}
+	return s.stringContent(), nil
+}
+
+func (c *Context) oakNetHostname(_ []Value) (Value, *runtimeError) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return null, nil
+	}
+	return MakeString(hostname), nil
+}
+
+func (c *Context) oakNetLookup(args []Value) (Value, *runtimeError) {
+	host, err := c.netStringArg("___net_lookup", args)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, lookupErr := net.LookupHost(host)
+	if lookupErr != nil {
+		return null, nil
+	}
+	return stringList(addrs), nil
+}
+
+func (c *Context) oakNetReverse(args []Value) (Value, *runtimeError) {
+	addr, err := c.netStringArg("___net_reverse", args)
+	if err != nil {
+		return nil, err
+	}
+
+	names, lookupErr := net.LookupAddr(addr)
+	if lookupErr != nil {
+		return null, nil
+	}
+	for i, name := range names {
+		names[i] = strings.TrimSuffix(name, ".")
+	}
+	return stringList(names), nil
+}
+
+func (c *Context) oakNetInterfaces(_ []Value) (Value, *runtimeError) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return null, nil
+	}
+
+	list := make([]Value, len(ifaces))
+	for i, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			addrs = nil
+		}
+		addrStrs := make([]string, len(addrs))
+		for j, addr := range addrs {
+			addrStrs[j] = addr.String()
+		}
+
+		list[i] = ObjectValue{
+			"name":      MakeString(iface.Name),
+			"mac":       MakeString(iface.HardwareAddr.String()),
+			"mtu":       IntValue(iface.MTU),
+			"up?":       BoolValue(iface.Flags&net.FlagUp != 0),
+			"loopback?": BoolValue(iface.Flags&net.FlagLoopback != 0),
+			"addrs":     stringList(addrStrs),
+		}
+	}
+	return MakeList(list...), nil
+}
+
+func (c *Context) oakNetPing(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___net_ping", args, 3); err != nil {
+		return nil, err
+	}
+
+	host, ok1 := args[0].(*StringValue)
+	port, ok2 := args[1].(IntValue)
+	timeout, ok3 := toFloat(args[2])
+	if !ok1 || !ok2 || !ok3 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___net_ping(%s, %s, %s)", args[0], args[1], args[2]),
+		}
+	}
+
+	addr := net.JoinHostPort(host.stringContent(), strconv.Itoa(int(port)))
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, time.Duration(timeout*float64(time.Second)))
+	if err != nil {
+		return null, nil
+	}
+	elapsed := time.Since(start)
+	conn.Close()
+	return FloatValue(elapsed.Seconds()), nil
+}
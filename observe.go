@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Objects can be observed in two ways: debug.watch(obj, key, cb) calls cb
+// every time obj.(key) is assigned, and reactive.subscribe(obj, cb) calls cb
+// once with every change made to obj since the last time, see reactive.go.
+// Observers are kept by the engine rather than in the objects they observe, so
+// observed objects look no different to the program, and assigning to a key
+// costs only a check of an empty map while nothing is being observed.
+
+type propWatch struct {
+	id int
+	cb Value
+}
+
+// objWatchers holds the observers of one object. It keeps a reference to the
+// object so that its address, by which it's found, can't be reused for
+// another object while it's observed.
+type objWatchers struct {
+	obj  ObjectValue
+	keys map[string][]propWatch
+	// subscribers, and the changes they're yet to be called with
+	subs      []propWatch
+	pending   []objChange
+	scheduled bool
+}
+
+// watchersOf returns the observers of obj, or nil if there are none.
+func (c *Context) watchersOf(obj ObjectValue) *objWatchers {
+	if len(c.eng.watchers) == 0 {
+		return nil
+	}
+	return c.eng.watchers[reflect.ValueOf(obj).Pointer()]
+}
+
+// observersFor returns the observers of obj, adding them if there are none.
+func (c *Context) observersFor(obj ObjectValue) (uintptr, *objWatchers) {
+	if c.eng.watchers == nil {
+		c.eng.watchers = map[uintptr]*objWatchers{}
+	}
+	id := reflect.ValueOf(obj).Pointer()
+	ws, ok := c.eng.watchers[id]
+	if !ok {
+		ws = &objWatchers{obj: obj, keys: map[string][]propWatch{}}
+		c.eng.watchers[id] = ws
+	}
+	return id, ws
+}
+
+// forgetIfUnobserved stops keeping the observers of an object once all of
+// them are removed.
+func (c *Context) forgetIfUnobserved(id uintptr, ws *objWatchers) {
+	if len(ws.keys) == 0 && len(ws.subs) == 0 && c.eng.watchers[id] == ws {
+		delete(c.eng.watchers, id)
+	}
+}
+
+// withoutWatch returns the watches in ws other than the one with the given id.
+// It returns a new slice, because a slice of watches may be in use by code
+// that's calling them.
+func withoutWatch(ws []propWatch, id int) []propWatch {
+	remaining := []propWatch{}
+	for _, w := range ws {
+		if w.id != id {
+			remaining = append(remaining, w)
+		}
+	}
+	return remaining
+}
+
+// withWatch returns ws with a new watch calling cb, and the watch's id.
+func (c *Context) withWatch(ws []propWatch, cb Value) ([]propWatch, int) {
+	c.eng.watchID++
+	return append(ws[:len(ws):len(ws)], propWatch{id: c.eng.watchID, cb: cb}), c.eng.watchID
+}
+
+// notifyWatchers is called after key of the observed object is assigned,
+// and calls its watchers right away and its subscribers later.
+func (c *Context) notifyWatchers(ws *objWatchers, key string, val, old Value) *runtimeError {
+	if len(ws.subs) > 0 {
+		c.queueChange(ws, key, val, old)
+	}
+	for _, w := range ws.keys[key] {
+		if _, err := c.EvalFnValue(w.cb, false, val, old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Context) unwatch(id uintptr, ws *objWatchers, key string, watchID int) {
+	if remaining := withoutWatch(ws.keys[key], watchID); len(remaining) > 0 {
+		ws.keys[key] = remaining
+	} else {
+		delete(ws.keys, key)
+	}
+	c.forgetIfUnobserved(id, ws)
+}
+
+func (c *Context) oakDebugWatch(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("watch", args, 3); err != nil {
+		return nil, err
+	}
+
+	obj, ok := args[0].(ObjectValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("First argument to watch must be an object, got %s", args[0]),
+		}
+	}
+
+	var key string
+	switch k := args[1].(type) {
+	case *StringValue:
+		key = string(*k)
+	case AtomValue:
+		key = string(k)
+	default:
+		key = k.String()
+	}
+
+	cb := args[2]
+	switch cb.(type) {
+	case FnValue, BuiltinFnValue:
+	default:
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Third argument to watch must be a function, got %s", cb),
+		}
+	}
+
+	id, ws := c.observersFor(obj)
+	var watchID int
+	ws.keys[key], watchID = c.withWatch(ws.keys[key], cb)
+
+	return BuiltinFnValue{
+		name: "unwatch",
+		fn: func(_ []Value) (Value, *runtimeError) {
+			c.unwatch(id, ws, key, watchID)
+			return null, nil
+		},
+	}, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Objects overload operators by defining protocol methods, functions under
+// keys like __add that the evaluator calls in place of the built-in behavior
+// of an operator, so that types like vectors or money can be written with
+// ordinary arithmetic. A binary operator calls the method of its left operand
+// if it has one, and otherwise that of its right operand, always with both
+// operands in order, as in __add(a, b).
+
+// operatorMethods maps each binary operator that objects can overload to the
+// key of its protocol method. The ordering operators all call __cmp(a, b),
+// which returns a number less than, equal to, or greater than zero.
+var operatorMethods = map[tokKind]string{
+	plus:    "__add",
+	minus:   "__sub",
+	times:   "__mul",
+	divide:  "__div",
+	modulus: "__mod",
+	power:   "__pow",
+	eq:      "__eq",
+	neq:     "__eq",
+	greater: "__cmp",
+	less:    "__cmp",
+	geq:     "__cmp",
+	leq:     "__cmp",
+}
+
+// protocolMethod returns the function under the key name of v, if v is an
+// object that defines it or inherits it from a prototype. Protocol methods
+// are called with their operands, so an inherited one isn't bound to v.
+func protocolMethod(v Value, name string) (Value, bool) {
+	obj, ok := v.(ObjectValue)
+	if !ok {
+		return nil, false
+	}
+	method, ok := obj[name]
+	if !ok {
+		method, _ = protoLookup(obj, name)
+	}
+	switch method.(type) {
+	case FnValue, BuiltinFnValue:
+		return method, true
+	}
+	return nil, false
+}
+
+// evalOverloadedOp evaluates a binary operator with the protocol method of one
+// of its operands, and reports whether either operand overloads op. Comparing
+// with ? or _ never calls __eq, so that checks like x = ? work on any object.
+func (c *Context) evalOverloadedOp(op tokKind, left, right Value) (Value, bool, *runtimeError) {
+	name, ok := operatorMethods[op]
+	if !ok {
+		return nil, false, nil
+	}
+	if name == "__eq" {
+		switch left.(type) {
+		case NullValue, EmptyValue:
+			return nil, false, nil
+		}
+		switch right.(type) {
+		case NullValue, EmptyValue:
+			return nil, false, nil
+		}
+	}
+
+	method, ok := protocolMethod(left, name)
+	if !ok {
+		if method, ok = protocolMethod(right, name); !ok {
+			return nil, false, nil
+		}
+	}
+
+	result, err := c.EvalFnValue(method, false, left, right)
+	if err != nil {
+		return nil, true, err
+	}
+
+	switch name {
+	case "__eq":
+		eq, ok := result.(BoolValue)
+		if !ok {
+			return nil, true, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("__eq must return a bool, got %s", result),
+			}
+		}
+		if op == neq {
+			return !eq, true, nil
+		}
+		return eq, true, nil
+	case "__cmp":
+		cmp, ok := toFloat(result)
+		if !ok {
+			return nil, true, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("__cmp must return a number, got %s", result),
+			}
+		}
+		switch op {
+		case greater:
+			return BoolValue(cmp > 0), true, nil
+		case less:
+			return BoolValue(cmp < 0), true, nil
+		case geq:
+			return BoolValue(cmp >= 0), true, nil
+		default:
+			return BoolValue(cmp <= 0), true, nil
+		}
+	}
+	return result, true, nil
+}
+
+// stringMethod returns the result of the __string method of v, if v is an
+// object that defines one, and otherwise v itself.
+func (c *Context) stringMethod(v Value) (Value, *runtimeError) {
+	method, ok := protocolMethod(v, "__string")
+	if !ok {
+		return v, nil
+	}
+
+	result, err := c.EvalFnValue(method, false, v)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := result.(*StringValue); !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("__string must return a string, got %s", result),
+		}
+	}
+	return result, nil
+}
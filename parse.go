@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -64,7 +65,12 @@ type floatNode struct {
 }
 
 func (n floatNode) String() string {
-	return strconv.FormatFloat(n.payload, 'g', -1, 64)
+	s := strconv.FormatFloat(n.payload, 'g', -1, 64)
+	// ensure the printed literal re-parses as a float rather than an int
+	if !strings.ContainsAny(s, ".eEIN") {
+		s += ".0"
+	}
+	return s
 }
 func (n floatNode) pos() pos {
 	return n.tok.pos
@@ -113,6 +119,20 @@ func (n listNode) pos() pos {
 	return n.tok.pos
 }
 
+// spreadNode is an element of a list literal of the form `xs...`, which
+// splices the elements of the list xs into the surrounding list.
+type spreadNode struct {
+	elem astNode
+	tok  *token
+}
+
+func (n spreadNode) String() string {
+	return n.elem.String() + "..."
+}
+func (n spreadNode) pos() pos {
+	return n.tok.pos
+}
+
 type objectEntry struct {
 	key astNode
 	val astNode
@@ -143,7 +163,12 @@ type fnNode struct {
 	args    []string
 	restArg string
 	body    astNode
-	tok     *token
+	// doc is the text of any /// doc comments preceding the fn keyword
+	doc string
+	// frame is the layout of the scope created by calling the function, or
+	// nil if the function hasn't been resolved
+	frame *frame
+	tok   *token
 }
 
 func (n fnNode) String() string {
@@ -169,7 +194,10 @@ func (n fnNode) pos() pos {
 
 type identifierNode struct {
 	payload string
-	tok     *token
+	// ref is the variable's location as found by the resolver, or nil if the
+	// identifier hasn't been resolved
+	ref *varRef
+	tok *token
 }
 
 func (n identifierNode) String() string {
@@ -183,7 +211,9 @@ type assignmentNode struct {
 	isLocal bool
 	left    astNode
 	right   astNode
-	tok     *token
+	// doc is the text of any /// doc comments preceding the assignment
+	doc string
+	tok *token
 }
 
 func (n assignmentNode) String() string {
@@ -199,10 +229,16 @@ func (n assignmentNode) pos() pos {
 type propertyAccessNode struct {
 	left  astNode
 	right astNode
-	tok   *token
+	// optional is set for accesses of the form a?.b, which evaluate to null
+	// rather than erroring if the left side is null.
+	optional bool
+	tok      *token
 }
 
 func (n propertyAccessNode) String() string {
+	if n.optional {
+		return "(" + n.left.String() + "?." + n.right.String() + ")"
+	}
 	return "(" + n.left.String() + "." + n.right.String() + ")"
 }
 func (n propertyAccessNode) pos() pos {
@@ -261,10 +297,16 @@ func (n fnCallNode) pos() pos {
 
 type ifBranch struct {
 	target astNode
-	body   astNode
+	// guard is an optional predicate that must also evaluate to true for the
+	// branch to match, as in `_ if n > 3 -> body`. It is nil if absent.
+	guard astNode
+	body  astNode
 }
 
 func (n ifBranch) String() string {
+	if n.guard != nil {
+		return n.target.String() + " if " + n.guard.String() + " -> " + n.body.String()
+	}
 	return n.target.String() + " -> " + n.body.String()
 }
 
@@ -287,6 +329,9 @@ func (n ifExprNode) pos() pos {
 
 type blockNode struct {
 	exprs []astNode
+	// frame is the layout of the scope created by evaluating the block, or
+	// nil if the block hasn't been resolved
+	frame *frame
 	tok   *token
 }
 
@@ -302,10 +347,328 @@ func (n blockNode) pos() pos {
 	return n.tok.pos
 }
 
+// awaitNode is an await expression in the body of an async function. It only
+// exists while the function is parsed, and is desugared into a call to
+// ___await by parseAsyncFn before the parser returns the function.
+type awaitNode struct {
+	expr astNode
+	tok  *token
+}
+
+func (n awaitNode) String() string {
+	return "await " + n.expr.String()
+}
+func (n awaitNode) pos() pos {
+	return n.tok.pos
+}
+
+// sourceString renders node as Oak source text, adding parentheses only where
+// operator precedence requires them. It is used to show expressions in error
+// messages the way they were written, rather than in the debug form of String.
+func sourceString(node astNode) string {
+	switch n := node.(type) {
+	case stringNode:
+		return quoteOakString(n.payload)
+	case listNode:
+		elems := make([]string, len(n.elems))
+		for i, el := range n.elems {
+			elems[i] = sourceString(el)
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	case spreadNode:
+		return sourceString(n.elem) + "..."
+	case objectNode:
+		if len(n.entries) == 0 {
+			return "{}"
+		}
+		entries := make([]string, len(n.entries))
+		for i, ent := range n.entries {
+			var key string
+			switch k := ent.key.(type) {
+			case identifierNode, stringNode, intNode:
+				key = sourceString(k)
+			default:
+				key = "(" + sourceString(k) + ")"
+			}
+			entries[i] = key + ": " + sourceString(ent.val)
+		}
+		return "{ " + strings.Join(entries, ", ") + " }"
+	case fnNode:
+		args := make([]string, len(n.args))
+		for i, arg := range n.args {
+			if arg == "" {
+				arg = "_"
+			}
+			args[i] = arg
+		}
+		if n.restArg != "" {
+			args = append(args, n.restArg+"...")
+		}
+		head := "fn"
+		if n.name != "" {
+			head += " " + n.name
+		}
+		return head + "(" + strings.Join(args, ", ") + ") " + sourceString(n.body)
+	case assignmentNode:
+		if n.isLocal {
+			return sourceString(n.left) + " := " + sourceString(n.right)
+		}
+		return sourceString(n.left) + " <- " + sourceString(n.right)
+	case propertyAccessNode:
+		dot := "."
+		if n.optional {
+			dot = "?."
+		}
+		var right string
+		switch r := n.right.(type) {
+		case identifierNode, intNode, blockNode:
+			right = sourceString(r)
+		default:
+			right = "(" + sourceString(r) + ")"
+		}
+		return operandSource(n.left) + dot + right
+	case unaryNode:
+		return token{kind: n.op}.String() + operandSource(n.right)
+	case binaryNode:
+		prec := infixOpPrecedence(n.op)
+		left, right := sourceString(n.left), sourceString(n.right)
+		if l, ok := n.left.(binaryNode); ok && infixOpPrecedence(l.op) < prec {
+			left = "(" + left + ")"
+		} else if _, ok := n.left.(assignmentNode); ok {
+			left = "(" + left + ")"
+		}
+		// binary operators associate to the left, so an operand on the right
+		// needs parentheses even at the same precedence
+		if r, ok := n.right.(binaryNode); ok && infixOpPrecedence(r.op) <= prec {
+			right = "(" + right + ")"
+		} else if _, ok := n.right.(assignmentNode); ok {
+			right = "(" + right + ")"
+		}
+		return left + " " + token{kind: n.op}.String() + " " + right
+	case fnCallNode:
+		args := make([]string, len(n.args))
+		for i, arg := range n.args {
+			args[i] = sourceString(arg)
+		}
+		if n.restArg != nil {
+			args = append(args, sourceString(n.restArg)+"...")
+		}
+		return operandSource(n.fn) + "(" + strings.Join(args, ", ") + ")"
+	case ifExprNode:
+		branches := make([]string, len(n.branches))
+		for i, br := range n.branches {
+			branch := sourceString(br.target)
+			if br.guard != nil {
+				branch += " if " + sourceString(br.guard)
+			}
+			branches[i] = branch + " -> " + sourceString(br.body)
+		}
+		return "if " + sourceString(n.cond) + " { " + strings.Join(branches, ", ") + " }"
+	case blockNode:
+		exprs := make([]string, len(n.exprs))
+		for i, ex := range n.exprs {
+			exprs[i] = sourceString(ex)
+		}
+		return "(" + strings.Join(exprs, ", ") + ")"
+	case awaitNode:
+		return "await " + sourceString(n.expr)
+	default:
+		// the remaining literals print as they are written
+		return node.String()
+	}
+}
+
+// operandSource renders node as the operand of a unary operator, property
+// access, or call, parenthesizing it unless it already binds tightly.
+func operandSource(node astNode) string {
+	switch node.(type) {
+	case binaryNode, assignmentNode, unaryNode, fnNode, ifExprNode:
+		return "(" + sourceString(node) + ")"
+	}
+	return sourceString(node)
+}
+
+// quoteOakString renders a byte string as a single-quoted Oak string literal
+func quoteOakString(s []byte) string {
+	sb := strings.Builder{}
+	sb.WriteByte('\'')
+	for _, b := range s {
+		switch b {
+		case '\'', '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(b)
+		case '\n':
+			sb.WriteString("\\n")
+		case '\t':
+			sb.WriteString("\\t")
+		case '\r':
+			sb.WriteString("\\r")
+		case '\f':
+			sb.WriteString("\\f")
+		default:
+			if b < 0x20 || b == 0x7f {
+				fmt.Fprintf(&sb, "\\x%02x", b)
+			} else {
+				sb.WriteByte(b)
+			}
+		}
+	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
+
+// walkNode calls visit for node and each of its descendants in the syntax
+// tree, in depth-first order. If visit returns false, walkNode does not
+// descend into that node's children.
+func walkNode(node astNode, visit func(astNode) bool) {
+	if node == nil || !visit(node) {
+		return
+	}
+
+	switch n := node.(type) {
+	case listNode:
+		for _, el := range n.elems {
+			walkNode(el, visit)
+		}
+	case spreadNode:
+		walkNode(n.elem, visit)
+	case objectNode:
+		for _, entry := range n.entries {
+			walkNode(entry.key, visit)
+			walkNode(entry.val, visit)
+		}
+	case fnNode:
+		walkNode(n.body, visit)
+	case assignmentNode:
+		walkNode(n.left, visit)
+		walkNode(n.right, visit)
+	case propertyAccessNode:
+		walkNode(n.left, visit)
+		walkNode(n.right, visit)
+	case unaryNode:
+		walkNode(n.right, visit)
+	case binaryNode:
+		walkNode(n.left, visit)
+		walkNode(n.right, visit)
+	case fnCallNode:
+		walkNode(n.fn, visit)
+		for _, arg := range n.args {
+			walkNode(arg, visit)
+		}
+		walkNode(n.restArg, visit)
+	case ifExprNode:
+		walkNode(n.cond, visit)
+		for _, branch := range n.branches {
+			walkNode(branch.target, visit)
+			walkNode(branch.guard, visit)
+			walkNode(branch.body, visit)
+		}
+	case blockNode:
+		for _, expr := range n.exprs {
+			walkNode(expr, visit)
+		}
+	}
+}
+
+// transformNode returns a copy of the syntax tree node with nodes replaced by
+// visit, which is called with each node after its children have been
+// transformed, and returns the node that replaces it, or nil to keep it. The
+// Oak counterpart for codemods written in Oak is transform in lib/syntax.oak.
+func transformNode(node astNode, visit func(astNode) astNode) astNode {
+	if node == nil {
+		return nil
+	}
+
+	transformAll := func(nodes []astNode) []astNode {
+		if nodes == nil {
+			return nil
+		}
+		result := make([]astNode, len(nodes))
+		for i, child := range nodes {
+			result[i] = transformNode(child, visit)
+		}
+		return result
+	}
+
+	switch n := node.(type) {
+	case listNode:
+		n.elems = transformAll(n.elems)
+		node = n
+	case spreadNode:
+		n.elem = transformNode(n.elem, visit)
+		node = n
+	case objectNode:
+		entries := make([]objectEntry, len(n.entries))
+		for i, entry := range n.entries {
+			entries[i] = objectEntry{
+				key: transformNode(entry.key, visit),
+				val: transformNode(entry.val, visit),
+			}
+		}
+		n.entries = entries
+		node = n
+	case fnNode:
+		n.body = transformNode(n.body, visit)
+		node = n
+	case assignmentNode:
+		n.left = transformNode(n.left, visit)
+		n.right = transformNode(n.right, visit)
+		node = n
+	case propertyAccessNode:
+		n.left = transformNode(n.left, visit)
+		n.right = transformNode(n.right, visit)
+		node = n
+	case unaryNode:
+		n.right = transformNode(n.right, visit)
+		node = n
+	case binaryNode:
+		n.left = transformNode(n.left, visit)
+		n.right = transformNode(n.right, visit)
+		node = n
+	case fnCallNode:
+		n.fn = transformNode(n.fn, visit)
+		n.args = transformAll(n.args)
+		n.restArg = transformNode(n.restArg, visit)
+		node = n
+	case ifExprNode:
+		n.cond = transformNode(n.cond, visit)
+		branches := make([]ifBranch, len(n.branches))
+		for i, branch := range n.branches {
+			branches[i] = ifBranch{
+				target: transformNode(branch.target, visit),
+				guard:  transformNode(branch.guard, visit),
+				body:   transformNode(branch.body, visit),
+			}
+		}
+		n.branches = branches
+		node = n
+	case blockNode:
+		n.exprs = transformAll(n.exprs)
+		node = n
+	}
+
+	if replacement := visit(node); replacement != nil {
+		return replacement
+	}
+	return node
+}
+
 type parser struct {
+	// tokens holds the tokens read so far. A streaming parser pulls tokens
+	// from stream as it needs them, and discards them once the top-level node
+	// containing them has been parsed.
 	tokens        []token
 	index         int
+	stream        *tokenStream
 	minBinaryPrec []int
+	// inAsync is true while parsing the body of an async function, where
+	// await begins an await expression rather than naming a variable. It
+	// stays true in functions nested in the body, so that an await there is
+	// reported as misplaced.
+	inAsync bool
+	// pipeTarget is true while parsing the call after a |>, which may have a
+	// ^ placeholder argument for the piped value.
+	pipeTarget bool
 }
 
 func newParser(tokens []token) parser {
@@ -316,6 +679,35 @@ func newParser(tokens []token) parser {
 	}
 }
 
+// newStreamingParser returns a parser that reads tokens from t lazily. Its
+// top-level nodes are read one by one with parseNext.
+func newStreamingParser(t *tokenizer) parser {
+	return parser{
+		tokens:        []token{},
+		index:         0,
+		stream:        newTokenStream(t),
+		minBinaryPrec: []int{0},
+	}
+}
+
+// fill ensures that the token at p.index+n has been read from the stream if
+// it exists, and reports whether it does.
+func (p *parser) fill(n int) bool {
+	for p.index+n >= len(p.tokens) {
+		if p.stream == nil {
+			return false
+		}
+
+		tok, ok := p.stream.read()
+		if !ok {
+			p.stream = nil
+			return false
+		}
+		p.tokens = append(p.tokens, tok)
+	}
+	return true
+}
+
 func (p *parser) lastMinPrec() int {
 	return p.minBinaryPrec[len(p.minBinaryPrec)-1]
 }
@@ -329,15 +721,16 @@ func (p *parser) popMinPrec() {
 }
 
 func (p *parser) isEOF() bool {
-	return p.index == len(p.tokens)
+	return !p.fill(0)
 }
 
 func (p *parser) peek() token {
+	p.fill(0)
 	return p.tokens[p.index]
 }
 
 func (p *parser) peekAhead(n int) token {
-	if p.index+n > len(p.tokens) {
+	if !p.fill(n) {
 		// Use comma as "nothing is here" value
 		return token{kind: comma}
 	}
@@ -345,6 +738,7 @@ func (p *parser) peekAhead(n int) token {
 }
 
 func (p *parser) next() token {
+	p.fill(0)
 	tok := p.tokens[p.index]
 
 	if p.index < len(p.tokens) {
@@ -400,7 +794,7 @@ func (e parseError) Error() string {
 	return fmt.Sprintf("Parse error at %s: %s", e.pos.String(), e.reason)
 }
 
-func (p *parser) parseAssignment(left astNode) (astNode, error) {
+func (p *parser) parseAssignment(left astNode, doc string) (astNode, error) {
 	if p.peek().kind != assign &&
 		p.peek().kind != nonlocalAssign {
 		return left, nil
@@ -410,6 +804,7 @@ func (p *parser) parseAssignment(left astNode) (astNode, error) {
 	node := assignmentNode{
 		isLocal: next.kind == assign,
 		left:    left,
+		doc:     doc,
 		tok:     &next,
 	}
 
@@ -422,6 +817,112 @@ func (p *parser) parseAssignment(left astNode) (astNode, error) {
 	return node, nil
 }
 
+// skipType reads a type annotation, like int, [string], { x: float }, or
+// fn(int) -> bool. Annotations are checked by oak typecheck, and the
+// interpreter ignores them.
+func (p *parser) skipType() error {
+	if p.isEOF() {
+		return parseError{
+			reason: "Unexpected end of input, expected a type",
+			pos:    p.tokens[len(p.tokens)-1].pos,
+		}
+	}
+
+	tok := p.next()
+	switch tok.kind {
+	case qmark, identifier:
+		return nil
+	case leftBracket:
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if _, err := p.expect(comma); err != nil {
+			return err
+		}
+		_, err := p.expect(rightBracket)
+		return err
+	case leftBrace:
+		for !p.isEOF() && p.peek().kind != rightBrace {
+			if _, err := p.expect(identifier); err != nil {
+				return err
+			}
+			if _, err := p.expect(colon); err != nil {
+				return err
+			}
+			if err := p.skipType(); err != nil {
+				return err
+			}
+			if _, err := p.expect(comma); err != nil {
+				return err
+			}
+		}
+		_, err := p.expect(rightBrace)
+		return err
+	case fnKeyword:
+		if p.isEOF() || p.peek().kind != leftParen {
+			return nil
+		}
+		p.next() // eat the leftParen
+		for !p.isEOF() && p.peek().kind != rightParen {
+			if err := p.skipType(); err != nil {
+				return err
+			}
+			if _, err := p.expect(comma); err != nil {
+				return err
+			}
+		}
+		if _, err := p.expect(rightParen); err != nil {
+			return err
+		}
+		if !p.isEOF() && p.peek().kind == branchArrow {
+			p.next() // eat the branchArrow
+			return p.skipType()
+		}
+		return nil
+	}
+	return parseError{
+		reason: fmt.Sprintf("Expected a type, got %s", tok),
+		pos:    tok.pos,
+	}
+}
+
+// skipAnnotation reads the type annotation of a name, a colon and a type, if
+// there is one.
+func (p *parser) skipAnnotation() error {
+	if p.isEOF() || p.peek().kind != colon {
+		return nil
+	}
+	p.next() // eat the colon
+	return p.skipType()
+}
+
+// typedNameAhead reports whether the next tokens are a name with a type
+// annotation followed by :=, as in `count: int := 0`, and if so reads the name
+// and the annotation and returns the name. Otherwise, no tokens are read, so
+// that entries like { count: int } still parse as objects.
+func (p *parser) typedNameAhead() (token, bool) {
+	if !p.fill(1) || p.peek().kind != identifier || p.peekAhead(1).kind != colon {
+		return token{}, false
+	}
+
+	start := p.index
+	name := p.next()
+	if err := p.skipAnnotation(); err == nil && !p.isEOF() && p.peek().kind == assign {
+		return name, true
+	}
+	p.index = start
+	return token{}, false
+}
+
+// parseStatement parses an expression in a block or at the top level of a
+// program, where a name declared by a statement may have a type annotation.
+func (p *parser) parseStatement() (astNode, error) {
+	if name, ok := p.typedNameAhead(); ok {
+		return p.parseAssignment(identifierNode{payload: name.payload, tok: &name}, name.doc)
+	}
+	return p.parseNode()
+}
+
 // parseUnit is responsible for parsing the smallest complete syntactic "units"
 // of Oak's syntax, like literals including function literals, grouped
 // expressions in blocks, and if/with expressions.
@@ -473,8 +974,10 @@ func (p *parser) parseUnit() (astNode, error) {
 			}
 		}
 		return stringNode{payload: payloadBuilder.Bytes(), tok: &tok}, nil
+	case rawStringLiteral:
+		return stringNode{payload: []byte(tok.payload), tok: &tok}, nil
 	case numberLiteral:
-		if strings.ContainsRune(tok.payload, '.') {
+		if strings.ContainsAny(tok.payload, ".eE") {
 			f, err := strconv.ParseFloat(tok.payload, 64)
 			if err != nil {
 				return nil, parseError{reason: err.Error(), pos: tok.pos}
@@ -530,6 +1033,10 @@ func (p *parser) parseUnit() (astNode, error) {
 			if err != nil {
 				return nil, err
 			}
+			if p.peek().kind == ellipsis {
+				ellipsisTok := p.next() // eat the ellipsis
+				node = spreadNode{elem: node, tok: &ellipsisTok}
+			}
 			if _, err := p.expect(comma); err != nil {
 				return nil, err
 			}
@@ -551,7 +1058,7 @@ func (p *parser) parseUnit() (astNode, error) {
 			return objectNode{entries: []objectEntry{}, tok: &tok}, nil
 		}
 
-		firstExpr, err := p.parseNode()
+		firstExpr, err := p.parseStatement()
 		if err != nil {
 			return nil, err
 		}
@@ -613,7 +1120,7 @@ func (p *parser) parseUnit() (astNode, error) {
 		}
 
 		for !p.isEOF() && p.peek().kind != rightBrace {
-			expr, err := p.parseNode()
+			expr, err := p.parseStatement()
 			if err != nil {
 				return nil, err
 			}
@@ -629,83 +1136,26 @@ func (p *parser) parseUnit() (astNode, error) {
 
 		return blockNode{exprs: exprs, tok: &tok}, nil
 	case fnKeyword:
-		p.pushMinPrec(0)
-		defer p.popMinPrec()
-
-		name := ""
-		if p.peek().kind == identifier {
-			// optional named fn
-			name = p.next().payload
+		return p.parseFn(tok, false)
+	case underscore:
+		return emptyNode{tok: &tok}, nil
+	case identifier:
+		if tok.payload == "async" && p.peek().kind == fnKeyword {
+			return p.parseAsyncFn(tok)
 		}
+		if tok.payload == "for" && p.forAhead() {
+			return p.parseFor(tok)
+		}
+		if tok.payload == "await" && p.inAsync {
+			p.pushMinPrec(0)
+			defer p.popMinPrec()
 
-		args := []string{}
-		var restArg string
-		if p.peek().kind == leftParen {
-			// optional argument list
-			p.next() // eat the leftParen
-			for !p.isEOF() && p.peek().kind != rightParen {
-				arg, err := p.expect(identifier)
-				if err != nil {
-					p.back() // try again
-
-					_, err := p.expect(underscore)
-					if err != nil {
-						return nil, err
-					}
-
-					args = append(args, "")
-
-					if _, err := p.expect(comma); err != nil {
-						return nil, err
-					}
-
-					continue
-				}
-
-				// maybe this is a rest arg
-				if p.peek().kind == ellipsis {
-					restArg = arg.payload
-					p.next() // eat the ellipsis
-
-					_, err = p.expect(comma)
-					if err != nil {
-						return nil, err
-					}
-					break
-				}
-
-				args = append(args, arg.payload)
-
-				if _, err := p.expect(comma); err != nil {
-					return nil, err
-				}
-			}
-			if _, err := p.expect(rightParen); err != nil {
+			expr, err := p.parseNode()
+			if err != nil {
 				return nil, err
 			}
+			return awaitNode{expr: expr, tok: &tok}, nil
 		}
-
-		body, err := p.parseNode()
-		if err != nil {
-			return nil, err
-		}
-
-		// Exception to the "{} is empty object" rule is that `fn {}` parses as
-		// a function with an empty block as a body
-		if objBody, ok := body.(objectNode); ok && len(objBody.entries) == 0 {
-			body = blockNode{exprs: []astNode{}, tok: objBody.tok}
-		}
-
-		return fnNode{
-			name:    name,
-			args:    args,
-			restArg: restArg,
-			body:    body,
-			tok:     &tok,
-		}, nil
-	case underscore:
-		return emptyNode{tok: &tok}, nil
-	case identifier:
 		return identifierNode{payload: tok.payload, tok: &tok}, nil
 	case minus, exclam:
 		right, err := p.parseSubNode()
@@ -775,18 +1225,30 @@ func (p *parser) parseUnit() (astNode, error) {
 
 		for !p.isEOF() && p.peek().kind != rightBrace {
 			targets := []astNode{}
+			var guard astNode
 			for !p.isEOF() && p.peek().kind != branchArrow {
 				target, err := p.parseNode()
 				if err != nil {
 					return nil, err
 				}
+				targets = append(targets, target)
+
+				// a guard clause `target if pred -> body` ends the list of
+				// targets, and applies to every target in the branch
+				if !p.isEOF() && p.peek().kind == ifKeyword {
+					p.next() // eat the if keyword
+					guard, err = p.parseNode()
+					if err != nil {
+						return nil, err
+					}
+					break
+				}
+
 				if p.peek().kind != branchArrow {
 					if _, err := p.expect(comma); err != nil {
 						return nil, err
 					}
 				}
-
-				targets = append(targets, target)
 			}
 			if _, err := p.expect(branchArrow); err != nil {
 				return nil, err
@@ -812,6 +1274,7 @@ func (p *parser) parseUnit() (astNode, error) {
 			for _, target := range targets {
 				branches = append(branches, ifBranch{
 					target: target,
+					guard:  guard,
 					body:   body,
 				})
 			}
@@ -855,7 +1318,7 @@ func (p *parser) parseUnit() (astNode, error) {
 
 		exprs := []astNode{}
 		for !p.isEOF() && p.peek().kind != rightParen {
-			expr, err := p.parseNode()
+			expr, err := p.parseStatement()
 			if err != nil {
 				return nil, err
 			}
@@ -878,6 +1341,395 @@ func (p *parser) parseUnit() (astNode, error) {
 	}
 }
 
+// parseFn parses a function literal after its fn keyword tok. The body of an
+// async function is parsed with await expressions, which are left for
+// parseAsyncFn to desugar.
+func (p *parser) parseFn(tok token, async bool) (fnNode, error) {
+	p.pushMinPrec(0)
+	defer p.popMinPrec()
+
+	name := ""
+	if p.peek().kind == identifier {
+		// optional named fn
+		name = p.next().payload
+	}
+
+	args := []string{}
+	var restArg string
+	if p.peek().kind == leftParen {
+		// optional argument list
+		p.next() // eat the leftParen
+		for !p.isEOF() && p.peek().kind != rightParen {
+			arg, err := p.expect(identifier)
+			if err != nil {
+				p.back() // try again
+
+				_, err := p.expect(underscore)
+				if err != nil {
+					return fnNode{}, err
+				}
+
+				args = append(args, "")
+
+				if err := p.skipAnnotation(); err != nil {
+					return fnNode{}, err
+				}
+				if _, err := p.expect(comma); err != nil {
+					return fnNode{}, err
+				}
+
+				continue
+			}
+
+			// maybe this is a rest arg
+			if p.peek().kind == ellipsis {
+				restArg = arg.payload
+				p.next() // eat the ellipsis
+
+				if err := p.skipAnnotation(); err != nil {
+					return fnNode{}, err
+				}
+				_, err = p.expect(comma)
+				if err != nil {
+					return fnNode{}, err
+				}
+				break
+			}
+
+			args = append(args, arg.payload)
+
+			if err := p.skipAnnotation(); err != nil {
+				return fnNode{}, err
+			}
+			if _, err := p.expect(comma); err != nil {
+				return fnNode{}, err
+			}
+		}
+		if _, err := p.expect(rightParen); err != nil {
+			return fnNode{}, err
+		}
+
+		// optional return type
+		if p.peek().kind == branchArrow {
+			p.next() // eat the branchArrow
+			if err := p.skipType(); err != nil {
+				return fnNode{}, err
+			}
+		}
+	}
+
+	outerAsync := p.inAsync
+	p.inAsync = async || outerAsync
+	body, err := p.parseNode()
+	p.inAsync = outerAsync
+	if err != nil {
+		return fnNode{}, err
+	}
+
+	// Exception to the "{} is empty object" rule is that `fn {}` parses as
+	// a function with an empty block as a body
+	if objBody, ok := body.(objectNode); ok && len(objBody.entries) == 0 {
+		body = blockNode{exprs: []astNode{}, tok: objBody.tok}
+	}
+
+	return fnNode{
+		name:    name,
+		args:    args,
+		restArg: restArg,
+		body:    body,
+		doc:     tok.doc,
+		tok:     &tok,
+	}, nil
+}
+
+// forAhead reports whether the tokens after a for are names separated by
+// commas and followed by in, as in `for k, v in xs`, so that for begins a for
+// expression. Elsewhere, for is an ordinary name, as in { for: 1 } or x.for.
+func (p *parser) forAhead() bool {
+	for i := 0; ; i += 2 {
+		if name := p.peekAhead(i); name.kind != identifier && name.kind != underscore {
+			return false
+		}
+		switch sep := p.peekAhead(i + 1); {
+		case sep.kind == identifier && sep.payload == "in":
+			return true
+		case sep.kind != comma:
+			return false
+		}
+	}
+}
+
+// parseFor parses a for expression after the for token tok.
+func (p *parser) parseFor(tok token) (astNode, error) {
+	p.pushMinPrec(0)
+	defer p.popMinPrec()
+
+	// `for k, v in xs body` desugars to ___for(xs, fn(k, v) body, false),
+	// a call to the builtin that iterates over xs, and `for v in xs body`
+	// to the same call with fn(_, v). In the form `for v in xs collect
+	// body`, the last argument is true, and the call returns a list of
+	// each value of the body rather than the last one.
+	args := []string{}
+	for {
+		if !p.isEOF() && p.peek().kind == underscore {
+			p.next() // eat the underscore
+			args = append(args, "")
+		} else {
+			arg, err := p.expect(identifier)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg.payload)
+		}
+
+		if p.isEOF() || p.peek().kind != comma {
+			break
+		}
+		p.next() // eat the comma
+	}
+	switch len(args) {
+	case 1:
+		args = []string{"", args[0]}
+	case 2:
+		// key and value
+	default:
+		return nil, parseError{
+			reason: fmt.Sprintf("for expression should name a key and a value, found %d names", len(args)),
+			pos:    tok.pos,
+		}
+	}
+
+	inTok, err := p.expect(identifier)
+	if err != nil {
+		return nil, err
+	}
+	if inTok.payload != "in" {
+		return nil, parseError{
+			reason: fmt.Sprintf("Unexpected token %s, expected in", inTok),
+			pos:    inTok.pos,
+		}
+	}
+
+	iterable, err := p.parseNode()
+	if err != nil {
+		return nil, err
+	}
+
+	collect := false
+	if !p.isEOF() && p.peek().kind == identifier && p.peek().payload == "collect" {
+		p.next() // eat the collect
+		collect = true
+	}
+
+	body, err := p.parseNode()
+	if err != nil {
+		return nil, err
+	}
+	// like fn {}, for ... {} has an empty block as a body
+	if objBody, ok := body.(objectNode); ok && len(objBody.entries) == 0 {
+		body = blockNode{exprs: []astNode{}, tok: objBody.tok}
+	}
+
+	return fnCallNode{
+		fn: identifierNode{payload: "___for", tok: &tok},
+		args: []astNode{
+			iterable,
+			fnNode{args: args, body: body, tok: &tok},
+			boolNode{payload: collect, tok: &tok},
+		},
+		tok: &tok,
+	}, nil
+}
+
+// parseAsyncFn parses an async function, `async fn name(args) body`, which
+// returns a task resolved with the value of its body. In its body, `await t`
+// or `x := await t` waits for the task t to settle before running the rest of
+// the body, so async code reads from top to bottom. An async function is
+// desugared to an ordinary function that calls ___async with its body, and
+// every statement after an await is moved into a callback, so that
+//
+//	async fn f(x) { y := await g(x), y + 1 }
+//
+// becomes fn f(x) ___async(fn() ___await(g(x), fn(___awaited) { y :=
+// ___awaited, y + 1 })). An await can't be moved out of an expression, so it
+// may only begin a statement, or follow the := or <- of one, directly in the
+// body of an async function.
+func (p *parser) parseAsyncFn(asyncTok token) (astNode, error) {
+	fnTok := p.next()
+	fn, err := p.parseFn(fnTok, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var body astNode
+	if block, ok := fn.body.(blockNode); ok {
+		block.exprs = awaitStatements(block.exprs)
+		body = block
+	} else {
+		body = awaitStatements([]astNode{fn.body})[0]
+	}
+
+	var stray *awaitNode
+	walkNode(body, func(node astNode) bool {
+		if n, ok := node.(awaitNode); ok && stray == nil {
+			stray = &n
+		}
+		return stray == nil
+	})
+	if stray != nil {
+		return nil, parseError{
+			reason: "await must begin a statement in the body of an async fn, or be assigned by one",
+			pos:    stray.tok.pos,
+		}
+	}
+
+	fn.body = fnCallNode{
+		fn:   identifierNode{payload: "___async", tok: &asyncTok},
+		args: []astNode{fnNode{body: body, tok: &fnTok}},
+		tok:  &asyncTok,
+	}
+	fn.doc = asyncTok.doc
+	return fn, nil
+}
+
+// awaitStatements desugars the first await in a list of statements into a
+// call to ___await with a callback running the statements after it, in which
+// later awaits are desugared in turn. An await that ends the list has no
+// callback, so its result is the result of the list.
+func awaitStatements(exprs []astNode) []astNode {
+	for i, expr := range exprs {
+		var await awaitNode
+		assignment, isAssignment := expr.(assignmentNode)
+		if isAssignment {
+			a, ok := assignment.right.(awaitNode)
+			if !ok {
+				continue
+			}
+			await = a
+		} else if a, ok := expr.(awaitNode); ok {
+			await = a
+		} else {
+			continue
+		}
+
+		rest := awaitStatements(exprs[i+1:])
+		var cont astNode
+		switch {
+		case isAssignment:
+			assignment.right = identifierNode{payload: "___awaited", tok: await.tok}
+			cont = fnNode{
+				args: []string{"___awaited"},
+				body: blockNode{exprs: append([]astNode{assignment}, rest...), tok: await.tok},
+				tok:  await.tok,
+			}
+		case len(rest) == 0:
+			cont = nullNode{tok: await.tok}
+		default:
+			cont = fnNode{
+				args: []string{},
+				body: blockNode{exprs: rest, tok: await.tok},
+				tok:  await.tok,
+			}
+		}
+
+		return append(exprs[:i:i], fnCallNode{
+			fn:   identifierNode{payload: "___await", tok: await.tok},
+			args: []astNode{await.expr, cont},
+			tok:  await.tok,
+		})
+	}
+	return exprs
+}
+
+// sliceAhead reports whether the parentheses starting at the next token hold
+// the bounds of a slice, as in xs.(start:end), rather than a block. A colon
+// directly inside the parentheses separates the bounds, unless it begins an
+// atom, as in xs.(:name).
+func (p *parser) sliceAhead() bool {
+	if p.isEOF() || p.peek().kind != leftParen {
+		return false
+	}
+
+	depth := 0
+	for i := 1; p.fill(i); i++ {
+		switch p.tokens[p.index+i].kind {
+		case leftParen, leftBracket, leftBrace:
+			depth++
+		case rightParen, rightBracket, rightBrace:
+			if depth == 0 {
+				return false
+			}
+			depth--
+		case colon:
+			if depth == 0 && !atomColon(p.tokens[p.index+i-1], p.peekAhead(i+1)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// atomColon reports whether a colon between the tokens prev and next begins
+// an atom, which it does if it's followed by a name and doesn't follow the end
+// of an expression.
+func atomColon(prev, next token) bool {
+	switch prev.kind {
+	case identifier, underscore, qmark, trueLiteral, falseLiteral, stringLiteral,
+		rawStringLiteral, numberLiteral, rightParen, rightBracket, rightBrace:
+		return false
+	}
+	switch next.kind {
+	case identifier, ifKeyword, fnKeyword, withKeyword, trueLiteral, falseLiteral:
+		return true
+	}
+	return false
+}
+
+// parseSlice parses the bounds of a slice of left, after the dot token dot.
+// xs.(start:end) desugars to ___slice(xs, start, end, false), a call to the
+// builtin that slices strings and lists, and xs?.(start:end) to the same call
+// with true. A missing bound is ?.
+func (p *parser) parseSlice(left astNode, dot token) (astNode, error) {
+	p.pushMinPrec(0)
+	defer p.popMinPrec()
+
+	p.next() // eat the leftParen
+
+	var start, end astNode = nullNode{tok: &dot}, nullNode{tok: &dot}
+	var err error
+	if p.peek().kind != colon {
+		if start, err = p.parseNode(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = p.expect(colon); err != nil {
+		return nil, err
+	}
+	// like every expression before a closing paren, the slice ends in a comma
+	if !p.isEOF() && p.peek().kind != comma {
+		if end, err = p.parseNode(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = p.expect(comma); err != nil {
+		return nil, err
+	}
+	if _, err = p.expect(rightParen); err != nil {
+		return nil, err
+	}
+
+	return fnCallNode{
+		fn: identifierNode{payload: "___slice", tok: &dot},
+		args: []astNode{
+			left,
+			start,
+			end,
+			boolNode{payload: dot.kind == optionalDot, tok: &dot},
+		},
+		tok: &dot,
+	}, nil
+}
+
 func infixOpPrecedence(op tokKind) int {
 	switch op {
 	case plus, minus:
@@ -886,6 +1738,8 @@ func infixOpPrecedence(op tokKind) int {
 		return 50
 	case modulus:
 		return 80
+	case power:
+		return 90
 	case eq, greater, less, geq, leq, neq:
 		return 30
 	case and:
@@ -902,6 +1756,43 @@ func infixOpPrecedence(op tokKind) int {
 	}
 }
 
+// keywordArgAhead reports whether the next tokens in a call's arguments are a
+// keyword argument like `width: 80`.
+func (p *parser) keywordArgAhead() bool {
+	return p.peek().kind == identifier && p.peekAhead(1).kind == colon
+}
+
+// parseKeywordArg parses a keyword argument into kwargs, the object of all
+// keyword arguments to a call. f(x, a: 1, b: 2) calls f(x, { a: 1, b: 2 }),
+// so functions with many optional arguments can take them as one object.
+func (p *parser) parseKeywordArg(kwargs *objectNode) error {
+	name := p.next()
+	p.next() // eat the colon
+
+	for _, entry := range kwargs.entries {
+		if entry.key.(identifierNode).payload == name.payload {
+			return parseError{
+				reason: fmt.Sprintf("Duplicate keyword argument %s", name.payload),
+				pos:    name.pos,
+			}
+		}
+	}
+
+	val, err := p.parseNode()
+	if err != nil {
+		return err
+	}
+	if _, err := p.expect(comma); err != nil {
+		return err
+	}
+
+	kwargs.entries = append(kwargs.entries, objectEntry{
+		key: identifierNode{payload: name.payload, tok: &name},
+		val: val,
+	})
+	return nil
+}
+
 // parseSubNode is responsible for parsing independent "terms" in the Oak
 // syntax, like terms in unary and binary expressions and in pipelines. It is
 // in between parseUnit and parseNode.
@@ -909,31 +1800,92 @@ func (p *parser) parseSubNode() (astNode, error) {
 	p.pushMinPrec(0)
 	defer p.popMinPrec()
 
+	// only the call directly after a |> may have a ^ placeholder, and not
+	// calls nested in its arguments
+	pipeTarget := p.pipeTarget
+	p.pipeTarget = false
+	placeholder := false
+
 	node, err := p.parseUnit()
 	if err != nil {
 		return nil, err
 	}
 
 	for !p.isEOF() {
+		if placeholder && (p.peek().kind == dot || p.peek().kind == optionalDot || p.peek().kind == leftParen) {
+			return nil, parseError{
+				reason: "A ^ placeholder can only be an argument of the call after |>",
+				pos:    p.peek().pos,
+			}
+		}
+
 		switch p.peek().kind {
-		case dot:
+		case dot, optionalDot:
 			next := p.next() // eat the dot
+			if p.sliceAhead() {
+				slice, err := p.parseSlice(node, next)
+				if err != nil {
+					return nil, err
+				}
+				node = slice
+				continue
+			}
+
 			right, err := p.parseUnit()
 			if err != nil {
 				return nil, err
 			}
 
 			node = propertyAccessNode{
-				left:  node,
-				right: right,
-				tok:   &next,
+				left:     node,
+				right:    right,
+				optional: next.kind == optionalDot,
+				tok:      &next,
 			}
 		case leftParen:
 			next := p.next() // eat the leftParen
 
 			args := []astNode{}
 			var restArg astNode = nil
+			var kwargs *objectNode
 			for !p.isEOF() && p.peek().kind != rightParen {
+				if p.keywordArgAhead() {
+					if kwargs == nil {
+						first := p.peek()
+						kwargs = &objectNode{entries: []objectEntry{}, tok: &first}
+					}
+					if err := p.parseKeywordArg(kwargs); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				if kwargs != nil {
+					return nil, parseError{
+						reason: "Positional arguments cannot follow keyword arguments",
+						pos:    p.peek().pos,
+					}
+				}
+
+				if p.peek().kind == xor && (p.peekAhead(1).kind == comma || p.peekAhead(1).kind == rightParen) {
+					tok := p.next() // eat the ^
+					if !pipeTarget {
+						return nil, parseError{
+							reason: "A ^ placeholder can only be an argument of the call after |>",
+							pos:    tok.pos,
+						}
+					}
+					args = append(args, emptyNode{tok: &tok})
+					placeholder = true
+
+					// no comma is inserted after a ^ at the end of a line
+					if p.peek().kind != rightParen {
+						if _, err := p.expect(comma); err != nil {
+							return nil, err
+						}
+					}
+					continue
+				}
+
 				arg, err := p.parseNode()
 				if err != nil {
 					return nil, err
@@ -959,6 +1911,9 @@ func (p *parser) parseSubNode() (astNode, error) {
 			if _, err := p.expect(rightParen); err != nil {
 				return nil, err
 			}
+			if kwargs != nil {
+				args = append(args, *kwargs)
+			}
 
 			node = fnCallNode{
 				fn:      node,
@@ -974,8 +1929,35 @@ func (p *parser) parseSubNode() (astNode, error) {
 	return node, nil
 }
 
+// pipeArgs returns the arguments of a call on the right of a pipe, with the
+// piped value in place of a ^ placeholder argument, as in x |> f(a, ^), or
+// otherwise as the first argument. The parser reads a ^ placeholder as an
+// empty node, which this replaces.
+func pipeArgs(piped astNode, args []astNode) ([]astNode, error) {
+	placeholder := -1
+	for i, arg := range args {
+		if empty, ok := arg.(emptyNode); ok && empty.tok.kind == xor {
+			if placeholder >= 0 {
+				return nil, parseError{
+					reason: "A call after |> can have only one ^ placeholder",
+					pos:    empty.tok.pos,
+				}
+			}
+			placeholder = i
+		}
+	}
+	if placeholder < 0 {
+		return append([]astNode{piped}, args...), nil
+	}
+
+	pipedArgs := append([]astNode{}, args...)
+	pipedArgs[placeholder] = piped
+	return pipedArgs, nil
+}
+
 // parseNode returns the next top-level astNode from the parser
 func (p *parser) parseNode() (astNode, error) {
+	doc := p.peek().doc
 	node, err := p.parseSubNode()
 	if err != nil {
 		return nil, err
@@ -986,8 +1968,8 @@ func (p *parser) parseNode() (astNode, error) {
 		case assign, nonlocalAssign:
 			// whatever follows an assignment expr cannot bind to the
 			// assignment expression itself by syntax rule, so we simply return
-			return p.parseAssignment(node)
-		case plus, minus, times, divide, modulus,
+			return p.parseAssignment(node, doc)
+		case plus, minus, times, divide, modulus, power,
 			xor, and, or, pushArrow,
 			greater, less, eq, geq, leq, neq:
 			// this case implements a mini Pratt parser threaded through the
@@ -1019,7 +2001,12 @@ func (p *parser) parseNode() (astNode, error) {
 					}
 				}
 
-				p.pushMinPrec(prec)
+				// ** is right-associative, so 2 ** 3 ** 2 is 2 ** (3 ** 2)
+				if op == power {
+					p.pushMinPrec(prec - 1)
+				} else {
+					p.pushMinPrec(prec)
+				}
 				right, err := p.parseNode()
 				if err != nil {
 					return nil, err
@@ -1040,6 +2027,7 @@ func (p *parser) parseNode() (astNode, error) {
 		case pipeArrow:
 			pipe := p.next() // eat the pipe
 
+			p.pipeTarget = true
 			pipeRight, err := p.parseSubNode()
 			if err != nil {
 				return nil, err
@@ -1052,7 +2040,11 @@ func (p *parser) parseNode() (astNode, error) {
 				}
 			}
 
-			pipedFnCall.args = append([]astNode{node}, pipedFnCall.args...)
+			args, err := pipeArgs(node, pipedFnCall.args)
+			if err != nil {
+				return nil, err
+			}
+			pipedFnCall.args = args
 			node = pipedFnCall
 		default:
 			return node, nil
@@ -1063,16 +2055,39 @@ func (p *parser) parseNode() (astNode, error) {
 	return node, nil
 }
 
+// parseNext parses the next top-level node in the program, returning io.EOF
+// when there are no more nodes.
+func (p *parser) parseNext() (astNode, error) {
+	if p.isEOF() {
+		return nil, io.EOF
+	}
+
+	node, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = p.expect(comma); err != nil {
+		return nil, err
+	}
+
+	if p.stream != nil {
+		// tokens before a top-level comma are never revisited
+		p.tokens = append(p.tokens[:0], p.tokens[p.index:]...)
+		p.index = 0
+	}
+
+	return node, nil
+}
+
 func (p *parser) parse() ([]astNode, error) {
 	nodes := []astNode{}
 
-	for !p.isEOF() {
-		node, err := p.parseNode()
-		if err != nil {
-			return nodes, err
-		}
-
-		if _, err = p.expect(comma); err != nil {
+	for {
+		node, err := p.parseNext()
+		if err == io.EOF {
+			break
+		} else if err != nil {
 			return nodes, err
 		}
 
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Native path resolution and glob matching, for the path standard library.
+//
+// The path library works with forward-slash paths, so paths returned to Oak
+// are converted with filepath.ToSlash, and paths and patterns given to these
+// builtins may use either forward slashes or the separator of the host OS.
+
+// pathArgs checks that a path builtin is called with n strings, and returns
+// them converted to forward-slash paths.
+func (c *Context) pathArgs(name string, args []Value, n int) ([]string, *runtimeError) {
+	if err := c.requireArgLen(name, args, n); err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, n)
+	for i, arg := range args[:n] {
+		s, ok := arg.(*StringValue)
+		if !ok {
+			types := make([]string, n)
+			for j, arg := range args[:n] {
+				types[j] = arg.String()
+			}
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Mismatched types in call %s(%s)", name, strings.Join(types, ", ")),
+			}
+		}
+		paths[i] = filepath.ToSlash(string(*s))
+	}
+	return paths, nil
+}
+
+// globMatch reports whether the parts of a path match the segments of a glob
+// pattern, where a ** segment matches any number of parts, and other segments
+// match a single part as path.Match does.
+func globMatch(segments, parts []string) (bool, error) {
+	for len(segments) > 0 {
+		if segments[0] == "**" {
+			for skip := 0; skip <= len(parts); skip++ {
+				if ok, err := globMatch(segments[1:], parts[skip:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+
+		if len(parts) == 0 {
+			return false, nil
+		}
+		if ok, err := path.Match(segments[0], parts[0]); !ok || err != nil {
+			return false, err
+		}
+		segments, parts = segments[1:], parts[1:]
+	}
+	return len(parts) == 0, nil
+}
+
+type globber struct {
+	matches []string
+	seen    map[string]bool
+}
+
+func globJoin(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	if strings.HasSuffix(dir, "/") {
+		return dir + name
+	}
+	return dir + "/" + name
+}
+
+func (g *globber) add(p string) {
+	if !g.seen[p] {
+		g.seen[p] = true
+		g.matches = append(g.matches, p)
+	}
+}
+
+// walk adds to the matches every path under dir that matches the given
+// pattern segments. Directories that can't be read have no matches, as in
+// filepath.Glob.
+func (g *globber) walk(dir string, segments []string) error {
+	if len(segments) == 0 {
+		if dir != "" {
+			g.add(dir)
+		}
+		return nil
+	}
+
+	segment, rest := segments[0], segments[1:]
+	if segment != "**" && !strings.ContainsAny(segment, `*?[\`) {
+		next := globJoin(dir, segment)
+		info, err := os.Stat(filepath.FromSlash(next))
+		if err != nil || (len(rest) > 0 && !info.IsDir()) {
+			return nil
+		}
+		return g.walk(next, rest)
+	}
+
+	readDir := dir
+	if readDir == "" {
+		readDir = "."
+	}
+	entries, err := os.ReadDir(filepath.FromSlash(readDir))
+	if err != nil {
+		entries = nil
+	}
+
+	if segment == "**" {
+		if err := g.walk(dir, rest); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			switch {
+			case entry.IsDir():
+				if err := g.walk(globJoin(dir, entry.Name()), segments); err != nil {
+					return err
+				}
+			case len(rest) == 0:
+				// a trailing ** matches files as well as directories
+				g.add(globJoin(dir, entry.Name()))
+			}
+		}
+		return nil
+	}
+
+	for _, entry := range entries {
+		ok, err := path.Match(segment, entry.Name())
+		if err != nil {
+			return err
+		}
+		if ok && (len(rest) == 0 || entry.IsDir()) {
+			if err := g.walk(globJoin(dir, entry.Name()), rest); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Context) oakPathAbs(args []Value) (Value, *runtimeError) {
+	paths, err := c.pathArgs("___path_abs", args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	abs, absErr := filepath.Abs(filepath.FromSlash(paths[0]))
+	if absErr != nil {
+		return nil, &runtimeError{
+			kind:   "ioError",
+			reason: fmt.Sprintf("Cannot resolve %s: %s", paths[0], absErr.Error()),
+		}
+	}
+	return MakeString(filepath.ToSlash(abs)), nil
+}
+
+func (c *Context) oakPathRel(args []Value) (Value, *runtimeError) {
+	paths, err := c.pathArgs("___path_rel", args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	rel, relErr := filepath.Rel(filepath.FromSlash(paths[0]), filepath.FromSlash(paths[1]))
+	if relErr != nil {
+		return nil, &runtimeError{
+			kind:   "valueError",
+			reason: fmt.Sprintf("Cannot make %s relative to %s", paths[1], paths[0]),
+		}
+	}
+	return MakeString(filepath.ToSlash(rel)), nil
+}
+
+func (c *Context) oakPathMatch(args []Value) (Value, *runtimeError) {
+	paths, err := c.pathArgs("___path_match", args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, matchErr := globMatch(strings.Split(paths[0], "/"), strings.Split(paths[1], "/"))
+	if matchErr != nil {
+		return nil, &runtimeError{
+			kind:   "valueError",
+			reason: fmt.Sprintf("Invalid glob pattern %s", paths[0]),
+		}
+	}
+	return BoolValue(ok), nil
+}
+
+func (c *Context) oakPathGlob(args []Value) (Value, *runtimeError) {
+	paths, err := c.pathArgs("___path_glob", args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := paths[0]
+	segments := strings.Split(pattern, "/")
+	root := ""
+	if strings.HasPrefix(pattern, "/") {
+		root, segments = "/", segments[1:]
+	}
+
+	g := globber{seen: map[string]bool{}}
+	if walkErr := g.walk(root, segments); walkErr != nil {
+		return nil, &runtimeError{
+			kind:   "valueError",
+			reason: fmt.Sprintf("Invalid glob pattern %s", pattern),
+		}
+	}
+	sort.Strings(g.matches)
+
+	if err := c.allocList(len(g.matches), len(g.matches)); err != nil {
+		return nil, err
+	}
+	matches := make([]Value, len(g.matches))
+	for i, match := range g.matches {
+		matches[i] = MakeString(match)
+	}
+	return MakeList(matches...), nil
+}
+
+func (c *Context) oakPathToSlash(args []Value) (Value, *runtimeError) {
+	paths, err := c.pathArgs("___path_to_slash", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return MakeString(paths[0]), nil
+}
+
+func (c *Context) oakPathFromSlash(args []Value) (Value, *runtimeError) {
+	paths, err := c.pathArgs("___path_from_slash", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return MakeString(filepath.FromSlash(paths[0])), nil
+}
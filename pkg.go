@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Third-party packages, fetched by `oak get` into a libs/ directory next to
+// an oak.pkg manifest, and resolved by import() by their module paths.
+
+const (
+	pkgManifestFile = "oak.pkg"
+	pkgLockFile     = "oak.lock"
+	pkgDir          = "libs"
+)
+
+// pkgRepoURL returns the URL of the git repository for a module path. It's a
+// variable so that tests can fetch packages from local repositories.
+var pkgRepoURL = func(modPath string) string {
+	return "https://" + modPath
+}
+
+type pkgRequirement struct {
+	path    string
+	version string
+}
+
+func (req pkgRequirement) String() string {
+	return req.path + "@" + req.version
+}
+
+// parsePkgRequirement parses a requirement of the form path@version, where
+// path is a module path like github.com/user/lib.
+func parsePkgRequirement(s string) (pkgRequirement, error) {
+	idx := strings.LastIndex(s, "@")
+	if idx < 0 {
+		return pkgRequirement{}, fmt.Errorf("%s has no version, specify one like %s@v1.0.0", s, s)
+	}
+	req := pkgRequirement{path: s[:idx], version: s[idx+1:]}
+	if req.version == "" {
+		return pkgRequirement{}, fmt.Errorf("%s has an empty version", s)
+	}
+	if !validPkgPath(req.path) {
+		return pkgRequirement{}, fmt.Errorf("%s is not a valid module path, like github.com/user/lib", req.path)
+	}
+	return req, nil
+}
+
+// validPkgPath reports whether a module path is safe to install under the
+// libs directory: a relative path of at least two segments, each a plain name
+// that isn't . or .. and has no separators or drive letters of its own.
+func validPkgPath(modPath string) bool {
+	if !strings.Contains(modPath, "/") || path.Clean(modPath) != modPath || strings.Contains(modPath, "..") {
+		return false
+	}
+	for _, segment := range strings.Split(modPath, "/") {
+		if segment == "" || strings.ContainsAny(segment, `\:`) {
+			return false
+		}
+	}
+	return true
+}
+
+// pkgLines returns the lines of a manifest or lockfile, without blank lines and
+// # comments. A file that doesn't exist has no lines.
+func pkgLines(filePath string) ([][]string, error) {
+	file, err := os.Open(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines [][]string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, strings.Fields(line))
+	}
+	return lines, scanner.Err()
+}
+
+// readPkgManifest reads the requirements in an oak.pkg manifest, each a line
+// with a module path and version. Module paths are checked as they are for
+// oak get, since they name directories under libs/.
+func readPkgManifest(root string) ([]pkgRequirement, error) {
+	lines, err := pkgLines(filepath.Join(root, pkgManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]pkgRequirement, 0, len(lines))
+	for _, fields := range lines {
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line in %s: %s", pkgManifestFile, strings.Join(fields, " "))
+		}
+		req, err := parsePkgRequirement(fields[0] + "@" + fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid line in %s: %s", pkgManifestFile, err)
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+func writePkgManifest(root string, reqs []pkgRequirement) error {
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].path < reqs[j].path })
+	var b strings.Builder
+	b.WriteString("# Oak packages, added with oak get\n")
+	for _, req := range reqs {
+		fmt.Fprintf(&b, "%s %s\n", req.path, req.version)
+	}
+	return os.WriteFile(filepath.Join(root, pkgManifestFile), []byte(b.String()), 0644)
+}
+
+// readPkgLock reads the checksums in an oak.lock file, keyed by
+// requirement. Checksums of remote imports are keyed by their URLs alone.
+func readPkgLock(root string) (map[pkgRequirement]string, error) {
+	lines, err := pkgLines(filepath.Join(root, pkgLockFile))
+	if err != nil {
+		return nil, err
+	}
+	sums := map[pkgRequirement]string{}
+	for _, fields := range lines {
+		switch len(fields) {
+		case 2:
+			// remote imports are pinned by URL, without a version
+			sums[pkgRequirement{path: fields[0]}] = fields[1]
+		case 3:
+			sums[pkgRequirement{path: fields[0], version: fields[1]}] = fields[2]
+		default:
+			return nil, fmt.Errorf("invalid line in %s: %s", pkgLockFile, strings.Join(fields, " "))
+		}
+	}
+	return sums, nil
+}
+
+func writePkgLock(root string, reqs []pkgRequirement, sums map[pkgRequirement]string) error {
+	var b strings.Builder
+	b.WriteString("# Checksums of Oak packages, generated by oak get. Do not edit.\n")
+	for _, req := range reqs {
+		if sum, ok := sums[req]; ok {
+			fmt.Fprintf(&b, "%s %s %s\n", req.path, req.version, sum)
+		}
+	}
+	urls := []string{}
+	for req := range sums {
+		if req.version == "" {
+			urls = append(urls, req.path)
+		}
+	}
+	sort.Strings(urls)
+	for _, modURL := range urls {
+		fmt.Fprintf(&b, "%s %s\n", modURL, sums[pkgRequirement{path: modURL}])
+	}
+	return os.WriteFile(filepath.Join(root, pkgLockFile), []byte(b.String()), 0644)
+}
+
+// pkgChecksum returns a checksum of the names and contents of every file in a
+// package directory.
+func pkgChecksum(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		fh := sha256.New()
+		if _, err := io.Copy(fh, file); err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %x\n", filepath.ToSlash(rel), fh.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+func pkgPath(root string, req pkgRequirement) string {
+	return filepath.Join(root, pkgDir, filepath.FromSlash(req.path))
+}
+
+// fetchPkg downloads a package into the libs directory, replacing any other
+// version of it, and returns its checksum. If the package was locked to a
+// checksum, it's only installed if the checksums match.
+func fetchPkg(root string, req pkgRequirement, locked string) (string, error) {
+	dest := pkgPath(root, req)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dest), ".oak-get-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	cmd := exec.Command("git", "clone", "--quiet", "--depth", "1", "--branch", req.version, pkgRepoURL(req.path), tmp)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("could not fetch %s: %s", req, strings.TrimSpace(string(out)))
+	}
+	if err := os.RemoveAll(filepath.Join(tmp, ".git")); err != nil {
+		return "", err
+	}
+
+	sum, err := pkgChecksum(tmp)
+	if err != nil {
+		return "", err
+	}
+	if locked != "" && locked != sum {
+		return "", fmt.Errorf("checksum mismatch for %s\n\t%s: %s\n\tdownloaded: %s", req, pkgLockFile, locked, sum)
+	}
+	if err := os.RemoveAll(dest); err != nil {
+		return "", err
+	}
+	return sum, os.Rename(tmp, dest)
+}
+
+// getPackages adds the given requirements to the manifest in root, fetching
+// them, or if none are given, fetches every package in the manifest that isn't
+// in the libs directory. Packages are checked against the checksums in the
+// lockfile, which records the checksums of new packages.
+func getPackages(root string, args []string, log func(string)) error {
+	reqs, err := readPkgManifest(root)
+	if err != nil {
+		return err
+	}
+	sums, err := readPkgLock(root)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		for _, req := range reqs {
+			if _, err := os.Stat(pkgPath(root, req)); err == nil {
+				continue
+			}
+			sum, err := fetchPkg(root, req, sums[req])
+			if err != nil {
+				return err
+			}
+			sums[req] = sum
+			log(fmt.Sprintf("Fetched %s", req))
+		}
+		return writePkgLock(root, reqs, sums)
+	}
+
+	for _, arg := range args {
+		req, err := parsePkgRequirement(arg)
+		if err != nil {
+			return err
+		}
+		sum, err := fetchPkg(root, req, sums[req])
+		if err != nil {
+			return err
+		}
+		sums[req] = sum
+
+		replaced := false
+		for i, existing := range reqs {
+			if existing.path == req.path {
+				reqs[i] = req
+				replaced = true
+			}
+		}
+		if !replaced {
+			reqs = append(reqs, req)
+		}
+		log(fmt.Sprintf("Added %s", req))
+	}
+	if err := writePkgManifest(root, reqs); err != nil {
+		return err
+	}
+	return writePkgLock(root, reqs, sums)
+}
+
+func runGet(args []string) {
+	root, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("[oak get] %s\n", err)
+		os.Exit(1)
+	}
+	if err := getPackages(root, args, func(msg string) {
+		fmt.Printf("[oak get] %s\n", msg)
+	}); err != nil {
+		fmt.Printf("[oak get] %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// resolvePackage finds the entry file of a package imported by name, which is
+// either its module path or the last element of it, in the manifest of the
+// nearest directory above the importing file with an oak.pkg. A package's
+// entry file is main.oak, or a file named after the package.
+func (c *Context) resolvePackage(name string) (string, bool) {
+	for dir := c.rootPath; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, pkgManifestFile)); err == nil {
+			reqs, err := readPkgManifest(dir)
+			if err != nil {
+				return "", false
+			}
+			for _, req := range reqs {
+				if req.path != name && path.Base(req.path) != name {
+					continue
+				}
+				base := pkgPath(dir, req)
+				for _, entry := range []string{"main.oak", path.Base(req.path) + ".oak"} {
+					if _, err := os.Stat(filepath.Join(base, entry)); err == nil {
+						return filepath.Join(base, entry), true
+					}
+				}
+				return filepath.Join(base, "main.oak"), true
+			}
+			return "", false
+		}
+		if filepath.Dir(dir) == dir {
+			return "", false
+		}
+	}
+}
@@ -0,0 +1,61 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/chzyer/readline"
+)
+
+// Terminal and OS facilities that aren't available when Oak is compiled to
+// WebAssembly. See platform_js.go for their WebAssembly counterparts.
+
+var sigHUP os.Signal = syscall.SIGHUP
+
+type ttyState = readline.State
+
+var errTTYInterrupt = readline.ErrInterrupt
+
+func ttyIsTerminal(fd int) bool {
+	return readline.IsTerminal(fd)
+}
+
+func ttySize(fd int) (int, int, error) {
+	return readline.GetSize(fd)
+}
+
+func ttyMakeRaw(fd int) (*ttyState, error) {
+	return readline.MakeRaw(fd)
+}
+
+func ttyRestore(fd int, state *ttyState) error {
+	return readline.Restore(fd, state)
+}
+
+// ttyReadLine reads a line of input from the terminal with line editing,
+// showing each character as mask if it isn't 0, and with the given history.
+func ttyReadLine(prompt string, mask rune, history []string) (string, error) {
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:                 prompt,
+		EnableMask:             mask != 0,
+		MaskRune:               mask,
+		DisableAutoSaveHistory: true,
+		HistoryLimit:           maxInputHistory,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer rl.Close()
+
+	for _, line := range history {
+		rl.SaveHistory(line)
+	}
+	return rl.Readline()
+}
+
+// loadPlatformBuiltins replaces builtins that aren't available on this
+// platform. Every builtin is available on native platforms.
+func (c *Context) loadPlatformBuiltins() {}
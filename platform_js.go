@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Stand-ins for the terminal and OS facilities in platform.go, for Oak
+// compiled to WebAssembly, where there is no terminal or process to control.
+
+// unsupportedSignal is an OS signal that js/wasm doesn't define.
+type unsupportedSignal string
+
+func (s unsupportedSignal) String() string { return string(s) }
+func (s unsupportedSignal) Signal()        {}
+
+var sigHUP os.Signal = unsupportedSignal("hangup")
+
+type ttyState struct{}
+
+var (
+	errTTYInterrupt = errors.New("Interrupt")
+	errNoTTY        = errors.New("no terminal in WebAssembly")
+)
+
+func ttyIsTerminal(fd int) bool {
+	return false
+}
+
+func ttySize(fd int) (int, int, error) {
+	return 0, 0, errNoTTY
+}
+
+func ttyMakeRaw(fd int) (*ttyState, error) {
+	return nil, errNoTTY
+}
+
+func ttyRestore(fd int, state *ttyState) error {
+	return nil
+}
+
+func ttyReadLine(prompt string, mask rune, history []string) (string, error) {
+	return "", errNoTTY
+}
+
+// platformUnsupported lists the builtins that need processes or OS signals,
+// which aren't available in WebAssembly.
+var platformUnsupported = []string{"exec", "spawn", "signal"}
+
+// loadPlatformBuiltins replaces builtins that aren't available in WebAssembly
+// with ones that raise an error saying so.
+func (c *Context) loadPlatformBuiltins() {
+	for _, name := range platformUnsupported {
+		name := name
+		c.LoadFunc(name, func(_ []Value) (Value, *runtimeError) {
+			return nil, &runtimeError{
+				kind:   "ioError",
+				reason: fmt.Sprintf("%s() is not available in WebAssembly", name),
+			}
+		})
+	}
+}
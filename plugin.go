@@ -0,0 +1,385 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Native extensions for Oak are programs in the plugins directory, which
+// provide builtins to Oak programs. Each plugin is started once when oak
+// starts, and oak talks to it in JSON-RPC 2.0 over its standard input and
+// output, one message per line. oak first asks a plugin for the names of its
+// builtins, then calls them with their arguments as params:
+//
+//	-> {"jsonrpc":"2.0","id":0,"method":"oak.builtins","params":[]}
+//	<- {"jsonrpc":"2.0","id":0,"result":["pg_connect","pg_query"]}
+//	-> {"jsonrpc":"2.0","id":1,"method":"pg_query","params":[1,"select 1"]}
+//	<- {"jsonrpc":"2.0","id":1,"result":[{"?column?":1}]}
+//
+// A plugin should exit when its standard input is closed, which happens when
+// oak exits. Plugins run with $OAK_PLUGIN set to their names, and an oak
+// process running as a plugin doesn't load plugins itself, so that plugins
+// written in Oak don't start themselves.
+
+// pluginStartTimeout is how long a plugin may take to list its builtins
+// before it's stopped and skipped.
+const pluginStartTimeout = 5 * time.Second
+
+// pluginsDisabled is set by --no-plugins.
+var pluginsDisabled bool
+
+// oakPluginDir returns the directory oak loads plugins from, which is
+// $OAK_PLUGIN_DIR if it's set, or a directory in the user's config directory.
+func oakPluginDir() (string, error) {
+	if dir := os.Getenv("OAK_PLUGIN_DIR"); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "oak", "plugins"), nil
+}
+
+type pluginRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int64         `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type pluginResponse struct {
+	ID     int64           `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// plugin is a running plugin process. Calls to it are made one at a time.
+type plugin struct {
+	sync.Mutex
+	name     string
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stdout   *bufio.Reader
+	nextID   int64
+	builtins []string
+}
+
+func (p *plugin) call(method string, params []interface{}) (json.RawMessage, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	id := p.nextID
+	p.nextID++
+	req, err := json.Marshal(pluginRequest{
+		JSONRPC: "2.0",
+		ID:      id,
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.stdin.Write(append(req, '\n')); err != nil {
+		return nil, fmt.Errorf("plugin %s is not running", p.name)
+	}
+
+	line, err := p.stdout.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s exited", p.name)
+	}
+	var resp pluginResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response from plugin %s: %s", p.name, err)
+	}
+	if resp.ID != id {
+		return nil, fmt.Errorf("plugin %s responded to request %d, expected %d", p.name, resp.ID, id)
+	}
+	if resp.Error != nil {
+		return nil, errors.New(resp.Error.Message)
+	}
+	return resp.Result, nil
+}
+
+func (p *plugin) close() error {
+	p.stdin.Close()
+	return p.cmd.Wait()
+}
+
+func startPlugin(pluginPath string) (*plugin, error) {
+	cmd := exec.Command(pluginPath)
+	cmd.Env = append(os.Environ(), "OAK_PLUGIN="+filepath.Base(pluginPath))
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &plugin{
+		name:   filepath.Base(pluginPath),
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+	}
+
+	type listing struct {
+		result json.RawMessage
+		err    error
+	}
+	listed := make(chan listing, 1)
+	go func() {
+		result, err := p.call("oak.builtins", []interface{}{})
+		listed <- listing{result, err}
+	}()
+
+	var l listing
+	select {
+	case l = <-listed:
+	case <-time.After(pluginStartTimeout):
+		l.err = fmt.Errorf("plugin did not list its builtins within %s", pluginStartTimeout)
+	}
+	if l.err == nil {
+		l.err = json.Unmarshal(l.result, &p.builtins)
+	}
+	if l.err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, l.err
+	}
+	return p, nil
+}
+
+func isPluginFile(entry os.DirEntry) bool {
+	if strings.HasPrefix(entry.Name(), ".") {
+		return false
+	}
+	info, err := entry.Info()
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(filepath.Ext(entry.Name()), ".exe")
+	}
+	return info.Mode()&0111 != 0
+}
+
+// startPlugins starts every plugin in dir, in order of name. Plugins that
+// can't be started are reported and skipped.
+func startPlugins(dir string) []*plugin {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		// most installations have no plugins directory
+		return nil
+	}
+
+	plugins := []*plugin{}
+	for _, entry := range entries {
+		if !isPluginFile(entry) {
+			continue
+		}
+		p, err := startPlugin(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not load plugin %s: %s\n", entry.Name(), err)
+			continue
+		}
+		plugins = append(plugins, p)
+	}
+	return plugins
+}
+
+var (
+	runningPlugins     []*plugin
+	runningPluginsOnce sync.Once
+)
+
+// LoadPlugins starts the plugins in the plugins directory, if they aren't
+// already running, and defines their builtins in the context.
+func (c *Context) LoadPlugins() {
+	if pluginsDisabled || os.Getenv("OAK_PLUGIN") != "" {
+		return
+	}
+	runningPluginsOnce.Do(func() {
+		if dir, err := oakPluginDir(); err == nil {
+			runningPlugins = startPlugins(dir)
+		}
+	})
+	c.definePlugins(runningPlugins)
+}
+
+// definePlugins defines the builtins of plugins in the context. Builtins never
+// replace names that are already defined, so plugins can't change the
+// behavior of the language's own builtins.
+func (c *Context) definePlugins(plugins []*plugin) {
+	for _, p := range plugins {
+		for _, name := range p.builtins {
+			if _, err := c.scope.get(name); err == nil {
+				fmt.Fprintf(os.Stderr, "Plugin %s: %s is already defined\n", p.name, name)
+				continue
+			}
+			c.LoadFunc(name, p.builtin(name))
+		}
+	}
+}
+
+func (p *plugin) builtin(name string) builtinFn {
+	return func(args []Value) (Value, *runtimeError) {
+		params := make([]interface{}, len(args))
+		for i, arg := range args {
+			param, err := jsonValue(arg, map[uintptr]bool{})
+			if err != nil {
+				return nil, err
+			}
+			params[i] = param
+		}
+
+		result, err := p.call(name, params)
+		if err != nil {
+			return nil, &runtimeError{
+				kind:   "pluginError",
+				reason: fmt.Sprintf("Error in %s(): %s", name, err),
+			}
+		}
+		val, err := valueFromJSON(result)
+		if err != nil {
+			return nil, &runtimeError{
+				kind:   "pluginError",
+				reason: fmt.Sprintf("Invalid result from %s(): %s", name, err),
+			}
+		}
+		return val, nil
+	}
+}
+
+// jsonValue converts an Oak value to a value that encoding/json can
+// serialize. Atoms become strings, like in the json library.
+func jsonValue(v Value, parents map[uintptr]bool) (interface{}, *runtimeError) {
+	if id, ok := containerID(v); ok {
+		if parents[id] {
+			return nil, &runtimeError{
+				kind:   "valueError",
+				reason: "Cannot serialize a value that contains itself",
+			}
+		}
+		parents[id] = true
+		defer delete(parents, id)
+	}
+
+	switch val := v.(type) {
+	case NullValue, EmptyValue:
+		return nil, nil
+	case BoolValue:
+		return bool(val), nil
+	case IntValue:
+		return int64(val), nil
+	case FloatValue:
+		if math.IsNaN(float64(val)) || math.IsInf(float64(val), 0) {
+			return nil, nil
+		}
+		return float64(val), nil
+	case *StringValue:
+		return string(*val), nil
+	case AtomValue:
+		return string(val), nil
+	case *IntArrayValue:
+		return []int64(*val), nil
+	case *FloatArrayValue:
+		arr := make([]interface{}, len(*val))
+		for i, n := range *val {
+			arr[i], _ = jsonValue(FloatValue(n), parents)
+		}
+		return arr, nil
+	case *ListValue:
+		arr := make([]interface{}, len(val.elems))
+		for i, el := range val.elems {
+			jsonEl, err := jsonValue(el, parents)
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = jsonEl
+		}
+		return arr, nil
+	case ObjectValue:
+		obj := make(map[string]interface{}, len(val))
+		for key, el := range val {
+			jsonEl, err := jsonValue(el, parents)
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = jsonEl
+		}
+		return obj, nil
+	}
+
+	return nil, &runtimeError{
+		kind:   "typeError",
+		reason: fmt.Sprintf("Cannot serialize %s to JSON", v),
+	}
+}
+
+// valueFromJSON parses JSON into an Oak value, keeping integers as ints.
+func valueFromJSON(data []byte) (Value, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		if err == io.EOF {
+			// a response without a result
+			return null, nil
+		}
+		return nil, err
+	}
+	return fromJSON(v), nil
+}
+
+func fromJSON(v interface{}) Value {
+	switch val := v.(type) {
+	case bool:
+		return BoolValue(val)
+	case json.Number:
+		if n, err := val.Int64(); err == nil {
+			return IntValue(n)
+		}
+		f, _ := val.Float64()
+		return FloatValue(f)
+	case string:
+		return MakeString(val)
+	case []interface{}:
+		elems := make([]Value, len(val))
+		for i, el := range val {
+			elems[i] = fromJSON(el)
+		}
+		return MakeList(elems...)
+	case map[string]interface{}:
+		obj := make(ObjectValue, len(val))
+		for key, el := range val {
+			obj[key] = fromJSON(el)
+		}
+		return obj
+	}
+	return null
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Child processes started by spawn(), which run alongside the program and are
+// controlled through a process handle.
+
+// eventQueue is an unbounded queue of events for an Oak handler. Output is
+// read from a child process into the queue without waiting for the
+// interpreter lock, so that a child never blocks on a full pipe while the
+// program holding the lock waits for it to exit.
+type eventQueue struct {
+	sync.Mutex
+	cond   *sync.Cond
+	events []Value
+	closed bool
+}
+
+func newEventQueue() *eventQueue {
+	q := &eventQueue{}
+	q.cond = sync.NewCond(&q.Mutex)
+	return q
+}
+
+func (q *eventQueue) push(evt Value) {
+	q.Lock()
+	defer q.Unlock()
+	q.events = append(q.events, evt)
+	q.cond.Signal()
+}
+
+func (q *eventQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+	q.closed = true
+	q.cond.Signal()
+}
+
+// pop returns the next event, waiting for one if there is none, or false once
+// the queue is closed and empty.
+func (q *eventQueue) pop() (Value, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.events) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.events) == 0 {
+		return nil, false
+	}
+	evt := q.events[0]
+	q.events = q.events[1:]
+	return evt, true
+}
+
+// processSignalsByName maps the atoms accepted by a process handle's kill()
+// to OS signals.
+var processSignalsByName = map[string]os.Signal{
+	"int":  os.Interrupt,
+	"term": syscall.SIGTERM,
+	"hup":  sigHUP,
+	"kill": os.Kill,
+}
+
+func exitStatus(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return 0
+}
+
+func (c *Context) oakSpawn(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("spawn", args, 2); err != nil {
+		return nil, err
+	}
+
+	path, ok1 := args[0].(*StringValue)
+	cliArgs, ok2 := args[1].(*ListValue)
+	var handler Value
+	ok3 := true
+	if len(args) > 2 {
+		handler = args[2]
+		_, ok3 = handler.(FnValue)
+	}
+	if !ok1 || !ok2 || !ok3 {
+		if len(args) > 2 {
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Mismatched types in call spawn(%s, %s, %s)", args[0], args[1], args[2]),
+			}
+		}
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call spawn(%s, %s)", args[0], args[1]),
+		}
+	}
+
+	argsList := make([]string, len(cliArgs.elems))
+	for i, arg := range cliArgs.elems {
+		if argStr, ok := arg.(*StringValue); ok {
+			argsList[i] = argStr.stringContent()
+		} else {
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Mismatched types in call spawn, arguments must be strings in %s", cliArgs),
+			}
+		}
+	}
+
+	cmd := exec.Command(path.stringContent(), argsList...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return errObj(fmt.Sprintf("Could not start command in spawn(): %s", err.Error())), nil
+	}
+
+	// without a handler, the child writes to the program's own stdout and
+	// stderr, and with one, its output is sent to the handler
+	var outputs []io.Reader
+	var outputTypes []string
+	if handler == nil {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	} else {
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return errObj(fmt.Sprintf("Could not start command in spawn(): %s", err.Error())), nil
+		}
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			return errObj(fmt.Sprintf("Could not start command in spawn(): %s", err.Error())), nil
+		}
+		outputs = []io.Reader{stdout, stderr}
+		outputTypes = []string{"stdout", "stderr"}
+	}
+
+	// output written by the program so far should come before the child's
+	stdoutStream.Flush()
+	stderrStream.Flush()
+	if err := cmd.Start(); err != nil {
+		return errObj(fmt.Sprintf("Could not start command in spawn(): %s", err.Error())), nil
+	}
+
+	events := newEventQueue()
+	exited := make(chan struct{})
+	var status int
+
+	// a running child keeps the program alive until it exits and the
+	// handler has received all of its events
+	c.eng.Add(1)
+	go func() {
+		var readers sync.WaitGroup
+		for i, output := range outputs {
+			readers.Add(1)
+			go func(output io.Reader, typ string) {
+				defer readers.Done()
+				buf := make([]byte, 4096)
+				for {
+					n, err := output.Read(buf)
+					if n > 0 {
+						events.push(ObjectValue{
+							"type": AtomValue(typ),
+							"data": MakeString(string(buf[:n])),
+						})
+					}
+					if err != nil {
+						return
+					}
+				}
+			}(output, outputTypes[i])
+		}
+		readers.Wait()
+
+		status = exitStatus(cmd.Wait())
+		close(exited)
+		events.push(ObjectValue{
+			"type":   AtomValue("end"),
+			"status": IntValue(status),
+		})
+		events.close()
+	}()
+	go func() {
+		defer c.eng.Done()
+
+		for {
+			evt, ok := events.pop()
+			if !ok {
+				return
+			}
+			if handler == nil {
+				continue
+			}
+
+			c.Lock()
+			_, err := c.EvalFnValue(handler, false, evt)
+			c.Unlock()
+			if err != nil {
+				c.eng.reportErr(err)
+			}
+		}
+	}()
+
+	endEvent := func() Value {
+		return ObjectValue{
+			"type":   AtomValue("end"),
+			"status": IntValue(status),
+		}
+	}
+
+	return ObjectValue{
+		"pid": IntValue(cmd.Process.Pid),
+		"write": BuiltinFnValue{
+			name: "write",
+			fn: func(args []Value) (Value, *runtimeError) {
+				if err := c.requireArgLen("write", args, 1); err != nil {
+					return nil, err
+				}
+				data, ok := args[0].(*StringValue)
+				if !ok {
+					return nil, &runtimeError{
+						kind:   "typeError",
+						reason: fmt.Sprintf("Mismatched types in call write(%s)", args[0]),
+					}
+				}
+
+				n, err := stdin.Write(*data)
+				if err != nil {
+					return nil, &runtimeError{
+						kind:   "ioError",
+						reason: fmt.Sprintf("Could not write to process %d: %s", cmd.Process.Pid, err.Error()),
+					}
+				}
+				return IntValue(n), nil
+			},
+		},
+		"closeStdin": BuiltinFnValue{
+			name: "closeStdin",
+			fn: func(_ []Value) (Value, *runtimeError) {
+				stdin.Close()
+				return null, nil
+			},
+		},
+		"kill": BuiltinFnValue{
+			name: "kill",
+			fn: func(args []Value) (Value, *runtimeError) {
+				var sig Value = AtomValue("term")
+				if len(args) > 0 {
+					sig = args[0]
+				}
+				name, ok := sig.(AtomValue)
+				if !ok {
+					return nil, &runtimeError{
+						kind:   "typeError",
+						reason: fmt.Sprintf("Mismatched types in call kill(%s)", sig),
+					}
+				}
+				osSig, ok := processSignalsByName[string(name)]
+				if !ok {
+					return nil, &runtimeError{
+						kind:   "valueError",
+						reason: fmt.Sprintf("Unknown signal %s in call kill()", name),
+					}
+				}
+
+				select {
+				case <-exited:
+					return oakFalse, nil
+				default:
+				}
+				return BoolValue(cmd.Process.Signal(osSig) == nil), nil
+			},
+		},
+		"wait": BuiltinFnValue{
+			name: "wait",
+			fn: func(args []Value) (Value, *runtimeError) {
+				if len(args) == 0 {
+					<-exited
+					return endEvent(), nil
+				}
+
+				seconds, ok := toFloat(args[0])
+				if !ok {
+					return nil, &runtimeError{
+						kind:   "typeError",
+						reason: fmt.Sprintf("Mismatched types in call wait(%s)", args[0]),
+					}
+				}
+				timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
+				defer timer.Stop()
+				select {
+				case <-exited:
+					return endEvent(), nil
+				case <-timer.C:
+					return null, nil
+				}
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+// An object may link to a prototype object under its __proto key, which
+// shares behavior among many objects, like the methods of a type. Accessing a
+// key that an object doesn't have looks it up in its prototype, then in the
+// prototype's own prototype, and so on. A function found on a prototype is a
+// method, and is returned bound to the object it was accessed on, which it
+// takes as its first argument, so p.norm() calls Point.norm(p) for an object
+// p with { __proto: Point }.
+
+// maxProtoDepth is the longest chain of prototypes that is searched for a
+// key, which stops lookups in objects that are their own prototypes.
+const maxProtoDepth = 64
+
+// protoLookup returns the value of key in the chain of prototypes of obj, not
+// including obj itself.
+func protoLookup(obj ObjectValue, key string) (Value, bool) {
+	for depth := 0; depth < maxProtoDepth; depth++ {
+		proto, ok := obj["__proto"].(ObjectValue)
+		if !ok {
+			return nil, false
+		}
+		if val, ok := proto[key]; ok {
+			return val, true
+		}
+		obj = proto
+	}
+	return nil, false
+}
+
+// protoProperty returns the value of key inherited by obj from its
+// prototypes, with methods bound to obj, or ? if no prototype has key.
+func (c *Context) protoProperty(obj ObjectValue, key string) Value {
+	val, ok := protoLookup(obj, key)
+	if !ok {
+		return null
+	}
+
+	switch method := val.(type) {
+	case FnValue, BuiltinFnValue:
+		return BuiltinFnValue{
+			name: key,
+			fn: func(args []Value) (Value, *runtimeError) {
+				return c.EvalFnValue(method, false, append([]Value{obj}, args...)...)
+			},
+		}
+	}
+	return val
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+)
+
+// reactive.subscribe(obj, cb) batches the assignments made to obj's keys, and
+// calls cb with the changes they made once the code making them returns to the
+// event loop, so that a program redrawing a view of obj, say, does so once for
+// many changes. Changes are delivered by a task the first assignment in a
+// batch schedules, which runs when the running code releases the interpreter.
+
+// objChange is a change to a key of an observed object, from its value before
+// the first assignment in a batch to its value after the last.
+type objChange struct {
+	key      string
+	val, old Value
+}
+
+func (c *Context) queueChange(ws *objWatchers, key string, val, old Value) {
+	for i, change := range ws.pending {
+		if change.key == key {
+			ws.pending[i].val = val
+			return
+		}
+	}
+	ws.pending = append(ws.pending, objChange{key: key, val: val, old: old})
+
+	if ws.scheduled {
+		return
+	}
+	ws.scheduled = true
+	c.eng.Add(1)
+	go func() {
+		defer c.eng.Done()
+
+		c.Lock()
+		defer c.Unlock()
+		if err := c.flushChanges(ws); err != nil {
+			c.eng.reportErr(err)
+		}
+	}()
+}
+
+// flushChanges calls the subscribers of an object with the changes made to it
+// since they were last called, leaving out keys set back to a primitive value
+// equal to the one they had. A list or object is always a change, as it may
+// have been modified in place and assigned again to announce it.
+func (c *Context) flushChanges(ws *objWatchers) *runtimeError {
+	pending := ws.pending
+	ws.pending = nil
+	ws.scheduled = false
+
+	changes := make([]Value, 0, len(pending))
+	for _, change := range pending {
+		if _, composite := containerID(change.val); !composite && change.val.Eq(change.old) {
+			continue
+		}
+		changes = append(changes, ObjectValue{
+			"key":   MakeString(change.key),
+			"value": change.val,
+			"old":   change.old,
+		})
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	for _, sub := range ws.subs {
+		if _, err := c.EvalFnValue(sub.cb, false, MakeList(changes...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Context) oakReactiveSubscribe(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("subscribe", args, 2); err != nil {
+		return nil, err
+	}
+
+	obj, ok := args[0].(ObjectValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("First argument to subscribe must be an object, got %s", args[0]),
+		}
+	}
+
+	cb := args[1]
+	switch cb.(type) {
+	case FnValue, BuiltinFnValue:
+	default:
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Second argument to subscribe must be a function, got %s", cb),
+		}
+	}
+
+	id, ws := c.observersFor(obj)
+	var subID int
+	ws.subs, subID = c.withWatch(ws.subs, cb)
+
+	return BuiltinFnValue{
+		name: "unsubscribe",
+		fn: func(_ []Value) (Value, *runtimeError) {
+			ws.subs = withoutWatch(ws.subs, subID)
+			if len(ws.subs) == 0 {
+				ws.pending = nil
+			}
+			c.forgetIfUnobserved(id, ws)
+			return null, nil
+		},
+	}, nil
+}
+
+func (c *Context) oakReactiveFlush(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("flush", args, 1); err != nil {
+		return nil, err
+	}
+
+	obj, ok := args[0].(ObjectValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Argument to flush must be an object, got %s", args[0]),
+		}
+	}
+
+	if ws := c.watchersOf(obj); ws != nil {
+		if err := c.flushChanges(ws); err != nil {
+			return nil, err
+		}
+	}
+	return null, nil
+}
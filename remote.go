@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Importing modules by URL. Downloaded modules are kept in a local cache,
+// stored by the hashes of their contents, and pinned to those hashes in the
+// project's oak.lock if it has one, so that a module that changes on the
+// server is refused rather than run.
+
+// remoteOffline, if set, makes remote imports use only the cache rather than
+// fetching modules. It's set with the --offline flag.
+var remoteOffline bool
+
+// remoteTimeout is how long fetching a single remote module may take.
+const remoteTimeout = 30 * time.Second
+
+func isRemoteImport(pathStr string) bool {
+	return strings.HasPrefix(pathStr, "https://") || strings.HasPrefix(pathStr, "http://")
+}
+
+// oakCacheDir returns the directory in which Oak caches remote and parsed
+// modules, which is $OAK_CACHE_DIR if it's set, or a directory in the user's
+// cache directory.
+func oakCacheDir() (string, error) {
+	if dir := os.Getenv("OAK_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "oak"), nil
+}
+
+func contentHash(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+// remoteCache stores module sources under content/ named by their hashes, and
+// the hash of the last version of each URL under urls/, named by the hash of
+// the URL.
+type remoteCache struct {
+	dir string
+}
+
+func (rc remoteCache) contentPath(hash string) string {
+	return filepath.Join(rc.dir, "content", strings.Replace(hash, ":", "-", 1))
+}
+
+func (rc remoteCache) urlPath(modURL string) string {
+	return filepath.Join(rc.dir, "urls", strings.Replace(contentHash([]byte(modURL)), ":", "-", 1))
+}
+
+// get returns the cached source with the given hash, checking that it hasn't
+// been changed on disk.
+func (rc remoteCache) get(hash string) ([]byte, bool) {
+	content, err := os.ReadFile(rc.contentPath(hash))
+	if err != nil || contentHash(content) != hash {
+		return nil, false
+	}
+	return content, true
+}
+
+// lookup returns the hash of the cached version of a URL.
+func (rc remoteCache) lookup(modURL string) (string, bool) {
+	hash, err := os.ReadFile(rc.urlPath(modURL))
+	if err != nil {
+		return "", false
+	}
+	return string(hash), true
+}
+
+func (rc remoteCache) put(modURL string, content []byte) error {
+	hash := contentHash(content)
+	for _, dir := range []string{"content", "urls"} {
+		if err := os.MkdirAll(filepath.Join(rc.dir, dir), 0755); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(rc.contentPath(hash), content, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(rc.urlPath(modURL), []byte(hash), 0644)
+}
+
+func fetchRemote(modURL string) ([]byte, error) {
+	client := http.Client{Timeout: remoteTimeout}
+	resp, err := client.Get(modURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server responded %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// findLockDir returns the nearest directory at or above dir with an oak.lock.
+func findLockDir(dir string) (string, bool) {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, pkgLockFile)); err == nil {
+			return dir, true
+		}
+		if filepath.Dir(dir) == dir {
+			return "", false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// remoteSource returns the source of a remote module, from the cache if
+// possible. If the program has a lockfile, the module must match the hash
+// pinned there, and modules not yet in the lockfile are pinned to the hash of
+// the version that's downloaded.
+func (c *Context) remoteSource(modURL string) ([]byte, error) {
+	dir, err := oakCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	cache := remoteCache{dir: filepath.Join(dir, "remote")}
+
+	var pins map[pkgRequirement]string
+	if c.eng.lockDir != "" {
+		if pins, err = readPkgLock(c.eng.lockDir); err != nil {
+			return nil, err
+		}
+	}
+	pin := pins[pkgRequirement{path: modURL}]
+
+	if pin != "" {
+		if content, ok := cache.get(pin); ok {
+			return content, nil
+		}
+	} else if hash, ok := cache.lookup(modURL); ok {
+		if content, ok := cache.get(hash); ok {
+			return content, nil
+		}
+	}
+
+	if remoteOffline {
+		return nil, fmt.Errorf("%s is not in the cache, and imports are offline", modURL)
+	}
+	content, err := fetchRemote(modURL)
+	if err != nil {
+		return nil, err
+	}
+	hash := contentHash(content)
+	if pin != "" && pin != hash {
+		return nil, fmt.Errorf("integrity check failed for %s\n\t%s: %s\n\tdownloaded: %s", modURL, pkgLockFile, pin, hash)
+	}
+	if err := cache.put(modURL, content); err != nil {
+		return nil, err
+	}
+
+	if c.eng.lockDir != "" && pin == "" {
+		reqs, err := readPkgManifest(c.eng.lockDir)
+		if err != nil {
+			return nil, err
+		}
+		pins[pkgRequirement{path: modURL}] = hash
+		if err := writePkgLock(c.eng.lockDir, reqs, pins); err != nil {
+			return nil, err
+		}
+	}
+	return content, nil
+}
+
+// remoteModuleURL returns the URL of a module imported from a remote module,
+// which is either a URL itself or a path relative to the importing module.
+func (c *Context) remoteModuleURL(pathStr string) (string, error) {
+	if isRemoteImport(pathStr) {
+		return pathStr, nil
+	}
+	base, err := url.Parse(c.rootPath + "/")
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(pathStr + ".oak")
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+func (c *Context) importRemote(pathStr string) (Value, *runtimeError) {
+	modURL, err := c.remoteModuleURL(pathStr)
+	if err != nil {
+		return nil, &runtimeError{
+			kind:   "importError",
+			reason: fmt.Sprintf("Could not import %s, %s", pathStr, err.Error()),
+			data:   ObjectValue{"path": MakeString(pathStr)},
+		}
+	}
+	if imported, ok := c.eng.importMap[modURL]; ok {
+		return moduleExports(imported), nil
+	}
+
+	// the lockfile of a program is the one nearest to the first file that
+	// imports a remote module, and applies to all remote modules after it
+	if c.eng.lockDir == "" && !isRemoteImport(c.rootPath) {
+		if dir, ok := findLockDir(c.rootPath); ok {
+			c.eng.lockDir = dir
+		}
+	}
+
+	source, err := c.remoteSource(modURL)
+	if err != nil {
+		return nil, &runtimeError{
+			kind:   "importError",
+			reason: fmt.Sprintf("Could not import %s, %s", modURL, err.Error()),
+			data:   ObjectValue{"path": MakeString(modURL)},
+		}
+	}
+
+	moduleDir := modURL[:strings.LastIndex(modURL, "/")]
+	return c.evalImport(modURL, moduleDir, source, pathStr)
+}
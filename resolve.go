@@ -0,0 +1,218 @@
+package main
+
+// frame is the static layout of a scope that is created at runtime by a
+// function call or a block. The resolver assigns every variable declared in
+// such a scope an index into the scope's slots, so that reading the variable
+// doesn't need to walk a chain of maps.
+type frame struct {
+	names []string
+	index map[string]int
+}
+
+func newFrame() *frame {
+	return &frame{
+		names: []string{},
+		index: map[string]int{},
+	}
+}
+
+func (f *frame) declare(name string) {
+	if name == "" {
+		return
+	}
+	if _, ok := f.index[name]; ok {
+		return
+	}
+	f.index[name] = len(f.names)
+	f.names = append(f.names, name)
+}
+
+// varRef is the resolved location of a variable reference. depth is the
+// number of scopes between the scope in which the reference is evaluated and
+// the scope that declares the variable. slot is the variable's index in that
+// scope's slots, or -1 if the variable is not declared in any enclosing
+// function or block, and must be looked up by name from the top-level scope.
+//
+// A declared variable may not yet be defined when it's read, because Oak
+// variables are defined by evaluating an assignment. Such reads fall back to
+// looking up the name in the scopes enclosing the declaring scope, exactly as
+// if the resolver hadn't run.
+type varRef struct {
+	depth int
+	slot  int
+}
+
+// resolver rewrites a syntax tree so that every identifierNode that names a
+// variable carries a varRef, and every fnNode and blockNode carries the frame
+// of the scope it creates at runtime.
+type resolver struct {
+	// frames of enclosing scopes, innermost last. The top-level scope of a
+	// program has no frame, because its variables are visible to other
+	// modules and to later programs in a REPL, so they stay in a map.
+	frames []*frame
+}
+
+func resolveNodes(nodes []astNode) []astNode {
+	r := resolver{frames: []*frame{}}
+	return r.resolveAll(nodes)
+}
+
+func (r *resolver) lookup(name string) *varRef {
+	for depth := 0; depth < len(r.frames); depth++ {
+		if slot, ok := r.frames[len(r.frames)-1-depth].index[name]; ok {
+			return &varRef{depth: depth, slot: slot}
+		}
+	}
+	return &varRef{depth: len(r.frames), slot: -1}
+}
+
+// declareAll adds to f every variable that node declares in the scope in
+// which it's evaluated. It does not descend into functions or non-empty
+// blocks, which evaluate in scopes of their own.
+func declareAll(f *frame, node astNode) {
+	walkNode(node, func(node astNode) bool {
+		switch n := node.(type) {
+		case fnNode:
+			f.declare(n.name)
+			return false
+		case blockNode:
+			return len(n.exprs) == 0
+		case assignmentNode:
+			if !n.isLocal {
+				return true
+			}
+
+			switch left := n.left.(type) {
+			case identifierNode:
+				f.declare(left.payload)
+			case listNode:
+				for _, el := range left.elems {
+					if ident, ok := el.(identifierNode); ok {
+						f.declare(ident.payload)
+					}
+				}
+			case objectNode:
+				for _, entry := range left.entries {
+					if ident, ok := entry.val.(identifierNode); ok {
+						f.declare(ident.payload)
+					}
+				}
+			}
+		}
+		return true
+	})
+}
+
+func (r *resolver) withFrame(f *frame, resolve func()) {
+	r.frames = append(r.frames, f)
+	resolve()
+	r.frames = r.frames[:len(r.frames)-1]
+}
+
+// resolveKey resolves an object key or property name, which is only a
+// variable reference if it isn't a bare identifier.
+func (r *resolver) resolveKey(node astNode) astNode {
+	if _, ok := node.(identifierNode); ok {
+		return node
+	}
+	return r.resolve(node)
+}
+
+func (r *resolver) resolveAll(nodes []astNode) []astNode {
+	resolved := make([]astNode, len(nodes))
+	for i, node := range nodes {
+		resolved[i] = r.resolve(node)
+	}
+	return resolved
+}
+
+func (r *resolver) resolve(node astNode) astNode {
+	switch n := node.(type) {
+	case identifierNode:
+		n.ref = r.lookup(n.payload)
+		return n
+	case listNode:
+		n.elems = r.resolveAll(n.elems)
+		return n
+	case spreadNode:
+		n.elem = r.resolve(n.elem)
+		return n
+	case objectNode:
+		entries := make([]objectEntry, len(n.entries))
+		for i, entry := range n.entries {
+			entries[i] = objectEntry{
+				key: r.resolveKey(entry.key),
+				val: r.resolve(entry.val),
+			}
+		}
+		n.entries = entries
+		return n
+	case fnNode:
+		f := newFrame()
+		for _, arg := range n.args {
+			f.declare(arg)
+		}
+		f.declare(n.restArg)
+		if _, ok := n.body.(blockNode); !ok {
+			declareAll(f, n.body)
+		}
+
+		r.withFrame(f, func() {
+			n.body = r.resolve(n.body)
+		})
+		n.frame = f
+		return n
+	case assignmentNode:
+		n.left = r.resolve(n.left)
+		n.right = r.resolve(n.right)
+		return n
+	case propertyAccessNode:
+		n.left = r.resolve(n.left)
+		n.right = r.resolveKey(n.right)
+		return n
+	case unaryNode:
+		n.right = r.resolve(n.right)
+		return n
+	case binaryNode:
+		n.left = r.resolve(n.left)
+		n.right = r.resolve(n.right)
+		return n
+	case fnCallNode:
+		n.fn = r.resolve(n.fn)
+		n.args = r.resolveAll(n.args)
+		if n.restArg != nil {
+			n.restArg = r.resolve(n.restArg)
+		}
+		return n
+	case ifExprNode:
+		n.cond = r.resolve(n.cond)
+		branches := make([]ifBranch, len(n.branches))
+		for i, branch := range n.branches {
+			branches[i] = branch
+			branches[i].target = r.resolve(branch.target)
+			if branch.guard != nil {
+				branches[i].guard = r.resolve(branch.guard)
+			}
+			branches[i].body = r.resolve(branch.body)
+		}
+		n.branches = branches
+		return n
+	case blockNode:
+		if len(n.exprs) == 0 {
+			return n
+		}
+
+		f := newFrame()
+		for _, expr := range n.exprs {
+			declareAll(f, expr)
+		}
+
+		r.withFrame(f, func() {
+			n.exprs = r.resolveAll(n.exprs)
+		})
+		n.frame = f
+		return n
+	}
+
+	return node
+}
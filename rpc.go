@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Line-delimited TCP connections for the rpc standard library, which sends
+// one JSON-RPC message per line. ___rpc_listen() accepts connections and
+// ___rpc_connect() opens one.
+
+// rpcConn is a connection that any number of handlers may write lines to.
+type rpcConn struct {
+	sync.Mutex
+	conn net.Conn
+}
+
+func (rc *rpcConn) send(name string, args []Value) (Value, *runtimeError) {
+	if len(args) < 1 {
+		return nil, &runtimeError{
+			kind:   "argumentError",
+			reason: fmt.Sprintf("%s requires 1 arguments, got %d", name, len(args)),
+		}
+	}
+	line, ok := args[0].(*StringValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call %s(%s)", name, args[0]),
+		}
+	}
+	if strings.ContainsRune(line.stringContent(), '\n') {
+		return nil, &runtimeError{
+			kind:   "valueError",
+			reason: fmt.Sprintf("Message in %s() must be a single line", name),
+		}
+	}
+
+	rc.Lock()
+	defer rc.Unlock()
+	if _, err := rc.conn.Write(append(append([]byte{}, *line...), '\n')); err != nil {
+		return errObj(fmt.Sprintf("Could not send in %s(): %s", name, err.Error())), nil
+	}
+	return null, nil
+}
+
+// readLines calls onLine with each line read from conn, under the interpreter
+// lock, until the connection is closed.
+func (c *Context) readLines(conn net.Conn, onLine func(line string) *runtimeError) {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		c.Lock()
+		evalErr := onLine(strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"))
+		c.Unlock()
+		if evalErr != nil {
+			c.eng.reportErr(evalErr)
+		}
+	}
+}
+
+func (c *Context) oakRPCListen(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___rpc_listen", args, 2); err != nil {
+		return nil, err
+	}
+
+	addr, ok1 := args[0].(*StringValue)
+	cb, ok2 := args[1].(FnValue)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___rpc_listen(%s, %s)", args[0], args[1]),
+		}
+	}
+
+	listener, err := net.Listen("tcp", addr.stringContent())
+	if err != nil {
+		return errObj(fmt.Sprintf("Could not listen in ___rpc_listen(): %s", err.Error())), nil
+	}
+
+	var closeOnce sync.Once
+	stopped := make(chan struct{})
+	var conns sync.Map
+
+	// like a server started by listen(), a listening server keeps the
+	// program running until it's closed
+	c.eng.Add(1)
+	go func() {
+		defer c.eng.Done()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-stopped:
+				default:
+					c.Lock()
+					_, err := c.EvalFnValue(cb, false, errObj(fmt.Sprintf("Error accepting connection in ___rpc_listen(): %s", err.Error())))
+					c.Unlock()
+					if err != nil {
+						c.eng.reportErr(err)
+					}
+				}
+				return
+			}
+
+			conns.Store(conn, true)
+			rc := &rpcConn{conn: conn}
+			reply := BuiltinFnValue{
+				name: "reply",
+				fn: func(args []Value) (Value, *runtimeError) {
+					return rc.send("reply", args)
+				},
+			}
+			go func() {
+				defer conns.Delete(conn)
+				defer conn.Close()
+				c.readLines(conn, func(line string) *runtimeError {
+					_, err := c.EvalFnValue(cb, false, ObjectValue{
+						"type":  AtomValue("data"),
+						"data":  MakeString(line),
+						"addr":  MakeString(conn.RemoteAddr().String()),
+						"reply": reply,
+					})
+					return err
+				})
+			}()
+		}
+	}()
+
+	return BuiltinFnValue{
+		name: "close",
+		fn: func(_ []Value) (Value, *runtimeError) {
+			closeOnce.Do(func() {
+				close(stopped)
+				listener.Close()
+				conns.Range(func(conn, _ interface{}) bool {
+					conn.(net.Conn).Close()
+					return true
+				})
+			})
+			return null, nil
+		},
+	}, nil
+}
+
+func (c *Context) oakRPCConnect(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___rpc_connect", args, 2); err != nil {
+		return nil, err
+	}
+
+	addr, ok1 := args[0].(*StringValue)
+	cb, ok2 := args[1].(FnValue)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___rpc_connect(%s, %s)", args[0], args[1]),
+		}
+	}
+
+	conn, err := net.Dial("tcp", addr.stringContent())
+	if err != nil {
+		return errObj(fmt.Sprintf("Could not connect in ___rpc_connect(): %s", err.Error())), nil
+	}
+
+	var closeOnce sync.Once
+	stopped := make(chan struct{})
+	rc := &rpcConn{conn: conn}
+
+	// an open connection keeps the program running until either side closes
+	// it
+	c.eng.Add(1)
+	go func() {
+		defer c.eng.Done()
+
+		c.readLines(conn, func(line string) *runtimeError {
+			_, err := c.EvalFnValue(cb, false, ObjectValue{
+				"type": AtomValue("data"),
+				"data": MakeString(line),
+			})
+			return err
+		})
+		conn.Close()
+
+		select {
+		case <-stopped:
+		default:
+			c.Lock()
+			_, err := c.EvalFnValue(cb, false, ObjectValue{
+				"type": AtomValue("end"),
+			})
+			c.Unlock()
+			if err != nil {
+				c.eng.reportErr(err)
+			}
+		}
+	}()
+
+	return ObjectValue{
+		"send": BuiltinFnValue{
+			name: "send",
+			fn: func(args []Value) (Value, *runtimeError) {
+				return rc.send("send", args)
+			},
+		},
+		"close": BuiltinFnValue{
+			name: "close",
+			fn: func(_ []Value) (Value, *runtimeError) {
+				closeOnce.Do(func() {
+					close(stopped)
+					conn.Close()
+				})
+				return null, nil
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,206 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// oak eval --stdio evaluates snippets of Oak sent by another program, like an
+// editor or a notebook, in one persistent context. Messages in both directions
+// are JSON objects, each preceded by a Content-Length header like in the
+// Language Server Protocol:
+//
+//	Content-Length: 28\r\n
+//	\r\n
+//	{"id":1,"code":"x := 1 + 2"}
+//
+// Each request gets a response with the same id, with either a result, the
+// printed form of the value of the snippet, or an error. Output printed by
+// the program is sent as it's written in messages with an output and the
+// stream it was printed to, and with the id of the request being evaluated,
+// or a null id if it's printed later from a callback.
+
+type sessionRequest struct {
+	ID   json.RawMessage `json:"id"`
+	Code string          `json:"code"`
+}
+
+type sessionMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Result *string         `json:"result,omitempty"`
+	Error  *sessionError   `json:"error,omitempty"`
+	Output *string         `json:"output,omitempty"`
+	Stream string          `json:"stream,omitempty"`
+}
+
+type sessionError struct {
+	Message string `json:"message"`
+	Kind    string `json:"kind,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Col     int    `json:"col,omitempty"`
+}
+
+func sessionErrorOf(err error) *sessionError {
+	switch e := err.(type) {
+	case *runtimeError:
+		return &sessionError{
+			Message: e.reason,
+			Kind:    e.errKind(),
+			Line:    e.pos.line,
+			Col:     e.pos.col,
+		}
+	case parseError:
+		return &sessionError{
+			Message: e.reason,
+			Kind:    "parseError",
+			Line:    e.pos.line,
+			Col:     e.pos.col,
+		}
+	}
+	return &sessionError{Message: err.Error()}
+}
+
+// evalSession writes messages to the client, and keeps track of the request
+// being evaluated, whose output is sent with its id.
+type evalSession struct {
+	sync.Mutex
+	out     io.Writer
+	current json.RawMessage
+}
+
+func (s *evalSession) send(msg sessionMessage) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *evalSession) setCurrent(id json.RawMessage) {
+	s.Lock()
+	defer s.Unlock()
+	s.current = id
+}
+
+// sessionOutput sends output written to a stream to the client.
+type sessionOutput struct {
+	s      *evalSession
+	stream string
+}
+
+func (o sessionOutput) Write(p []byte) (int, error) {
+	o.s.Lock()
+	id := o.s.current
+	o.s.Unlock()
+
+	output := string(p)
+	o.s.send(sessionMessage{ID: id, Output: &output, Stream: o.stream})
+	return len(p), nil
+}
+
+// readSessionMessage reads the body of the next message from r.
+func readSessionMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line != "" {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if length < 0 {
+				// blank lines between messages are allowed
+				continue
+			}
+			break
+		}
+
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("invalid header %q", line)
+		}
+		name, value := strings.TrimSpace(line[:colon]), strings.TrimSpace(line[colon+1:])
+		if strings.EqualFold(name, "Content-Length") {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid Content-Length %q", value)
+			}
+			length = n
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return body, nil
+}
+
+func runEvalSession(in io.Reader, out io.Writer) {
+	s := &evalSession{out: out}
+
+	ctx := NewContextWithCwd()
+	defer ctx.Wait()
+	ctx.LoadBuiltins()
+	ctx.LoadPlugins()
+	ctx.mustLoadAllLibs()
+	ctx.eng.reportErr = func(err error) {
+		s.send(sessionMessage{Error: sessionErrorOf(err)})
+	}
+
+	stdoutStream.Lock()
+	stdoutStream.out = sessionOutput{s: s, stream: "stdout"}
+	stdoutStream.Unlock()
+	stderrStream.Lock()
+	stderrStream.out = sessionOutput{s: s, stream: "stderr"}
+	stderrStream.Unlock()
+
+	reader := bufio.NewReader(in)
+	for {
+		body, err := readSessionMessage(reader)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			// the rest of the input can't be framed into messages
+			s.send(sessionMessage{Error: &sessionError{Message: err.Error()}})
+			return
+		}
+
+		var req sessionRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.send(sessionMessage{Error: &sessionError{Message: "Invalid request: " + err.Error()}})
+			continue
+		}
+
+		s.setCurrent(req.ID)
+		val, err := ctx.Eval(strings.NewReader(req.Code))
+		stdoutStream.Flush()
+		stderrStream.Flush()
+		s.setCurrent(nil)
+
+		if err != nil {
+			s.send(sessionMessage{ID: req.ID, Error: sessionErrorOf(err)})
+			continue
+		}
+		result := val.String()
+		s.send(sessionMessage{ID: req.ID, Result: &result})
+
+		// keep last evaluated result as __, like the REPL
+		ctx.scope.put("__", val)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// The standard streams, as returned by stdio(). Standard input is read through
+// the same buffered reader as input() and lines(), and standard output is
+// written through the same stream as print(), so that they can be mixed.
+
+// outStream is an output stream, which is unbuffered unless its buffer size
+// has been set with buffer().
+type outStream struct {
+	sync.Mutex
+	file *os.File
+	// out, if set, is written to instead of file, like a JavaScript callback
+	// in WebAssembly
+	out io.Writer
+	buf *bufio.Writer
+}
+
+var (
+	stdoutStream = &outStream{file: os.Stdout}
+	stderrStream = &outStream{file: os.Stderr}
+)
+
+func (s *outStream) writer() io.Writer {
+	if s.out != nil {
+		return s.out
+	}
+	return s.file
+}
+
+func (s *outStream) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.buf == nil {
+		return s.writer().Write(p)
+	}
+	return s.buf.Write(p)
+}
+
+func (s *outStream) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.buf == nil {
+		return nil
+	}
+	return s.buf.Flush()
+}
+
+// setBuffer flushes any buffered output, and then buffers up to size bytes of
+// output, or none if size is 0.
+func (s *outStream) setBuffer(size int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.buf != nil {
+		if err := s.buf.Flush(); err != nil {
+			return err
+		}
+	}
+	if size == 0 {
+		s.buf = nil
+	} else {
+		s.buf = bufio.NewWriterSize(s.writer(), size)
+	}
+	return nil
+}
+
+// flushStdStreams writes out output buffered by stdout and stderr. It's called
+// when a program finishes, exits, or stops with an error.
+func flushStdStreams() {
+	stdoutStream.Flush()
+	stderrStream.Flush()
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func stdioError(name string, err error) *runtimeError {
+	return &runtimeError{
+		kind:   "ioError",
+		reason: fmt.Sprintf("Could not %s: %s", name, err.Error()),
+	}
+}
+
+func (c *Context) stdinHandle() ObjectValue {
+	inputReaderInit.Do(initInputReader)
+
+	return ObjectValue{
+		"name": AtomValue("stdin"),
+		"tty?": BuiltinFnValue{
+			name: "tty?",
+			fn: func(_ []Value) (Value, *runtimeError) {
+				return BoolValue(isTerminal(os.Stdin)), nil
+			},
+		},
+		"readLine": BuiltinFnValue{
+			name: "readLine",
+			fn: func(_ []Value) (Value, *runtimeError) {
+				line, err := inputReader.ReadString('\n')
+				if err == io.EOF && line == "" {
+					return null, nil
+				} else if err != nil && err != io.EOF {
+					return nil, stdioError("read standard input", err)
+				}
+
+				line = strings.TrimSuffix(line, "\n")
+				line = strings.TrimSuffix(line, "\r")
+				return MakeString(line), nil
+			},
+		},
+		"read": BuiltinFnValue{
+			name: "read",
+			fn: func(args []Value) (Value, *runtimeError) {
+				if err := c.requireArgLen("read", args, 1); err != nil {
+					return nil, err
+				}
+				n, ok := args[0].(IntValue)
+				if !ok {
+					return nil, &runtimeError{
+						kind:   "typeError",
+						reason: fmt.Sprintf("Mismatched types in call read(%s)", args[0]),
+					}
+				}
+				if n <= 0 {
+					return nil, &runtimeError{
+						kind:   "valueError",
+						reason: fmt.Sprintf("Cannot read %d bytes", n),
+					}
+				}
+				if err := c.allocString(int(n), int(n)); err != nil {
+					return nil, err
+				}
+
+				buf := make([]byte, n)
+				count, err := inputReader.Read(buf)
+				if err == io.EOF && count == 0 {
+					return null, nil
+				} else if err != nil && err != io.EOF {
+					return nil, stdioError("read standard input", err)
+				}
+				return MakeString(string(buf[:count])), nil
+			},
+		},
+		"readAll": BuiltinFnValue{
+			name: "readAll",
+			fn: func(_ []Value) (Value, *runtimeError) {
+				data, err := io.ReadAll(inputReader)
+				if err != nil {
+					return nil, stdioError("read standard input", err)
+				}
+				if err := c.allocString(len(data), len(data)); err != nil {
+					return nil, err
+				}
+				return MakeString(string(data)), nil
+			},
+		},
+		"lines": BuiltinFnValue{
+			name: "lines",
+			fn: func(_ []Value) (Value, *runtimeError) {
+				return c.oakLines(nil)
+			},
+		},
+	}
+}
+
+func (c *Context) outHandle(name string, s *outStream) ObjectValue {
+	return ObjectValue{
+		"name": AtomValue(name),
+		"tty?": BuiltinFnValue{
+			name: "tty?",
+			fn: func(_ []Value) (Value, *runtimeError) {
+				return BoolValue(isTerminal(s.file)), nil
+			},
+		},
+		"write": BuiltinFnValue{
+			name: "write",
+			fn: func(args []Value) (Value, *runtimeError) {
+				if err := c.requireArgLen("write", args, 1); err != nil {
+					return nil, err
+				}
+				data, ok := args[0].(*StringValue)
+				if !ok {
+					return nil, &runtimeError{
+						kind:   "typeError",
+						reason: fmt.Sprintf("Mismatched types in call write(%s)", args[0]),
+					}
+				}
+
+				n, err := s.Write(*data)
+				if err != nil {
+					return nil, stdioError("write to "+name, err)
+				}
+				return IntValue(n), nil
+			},
+		},
+		"flush": BuiltinFnValue{
+			name: "flush",
+			fn: func(_ []Value) (Value, *runtimeError) {
+				if err := s.Flush(); err != nil {
+					return nil, stdioError("write to "+name, err)
+				}
+				return null, nil
+			},
+		},
+		"buffer": BuiltinFnValue{
+			name: "buffer",
+			fn: func(args []Value) (Value, *runtimeError) {
+				if err := c.requireArgLen("buffer", args, 1); err != nil {
+					return nil, err
+				}
+				size, ok := args[0].(IntValue)
+				if !ok {
+					return nil, &runtimeError{
+						kind:   "typeError",
+						reason: fmt.Sprintf("Mismatched types in call buffer(%s)", args[0]),
+					}
+				}
+				if size < 0 {
+					return nil, &runtimeError{
+						kind:   "valueError",
+						reason: fmt.Sprintf("Invalid buffer size %d", size),
+					}
+				}
+
+				if err := s.setBuffer(int(size)); err != nil {
+					return nil, stdioError("write to "+name, err)
+				}
+				return null, nil
+			},
+		},
+	}
+}
+
+// inputHistory holds the lines entered at prompts of input() with history,
+// most recent last, up to maxInputHistory lines.
+var (
+	inputHistory     []string
+	inputHistoryLock sync.Mutex
+)
+
+const maxInputHistory = 500
+
+// oakPromptInput implements input(prompt, options?). When the standard input
+// is a terminal, the line is read with line editing, and with history unless
+// it's masked. Otherwise, the prompt is written to the standard output and a
+// line is read as by input().
+func (c *Context) oakPromptInput(args []Value) (Value, *runtimeError) {
+	prompt, ok1 := args[0].(*StringValue)
+	options, ok2 := ObjectValue{}, true
+	if len(args) > 1 {
+		options, ok2 = args[1].(ObjectValue)
+	}
+	if !ok1 || !ok2 {
+		if len(args) > 1 {
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Mismatched types in call input(%s, %s)", args[0], args[1]),
+			}
+		}
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call input(%s)", args[0]),
+		}
+	}
+
+	stdoutStream.Flush()
+	if !ttyIsTerminal(int(os.Stdin.Fd())) {
+		stdoutStream.Write(*prompt)
+		return c.oakInput(nil)
+	}
+
+	var mask rune
+	switch m := options["mask"].(type) {
+	case BoolValue:
+		if m {
+			mask = '*'
+		}
+	case *StringValue:
+		mask, _ = utf8.DecodeRune(*m)
+	}
+	history := mask == 0 && options["history"] != oakFalse
+
+	inputHistoryLock.Lock()
+	defer inputHistoryLock.Unlock()
+	var lines []string
+	if history {
+		lines = inputHistory
+	}
+
+	line, err := ttyReadLine(string(*prompt), mask, lines)
+	switch {
+	case err == io.EOF:
+		return ObjectValue{
+			"type":  AtomValue("error"),
+			"error": MakeString("EOF"),
+			"data":  MakeString(line),
+		}, nil
+	case err == errTTYInterrupt:
+		return errObj("Interrupted"), nil
+	case err != nil:
+		return errObj(fmt.Sprintf("Could not read input: %s", err.Error())), nil
+	}
+
+	if history && strings.TrimSpace(line) != "" {
+		inputHistory = append(inputHistory, line)
+		if len(inputHistory) > maxInputHistory {
+			inputHistory = inputHistory[1:]
+		}
+	}
+	return ObjectValue{
+		"type": AtomValue("data"),
+		"data": MakeString(line),
+	}, nil
+}
+
+func (c *Context) oakStdio(_ []Value) (Value, *runtimeError) {
+	return ObjectValue{
+		"in":  c.stdinHandle(),
+		"out": c.outHandle("stdout", stdoutStream),
+		"err": c.outHandle("stderr", stderrStream),
+	}, nil
+}
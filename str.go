@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Native implementations of the string operations of the str standard
+// library that dominate the runtime of text processing programs. Like the rest
+// of Oak, they treat strings as bytes, except that upper and lower change the
+// case of any Unicode letters in valid UTF-8.
+
+// strSpace is the set of characters removed by str.trim without an argument.
+const strSpace = " \t\n\r\f"
+
+// strArgs returns the first count arguments to the builtin name as strings,
+// and whether each was given. Arguments after the first may be ?, which is
+// returned as "" and not given.
+func strArgs(name string, args []Value, count int) ([]string, []bool, *runtimeError) {
+	if len(args) < count {
+		return nil, nil, &runtimeError{
+			kind:   "argumentError",
+			reason: fmt.Sprintf("%s requires %d arguments, got %d", name, count, len(args)),
+		}
+	}
+
+	strs := make([]string, count)
+	given := make([]bool, count)
+	for i, arg := range args[:count] {
+		if s, ok := arg.(*StringValue); ok {
+			strs[i], given[i] = string(*s), true
+			continue
+		}
+		if _, ok := arg.(NullValue); !ok || i == 0 {
+			return nil, nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Argument %d to %s must be a string, got %s", i, name, arg),
+			}
+		}
+	}
+	return strs, given, nil
+}
+
+func (c *Context) oakStrSplit(args []Value) (Value, *runtimeError) {
+	strs, _, err := strArgs("___str_split", args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	s, sep := strs[0], strs[1]
+	var parts []string
+	if sep == "" {
+		parts = make([]string, len(s))
+		for i := range parts {
+			parts[i] = s[i : i+1]
+		}
+	} else {
+		parts = strings.Split(s, sep)
+	}
+
+	// the parts hold every byte of s but the separators
+	if err := c.alloc(len(s) - len(sep)*(len(parts)-1)); err != nil {
+		return nil, err
+	}
+	elems := make([]Value, len(parts))
+	for i, part := range parts {
+		elems[i] = MakeString(part)
+	}
+	return c.makeList(elems...)
+}
+
+func (c *Context) oakStrReplace(args []Value) (Value, *runtimeError) {
+	strs, _, err := strArgs("___str_replace", args, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	s, old, new := strs[0], strs[1], strs[2]
+	if old == "" {
+		return c.makeString(s)
+	}
+	// checked before replacing, which may grow s many times over
+	size := len(s) + strings.Count(s, old)*(len(new)-len(old))
+	if err := c.allocString(size, size); err != nil {
+		return nil, err
+	}
+	return MakeString(strings.ReplaceAll(s, old, new)), nil
+}
+
+func (c *Context) oakStrIndex(args []Value) (Value, *runtimeError) {
+	strs, _, err := strArgs("___str_index", args, 2)
+	if err != nil {
+		return nil, err
+	}
+	return IntValue(strings.Index(strs[0], strs[1])), nil
+}
+
+func (c *Context) oakStrRindex(args []Value) (Value, *runtimeError) {
+	strs, _, err := strArgs("___str_rindex", args, 2)
+	if err != nil {
+		return nil, err
+	}
+	return IntValue(strings.LastIndex(strs[0], strs[1])), nil
+}
+
+// oakStrTrimStart removes every repetition of a prefix from the start of a
+// string, or whitespace if the prefix is ?.
+func (c *Context) oakStrTrimStart(args []Value) (Value, *runtimeError) {
+	strs, given, err := strArgs("___str_trim_start", args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	s, prefix := strs[0], strs[1]
+	if !given[1] {
+		return c.makeString(strings.TrimLeft(s, strSpace))
+	}
+	if prefix != "" {
+		for strings.HasPrefix(s, prefix) {
+			s = s[len(prefix):]
+		}
+	}
+	return c.makeString(s)
+}
+
+// oakStrTrimEnd removes every repetition of a suffix from the end of a
+// string, or whitespace if the suffix is ?.
+func (c *Context) oakStrTrimEnd(args []Value) (Value, *runtimeError) {
+	strs, given, err := strArgs("___str_trim_end", args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	s, suffix := strs[0], strs[1]
+	if !given[1] {
+		return c.makeString(strings.TrimRight(s, strSpace))
+	}
+	if suffix != "" {
+		for strings.HasSuffix(s, suffix) {
+			s = s[:len(s)-len(suffix)]
+		}
+	}
+	return c.makeString(s)
+}
+
+// strPadding returns repetitions of pad, cut to n bytes, to pad s to n bytes.
+// The padded string is checked against the limits before it's built.
+func (c *Context) strPadding(name string, args []Value) (string, string, *runtimeError) {
+	if err := c.requireArgLen(name, args, 3); err != nil {
+		return "", "", err
+	}
+
+	var n int
+	switch arg := args[1].(type) {
+	case IntValue:
+		n = int(arg)
+	case FloatValue:
+		n = int(arg)
+	default:
+		return "", "", &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Length to %s must be a number, got %s", name, args[1]),
+		}
+	}
+	strs, _, err := strArgs(name, []Value{args[0], args[2]}, 2)
+	if err != nil {
+		return "", "", err
+	}
+
+	s, pad := strs[0], strs[1]
+	if len(s) >= n || pad == "" {
+		return s, "", c.allocString(len(s), len(s))
+	}
+	if err := c.allocString(n, n); err != nil {
+		return "", "", err
+	}
+	missing := n - len(s)
+	return s, strings.Repeat(pad, missing/len(pad)) + pad[:missing%len(pad)], nil
+}
+
+func (c *Context) oakStrPadStart(args []Value) (Value, *runtimeError) {
+	s, padding, err := c.strPadding("___str_pad_start", args)
+	if err != nil {
+		return nil, err
+	}
+	return MakeString(padding + s), nil
+}
+
+func (c *Context) oakStrPadEnd(args []Value) (Value, *runtimeError) {
+	s, padding, err := c.strPadding("___str_pad_end", args)
+	if err != nil {
+		return nil, err
+	}
+	return MakeString(s + padding), nil
+}
+
+// strMapCase adds delta to each byte of s between lo and hi. Only ASCII
+// letters change case, so that upper and lower give the same results in Go
+// and in Oak compiled to JavaScript.
+func strMapCase(s string, lo, hi byte, delta int) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= lo && c <= hi {
+			b[i] = byte(int(c) + delta)
+		}
+	}
+	return string(b)
+}
+
+func (c *Context) oakStrUpper(args []Value) (Value, *runtimeError) {
+	strs, _, err := strArgs("___str_upper", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return c.makeString(strMapCase(strs[0], 'a', 'z', 'A'-'a'))
+}
+
+func (c *Context) oakStrLower(args []Value) (Value, *runtimeError) {
+	strs, _, err := strArgs("___str_lower", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return c.makeString(strMapCase(strs[0], 'A', 'Z', 'a'-'A'))
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+)
+
+// A task is the eventual result of some asynchronous work, so that async code
+// can pass results around as values, and chain steps with then and catch
+// rather than nesting callbacks. task(f) calls f(resolve, reject) and returns
+// a task that's resolved with the value given to resolve, or rejected with
+// the one given to reject or the error f raises.
+//
+// A task is an object { type: :task, then, catch }. t.then(onOk, onErr?)
+// returns a new task that's settled by whichever of the functions is called
+// with t's result once t is settled, or like t if that function isn't given,
+// and t.catch(onErr) is t.then(?, onErr). Any object with a then method is
+// taken for a task when it resolves another, so a task resolved with a task
+// takes on that task's result. As with JavaScript's promises, callbacks are
+// never called as soon as a task is settled, but queued on the event loop, so
+// they see the same state no matter how quickly the work finished.
+
+type taskState int
+
+const (
+	taskPending taskState = iota
+	taskResolved
+	taskRejected
+)
+
+type task struct {
+	obj       ObjectValue
+	state     taskState
+	value     Value
+	callbacks []func()
+	// set once a callback is added, so rejections no one handles are reported
+	handled bool
+}
+
+// enqueueJob queues job to run on the event loop, after the running code and
+// every job queued before it.
+func (c *Context) enqueueJob(job func()) {
+	c.eng.jobs = append(c.eng.jobs, job)
+	c.runJobs()
+}
+
+// runJobs starts running the queued jobs on the event loop, unless they're
+// already running. Once no jobs are left, rejected tasks that none of them
+// handled are reported, since a job may be what adds a task's catch handler,
+// as when another task adopts it.
+func (c *Context) runJobs() {
+	if c.eng.runningJobs {
+		return
+	}
+
+	c.eng.runningJobs = true
+	c.eng.Add(1)
+	go func() {
+		defer c.eng.Done()
+
+		c.Lock()
+		defer c.Unlock()
+		for len(c.eng.jobs) > 0 {
+			job := c.eng.jobs[0]
+			c.eng.jobs = c.eng.jobs[1:]
+			job()
+		}
+		c.eng.jobs = nil
+		c.eng.runningJobs = false
+
+		for _, t := range c.eng.rejected {
+			if !t.handled {
+				c.eng.reportErr(&runtimeError{
+					reason: fmt.Sprintf("Task rejected with %s, which no catch handled", t.value),
+				})
+			}
+		}
+		c.eng.rejected = nil
+	}()
+}
+
+func isFunction(v Value) bool {
+	switch v.(type) {
+	case FnValue, BuiltinFnValue:
+		return true
+	}
+	return false
+}
+
+// thenMethod returns the then method of v if it's a task, or any object with
+// a then method.
+func thenMethod(v Value) (Value, bool) {
+	obj, ok := v.(ObjectValue)
+	if !ok {
+		return nil, false
+	}
+	then, ok := obj["then"]
+	return then, ok && isFunction(then)
+}
+
+func (c *Context) settleTask(t *task, state taskState, val Value) {
+	if t.state != taskPending {
+		return
+	}
+	t.state = state
+	t.value = val
+
+	for _, cb := range t.callbacks {
+		c.enqueueJob(cb)
+	}
+	t.callbacks = nil
+
+	if state == taskRejected && !t.handled {
+		c.eng.rejected = append(c.eng.rejected, t)
+		c.runJobs()
+	}
+}
+
+// resolveTask resolves t with val, or if val is a task, settles t the way val
+// settles.
+func (c *Context) resolveTask(t *task, val Value) {
+	if t.state != taskPending {
+		return
+	}
+	if id, ok := containerID(val); ok {
+		if own, _ := containerID(t.obj); id == own {
+			c.settleTask(t, taskRejected, (&runtimeError{
+				kind:   "typeError",
+				reason: "Cannot resolve a task with itself",
+			}).value())
+			return
+		}
+	}
+
+	then, ok := thenMethod(val)
+	if !ok {
+		c.settleTask(t, taskResolved, val)
+		return
+	}
+	c.enqueueJob(func() {
+		resolve, reject := c.taskResolvers(t)
+		if _, err := c.EvalFnValue(then, false, resolve, reject); err != nil {
+			c.settleTask(t, taskRejected, err.value())
+		}
+	})
+}
+
+// taskResolvers returns the resolve and reject functions of t, of which only
+// the first call does anything.
+func (c *Context) taskResolvers(t *task) (BuiltinFnValue, BuiltinFnValue) {
+	done := false
+	resolve := BuiltinFnValue{
+		name: "resolve",
+		fn: func(args []Value) (Value, *runtimeError) {
+			if !done {
+				done = true
+				c.resolveTask(t, argOrNull(args, 0))
+			}
+			return null, nil
+		},
+	}
+	reject := BuiltinFnValue{
+		name: "reject",
+		fn: func(args []Value) (Value, *runtimeError) {
+			if !done {
+				done = true
+				c.settleTask(t, taskRejected, argOrNull(args, 0))
+			}
+			return null, nil
+		},
+	}
+	return resolve, reject
+}
+
+func argOrNull(args []Value, i int) Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return null
+}
+
+func (c *Context) newTask() *task {
+	t := &task{}
+	then := BuiltinFnValue{
+		name: "then",
+		fn: func(args []Value) (Value, *runtimeError) {
+			return c.taskThen(t, argOrNull(args, 0), argOrNull(args, 1)).obj, nil
+		},
+	}
+	t.obj = ObjectValue{
+		"type": AtomValue("task"),
+		"then": then,
+		"catch": BuiltinFnValue{
+			name: "catch",
+			fn: func(args []Value) (Value, *runtimeError) {
+				return c.taskThen(t, null, argOrNull(args, 0)).obj, nil
+			},
+		},
+	}
+	return t
+}
+
+// taskThen returns a task settled by calling onOk or onErr with the result of
+// t, once t is settled.
+func (c *Context) taskThen(t *task, onOk, onErr Value) *task {
+	next := c.newTask()
+	t.handled = true
+
+	cb := func() {
+		handler := onOk
+		if t.state == taskRejected {
+			handler = onErr
+		}
+		if !isFunction(handler) {
+			if t.state == taskRejected {
+				c.settleTask(next, taskRejected, t.value)
+			} else {
+				c.resolveTask(next, t.value)
+			}
+			return
+		}
+
+		result, err := c.EvalFnValue(handler, false, t.value)
+		if err != nil {
+			c.settleTask(next, taskRejected, err.value())
+			return
+		}
+		c.resolveTask(next, result)
+	}
+	if t.state == taskPending {
+		t.callbacks = append(t.callbacks, cb)
+	} else {
+		c.enqueueJob(cb)
+	}
+	return next
+}
+
+func (c *Context) oakTask(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("task", args, 1); err != nil {
+		return nil, err
+	}
+	if !isFunction(args[0]) {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Argument to task must be a function, got %s", args[0]),
+		}
+	}
+
+	t := c.newTask()
+	resolve, reject := c.taskResolvers(t)
+	if _, err := c.EvalFnValue(args[0], false, resolve, reject); err != nil {
+		// a cancelled program must stop, so cancellation can't be caught
+		if err.kind == "cancelled" {
+			return nil, err
+		}
+		reject.fn([]Value{err.value()})
+	}
+	return t.obj, nil
+}
+
+// ___async is the builtin that the body of an async fn desugars to, see
+// parseAsyncFn. ___async(f) returns a task resolved with the value of f(), so
+// an async fn returns a task even if it never awaits anything.
+func (c *Context) oakAsync(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___async", args, 1); err != nil {
+		return nil, err
+	}
+
+	t := c.newTask()
+	result, err := c.EvalFnValue(args[0], false)
+	if err != nil {
+		if err.kind == "cancelled" {
+			return nil, err
+		}
+		c.settleTask(t, taskRejected, err.value())
+		return t.obj, nil
+	}
+	c.resolveTask(t, result)
+	return t.obj, nil
+}
+
+// ___await is the builtin that await statements desugar to. ___await(x,
+// cont) returns a task settled by cont(v), where v is the result of x if it's
+// a task or x otherwise, or settled like x if cont is ?. A rejected x skips
+// cont, and rejects the returned task with the same value.
+func (c *Context) oakAwait(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___await", args, 2); err != nil {
+		return nil, err
+	}
+
+	t := c.newTask()
+	c.resolveTask(t, args[0])
+	return c.taskThen(t, args[1], null).obj, nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Templates for the template standard library, whose syntax is documented in
+// lib/template.oak. A template is compiled once into a tree of nodes, which is
+// then rendered with data any number of times.
+
+type tmplNode interface{}
+
+type tmplText string
+
+type tmplValue struct {
+	path []string
+	raw  bool
+}
+
+type tmplBranch struct {
+	path []string
+	not  bool
+	body []tmplNode
+}
+
+type tmplIf struct {
+	branches  []tmplBranch
+	otherwise []tmplNode
+}
+
+type tmplEach struct {
+	key, item string
+	path      []string
+	body      []tmplNode
+	otherwise []tmplNode
+}
+
+type tmplParser struct {
+	s string
+	i int
+	// action is the text of the last action read
+	action string
+	// actionStart is the offset of the last action read
+	actionStart int
+}
+
+func (p *tmplParser) errorf(format string, args ...interface{}) *runtimeError {
+	line := strings.Count(p.s[:p.actionStart], "\n") + 1
+	return &runtimeError{
+		kind:   "valueError",
+		reason: fmt.Sprintf("Invalid template at line %d: ", line) + fmt.Sprintf(format, args...),
+	}
+}
+
+func (p *tmplParser) path(s string) ([]string, *runtimeError) {
+	if s == "." {
+		return []string{}, nil
+	}
+	parts := strings.Split(s, ".")
+	for _, part := range parts {
+		if part == "" || strings.ContainsAny(part, " \t\n{}") {
+			return nil, p.errorf("invalid path %s", s)
+		}
+	}
+	return parts, nil
+}
+
+// nodes parses nodes until the end of the template, or an {{ else }} or
+// {{ end }} action, whose text it returns.
+func (p *tmplParser) nodes() ([]tmplNode, string, *runtimeError) {
+	nodes := []tmplNode{}
+	for {
+		start := strings.Index(p.s[p.i:], "{{")
+		if start < 0 {
+			if p.i < len(p.s) {
+				nodes = append(nodes, tmplText(p.s[p.i:]))
+			}
+			p.i = len(p.s)
+			return nodes, "", nil
+		}
+		if start > 0 {
+			nodes = append(nodes, tmplText(p.s[p.i:p.i+start]))
+		}
+
+		p.actionStart = p.i + start
+		end := strings.Index(p.s[p.actionStart:], "}}")
+		if end < 0 {
+			return nil, "", p.errorf("unclosed action")
+		}
+		p.action = strings.TrimSpace(p.s[p.actionStart+2 : p.actionStart+end])
+		p.i = p.actionStart + end + 2
+
+		words := strings.Fields(p.action)
+		if len(words) == 0 {
+			return nil, "", p.errorf("empty action")
+		}
+
+		switch {
+		case strings.HasPrefix(p.action, "#"):
+			continue
+		case words[0] == "end" || words[0] == "else":
+			return nodes, p.action, nil
+		case words[0] == "if":
+			node, err := p.ifNode(words[1:])
+			if err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, node)
+		case words[0] == "each":
+			node, err := p.eachNode(words[1:])
+			if err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, node)
+		case words[0] == "raw" && len(words) == 2:
+			path, err := p.path(words[1])
+			if err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, tmplValue{path: path, raw: true})
+		case len(words) == 1:
+			path, err := p.path(words[0])
+			if err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, tmplValue{path: path})
+		default:
+			return nil, "", p.errorf("unknown action {{ %s }}", p.action)
+		}
+	}
+}
+
+// condition parses the condition of an if or else if action.
+func (p *tmplParser) condition(words []string) ([]string, bool, *runtimeError) {
+	not := len(words) == 2 && words[0] == "not"
+	if not {
+		words = words[1:]
+	}
+	if len(words) != 1 {
+		return nil, false, p.errorf("invalid condition in {{ %s }}", p.action)
+	}
+	path, err := p.path(words[0])
+	return path, not, err
+}
+
+func (p *tmplParser) ifNode(words []string) (tmplNode, *runtimeError) {
+	node := tmplIf{}
+	for {
+		path, not, err := p.condition(words)
+		if err != nil {
+			return nil, err
+		}
+		body, closer, err := p.nodes()
+		if err != nil {
+			return nil, err
+		}
+		node.branches = append(node.branches, tmplBranch{path: path, not: not, body: body})
+
+		closeWords := strings.Fields(closer)
+		switch {
+		case closer == "":
+			return nil, p.errorf("unclosed {{ if }}")
+		case closer == "end":
+			return node, nil
+		case len(closeWords) > 1 && closeWords[1] == "if":
+			words = closeWords[2:]
+			continue
+		case closer == "else":
+			if node.otherwise, err = p.closedNodes("if"); err != nil {
+				return nil, err
+			}
+			return node, nil
+		}
+		return nil, p.errorf("unknown action {{ %s }}", closer)
+	}
+}
+
+func (p *tmplParser) eachNode(words []string) (tmplNode, *runtimeError) {
+	node := tmplEach{}
+	// each x in path, or each k, x in path
+	switch {
+	case len(words) == 3 && words[1] == "in":
+		node.item = words[0]
+	case len(words) == 4 && words[2] == "in" && strings.HasSuffix(words[0], ","):
+		node.key = strings.TrimSuffix(words[0], ",")
+		node.item = words[1]
+	default:
+		return nil, p.errorf("invalid loop {{ %s }}", p.action)
+	}
+	path, err := p.path(words[len(words)-1])
+	if err != nil {
+		return nil, err
+	}
+	node.path = path
+
+	body, closer, err := p.nodes()
+	if err != nil {
+		return nil, err
+	}
+	node.body = body
+	switch closer {
+	case "":
+		return nil, p.errorf("unclosed {{ each }}")
+	case "end":
+		return node, nil
+	case "else":
+		if node.otherwise, err = p.closedNodes("each"); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+	return nil, p.errorf("unknown action {{ %s }}", closer)
+}
+
+// closedNodes parses the nodes of an {{ else }} branch, which must end with
+// {{ end }}.
+func (p *tmplParser) closedNodes(block string) ([]tmplNode, *runtimeError) {
+	nodes, closer, err := p.nodes()
+	if err != nil {
+		return nil, err
+	}
+	if closer != "end" {
+		return nil, p.errorf("unclosed {{ %s }}", block)
+	}
+	return nodes, nil
+}
+
+// tmplScope holds the variables bound by a loop.
+type tmplScope struct {
+	vars   map[string]Value
+	parent *tmplScope
+}
+
+type tmplRenderer struct {
+	html bool
+	data Value
+	b    strings.Builder
+}
+
+func (r *tmplRenderer) lookup(path []string, scope *tmplScope) Value {
+	if len(path) == 0 {
+		return r.data
+	}
+
+	v, found := Value(nil), false
+	for s := scope; s != nil && !found; s = s.parent {
+		v, found = s.vars[path[0]]
+	}
+	if !found {
+		v = tmplIndex(r.data, path[0])
+	}
+	for _, part := range path[1:] {
+		v = tmplIndex(v, part)
+	}
+	return v
+}
+
+func tmplIndex(v Value, key string) Value {
+	switch val := v.(type) {
+	case ObjectValue:
+		if el, ok := val[key]; ok {
+			return el
+		}
+	case *ListValue:
+		if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(val.elems) {
+			return val.elems[i]
+		}
+	case numArray:
+		if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < val.length() {
+			return val.at(i)
+		}
+	}
+	return null
+}
+
+// tmplTruthy reports whether a value satisfies a condition. False, ?, _, and
+// empty strings, lists, and objects do not.
+func tmplTruthy(v Value) bool {
+	switch val := v.(type) {
+	case NullValue, EmptyValue:
+		return false
+	case BoolValue:
+		return bool(val)
+	case *StringValue:
+		return len(*val) > 0
+	case *ListValue:
+		return len(val.elems) > 0
+	case numArray:
+		return val.length() > 0
+	case ObjectValue:
+		return len(val) > 0
+	}
+	return true
+}
+
+var tmplHTMLEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&quot;",
+	"'", "&#39;",
+)
+
+func (r *tmplRenderer) render(nodes []tmplNode, scope *tmplScope) {
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case tmplText:
+			r.b.WriteString(string(n))
+		case tmplValue:
+			var s string
+			switch v := r.lookup(n.path, scope).(type) {
+			case NullValue, EmptyValue:
+			case *StringValue:
+				s = string(*v)
+			default:
+				s = v.String()
+			}
+			if r.html && !n.raw {
+				s = tmplHTMLEscaper.Replace(s)
+			}
+			r.b.WriteString(s)
+		case tmplIf:
+			body := n.otherwise
+			for _, branch := range n.branches {
+				if tmplTruthy(r.lookup(branch.path, scope)) != branch.not {
+					body = branch.body
+					break
+				}
+			}
+			r.render(body, scope)
+		case tmplEach:
+			r.each(n, scope)
+		}
+	}
+}
+
+func (r *tmplRenderer) each(n tmplEach, scope *tmplScope) {
+	bind := func(key, item Value) {
+		vars := map[string]Value{n.item: item}
+		if n.key != "" {
+			vars[n.key] = key
+		}
+		r.render(n.body, &tmplScope{vars: vars, parent: scope})
+	}
+
+	switch v := r.lookup(n.path, scope).(type) {
+	case *ListValue:
+		for i, el := range v.elems {
+			bind(IntValue(i), el)
+		}
+	case numArray:
+		for i := 0; i < v.length(); i++ {
+			bind(IntValue(i), v.at(i))
+		}
+	case ObjectValue:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			bind(MakeString(key), v[key])
+		}
+	}
+
+	if !tmplTruthy(r.lookup(n.path, scope)) {
+		r.render(n.otherwise, scope)
+	}
+}
+
+func (c *Context) oakTemplateCompile(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___template_compile", args, 2); err != nil {
+		return nil, err
+	}
+
+	source, ok1 := args[0].(*StringValue)
+	html, ok2 := args[1].(BoolValue)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___template_compile(%s, %s)", args[0], args[1]),
+		}
+	}
+
+	p := tmplParser{s: string(*source)}
+	nodes, closer, err := p.nodes()
+	if err != nil {
+		return nil, err
+	}
+	if closer != "" {
+		return nil, p.errorf("unexpected {{ %s }}", closer)
+	}
+
+	return BuiltinFnValue{
+		name: "render",
+		fn: func(args []Value) (Value, *runtimeError) {
+			var data Value = null
+			if len(args) > 0 {
+				data = args[0]
+			}
+
+			r := tmplRenderer{html: bool(html), data: data}
+			r.render(nodes, nil)
+			s := r.b.String()
+			if err := c.allocString(len(s), len(s)); err != nil {
+				return nil, err
+			}
+			return MakeString(s), nil
+		},
+	}, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"unicode/utf8"
+)
+
+// Terminal control, for the term standard library.
+
+// rawState holds the terminal state of standard input from before it was put
+// into raw mode, or nil if it isn't in raw mode.
+var (
+	rawState *ttyState
+	rawLock  sync.Mutex
+)
+
+// restoreTerminal takes standard input out of raw mode, if it's in raw mode.
+// Like flushStdStreams, it's called when a program finishes, exits, or stops
+// with an error, so that programs don't leave the terminal in raw mode.
+func restoreTerminal() {
+	rawLock.Lock()
+	defer rawLock.Unlock()
+
+	if rawState != nil {
+		ttyRestore(int(os.Stdin.Fd()), rawState)
+		rawState = nil
+	}
+}
+
+// termEscapeKeys names the keys sent as escape sequences, without their
+// leading escape character, by common terminals.
+var termEscapeKeys = map[string]string{
+	"[A": "up", "[B": "down", "[C": "right", "[D": "left",
+	"OA": "up", "OB": "down", "OC": "right", "OD": "left",
+	"[H": "home", "[F": "end", "OH": "home", "OF": "end",
+	"[1~": "home", "[7~": "home", "[4~": "end", "[8~": "end",
+	"[2~": "insert", "[3~": "delete", "[5~": "pageUp", "[6~": "pageDown",
+}
+
+// termKey reads a keypress. Keys that produce a character are returned as a
+// string of that character, and keys that don't as an atom naming the key.
+func termKey(r *bufio.Reader) (Value, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch b {
+	case '\r', '\n':
+		return AtomValue("enter"), nil
+	case '\t':
+		return AtomValue("tab"), nil
+	case 0x7f, '\b':
+		return AtomValue("backspace"), nil
+	case 0x1b:
+		// an escape sequence arrives all at once, so an escape with nothing
+		// after it is the escape key
+		if r.Buffered() == 0 {
+			return AtomValue("escape"), nil
+		}
+
+		seq := []byte{}
+		for r.Buffered() > 0 {
+			c, _ := r.ReadByte()
+			seq = append(seq, c)
+			// sequences begun by [ or O end at their first letter or ~ after
+			// it, and others, like those sent for Alt and a key, at once
+			if seq[0] != '[' && seq[0] != 'O' ||
+				len(seq) > 1 && (c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '~') {
+				break
+			}
+		}
+		if name, ok := termEscapeKeys[string(seq)]; ok {
+			return AtomValue(name), nil
+		}
+		return MakeString("\x1b" + string(seq)), nil
+	}
+
+	if b < utf8.RuneSelf {
+		return MakeString(string([]byte{b})), nil
+	}
+	// read the rest of a multibyte character
+	if err := r.UnreadByte(); err != nil {
+		return nil, err
+	}
+	ch, _, err := r.ReadRune()
+	if err != nil {
+		return nil, err
+	}
+	return MakeString(string(ch)), nil
+}
+
+func (c *Context) oakTermSize(_ []Value) (Value, *runtimeError) {
+	fd := int(os.Stdout.Fd())
+	if !ttyIsTerminal(fd) {
+		return null, nil
+	}
+
+	width, height, err := ttySize(fd)
+	if err != nil {
+		return nil, &runtimeError{
+			kind:   "ioError",
+			reason: fmt.Sprintf("Could not get terminal size: %s", err.Error()),
+		}
+	}
+	return ObjectValue{
+		"width":  IntValue(width),
+		"height": IntValue(height),
+	}, nil
+}
+
+func (c *Context) oakTermRaw(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___term_raw", args, 1); err != nil {
+		return nil, err
+	}
+
+	raw, ok := args[0].(BoolValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___term_raw(%s)", args[0]),
+		}
+	}
+
+	if !raw {
+		restoreTerminal()
+		return oakTrue, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !ttyIsTerminal(fd) {
+		return oakFalse, nil
+	}
+
+	rawLock.Lock()
+	defer rawLock.Unlock()
+	if rawState != nil {
+		return oakTrue, nil
+	}
+	state, err := ttyMakeRaw(fd)
+	if err != nil {
+		return nil, &runtimeError{
+			kind:   "ioError",
+			reason: fmt.Sprintf("Could not enter raw mode: %s", err.Error()),
+		}
+	}
+	rawState = state
+	return oakTrue, nil
+}
+
+func (c *Context) oakTermKey(_ []Value) (Value, *runtimeError) {
+	inputReaderInit.Do(initInputReader)
+
+	key, err := termKey(inputReader)
+	if err == io.EOF {
+		return null, nil
+	} else if err != nil {
+		return nil, &runtimeError{
+			kind:   "ioError",
+			reason: fmt.Sprintf("Could not read key: %s", err.Error()),
+		}
+	}
+	return key, nil
+}
@@ -1,23 +1,49 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type tokenizer struct {
+	// source holds a window of the program text starting at index base. When
+	// the tokenizer reads from a reader, source is filled lazily and runes
+	// already consumed are discarded, so the whole program is never held in
+	// memory at once.
 	source []rune
+	base   int
 	index  int
+	reader *bufio.Reader
+	err    error
 
 	fileName string
+	offset   int
 	line     int
 	col      int
+
+	// position before the last call to next(), so back() can restore it
+	// exactly, including across line breaks
+	last tokenizerState
+}
+
+type tokenizerState struct {
+	index  int
+	offset int
+	line   int
+	col    int
 }
 
+// pos is a position in Oak source. offset is the byte offset into the source
+// text, and line and col are 1-based. Columns count Unicode code points, so a
+// tab is a single column, and a CRLF line ending counts as a single line break.
 type pos struct {
 	fileName string
+	offset   int
 	line     int
 	col      int
 }
@@ -32,10 +58,12 @@ const (
 	// sentinel
 	unknown tokKind = iota
 	comment
+	docComment
 
 	// language tokens
 	comma
 	dot
+	optionalDot
 	leftParen
 	rightParen
 	leftBracket
@@ -58,6 +86,7 @@ const (
 	times
 	divide
 	modulus
+	power
 	xor
 	and
 	or
@@ -79,6 +108,7 @@ const (
 	trueLiteral
 	falseLiteral
 	stringLiteral
+	rawStringLiteral
 	numberLiteral
 )
 
@@ -86,16 +116,23 @@ type token struct {
 	kind tokKind
 	pos
 	payload string
+	// doc holds the text of any /// doc comments immediately preceding this
+	// token, which the parser attaches to fn and assignment nodes.
+	doc string
 }
 
 func (t token) String() string {
 	switch t.kind {
 	case comment:
 		return fmt.Sprintf("//(%s)", t.payload)
+	case docComment:
+		return fmt.Sprintf("///(%s)", t.payload)
 	case comma:
 		return ","
 	case dot:
 		return "."
+	case optionalDot:
+		return "?."
 	case leftParen:
 		return "("
 	case rightParen:
@@ -136,6 +173,8 @@ func (t token) String() string {
 		return "/"
 	case modulus:
 		return "%"
+	case power:
+		return "**"
 	case xor:
 		return "^"
 	case and:
@@ -170,6 +209,8 @@ func (t token) String() string {
 		return "false"
 	case stringLiteral:
 		return fmt.Sprintf("string(%s)", strconv.Quote(t.payload))
+	case rawStringLiteral:
+		return fmt.Sprintf("rawString(%s)", strconv.Quote(t.payload))
 	case numberLiteral:
 		return fmt.Sprintf("number(%s)", t.payload)
 	default:
@@ -183,45 +224,114 @@ func newTokenizer(sourceString string) tokenizer {
 		index:    0,
 		fileName: "(input)",
 		line:     1,
-		col:      0,
+		col:      1,
 	}
 }
 
+// newReaderTokenizer returns a tokenizer that reads source text from r lazily,
+// as tokens are requested.
+func newReaderTokenizer(r io.Reader) tokenizer {
+	return tokenizer{
+		source:   []rune{},
+		index:    0,
+		reader:   bufio.NewReader(r),
+		fileName: "(input)",
+		line:     1,
+		col:      1,
+	}
+}
+
+// minDiscardRunes is the number of consumed runes a reader-backed tokenizer
+// accumulates before discarding them from its source window.
+const minDiscardRunes = 4096
+
+// fill ensures that the rune at index i is in the source window if it exists,
+// reading more source from the reader as needed. It reports whether the source
+// has a rune at index i.
+func (t *tokenizer) fill(i int) bool {
+	for i-t.base >= len(t.source) {
+		if t.reader == nil {
+			return false
+		}
+
+		// back() may return to t.last, so only runes before it are discarded
+		if discard := t.last.index - t.base; discard >= minDiscardRunes {
+			t.source = append(t.source[:0], t.source[discard:]...)
+			t.base += discard
+		}
+
+		r, _, err := t.reader.ReadRune()
+		if err != nil {
+			if err != io.EOF {
+				t.err = err
+			}
+			t.reader = nil
+			return false
+		}
+		t.source = append(t.source, r)
+	}
+	return true
+}
+
+func (t *tokenizer) at(i int) rune {
+	return t.source[i-t.base]
+}
+
 func (t *tokenizer) currentPos() pos {
 	return pos{
 		fileName: t.fileName,
+		offset:   t.offset,
 		line:     t.line,
 		col:      t.col,
 	}
 }
 
 func (t *tokenizer) isEOF() bool {
-	return t.index == len(t.source)
+	return !t.fill(t.index)
+}
+
+// isCRLF reports whether the source has a CRLF line ending at index i.
+func (t *tokenizer) isCRLF(i int) bool {
+	return t.at(i) == '\r' && t.fill(i+1) && t.at(i+1) == '\n'
 }
 
 func (t *tokenizer) peek() rune {
-	return t.source[t.index]
+	if t.isCRLF(t.index) {
+		return '\n'
+	}
+	return t.at(t.index)
 }
 
 func (t *tokenizer) peekAhead(n int) rune {
-	if t.index+n >= len(t.source) {
+	if !t.fill(t.index + n) {
 		// In Oak, whitespace is insignificant, so we return it as the "nothing
 		// is here" value.
 		return ' '
 	}
-	return t.source[t.index+n]
+	return t.at(t.index + n)
 }
 
 func (t *tokenizer) next() rune {
-	char := t.source[t.index]
+	t.last = tokenizerState{
+		index:  t.index,
+		offset: t.offset,
+		line:   t.line,
+		col:    t.col,
+	}
 
-	if t.index < len(t.source) {
+	// CRLF line endings are read as a single '\n'
+	if t.isCRLF(t.index) {
 		t.index++
+		t.offset++
 	}
 
+	char := t.at(t.index)
+	t.index++
+	t.offset += utf8.RuneLen(char)
+
 	if char == '\n' {
 		t.line++
-		t.col = 0
+		t.col = 1
 	} else {
 		t.col++
 	}
@@ -229,17 +339,13 @@ func (t *tokenizer) next() rune {
 	return char
 }
 
+// back undoes the last call to next(). It may only be called once per call to
+// next().
 func (t *tokenizer) back() {
-	if t.index > 0 {
-		t.index--
-	}
-
-	if t.source[t.index] == '\n' {
-		t.line--
-		// TODO: reset col correctly
-	} else {
-		t.col--
-	}
+	t.index = t.last.index
+	t.offset = t.last.offset
+	t.line = t.last.line
+	t.col = t.last.col
 }
 
 func (t *tokenizer) readUntilRune(c rune) string {
@@ -250,6 +356,28 @@ func (t *tokenizer) readUntilRune(c rune) string {
 	return string(accumulator)
 }
 
+// readBlockComment reads the body of a /* ... */ comment after the opening
+// delimiter, consuming the closing delimiter. Block comments nest, so each /*
+// within the comment must be matched by its own */.
+func (t *tokenizer) readBlockComment() string {
+	depth := 1
+	accumulator := []rune{}
+	for !t.isEOF() {
+		c := t.next()
+		if c == '/' && !t.isEOF() && t.peek() == '*' {
+			depth++
+		} else if c == '*' && !t.isEOF() && t.peek() == '/' {
+			depth--
+			if depth == 0 {
+				t.next()
+				break
+			}
+		}
+		accumulator = append(accumulator, c)
+	}
+	return string(accumulator)
+}
+
 func (t *tokenizer) readValidIdentifier() string {
 	accumulator := []rune{}
 	for {
@@ -258,7 +386,12 @@ func (t *tokenizer) readValidIdentifier() string {
 		}
 
 		c := t.next()
-		if unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '?' || c == '!' {
+		if c == '?' && t.peekAhead(0) == '.' && t.peekAhead(1) != '.' {
+			// a ? followed by a property access is an optional property
+			// access, as in resp?.body, rather than part of the identifier
+			t.back()
+			break
+		} else if unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '?' || c == '!' {
 			accumulator = append(accumulator, c)
 		} else {
 			t.back()
@@ -270,6 +403,7 @@ func (t *tokenizer) readValidIdentifier() string {
 
 func (t *tokenizer) readValidNumeral() string {
 	sawDot := false
+	sawExp := false
 	accumulator := []rune{}
 	for {
 		if t.isEOF() {
@@ -282,6 +416,15 @@ func (t *tokenizer) readValidNumeral() string {
 		} else if c == '.' && !sawDot {
 			sawDot = true
 			accumulator = append(accumulator, c)
+		} else if (c == 'e' || c == 'E') && !sawExp && isExponentStart(t.peekAhead(0), t.peekAhead(1)) {
+			// scientific notation, as in 6.022e23 or 1e-9. No fractional part
+			// may follow the exponent.
+			sawDot = true
+			sawExp = true
+			accumulator = append(accumulator, c)
+			if sign := t.peek(); sign == '+' || sign == '-' {
+				accumulator = append(accumulator, t.next())
+			}
 		} else {
 			t.back()
 			break
@@ -290,107 +433,131 @@ func (t *tokenizer) readValidNumeral() string {
 	return string(accumulator)
 }
 
+// isExponentStart reports whether the two runes following an 'e' in a number
+// literal begin a valid exponent, i.e. a digit optionally preceded by a sign.
+func isExponentStart(c, d rune) bool {
+	return unicode.IsDigit(c) || ((c == '+' || c == '-') && unicode.IsDigit(d))
+}
+
 func (t *tokenizer) nextToken() token {
+	pos := t.currentPos()
 	c := t.next()
 
 	switch c {
 	case ',':
-		return token{kind: comma, pos: t.currentPos()}
+		return token{kind: comma, pos: pos}
 	case '.':
 		if !t.isEOF() && t.peek() == '.' && t.peekAhead(1) == '.' {
-			pos := t.currentPos()
 			t.next()
 			t.next()
 			return token{kind: ellipsis, pos: pos}
 		}
-		return token{kind: dot, pos: t.currentPos()}
+		return token{kind: dot, pos: pos}
 	case '(':
-		return token{kind: leftParen, pos: t.currentPos()}
+		return token{kind: leftParen, pos: pos}
 	case ')':
-		return token{kind: rightParen, pos: t.currentPos()}
+		return token{kind: rightParen, pos: pos}
 	case '[':
-		return token{kind: leftBracket, pos: t.currentPos()}
+		return token{kind: leftBracket, pos: pos}
 	case ']':
-		return token{kind: rightBracket, pos: t.currentPos()}
+		return token{kind: rightBracket, pos: pos}
 	case '{':
-		return token{kind: leftBrace, pos: t.currentPos()}
+		return token{kind: leftBrace, pos: pos}
 	case '}':
-		return token{kind: rightBrace, pos: t.currentPos()}
+		return token{kind: rightBrace, pos: pos}
 	case ':':
 		if !t.isEOF() && t.peek() == '=' {
-			pos := t.currentPos()
 			t.next()
 			return token{kind: assign, pos: pos}
 		}
-		return token{kind: colon, pos: t.currentPos()}
+		return token{kind: colon, pos: pos}
 	case '<':
 		if !t.isEOF() {
 			switch t.peek() {
 			case '<':
 				t.next()
-				return token{kind: pushArrow, pos: t.currentPos()}
+				return token{kind: pushArrow, pos: pos}
 			case '-':
 				t.next()
-				return token{kind: nonlocalAssign, pos: t.currentPos()}
+				return token{kind: nonlocalAssign, pos: pos}
 			case '=':
 				t.next()
-				return token{kind: leq, pos: t.currentPos()}
+				return token{kind: leq, pos: pos}
 			}
 		}
-		return token{kind: less, pos: t.currentPos()}
+		return token{kind: less, pos: pos}
 	case '?':
-		return token{kind: qmark, pos: t.currentPos()}
+		// ?. is optional property access, but ?... spreads a null
+		if !t.isEOF() && t.peek() == '.' && t.peekAhead(1) != '.' {
+			t.next()
+			return token{kind: optionalDot, pos: pos}
+		}
+		return token{kind: qmark, pos: pos}
 	case '!':
 		if !t.isEOF() && t.peek() == '=' {
 			t.next()
-			return token{kind: neq, pos: t.currentPos()}
+			return token{kind: neq, pos: pos}
 		}
-		return token{kind: exclam, pos: t.currentPos()}
+		return token{kind: exclam, pos: pos}
 	case '+':
-		return token{kind: plus, pos: t.currentPos()}
+		return token{kind: plus, pos: pos}
 	case '-':
 		if !t.isEOF() && t.peek() == '>' {
 			t.next()
-			return token{kind: branchArrow, pos: t.currentPos()}
+			return token{kind: branchArrow, pos: pos}
 		}
-		return token{kind: minus, pos: t.currentPos()}
+		return token{kind: minus, pos: pos}
 	case '*':
-		return token{kind: times, pos: t.currentPos()}
+		if !t.isEOF() && t.peek() == '*' {
+			t.next()
+			return token{kind: power, pos: pos}
+		}
+		return token{kind: times, pos: pos}
 	case '/':
 		if !t.isEOF() && t.peek() == '/' {
-			pos := t.currentPos()
 			t.next()
+			kind := comment
+			if !t.isEOF() && t.peek() == '/' && t.peekAhead(1) != '/' {
+				t.next()
+				kind = docComment
+			}
 			commentString := strings.TrimSpace(t.readUntilRune('\n'))
 			return token{
-				kind:    comment,
+				kind:    kind,
 				pos:     pos,
 				payload: commentString,
 			}
 		}
-		return token{kind: divide, pos: t.currentPos()}
+		if !t.isEOF() && t.peek() == '*' {
+			t.next()
+			return token{
+				kind:    comment,
+				pos:     pos,
+				payload: t.readBlockComment(),
+			}
+		}
+		return token{kind: divide, pos: pos}
 	case '%':
-		return token{kind: modulus, pos: t.currentPos()}
+		return token{kind: modulus, pos: pos}
 	case '^':
-		return token{kind: xor, pos: t.currentPos()}
+		return token{kind: xor, pos: pos}
 	case '&':
-		return token{kind: and, pos: t.currentPos()}
+		return token{kind: and, pos: pos}
 	case '|':
 		if !t.isEOF() && t.peek() == '>' {
 			t.next()
-			return token{kind: pipeArrow, pos: t.currentPos()}
+			return token{kind: pipeArrow, pos: pos}
 		}
-		return token{kind: or, pos: t.currentPos()}
+		return token{kind: or, pos: pos}
 	case '>':
 		if !t.isEOF() && t.peek() == '=' {
-			pos := t.currentPos()
 			t.next()
 			return token{kind: geq, pos: pos}
 		}
-		return token{kind: greater, pos: t.currentPos()}
+		return token{kind: greater, pos: pos}
 	case '=':
-		return token{kind: eq, pos: t.currentPos()}
+		return token{kind: eq, pos: pos}
 	case '\'':
-		pos := t.currentPos()
 		payloadBuilder := strings.Builder{}
 		for !t.isEOF() && t.peek() != '\'' {
 			c := t.next()
@@ -418,8 +585,19 @@ func (t *tokenizer) nextToken() token {
 			pos:     pos,
 			payload: payloadBuilder.String(),
 		}
+	case '`':
+		// raw strings take everything up to the closing backtick verbatim,
+		// including backslashes and newlines
+		payload := t.readUntilRune('`')
+		if !t.isEOF() {
+			t.next() // read ending backtick
+		}
+		return token{
+			kind:    rawStringLiteral,
+			pos:     pos,
+			payload: payload,
+		}
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-		pos := t.currentPos()
 		payload := string(c) + t.readValidNumeral()
 		return token{
 			kind:    numberLiteral,
@@ -427,7 +605,6 @@ func (t *tokenizer) nextToken() token {
 			payload: payload,
 		}
 	default:
-		pos := t.currentPos()
 		payload := string(c) + t.readValidIdentifier()
 		switch payload {
 		case "_":
@@ -448,73 +625,145 @@ func (t *tokenizer) nextToken() token {
 	}
 }
 
+// Tokenize reads all of r and returns the Oak tokens in it. Every token
+// records the byte offset, line, and column at which it starts.
+func Tokenize(r io.Reader) ([]token, error) {
+	t := newReaderTokenizer(r)
+	tokens := t.tokenize()
+	if t.err != nil {
+		return nil, t.err
+	}
+	return tokens, nil
+}
+
 func (t *tokenizer) tokenize() []token {
 	tokens := []token{}
 
-	if !t.isEOF() && t.peek() == '#' && t.peekAhead(1) == '!' {
-		// shebang-style ignored line, keep taking until EOL
-		t.readUntilRune('\n')
-		if !t.isEOF() {
-			t.next()
+	stream := newTokenStream(t)
+	for {
+		tok, ok := stream.read()
+		if !ok {
+			break
 		}
+		tokens = append(tokens, tok)
 	}
 
-	// snip whitespace before
-	for !t.isEOF() && unicode.IsSpace(t.peek()) {
-		t.next()
+	return tokens
+}
+
+// tokenStream produces the tokens of a program one at a time, inserting commas
+// and attaching doc comments exactly as tokenize() does, without keeping more
+// than a few tokens in memory.
+type tokenStream struct {
+	t        *tokenizer
+	started  bool
+	done     bool
+	last     token
+	docLines []string
+	pending  []token
+}
+
+func newTokenStream(t *tokenizer) *tokenStream {
+	return &tokenStream{
+		t:    t,
+		last: token{kind: comma},
 	}
+}
 
-	last := token{kind: comma}
-	for !t.isEOF() {
-		next := t.nextToken()
+// read returns the next token in the stream, or false if the stream is
+// exhausted.
+func (s *tokenStream) read() (token, bool) {
+	for len(s.pending) == 0 && !s.done {
+		s.advance()
+	}
+	if len(s.pending) == 0 {
+		return token{}, false
+	}
 
-		if (last.kind != leftParen && last.kind != leftBracket &&
-			last.kind != leftBrace && last.kind != comma) &&
-			(next.kind == rightParen || next.kind == rightBracket ||
-				next.kind == rightBrace) {
-			tokens = append(tokens, token{
-				kind: comma,
-				pos:  t.currentPos(),
-			})
-		}
+	tok := s.pending[0]
+	s.pending = s.pending[1:]
+	return tok, true
+}
 
-		if next.kind == comment {
-			next = last
-		} else {
-			tokens = append(tokens, next)
+// advance reads one token from the source, queueing it along with any commas
+// it implies.
+func (s *tokenStream) advance() {
+	t := s.t
+
+	if !s.started {
+		s.started = true
+
+		if !t.isEOF() && t.peek() == '#' && t.peekAhead(1) == '!' {
+			// shebang-style ignored line, keep taking until EOL
+			t.readUntilRune('\n')
+			if !t.isEOF() {
+				t.next()
+			}
 		}
 
-		// snip whitespace after
+		// snip whitespace before
 		for !t.isEOF() && unicode.IsSpace(t.peek()) {
-			if t.peek() == '\n' {
-				switch next.kind {
-				case comma, leftParen, leftBracket, leftBrace, plus, minus,
-					times, divide, modulus, xor, and, or, exclam, greater, less,
-					eq, geq, leq, assign, nonlocalAssign, dot, colon, fnKeyword,
-					ifKeyword, withKeyword, pipeArrow, branchArrow, pushArrow:
-					// do nothing
-				default:
-					next = token{
-						kind: comma,
-						pos:  t.currentPos(),
-					}
-					tokens = append(tokens, next)
-				}
-			}
 			t.next()
 		}
+	}
 
-		if next.kind != comment {
-			last = next
+	if t.isEOF() {
+		if s.last.kind != comma {
+			s.pending = append(s.pending, token{
+				kind: comma,
+				pos:  t.currentPos(),
+			})
 		}
+		s.done = true
+		return
 	}
 
-	if last.kind != comma {
-		tokens = append(tokens, token{
+	next := t.nextToken()
+
+	if (s.last.kind != leftParen && s.last.kind != leftBracket &&
+		s.last.kind != leftBrace && s.last.kind != comma) &&
+		(next.kind == rightParen || next.kind == rightBracket ||
+			next.kind == rightBrace) {
+		s.pending = append(s.pending, token{
 			kind: comma,
 			pos:  t.currentPos(),
 		})
 	}
 
-	return tokens
+	if next.kind == comment {
+		next = s.last
+	} else if next.kind == docComment {
+		s.docLines = append(s.docLines, next.payload)
+		next = s.last
+	} else {
+		if len(s.docLines) > 0 {
+			next.doc = strings.Join(s.docLines, "\n")
+			s.docLines = s.docLines[:0]
+		}
+		s.pending = append(s.pending, next)
+	}
+
+	// snip whitespace after
+	for !t.isEOF() && unicode.IsSpace(t.peek()) {
+		if t.peek() == '\n' {
+			switch next.kind {
+			case comma, leftParen, leftBracket, leftBrace, plus, minus,
+				times, divide, modulus, power, xor, and, or, exclam, greater, less,
+				eq, geq, leq, assign, nonlocalAssign, dot, optionalDot, colon, fnKeyword,
+				ifKeyword, withKeyword, pipeArrow, branchArrow, pushArrow:
+				// do nothing
+			default:
+				next = token{
+					kind: comma,
+					pos:  t.currentPos(),
+				}
+				s.pending = append(s.pending, next)
+			}
+		}
+		t.next()
+	}
+
+	if next.kind != comment {
+		s.last = next
+	}
 }
@@ -0,0 +1,894 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// TOML parsing and serialization, for the toml standard library.
+//
+// TOML documents parse to Oak objects. Dates and times, which Oak has no type
+// for, parse to strings as they are written in the document. Oak values
+// serialize to TOML with nested objects as tables, and lists of objects as
+// arrays of tables. TOML has no null value, so null object entries are left
+// out of serialized documents.
+
+var (
+	tomlBareKey  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	tomlDateTime = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})?([Tt ]?\d{2}:\d{2}:\d{2}(\.\d+)?([Zz]|[+-]\d{2}:\d{2})?)?$`)
+	tomlDecimal  = regexp.MustCompile(`^[+-]?(0|[1-9](_?\d)*)$`)
+	tomlFloat    = regexp.MustCompile(`^[+-]?(0|[1-9](_?\d)*)(\.\d(_?\d)*)?([eE][+-]?\d(_?\d)*)?$`)
+)
+
+type tomlParser struct {
+	s string
+	i int
+
+	// defined holds tables that can't be defined again with a header, and
+	// frozen holds inline tables, which can't be extended at all
+	defined map[uintptr]bool
+	frozen  map[uintptr]bool
+	// tableArrays holds arrays of tables defined with [[headers]]
+	tableArrays map[*ListValue]bool
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) *runtimeError {
+	line := strings.Count(p.s[:p.i], "\n") + 1
+	return &runtimeError{
+		kind:   "valueError",
+		reason: fmt.Sprintf("Invalid TOML at line %d: ", line) + fmt.Sprintf(format, args...),
+	}
+}
+
+func (p *tomlParser) peek() byte {
+	if p.i < len(p.s) {
+		return p.s[p.i]
+	}
+	return 0
+}
+
+func (p *tomlParser) skipSpace() {
+	for p.i < len(p.s) && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+// skipLines skips whitespace, comments, and newlines.
+func (p *tomlParser) skipLines() {
+	for p.i < len(p.s) {
+		switch p.s[p.i] {
+		case ' ', '\t', '\r', '\n':
+			p.i++
+		case '#':
+			for p.i < len(p.s) && p.s[p.i] != '\n' {
+				p.i++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// endLine consumes the rest of a line after a key/value pair or header, which
+// may only hold whitespace and a comment.
+func (p *tomlParser) endLine() *runtimeError {
+	p.skipSpace()
+	if p.peek() == '#' {
+		for p.i < len(p.s) && p.s[p.i] != '\n' {
+			p.i++
+		}
+	}
+	if strings.HasPrefix(p.s[p.i:], "\r\n") {
+		p.i += 2
+		return nil
+	}
+	if p.i == len(p.s) {
+		return nil
+	}
+	if p.s[p.i] == '\n' {
+		p.i++
+		return nil
+	}
+	return p.errorf("expected end of line, found %q", p.s[p.i])
+}
+
+func (p *tomlParser) key() ([]string, *runtimeError) {
+	var parts []string
+	for {
+		p.skipSpace()
+		switch p.peek() {
+		case '"':
+			s, err := p.basicString()
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, s)
+		case '\'':
+			s, err := p.literalString()
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, s)
+		default:
+			start := p.i
+			for p.i < len(p.s) && tomlBareKey.MatchString(p.s[p.i:p.i+1]) {
+				p.i++
+			}
+			if p.i == start {
+				return nil, p.errorf("expected a key")
+			}
+			parts = append(parts, p.s[start:p.i])
+		}
+
+		p.skipSpace()
+		if p.peek() != '.' {
+			return parts, nil
+		}
+		p.i++
+	}
+}
+
+func (p *tomlParser) escape() (string, *runtimeError) {
+	p.i++ // backslash
+	if p.i >= len(p.s) {
+		return "", p.errorf("unterminated string")
+	}
+	c := p.s[p.i]
+	p.i++
+	switch c {
+	case 'b':
+		return "\b", nil
+	case 't':
+		return "\t", nil
+	case 'n':
+		return "\n", nil
+	case 'f':
+		return "\f", nil
+	case 'r':
+		return "\r", nil
+	case 'e':
+		return "\x1b", nil
+	case '"':
+		return "\"", nil
+	case '\\':
+		return "\\", nil
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if p.i+size > len(p.s) {
+			return "", p.errorf("invalid unicode escape")
+		}
+		n, err := strconv.ParseUint(p.s[p.i:p.i+size], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(n)) {
+			return "", p.errorf("invalid unicode escape")
+		}
+		p.i += size
+		return string(rune(n)), nil
+	}
+	p.i--
+	return "", p.errorf("invalid escape \\%c", c)
+}
+
+func (p *tomlParser) basicString() (string, *runtimeError) {
+	if strings.HasPrefix(p.s[p.i:], `"""`) {
+		return p.multilineBasicString()
+	}
+
+	p.i++
+	var b strings.Builder
+	for {
+		if p.i >= len(p.s) || p.s[p.i] == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		switch p.s[p.i] {
+		case '"':
+			p.i++
+			return b.String(), nil
+		case '\\':
+			s, err := p.escape()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(s)
+		default:
+			b.WriteByte(p.s[p.i])
+			p.i++
+		}
+	}
+}
+
+func (p *tomlParser) multilineBasicString() (string, *runtimeError) {
+	p.i += 3
+	p.trimNewline()
+
+	var b strings.Builder
+	for {
+		if p.i >= len(p.s) {
+			return "", p.errorf("unterminated string")
+		}
+		if strings.HasPrefix(p.s[p.i:], `"""`) {
+			// up to two quotes may precede the closing delimiter
+			for n := 0; n < 2 && strings.HasPrefix(p.s[p.i+1:], `"""`); n++ {
+				b.WriteByte('"')
+				p.i++
+			}
+			p.i += 3
+			return b.String(), nil
+		}
+
+		if p.s[p.i] != '\\' {
+			b.WriteByte(p.s[p.i])
+			p.i++
+			continue
+		}
+
+		// a backslash at the end of a line trims all following whitespace
+		j := p.i + 1
+		for j < len(p.s) && (p.s[j] == ' ' || p.s[j] == '\t') {
+			j++
+		}
+		if j < len(p.s) && (p.s[j] == '\n' || strings.HasPrefix(p.s[j:], "\r\n")) {
+			p.i = j
+			for p.i < len(p.s) && strings.ContainsRune(" \t\r\n", rune(p.s[p.i])) {
+				p.i++
+			}
+			continue
+		}
+
+		s, err := p.escape()
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(s)
+	}
+}
+
+func (p *tomlParser) literalString() (string, *runtimeError) {
+	if strings.HasPrefix(p.s[p.i:], "'''") {
+		p.i += 3
+		p.trimNewline()
+
+		end := strings.Index(p.s[p.i:], "'''")
+		if end < 0 {
+			return "", p.errorf("unterminated string")
+		}
+		// up to two quotes may precede the closing delimiter
+		for n := 0; n < 2 && strings.HasPrefix(p.s[p.i+end+1:], "'''"); n++ {
+			end++
+		}
+		s := p.s[p.i : p.i+end]
+		p.i += end + 3
+		return s, nil
+	}
+
+	p.i++
+	end := strings.IndexAny(p.s[p.i:], "'\n")
+	if end < 0 || p.s[p.i+end] != '\'' {
+		return "", p.errorf("unterminated string")
+	}
+	s := p.s[p.i : p.i+end]
+	p.i += end + 1
+	return s, nil
+}
+
+// trimNewline skips a newline immediately following the opening delimiter of
+// a multi-line string.
+func (p *tomlParser) trimNewline() {
+	if strings.HasPrefix(p.s[p.i:], "\r\n") {
+		p.i += 2
+	} else if p.peek() == '\n' {
+		p.i++
+	}
+}
+
+func (p *tomlParser) value() (Value, *runtimeError) {
+	switch p.peek() {
+	case '"':
+		s, err := p.basicString()
+		if err != nil {
+			return nil, err
+		}
+		return MakeString(s), nil
+	case '\'':
+		s, err := p.literalString()
+		if err != nil {
+			return nil, err
+		}
+		return MakeString(s), nil
+	case '[':
+		return p.array()
+	case '{':
+		return p.inlineTable()
+	}
+
+	start := p.i
+	for p.i < len(p.s) && strings.IndexByte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_+-.:", p.s[p.i]) >= 0 {
+		p.i++
+	}
+	// a date and time may be separated by a space
+	if p.i-start == 10 && strings.HasPrefix(p.s[p.i:], " ") && p.i+3 < len(p.s) &&
+		p.s[p.i+1] >= '0' && p.s[p.i+1] <= '9' && p.s[p.i+3] == ':' {
+		p.i++
+		for p.i < len(p.s) && strings.IndexByte("0123456789:.+-Zz", p.s[p.i]) >= 0 {
+			p.i++
+		}
+	}
+	token := p.s[start:p.i]
+
+	switch token {
+	case "":
+		return nil, p.errorf("expected a value")
+	case "true":
+		return oakTrue, nil
+	case "false":
+		return oakFalse, nil
+	case "inf", "+inf":
+		return FloatValue(math.Inf(1)), nil
+	case "-inf":
+		return FloatValue(math.Inf(-1)), nil
+	case "nan", "+nan", "-nan":
+		return FloatValue(math.NaN()), nil
+	}
+
+	if len(token) > 2 && token[0] == '0' && strings.IndexByte("xob", token[1]) >= 0 {
+		base := map[byte]int{'x': 16, 'o': 8, 'b': 2}[token[1]]
+		digits := token[2:]
+		if digits[0] == '_' || digits[len(digits)-1] == '_' || strings.Contains(digits, "__") {
+			return nil, p.errorf("invalid number %s", token)
+		}
+		n, err := strconv.ParseInt(strings.ReplaceAll(digits, "_", ""), base, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", token)
+		}
+		return IntValue(n), nil
+	}
+	if tomlDecimal.MatchString(token) {
+		n, err := strconv.ParseInt(strings.ReplaceAll(token, "_", ""), 10, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", token)
+		}
+		return IntValue(n), nil
+	}
+	if tomlFloat.MatchString(token) {
+		f, err := strconv.ParseFloat(strings.ReplaceAll(token, "_", ""), 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", token)
+		}
+		return FloatValue(f), nil
+	}
+	if strings.ContainsAny(token, ":-") && tomlDateTime.MatchString(token) {
+		return MakeString(token), nil
+	}
+	return nil, p.errorf("invalid value %s", token)
+}
+
+func (p *tomlParser) array() (Value, *runtimeError) {
+	p.i++
+	elems := []Value{}
+	for {
+		p.skipLines()
+		if p.peek() == ']' {
+			p.i++
+			break
+		}
+
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, v)
+
+		p.skipLines()
+		if p.peek() == ',' {
+			p.i++
+		} else if p.peek() != ']' {
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+
+	return MakeList(elems...), nil
+}
+
+func (p *tomlParser) inlineTable() (Value, *runtimeError) {
+	p.i++
+	obj := ObjectValue{}
+	p.skipSpace()
+	if p.peek() == '}' {
+		p.i++
+		p.freeze(obj)
+		return obj, nil
+	}
+
+	for {
+		if err := p.keyValue(obj); err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.peek() == '}' {
+			p.i++
+			break
+		}
+		if p.peek() != ',' {
+			return nil, p.errorf("expected , or } in inline table")
+		}
+		p.i++
+	}
+
+	p.freeze(obj)
+	return obj, nil
+}
+
+// freeze marks an inline table and the tables defined within it with dotted
+// keys as not extensible.
+func (p *tomlParser) freeze(obj ObjectValue) {
+	p.frozen[reflectID(obj)] = true
+	for _, v := range obj {
+		if o, ok := v.(ObjectValue); ok {
+			p.freeze(o)
+		}
+	}
+}
+
+// keyValue parses a key/value pair into the table obj.
+func (p *tomlParser) keyValue(obj ObjectValue) *runtimeError {
+	start := p.i
+	key, err := p.key()
+	if err != nil {
+		return err
+	}
+	if p.peek() != '=' {
+		return p.errorf("expected = after key")
+	}
+	p.i++
+	p.skipSpace()
+
+	v, err := p.value()
+	if err != nil {
+		return err
+	}
+
+	for _, part := range key[:len(key)-1] {
+		next, ok := obj[part]
+		if !ok {
+			next = ObjectValue{}
+			obj[part] = next
+			p.defined[reflectID(next)] = true
+		}
+		nextObj, ok := next.(ObjectValue)
+		if !ok || p.frozen[reflectID(nextObj)] {
+			p.i = start
+			return p.errorf("cannot redefine key %s", strings.Join(key, "."))
+		}
+		obj = nextObj
+	}
+
+	last := key[len(key)-1]
+	if _, ok := obj[last]; ok {
+		p.i = start
+		return p.errorf("cannot redefine key %s", strings.Join(key, "."))
+	}
+	obj[last] = v
+	return nil
+}
+
+// table parses a [table] or [[array of tables]] header, and returns the table
+// it defines.
+func (p *tomlParser) table(root ObjectValue) (ObjectValue, *runtimeError) {
+	start := p.i
+	isArray := strings.HasPrefix(p.s[p.i:], "[[")
+	if isArray {
+		p.i += 2
+	} else {
+		p.i++
+	}
+
+	key, err := p.key()
+	if err != nil {
+		return nil, err
+	}
+	if isArray {
+		if !strings.HasPrefix(p.s[p.i:], "]]") {
+			return nil, p.errorf("expected ]] after table name")
+		}
+		p.i += 2
+	} else {
+		if p.peek() != ']' {
+			return nil, p.errorf("expected ] after table name")
+		}
+		p.i++
+	}
+	if err := p.endLine(); err != nil {
+		return nil, err
+	}
+
+	redefined := func() (ObjectValue, *runtimeError) {
+		p.i = start
+		return nil, p.errorf("cannot redefine table %s", strings.Join(key, "."))
+	}
+
+	obj := root
+	for _, part := range key[:len(key)-1] {
+		switch next := obj[part].(type) {
+		case nil:
+			nextObj := ObjectValue{}
+			obj[part] = nextObj
+			obj = nextObj
+		case ObjectValue:
+			if p.frozen[reflectID(next)] {
+				return redefined()
+			}
+			obj = next
+		case *ListValue:
+			if !p.tableArrays[next] {
+				return redefined()
+			}
+			obj = next.elems[len(next.elems)-1].(ObjectValue)
+		default:
+			return redefined()
+		}
+	}
+
+	last := key[len(key)-1]
+	table := ObjectValue{}
+	if isArray {
+		switch existing := obj[last].(type) {
+		case nil:
+			list := MakeList(table)
+			p.tableArrays[list] = true
+			obj[last] = list
+		case *ListValue:
+			if !p.tableArrays[existing] {
+				return redefined()
+			}
+			existing.elems = append(existing.elems, table)
+		default:
+			return redefined()
+		}
+		return table, nil
+	}
+
+	switch existing := obj[last].(type) {
+	case nil:
+		obj[last] = table
+	case ObjectValue:
+		if p.defined[reflectID(existing)] || p.frozen[reflectID(existing)] {
+			return redefined()
+		}
+		table = existing
+	default:
+		return redefined()
+	}
+	p.defined[reflectID(table)] = true
+	return table, nil
+}
+
+func (p *tomlParser) document() (ObjectValue, *runtimeError) {
+	root := ObjectValue{}
+	table := root
+	for {
+		p.skipLines()
+		if p.i >= len(p.s) {
+			return root, nil
+		}
+
+		if p.peek() == '[' {
+			var err *runtimeError
+			if table, err = p.table(root); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err := p.keyValue(table); err != nil {
+			return nil, err
+		}
+		if err := p.endLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func reflectID(v Value) uintptr {
+	id, _ := containerID(v)
+	return id
+}
+
+func tomlKey(key string) string {
+	if tomlBareKey.MatchString(key) {
+		return key
+	}
+	return tomlString(key)
+}
+
+func tomlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func tomlFloatString(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+type tomlSerializer struct {
+	b       strings.Builder
+	parents map[uintptr]bool
+}
+
+func (t *tomlSerializer) enter(v Value) (func(), *runtimeError) {
+	id, _ := containerID(v)
+	if t.parents[id] {
+		return nil, &runtimeError{
+			kind:   "valueError",
+			reason: "Cannot serialize a value that contains itself",
+		}
+	}
+	t.parents[id] = true
+	return func() { delete(t.parents, id) }, nil
+}
+
+// inline returns a value written within a line, with objects as inline tables.
+func (t *tomlSerializer) inline(v Value) (string, *runtimeError) {
+	switch val := v.(type) {
+	case BoolValue:
+		return val.String(), nil
+	case IntValue:
+		return val.String(), nil
+	case FloatValue:
+		return tomlFloatString(float64(val)), nil
+	case *StringValue:
+		if !utf8.ValidString(string(*val)) {
+			return "", &runtimeError{
+				kind:   "valueError",
+				reason: "Cannot serialize a string that is not valid UTF-8 to TOML",
+			}
+		}
+		return tomlString(string(*val)), nil
+	case AtomValue:
+		return tomlString(string(val)), nil
+	case numArray:
+		return t.inline(val.list())
+	case *ListValue:
+		exit, err := t.enter(val)
+		if err != nil {
+			return "", err
+		}
+		defer exit()
+
+		elems := make([]string, len(val.elems))
+		for i, el := range val.elems {
+			if elems[i], err = t.inline(el); err != nil {
+				return "", err
+			}
+		}
+		return "[" + strings.Join(elems, ", ") + "]", nil
+	case ObjectValue:
+		exit, err := t.enter(val)
+		if err != nil {
+			return "", err
+		}
+		defer exit()
+
+		var entries []string
+		for _, key := range sortedKeys(val) {
+			el := val[key]
+			if isNullish(el) {
+				continue
+			}
+			s, err := t.inline(el)
+			if err != nil {
+				return "", err
+			}
+			entries = append(entries, tomlKey(key)+" = "+s)
+		}
+		if len(entries) == 0 {
+			return "{}", nil
+		}
+		return "{ " + strings.Join(entries, ", ") + " }", nil
+	}
+
+	return "", &runtimeError{
+		kind:   "typeError",
+		reason: fmt.Sprintf("Cannot serialize %s to TOML", v),
+	}
+}
+
+// tableArray returns the elements of v if it is a list of objects, which
+// serializes as an array of tables.
+func tableArray(v Value) ([]Value, bool) {
+	list, ok := v.(*ListValue)
+	if !ok || len(list.elems) == 0 {
+		return nil, false
+	}
+	for _, el := range list.elems {
+		if _, ok := el.(ObjectValue); !ok {
+			return nil, false
+		}
+	}
+	return list.elems, true
+}
+
+// table writes the entries of a table after its header, followed by its
+// subtables.
+func (t *tomlSerializer) table(path []string, obj ObjectValue) *runtimeError {
+	exit, err := t.enter(obj)
+	if err != nil {
+		return err
+	}
+	defer exit()
+
+	keys := sortedKeys(obj)
+	for _, key := range keys {
+		v := obj[key]
+		if _, ok := v.(ObjectValue); ok || isNullish(v) {
+			continue
+		}
+		if _, ok := tableArray(v); ok {
+			continue
+		}
+
+		s, err := t.inline(v)
+		if err != nil {
+			return err
+		}
+		t.b.WriteString(tomlKey(key) + " = " + s + "\n")
+	}
+
+	for _, key := range keys {
+		subpath := append(append([]string{}, path...), tomlKey(key))
+		switch v := obj[key].(type) {
+		case ObjectValue:
+			if tomlNeedsHeader(v) {
+				if t.b.Len() > 0 {
+					t.b.WriteByte('\n')
+				}
+				t.b.WriteString("[" + strings.Join(subpath, ".") + "]\n")
+			}
+			if err := t.table(subpath, v); err != nil {
+				return err
+			}
+		default:
+			elems, ok := tableArray(v)
+			if !ok {
+				continue
+			}
+			for _, el := range elems {
+				if t.b.Len() > 0 {
+					t.b.WriteByte('\n')
+				}
+				t.b.WriteString("[[" + strings.Join(subpath, ".") + "]]\n")
+				if err := t.table(subpath, el.(ObjectValue)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// tomlNeedsHeader reports whether a table must have a header, because it has
+// entries of its own or no subtables whose headers would define it.
+func tomlNeedsHeader(obj ObjectValue) bool {
+	hasSubtables := false
+	for _, v := range obj {
+		_, isTable := v.(ObjectValue)
+		_, isTableArray := tableArray(v)
+		switch {
+		case isTable || isTableArray:
+			hasSubtables = true
+		case !isNullish(v):
+			return true
+		}
+	}
+	return !hasSubtables
+}
+
+func sortedKeys(obj ObjectValue) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isNullish(v Value) bool {
+	switch v.(type) {
+	case NullValue, EmptyValue:
+		return true
+	}
+	return false
+}
+
+func (c *Context) oakTomlParse(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___toml_parse", args, 1); err != nil {
+		return nil, err
+	}
+
+	s, ok := args[0].(*StringValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___toml_parse(%s)", args[0]),
+		}
+	}
+
+	p := tomlParser{
+		s:           string(*s),
+		defined:     map[uintptr]bool{},
+		frozen:      map[uintptr]bool{},
+		tableArrays: map[*ListValue]bool{},
+	}
+	doc, err := p.document()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.allocValue(doc, map[uintptr]bool{}); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (c *Context) oakTomlSerialize(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___toml_serialize", args, 1); err != nil {
+		return nil, err
+	}
+
+	obj, ok := args[0].(ObjectValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___toml_serialize(%s)", args[0]),
+		}
+	}
+
+	t := tomlSerializer{parents: map[uintptr]bool{}}
+	if err := t.table(nil, obj); err != nil {
+		return nil, err
+	}
+	s := t.b.String()
+	if err := c.allocString(len(s), len(s)); err != nil {
+		return nil, err
+	}
+	return MakeString(s), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Tracing prints a line when each call to an Oak function starts and when it
+// returns, indented by the depth of the call, for debugging with oak --trace.
+// A tail call replaces the call that made it, so it's printed at the same depth
+// and only the last call in a chain of tail calls prints its return.
+
+// traceValueLen is the most characters of each argument or return value that
+// a trace prints.
+const traceValueLen = 60
+
+type tracer struct {
+	out io.Writer
+	// pattern, if set, selects the names of functions to trace
+	pattern *regexp.Regexp
+}
+
+// SetTrace traces function calls in this context, and in every context that
+// shares its interpreter, to out. If pattern is not nil, only calls to named
+// functions whose names match it are traced.
+func (c *Context) SetTrace(out io.Writer, pattern *regexp.Regexp) {
+	c.eng.trace = &tracer{out: out, pattern: pattern}
+}
+
+func traceValue(v Value) string {
+	s := []rune(v.String())
+	if len(s) > traceValueLen {
+		return string(s[:traceValueLen-3]) + "..."
+	}
+	return string(s)
+}
+
+// traceEnter prints the start of the call in thunk, and returns its
+// description, or "" if the function is not traced.
+func (c *Context) traceEnter(thunk thunkValue) string {
+	t := c.eng.trace
+	name := thunk.defn.name
+	if t.pattern != nil && (name == "" || !t.pattern.MatchString(name)) {
+		return ""
+	}
+	if name == "" {
+		name = "fn " + thunk.defn.pos().String()
+	}
+
+	args := make([]string, 0, len(thunk.defn.args)+1)
+	for _, argName := range thunk.defn.args {
+		if argName == "" {
+			args = append(args, "_")
+			continue
+		}
+		arg, _ := thunk.scope.get(argName)
+		args = append(args, traceValue(arg))
+	}
+	if thunk.defn.restArg != "" {
+		rest, _ := thunk.scope.get(thunk.defn.restArg)
+		if list, ok := rest.(*ListValue); ok {
+			for _, arg := range list.elems {
+				args = append(args, traceValue(arg))
+			}
+		}
+	}
+
+	call := name + "(" + strings.Join(args, ", ") + ")"
+	c.traceLine("> " + call)
+	return call
+}
+
+// traceExit prints the return of a call described by traceEnter.
+func (c *Context) traceExit(call string, v Value) {
+	c.traceLine("< " + call + " = " + traceValue(v))
+}
+
+func (c *Context) traceLine(line string) {
+	depth := c.eng.callDepth - 1
+	if depth < 0 {
+		depth = 0
+	}
+	io.WriteString(c.eng.trace.out, strings.Repeat("  ", depth)+line+"\n")
+}
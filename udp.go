@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// UDP sockets, with udpListen() receiving datagrams and udpSend() sending them.
+
+// maxDatagramSize is the largest payload of a UDP datagram over IPv4.
+const maxDatagramSize = 65507
+
+func (c *Context) oakUDPListen(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("udpListen", args, 2); err != nil {
+		return nil, err
+	}
+
+	addr, ok1 := args[0].(*StringValue)
+	cb, ok2 := args[1].(FnValue)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call udpListen(%s, %s)", args[0], args[1]),
+		}
+	}
+
+	conn, err := net.ListenPacket("udp", addr.stringContent())
+	if err != nil {
+		return errObj(fmt.Sprintf("Could not listen in udpListen(): %s", err.Error())), nil
+	}
+
+	var closeOnce sync.Once
+	stopped := make(chan struct{})
+
+	// like a server started by listen(), an open socket keeps the program
+	// running until it's closed
+	c.eng.Add(1)
+	go func() {
+		defer c.eng.Done()
+
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				select {
+				case <-stopped:
+				default:
+					c.Lock()
+					_, err := c.EvalFnValue(cb, false, errObj(fmt.Sprintf("Error reading from socket in udpListen(): %s", err.Error())))
+					c.Unlock()
+					if err != nil {
+						c.eng.reportErr(err)
+					}
+				}
+				return
+			}
+
+			c.Lock()
+			_, evalErr := c.EvalFnValue(cb, false, ObjectValue{
+				"type": AtomValue("data"),
+				"data": MakeString(string(buf[:n])),
+				"addr": MakeString(from.String()),
+				"reply": BuiltinFnValue{
+					name: "reply",
+					fn: func(args []Value) (Value, *runtimeError) {
+						if err := c.requireArgLen("reply", args, 1); err != nil {
+							return nil, err
+						}
+						data, ok := args[0].(*StringValue)
+						if !ok {
+							return nil, &runtimeError{
+								kind:   "typeError",
+								reason: fmt.Sprintf("Mismatched types in call reply(%s)", args[0]),
+							}
+						}
+
+						n, err := conn.WriteTo(*data, from)
+						if err != nil {
+							return nil, &runtimeError{
+								kind:   "ioError",
+								reason: fmt.Sprintf("Could not reply to %s: %s", from, err.Error()),
+							}
+						}
+						return IntValue(n), nil
+					},
+				},
+			})
+			c.Unlock()
+			if evalErr != nil {
+				c.eng.reportErr(evalErr)
+			}
+		}
+	}()
+
+	return BuiltinFnValue{
+		name: "close",
+		fn: func(_ []Value) (Value, *runtimeError) {
+			closeOnce.Do(func() {
+				close(stopped)
+				conn.Close()
+			})
+			return null, nil
+		},
+	}, nil
+}
+
+func (c *Context) oakUDPSend(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("udpSend", args, 2); err != nil {
+		return nil, err
+	}
+
+	addr, ok1 := args[0].(*StringValue)
+	data, ok2 := args[1].(*StringValue)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call udpSend(%s, %s)", args[0], args[1]),
+		}
+	}
+
+	conn, err := net.Dial("udp", addr.stringContent())
+	if err != nil {
+		return errObj(fmt.Sprintf("Could not send in udpSend(): %s", err.Error())), nil
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(*data); err != nil {
+		return errObj(fmt.Sprintf("Could not send in udpSend(): %s", err.Error())), nil
+	}
+
+	return ObjectValue{
+		"type": AtomValue("end"),
+	}, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// walker holds the state of a call to walk().
+type walker struct {
+	c      *Context
+	cb     Value
+	hidden bool
+	follow bool
+	// visited holds the real paths of the directories walked so far when
+	// following symlinks, so that symlink cycles are walked only once
+	visited map[string]bool
+}
+
+func walkEntryType(mode fs.FileMode) AtomValue {
+	switch {
+	case mode.IsDir():
+		return AtomValue("dir")
+	case mode.IsRegular():
+		return AtomValue("file")
+	case mode&fs.ModeSymlink != 0:
+		return AtomValue("symlink")
+	}
+	return AtomValue("other")
+}
+
+// dir walks the entries of a directory, and reports whether the walk was
+// stopped by the callback.
+func (w *walker) dir(dirPath string) (bool, *runtimeError) {
+	if w.follow {
+		real, err := filepath.EvalSymlinks(dirPath)
+		if err != nil || w.visited[real] {
+			return false, nil
+		}
+		w.visited[real] = true
+	}
+
+	// directories under the root that can't be read are skipped
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return false, nil
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !w.hidden && strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		entryPath := filepath.Join(dirPath, name)
+		info, err := os.Lstat(entryPath)
+		if err != nil {
+			continue
+		}
+		if w.follow && info.Mode()&fs.ModeSymlink != 0 {
+			// broken symlinks are reported as symlinks
+			if target, err := os.Stat(entryPath); err == nil {
+				info = target
+			}
+		}
+
+		result, rtErr := w.c.EvalFnValue(w.cb, false, ObjectValue{
+			"path": MakeString(entryPath),
+			"name": MakeString(name),
+			"type": walkEntryType(info.Mode()),
+			"len":  IntValue(info.Size()),
+			"mod":  IntValue(info.ModTime().Unix()),
+		})
+		if rtErr != nil {
+			return false, rtErr
+		}
+
+		switch result {
+		case AtomValue("stop"):
+			return true, nil
+		case AtomValue("skip"):
+			continue
+		}
+		if info.IsDir() {
+			if stopped, rtErr := w.dir(entryPath); stopped || rtErr != nil {
+				return stopped, rtErr
+			}
+		}
+	}
+	return false, nil
+}
+
+func (c *Context) oakWalk(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("walk", args, 2); err != nil {
+		return nil, err
+	}
+
+	// options arg is optional
+	options := ObjectValue{}
+	if len(args) > 2 {
+		opts, ok := args[1].(ObjectValue)
+		if !ok {
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Mismatched types in call walk(%s, %s, %s)", args[0], args[1], args[2]),
+			}
+		}
+		options = opts
+		args = []Value{args[0], args[2]}
+	}
+
+	root, ok1 := args[0].(*StringValue)
+	_, ok2 := args[1].(FnValue)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call walk(%s, %s)", args[0], args[1]),
+		}
+	}
+
+	w := walker{
+		c:       c,
+		cb:      args[1],
+		hidden:  options["hidden"] != oakFalse,
+		follow:  options["follow"] == oakTrue,
+		visited: map[string]bool{},
+	}
+
+	rootPath := root.stringContent()
+	if info, err := os.Stat(rootPath); err != nil || !info.IsDir() {
+		if err == nil {
+			return errObj(fmt.Sprintf("Could not walk %s: not a directory", rootPath)), nil
+		}
+		return errObj(fmt.Sprintf("Could not walk %s: %s", rootPath, err.Error())), nil
+	}
+
+	if _, err := w.dir(rootPath); err != nil {
+		return nil, err
+	}
+	return ObjectValue{
+		"type": AtomValue("end"),
+	}, nil
+}
@@ -0,0 +1,236 @@
+//go:build js && wasm
+// +build js,wasm
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall/js"
+)
+
+// The Oak interpreter compiled to WebAssembly, with GOOS=js GOARCH=wasm, and
+// loaded with the wasm_exec.js that comes with Go. It defines a global Oak
+// object for JavaScript hosts:
+//
+//	Oak.eval(source)        runs a program, and returns a Promise of the value
+//	                        of its last expression once it's finished
+//	Oak.register(name, fn)  defines a builtin that calls a JavaScript function,
+//	                        and returns false if fn isn't a function
+//	Oak.onStdout(fn)        calls fn(text) with output, instead of the console
+//	Oak.onStderr(fn)        the same, for standard error
+//
+// Values passed between Oak and JavaScript are converted to their closest
+// counterparts, so that atoms become strings and ? becomes null. Functions
+// can't be passed to JavaScript, and become their string representations.
+// See interop_js.go for the JavaScript objects used by the dom library.
+
+// hostFns holds the JavaScript functions registered with Oak.register.
+var (
+	hostFns     = map[string]js.Value{}
+	hostFnsLock sync.Mutex
+)
+
+// jsWriter writes output to a JavaScript callback.
+type jsWriter struct {
+	fn js.Value
+}
+
+func (w jsWriter) Write(p []byte) (int, error) {
+	w.fn.Invoke(string(p))
+	return len(p), nil
+}
+
+func valueToJS(v Value, parents map[uintptr]bool) interface{} {
+	if id, ok := containerID(v); ok {
+		if parents[id] {
+			return nil
+		}
+		parents[id] = true
+		defer delete(parents, id)
+	}
+
+	switch val := v.(type) {
+	case NullValue, EmptyValue:
+		return nil
+	case BoolValue:
+		return bool(val)
+	case IntValue:
+		return int64(val)
+	case FloatValue:
+		return float64(val)
+	case *StringValue:
+		return string(*val)
+	case AtomValue:
+		return string(val)
+	case *IntArrayValue:
+		arr := make([]interface{}, len(*val))
+		for i, n := range *val {
+			arr[i] = n
+		}
+		return arr
+	case *FloatArrayValue:
+		arr := make([]interface{}, len(*val))
+		for i, n := range *val {
+			arr[i] = n
+		}
+		return arr
+	case *ListValue:
+		arr := make([]interface{}, len(val.elems))
+		for i, el := range val.elems {
+			arr[i] = valueToJS(el, parents)
+		}
+		return arr
+	case ObjectValue:
+		obj := make(map[string]interface{}, len(val))
+		for key, el := range val {
+			obj[key] = valueToJS(el, parents)
+		}
+		return obj
+	case jsValue:
+		return val.v
+	}
+	return v.String()
+}
+
+func jsToValue(v js.Value) Value {
+	switch v.Type() {
+	case js.TypeBoolean:
+		return BoolValue(v.Bool())
+	case js.TypeNumber:
+		f := v.Float()
+		if f == float64(int64(f)) {
+			return IntValue(int64(f))
+		}
+		return FloatValue(f)
+	case js.TypeString:
+		return MakeString(v.String())
+	case js.TypeObject:
+		if js.Global().Get("Array").Call("isArray", v).Bool() {
+			elems := make([]Value, v.Length())
+			for i := range elems {
+				elems[i] = jsToValue(v.Index(i))
+			}
+			return MakeList(elems...)
+		}
+		obj := ObjectValue{}
+		keys := js.Global().Get("Object").Call("keys", v)
+		for i := 0; i < keys.Length(); i++ {
+			key := keys.Index(i).String()
+			obj[key] = jsToValue(v.Get(key))
+		}
+		return obj
+	}
+	return null
+}
+
+// hostBuiltin returns a builtin that calls a JavaScript function with its
+// arguments, and returns what it returns. Exceptions thrown by the function
+// are raised in Oak as hostErrors.
+func (c *Context) hostBuiltin(name string, fn js.Value) builtinFn {
+	return func(args []Value) (Value, *runtimeError) {
+		jsArgs := make([]interface{}, len(args))
+		for i, arg := range args {
+			jsArgs[i] = valueToJS(arg, map[uintptr]bool{})
+		}
+		result, err := c.jsInvoke("host function "+name, func() js.Value {
+			return fn.Invoke(jsArgs...)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return jsToValue(result), nil
+	}
+}
+
+func wasmEval(source string) (interface{}, error) {
+	// browsers have no working directory, so modules are imported from /
+	cwd, err := os.Getwd()
+	if err != nil {
+		cwd = "/"
+	}
+	ctx := NewContext(cwd)
+	ctx.LoadBuiltins()
+	ctx.eng.reportErr = func(err error) {
+		fmt.Fprintln(stderrStream, err)
+	}
+
+	hostFnsLock.Lock()
+	for name, fn := range hostFns {
+		ctx.LoadFunc(name, ctx.hostBuiltin(name, fn))
+	}
+	hostFnsLock.Unlock()
+
+	val, evalErr := ctx.Eval(strings.NewReader(source))
+	ctx.Wait()
+	if evalErr != nil {
+		return nil, evalErr
+	}
+	return valueToJS(val, map[uintptr]bool{}), nil
+}
+
+// outputSetter returns a JavaScript function that sends output written to a
+// stream to a callback, or back to the file if it's called with null.
+func outputSetter(stream *outStream) js.Func {
+	return js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+		stream.Lock()
+		defer stream.Unlock()
+
+		stream.out = nil
+		if len(args) > 0 && args[0].Type() == js.TypeFunction {
+			stream.out = jsWriter{fn: args[0]}
+		}
+		return nil
+	})
+}
+
+func main() {
+	oak := js.Global().Get("Object").New()
+
+	oak.Set("eval", js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return js.Global().Get("Promise").Call("reject",
+				js.Global().Get("TypeError").New("Oak.eval() takes a string of Oak source"))
+		}
+		source := args[0].String()
+
+		// timers in WebAssembly run on the JavaScript event loop, so a program
+		// that waits for them can't block this callback, and runs separately
+		executor := js.FuncOf(func(_ js.Value, promise []js.Value) interface{} {
+			resolve, reject := promise[0], promise[1]
+			go func() {
+				val, err := wasmEval(source)
+				if err != nil {
+					reject.Invoke(js.Global().Get("Error").New(err.Error()))
+					return
+				}
+				resolve.Invoke(val)
+			}()
+			return nil
+		})
+		defer executor.Release()
+		return js.Global().Get("Promise").New(executor)
+	}))
+
+	oak.Set("register", js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+		// a panic here would stop the interpreter, so invalid arguments are
+		// reported by returning false rather than by throwing
+		if len(args) < 2 || args[0].Type() != js.TypeString || args[1].Type() != js.TypeFunction {
+			return false
+		}
+		hostFnsLock.Lock()
+		defer hostFnsLock.Unlock()
+		hostFns[args[0].String()] = args[1]
+		return true
+	}))
+
+	oak.Set("onStdout", outputSetter(stdoutStream))
+	oak.Set("onStderr", outputSetter(stderrStream))
+
+	js.Global().Set("Oak", oak)
+
+	// the Go program must keep running for Oak to be called from JavaScript
+	select {}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// watch() polls the files it watches for changes rather than subscribing to
+// OS file system events, so that it works the same on every platform.
+
+// defaultWatchInterval is how often watch() polls for changes, unless it's
+// given an interval.
+const defaultWatchInterval = 100 * time.Millisecond
+
+type watchStat struct {
+	dir  bool
+	size int64
+	mod  time.Time
+}
+
+// watchSnapshot returns the state of every watched path, and of every file
+// and directory under the watched directories.
+func watchSnapshot(paths []string) map[string]watchStat {
+	snapshot := map[string]watchStat{}
+	for _, root := range paths {
+		filepath.WalkDir(root, func(p string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info, err := entry.Info(); err == nil {
+				snapshot[p] = watchStat{dir: info.IsDir(), size: info.Size(), mod: info.ModTime()}
+			}
+			return nil
+		})
+	}
+	return snapshot
+}
+
+// watchEvents returns the events that change one snapshot into the next,
+// ordered by path.
+func watchEvents(prev, next map[string]watchStat) []Value {
+	paths := []string{}
+	events := map[string]string{}
+	for p, stat := range next {
+		prevStat, ok := prev[p]
+		switch {
+		case !ok:
+			events[p] = "create"
+		case !stat.dir && (stat.size != prevStat.size || !stat.mod.Equal(prevStat.mod)):
+			events[p] = "write"
+		default:
+			continue
+		}
+		paths = append(paths, p)
+	}
+	for p := range prev {
+		if _, ok := next[p]; !ok {
+			events[p] = "remove"
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	evts := make([]Value, len(paths))
+	for i, p := range paths {
+		evts[i] = ObjectValue{
+			"event": AtomValue(events[p]),
+			"path":  MakeString(p),
+		}
+	}
+	return evts
+}
+
+func (c *Context) oakWatch(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("watch", args, 2); err != nil {
+		return nil, err
+	}
+
+	// options arg is optional
+	options := ObjectValue{}
+	if len(args) > 2 {
+		opts, ok := args[1].(ObjectValue)
+		if !ok {
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Mismatched types in call watch(%s, %s, %s)", args[0], args[1], args[2]),
+			}
+		}
+		options = opts
+		args = []Value{args[0], args[2]}
+	}
+
+	var paths []string
+	ok1 := true
+	switch arg := args[0].(type) {
+	case *StringValue:
+		paths = []string{arg.stringContent()}
+	case *ListValue:
+		for _, el := range arg.elems {
+			p, ok := el.(*StringValue)
+			if !ok {
+				ok1 = false
+				break
+			}
+			paths = append(paths, p.stringContent())
+		}
+	default:
+		ok1 = false
+	}
+	cb, ok2 := args[1].(FnValue)
+	if !ok1 || !ok2 {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call watch(%s, %s)", args[0], args[1]),
+		}
+	}
+
+	interval := defaultWatchInterval
+	switch ms := options["interval"].(type) {
+	case IntValue:
+		interval = time.Duration(ms) * time.Millisecond
+	case FloatValue:
+		interval = time.Duration(float64(ms) * float64(time.Millisecond))
+	}
+	if interval <= 0 {
+		return nil, &runtimeError{
+			kind:   "valueError",
+			reason: fmt.Sprintf("Invalid watch interval %s", options["interval"]),
+		}
+	}
+
+	snapshot := watchSnapshot(paths)
+	stopped := make(chan struct{})
+
+	// like a signal handler, a watcher keeps the program alive until it's
+	// stopped
+	c.eng.Add(1)
+	go func() {
+		defer c.eng.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-ticker.C:
+			}
+
+			next := watchSnapshot(paths)
+			for _, evt := range watchEvents(snapshot, next) {
+				// events that arrive after the watcher is stopped, even
+				// from its own callback, are dropped
+				select {
+				case <-stopped:
+					return
+				default:
+				}
+
+				c.Lock()
+				_, err := c.EvalFnValue(cb, false, evt)
+				c.Unlock()
+				if err != nil {
+					c.eng.reportErr(err)
+				}
+			}
+			snapshot = next
+		}
+	}()
+
+	var once sync.Once
+	stopper := func(_ []Value) (Value, *runtimeError) {
+		once.Do(func() {
+			close(stopped)
+		})
+		return null, nil
+	}
+
+	return BuiltinFnValue{
+		name: "stop",
+		fn:   stopper,
+	}, nil
+}
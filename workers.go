@@ -0,0 +1,462 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"runtime"
+	"sync"
+)
+
+// workers(n?) starts a pool of n workers, or one for each CPU, each an
+// interpreter of its own on its own goroutine, so that CPU-bound work spread
+// across them runs in parallel. The pool is an object { size, run, map, close
+// }. pool.run(f, args...) calls f(args...) on the least busy worker and
+// returns a task resolved with the result, and pool.map(xs, f) calls f(x, i)
+// for each element of xs across the workers, and returns a task resolved with
+// the list of results. pool.close() stops the workers once they finish the
+// calls given to them.
+//
+// Workers share no values with the program or with each other. A function is
+// sent to a worker with copies of the variables it uses from the scopes
+// around it, and arguments and results are deep-copied, so changes a worker
+// makes to them aren't seen by the program. Builtins are swapped for the
+// worker's own, but other native functions, like the methods of a task,
+// can't be sent to a worker.
+
+// valueCopier deep-copies values from one interpreter into another. A value
+// reachable more than once, as through a cycle, is copied once.
+type valueCopier struct {
+	// builtins of the interpreter values are copied into, by name
+	builtins map[string]Value
+	refs     map[uintptr]Value
+	scopes   map[uintptr]*copiedScope
+}
+
+// copiedScope is a copy of a scope, which holds copies of the variables used
+// by the functions copied with it so far.
+type copiedScope struct {
+	sc     *scope
+	copied map[string]bool
+}
+
+func newValueCopier(builtins map[string]Value) *valueCopier {
+	return &valueCopier{
+		builtins: builtins,
+		refs:     map[uintptr]Value{},
+		scopes:   map[uintptr]*copiedScope{},
+	}
+}
+
+// builtinsOf returns the builtins loaded into a top-level scope, by name.
+func builtinsOf(sc scope) map[string]Value {
+	builtins := map[string]Value{}
+	for name, v := range sc.vars {
+		if b, ok := v.(BuiltinFnValue); ok && b.name == name {
+			builtins[name] = b
+		}
+	}
+	return builtins
+}
+
+func (vc *valueCopier) copy(v Value) (Value, *runtimeError) {
+	id, isContainer := containerID(v)
+	if copied, ok := vc.refs[id]; isContainer && ok {
+		return copied, nil
+	}
+
+	switch val := v.(type) {
+	case *StringValue:
+		s := make(StringValue, len(*val))
+		copy(s, *val)
+		return &s, nil
+	case DecimalValue:
+		return makeDecimal(new(big.Rat).Set(val.rat)), nil
+	case *IntArrayValue:
+		xs := make(IntArrayValue, len(*val))
+		copy(xs, *val)
+		return &xs, nil
+	case *FloatArrayValue:
+		xs := make(FloatArrayValue, len(*val))
+		copy(xs, *val)
+		return &xs, nil
+	case *ListValue:
+		list := &ListValue{elems: make([]Value, len(val.elems))}
+		vc.refs[id] = list
+		for i, elem := range val.elems {
+			copied, err := vc.copy(elem)
+			if err != nil {
+				return nil, err
+			}
+			list.elems[i] = copied
+		}
+		return list, nil
+	case ObjectValue:
+		obj := make(ObjectValue, len(val))
+		vc.refs[id] = obj
+		for key, elem := range val {
+			copied, err := vc.copy(elem)
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = copied
+		}
+		return obj, nil
+	case *MapValue:
+		m := makeMap()
+		vc.refs[id] = m
+		var err *runtimeError
+		val.each(func(key, elem Value) {
+			if err != nil {
+				return
+			}
+			var k, e Value
+			if k, err = vc.copy(key); err != nil {
+				return
+			}
+			if e, err = vc.copy(elem); err != nil {
+				return
+			}
+			m.set(k, e)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	case FnValue:
+		sc, err := vc.copyScope(&val.scope, namesUsed(val.defn))
+		if err != nil {
+			return nil, err
+		}
+		return FnValue{defn: val.defn, scope: *sc}, nil
+	case BuiltinFnValue:
+		if b, ok := vc.builtins[val.name]; ok {
+			return b, nil
+		}
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Cannot copy %s to another interpreter", val),
+		}
+	}
+	return v, nil
+}
+
+// copyScope returns a copy of sc and the scopes enclosing it, with copies of
+// the variables in them with the given names. Slots keep their frames, so
+// that the resolved identifiers of the functions defined in sc still find
+// them.
+func (vc *valueCopier) copyScope(sc *scope, names map[string]bool) (*scope, *runtimeError) {
+	if sc == nil {
+		return nil, nil
+	}
+
+	id := scopeID(sc)
+	cs, ok := vc.scopes[id]
+	if !ok || id == 0 {
+		cs = &copiedScope{
+			sc:     &scope{frame: sc.frame},
+			copied: map[string]bool{},
+		}
+		if sc.vars != nil {
+			cs.sc.vars = map[string]Value{}
+		}
+		if sc.slots != nil {
+			cs.sc.slots = make([]Value, len(sc.slots))
+		}
+		if id != 0 {
+			vc.scopes[id] = cs
+		}
+	}
+
+	parent, err := vc.copyScope(sc.parent, names)
+	if err != nil {
+		return nil, err
+	}
+	cs.sc.parent = parent
+
+	for name := range names {
+		if cs.copied[name] {
+			continue
+		}
+		// marked before copying, in case the variable holds a function
+		// that uses itself
+		cs.copied[name] = true
+		if v, ok := sc.vars[name]; ok {
+			copied, err := vc.copy(v)
+			if err != nil {
+				return nil, err
+			}
+			cs.sc.vars[name] = copied
+		}
+		if i, ok := sc.slot(name); ok && sc.slots[i] != nil {
+			copied, err := vc.copy(sc.slots[i])
+			if err != nil {
+				return nil, err
+			}
+			cs.sc.slots[i] = copied
+		}
+	}
+	return cs.sc, nil
+}
+
+// namesUsed returns every name used in the body of a function. Names declared
+// in the body are included, which costs only copies of variables it shadows.
+func namesUsed(defn *fnNode) map[string]bool {
+	names := map[string]bool{}
+	walkNode(defn.body, func(node astNode) bool {
+		if n, ok := node.(identifierNode); ok {
+			names[n.payload] = true
+		}
+		return true
+	})
+	return names
+}
+
+type workerCall struct {
+	fn   Value
+	args []Value
+	// done is called on the worker's goroutine with the result of the call
+	done func(Value, *runtimeError)
+}
+
+type worker struct {
+	ctx      *Context
+	builtins map[string]Value
+	// number of calls given to the worker and not yet finished, which is
+	// only changed while the program holds its interpreter lock
+	pending int
+
+	sync.Mutex
+	cond   *sync.Cond
+	queue  []workerCall
+	closed bool
+}
+
+func (c *Context) startWorker() *worker {
+	ctx := NewContext(c.rootPath)
+	ctx.LoadBuiltins()
+	w := &worker{ctx: &ctx, builtins: builtinsOf(ctx.scope)}
+	w.cond = sync.NewCond(&w.Mutex)
+
+	go func() {
+		for {
+			w.Lock()
+			for len(w.queue) == 0 && !w.closed {
+				w.cond.Wait()
+			}
+			if len(w.queue) == 0 {
+				w.Unlock()
+				return
+			}
+			call := w.queue[0]
+			w.queue = w.queue[1:]
+			w.Unlock()
+
+			w.ctx.Lock()
+			result, err := w.ctx.EvalFnValue(call.fn, false, call.args...)
+			call.done(result, err)
+			w.ctx.Unlock()
+		}
+	}()
+	return w
+}
+
+func (w *worker) enqueue(call workerCall) {
+	w.Lock()
+	defer w.Unlock()
+	w.queue = append(w.queue, call)
+	w.cond.Signal()
+}
+
+// close stops the worker once it's finished the calls in its queue.
+func (w *worker) close() {
+	w.Lock()
+	defer w.Unlock()
+	w.closed = true
+	w.cond.Signal()
+}
+
+type workerPool struct {
+	workers []*worker
+	// builtins of the program, for copying results back into it
+	builtins map[string]Value
+	closed   bool
+}
+
+// call copies f and args into the least busy worker of the pool and calls f
+// there. onResult is called on the program's event loop with a copy of the
+// result, or of the error the call raised and true.
+func (c *Context) callOnWorker(p *workerPool, f Value, args []Value, onResult func(Value, bool)) *runtimeError {
+	if p.closed {
+		return &runtimeError{
+			reason: "Cannot call a function on a closed worker pool",
+		}
+	}
+
+	w := p.workers[0]
+	for _, other := range p.workers[1:] {
+		if other.pending < w.pending {
+			w = other
+		}
+	}
+
+	vc := newValueCopier(w.builtins)
+	fn, err := vc.copy(f)
+	if err != nil {
+		return err
+	}
+	copiedArgs := make([]Value, len(args))
+	for i, arg := range args {
+		if copiedArgs[i], err = vc.copy(arg); err != nil {
+			return err
+		}
+	}
+
+	w.pending++
+	c.eng.Add(1)
+	w.enqueue(workerCall{
+		fn:   fn,
+		args: copiedArgs,
+		done: func(result Value, err *runtimeError) {
+			rejected := err != nil
+			if rejected {
+				result = err.value()
+			}
+			// copied here, where the worker can't change it
+			copied, cerr := newValueCopier(p.builtins).copy(result)
+			if cerr != nil {
+				copied, rejected = cerr.value(), true
+			}
+
+			go func() {
+				defer c.eng.Done()
+
+				c.Lock()
+				defer c.Unlock()
+				w.pending--
+				onResult(copied, rejected)
+			}()
+		},
+	})
+	return nil
+}
+
+func (c *Context) oakWorkers(args []Value) (Value, *runtimeError) {
+	size := runtime.NumCPU()
+	if len(args) > 0 {
+		switch n := args[0].(type) {
+		case NullValue:
+		case IntValue:
+			if n < 1 {
+				return nil, &runtimeError{
+					kind:   "typeError",
+					reason: fmt.Sprintf("A worker pool needs at least 1 worker, got %d", n),
+				}
+			}
+			size = int(n)
+		default:
+			return nil, &runtimeError{
+				kind:   "typeError",
+				reason: fmt.Sprintf("Argument to workers must be an int, got %s", args[0]),
+			}
+		}
+	}
+
+	p := &workerPool{builtins: builtinsOf(c.scope)}
+	for i := 0; i < size; i++ {
+		p.workers = append(p.workers, c.startWorker())
+	}
+
+	requireFn := func(name string, f Value) *runtimeError {
+		if isFunction(f) {
+			return nil
+		}
+		return &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Function given to %s must be a function, got %s", name, f),
+		}
+	}
+
+	return ObjectValue{
+		"size": IntValue(size),
+		"run": BuiltinFnValue{
+			name: "run",
+			fn: func(args []Value) (Value, *runtimeError) {
+				if err := c.requireArgLen("run", args, 1); err != nil {
+					return nil, err
+				}
+				if err := requireFn("run", args[0]); err != nil {
+					return nil, err
+				}
+
+				t := c.newTask()
+				err := c.callOnWorker(p, args[0], args[1:], func(result Value, rejected bool) {
+					if rejected {
+						c.settleTask(t, taskRejected, result)
+					} else {
+						c.resolveTask(t, result)
+					}
+				})
+				if err != nil {
+					return nil, err
+				}
+				return t.obj, nil
+			},
+		},
+		"map": BuiltinFnValue{
+			name: "map",
+			fn: func(args []Value) (Value, *runtimeError) {
+				if err := c.requireArgLen("map", args, 2); err != nil {
+					return nil, err
+				}
+				xs, ok := args[0].(*ListValue)
+				if !ok {
+					return nil, &runtimeError{
+						kind:   "typeError",
+						reason: fmt.Sprintf("First argument to map must be a list, got %s", args[0]),
+					}
+				}
+				if err := requireFn("map", args[1]); err != nil {
+					return nil, err
+				}
+
+				t := c.newTask()
+				results := make([]Value, len(xs.elems))
+				remaining := len(xs.elems)
+				if remaining == 0 {
+					c.resolveTask(t, MakeList())
+					return t.obj, nil
+				}
+				for i, x := range xs.elems {
+					i := i
+					err := c.callOnWorker(p, args[1], []Value{x, IntValue(i)}, func(result Value, rejected bool) {
+						if rejected {
+							c.settleTask(t, taskRejected, result)
+							return
+						}
+						results[i] = result
+						remaining--
+						if remaining == 0 {
+							c.resolveTask(t, MakeList(results...))
+						}
+					})
+					if err != nil {
+						return nil, err
+					}
+				}
+				return t.obj, nil
+			},
+		},
+		"close": BuiltinFnValue{
+			name: "close",
+			fn: func(_ []Value) (Value, *runtimeError) {
+				if !p.closed {
+					p.closed = true
+					for _, w := range p.workers {
+						w.close()
+					}
+				}
+				return null, nil
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,1086 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// YAML parsing and serialization, for the yaml standard library.
+//
+// The parser supports the parts of YAML used by configuration files: block
+// and flow mappings and sequences, plain, quoted, and block scalars, comments,
+// multiple documents, anchors and aliases, and merge keys. Plain scalars are
+// resolved with the YAML 1.2 core schema, so "yes" and "on" are strings.
+// Mapping keys are always strings, since Oak objects only have string keys.
+// Tags other than !!str, !!int, !!float, !!bool, and !!null are ignored.
+//
+// Oak values serialize to YAML in block style, with strings quoted wherever
+// they would otherwise parse as something else.
+
+var (
+	yamlIntRE   = regexp.MustCompile(`^[-+]?[0-9]+$`)
+	yamlOctRE   = regexp.MustCompile(`^0o[0-7]+$`)
+	yamlHexRE   = regexp.MustCompile(`^0x[0-9a-fA-F]+$`)
+	yamlFloatRE = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+	yamlInfRE   = regexp.MustCompile(`^[-+]?\.(inf|Inf|INF)$`)
+	yamlNaNRE   = regexp.MustCompile(`^\.(nan|NaN|NAN)$`)
+)
+
+// yamlResolve returns the value of a plain scalar.
+func yamlResolve(s string) Value {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return null
+	case "true", "True", "TRUE":
+		return oakTrue
+	case "false", "False", "FALSE":
+		return oakFalse
+	}
+
+	switch {
+	case yamlIntRE.MatchString(s):
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return IntValue(n)
+		}
+		// ints too large for an Oak int keep their magnitude as floats
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return FloatValue(f)
+		}
+	case yamlOctRE.MatchString(s):
+		if n, err := strconv.ParseInt(s[2:], 8, 64); err == nil {
+			return IntValue(n)
+		}
+	case yamlHexRE.MatchString(s):
+		if n, err := strconv.ParseInt(s[2:], 16, 64); err == nil {
+			return IntValue(n)
+		}
+	case yamlFloatRE.MatchString(s):
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return FloatValue(f)
+		}
+	case yamlInfRE.MatchString(s):
+		if s[0] == '-' {
+			return FloatValue(math.Inf(-1))
+		}
+		return FloatValue(math.Inf(1))
+	case yamlNaNRE.MatchString(s):
+		return FloatValue(math.NaN())
+	}
+	return MakeString(s)
+}
+
+// yamlTag applies a tag to a scalar, given its source text if it was plain.
+func yamlTag(tag string, v Value, plain string) Value {
+	switch tag {
+	case "!!str":
+		if plain != "" {
+			return MakeString(plain)
+		}
+	case "!!int", "!!float", "!!bool":
+		if s, ok := v.(*StringValue); ok {
+			v = yamlResolve(string(*s))
+		}
+		if n, ok := v.(IntValue); ok && tag == "!!float" {
+			return FloatValue(n)
+		}
+	case "!!null":
+		return null
+	}
+	return v
+}
+
+type yamlParser struct {
+	lines []string
+	// line is the line number of the first of lines in the source
+	line    int
+	i       int
+	anchors map[string]Value
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) *runtimeError {
+	return &runtimeError{
+		kind:   "valueError",
+		reason: fmt.Sprintf("Invalid YAML at line %d: ", p.line+p.i) + fmt.Sprintf(format, args...),
+	}
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func blankLine(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || trimmed[0] == '#'
+}
+
+// skipBlank skips empty lines and lines with only a comment.
+func (p *yamlParser) skipBlank() {
+	for p.i < len(p.lines) && blankLine(p.lines[p.i]) {
+		p.i++
+	}
+}
+
+// stripComment removes a trailing comment from a line, which begins with a #
+// that is not in a quoted scalar and follows whitespace.
+func stripComment(s string) string {
+	var quote byte
+	for j := 0; j < len(s); j++ {
+		c := s[j]
+		switch {
+		case quote == '"' && c == '\\':
+			j++
+		case quote != 0 && c == quote:
+			if quote == '\'' && j+1 < len(s) && s[j+1] == '\'' {
+				j++
+			} else {
+				quote = 0
+			}
+		case quote != 0:
+		case (c == '"' || c == '\'') && (j == 0 || strings.IndexByte(" \t[{,:", s[j-1]) >= 0):
+			quote = c
+		case c == '#' && (j == 0 || s[j-1] == ' ' || s[j-1] == '\t'):
+			return strings.TrimRight(s[:j], " \t")
+		}
+	}
+	return strings.TrimRight(s, " \t")
+}
+
+func seqItem(content string) bool {
+	return content == "-" || strings.HasPrefix(content, "- ") || strings.HasPrefix(content, "-\t")
+}
+
+// splitKey splits a line of a block mapping into its key and the text after
+// the colon that follows it.
+func (p *yamlParser) splitKey(content string) (key string, rest string, ok bool, err *runtimeError) {
+	if content == "" || strings.IndexByte("[{#", content[0]) >= 0 || seqItem(content) {
+		return "", "", false, nil
+	}
+
+	if content[0] == '"' || content[0] == '\'' {
+		f := yamlFlow{p: p, s: content}
+		s, err := f.quoted()
+		if err != nil {
+			// not a quoted key, but may be a multi-line quoted scalar
+			return "", "", false, nil
+		}
+		after := strings.TrimLeft(content[f.i:], " \t")
+		if after == ":" || strings.HasPrefix(after, ": ") || strings.HasPrefix(after, ":\t") {
+			return s, strings.TrimSpace(after[1:]), true, nil
+		}
+		return "", "", false, nil
+	}
+
+	stripped := stripComment(content)
+	for j := 0; j < len(stripped); j++ {
+		if stripped[j] == ':' && (j+1 == len(stripped) || stripped[j+1] == ' ' || stripped[j+1] == '\t') {
+			key := strings.TrimRight(stripped[:j], " \t")
+			if key == "?" || strings.HasPrefix(key, "? ") {
+				return "", "", false, p.errorf("complex mapping keys are not supported")
+			}
+			return key, strings.TrimSpace(stripped[j+1:]), true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+// props reads the anchor and tag that may precede a node.
+func props(text string) (anchor, tag, rest string) {
+	for len(text) > 0 && (text[0] == '&' || text[0] == '!') {
+		end := strings.IndexAny(text, " \t")
+		if end < 0 {
+			end = len(text)
+		}
+		if text[0] == '&' {
+			anchor = text[1:end]
+		} else {
+			tag = text[:end]
+		}
+		text = strings.TrimLeft(text[end:], " \t")
+	}
+	return anchor, tag, text
+}
+
+func (p *yamlParser) alias(name string) (Value, *runtimeError) {
+	v, ok := p.anchors[name]
+	if !ok {
+		return nil, p.errorf("unknown alias *%s", name)
+	}
+	return v, nil
+}
+
+// node parses a block node on the following lines, indented at least
+// minIndent spaces.
+func (p *yamlParser) node(minIndent int) (Value, *runtimeError) {
+	p.skipBlank()
+	if p.i >= len(p.lines) {
+		return null, nil
+	}
+
+	line := p.lines[p.i]
+	indent := indentOf(line)
+	if indent < minIndent {
+		return null, nil
+	}
+	content := line[indent:]
+	if seqItem(content) {
+		return p.sequence(indent)
+	}
+	if _, _, ok, err := p.splitKey(content); err != nil {
+		return nil, err
+	} else if ok {
+		return p.mapping(indent)
+	}
+	return p.value(content, indent-1, false)
+}
+
+// value parses the node that begins with text on the current line, after a
+// mapping key or sequence indicator at the given indentation. Lines that
+// continue the node are indented further.
+func (p *yamlParser) value(text string, indent int, inMapping bool) (Value, *runtimeError) {
+	anchor, tag, text := props(text)
+
+	var v Value
+	var err *runtimeError
+	switch {
+	case text == "" || text[0] == '#':
+		p.i++
+		p.skipBlank()
+		// a sequence may be a mapping value at the same indentation as its key
+		if inMapping && p.i < len(p.lines) && indentOf(p.lines[p.i]) == indent &&
+			seqItem(p.lines[p.i][indent:]) {
+			v, err = p.sequence(indent)
+		} else {
+			v, err = p.node(indent + 1)
+		}
+	case text[0] == '|' || text[0] == '>':
+		v, err = p.blockScalar(text, indent)
+	case text[0] == '*':
+		v, err = p.alias(stripComment(text)[1:])
+		p.i++
+	case text[0] == '[' || text[0] == '{' || text[0] == '"' || text[0] == '\'':
+		v, err = p.flow(text, indent)
+	default:
+		s := p.plain(text, indent)
+		v = yamlTag(tag, yamlResolve(s), s)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tag != "" {
+		v = yamlTag(tag, v, "")
+	}
+	if anchor != "" {
+		p.anchors[anchor] = v
+	}
+	return v, nil
+}
+
+// plain reads a plain scalar, which may continue on following lines.
+func (p *yamlParser) plain(text string, indent int) string {
+	s := stripComment(text)
+	hasComment := len(s) < len(strings.TrimRight(text, " \t"))
+	p.i++
+
+	for !hasComment && p.i < len(p.lines) {
+		line := p.lines[p.i]
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed[0] == '#' || indentOf(line) <= indent {
+			break
+		}
+		if _, _, ok, _ := p.splitKey(trimmed); ok {
+			break
+		}
+
+		cont := stripComment(trimmed)
+		hasComment = len(cont) < len(trimmed)
+		s += " " + cont
+		p.i++
+	}
+	return s
+}
+
+// flow reads a flow collection or quoted scalar, which may continue on
+// following lines.
+func (p *yamlParser) flow(text string, indent int) (Value, *runtimeError) {
+	start := p.i
+	if text[0] == '"' || text[0] == '\'' {
+		text = stripComment(p.quotedLines(text))
+	} else {
+		text = stripComment(text)
+		for !yamlBalanced(text) && p.i+1 < len(p.lines) {
+			p.i++
+			text += " " + stripComment(strings.TrimSpace(p.lines[p.i]))
+		}
+	}
+	p.i++
+
+	f := yamlFlow{p: p, s: text}
+	v, err := f.node()
+	if err != nil {
+		p.i = start
+		return nil, err
+	}
+	f.skipSpace()
+	if f.i < len(f.s) {
+		p.i = start
+		return nil, p.errorf("unexpected %q after value", f.s[f.i:])
+	}
+	return v, nil
+}
+
+// quotedLines joins the lines of a quoted scalar that spans several lines,
+// folding line breaks into spaces and empty lines into newlines.
+func (p *yamlParser) quotedLines(text string) string {
+	quote := text[0]
+	closed := func(s string) bool {
+		for j := 1; j < len(s); j++ {
+			switch {
+			case quote == '"' && s[j] == '\\':
+				j++
+			case s[j] == quote && quote == '\'' && j+1 < len(s) && s[j+1] == '\'':
+				j++
+			case s[j] == quote:
+				return true
+			}
+		}
+		return false
+	}
+
+	s := strings.TrimRight(text, " \t")
+	breaks := 0
+	for !closed(s) && p.i+1 < len(p.lines) {
+		p.i++
+		line := strings.TrimSpace(p.lines[p.i])
+		if line == "" {
+			breaks++
+			continue
+		}
+
+		switch {
+		case quote == '"' && strings.HasSuffix(s, "\\") && breaks == 0:
+			// an escaped line break is removed
+			s = s[:len(s)-1]
+		case breaks == 0:
+			s += " "
+		default:
+			s += strings.Repeat("\n", breaks)
+		}
+		s += line
+		breaks = 0
+	}
+	return s
+}
+
+// yamlBalanced reports whether all flow collections opened in s are closed.
+func yamlBalanced(s string) bool {
+	depth := 0
+	var quote byte
+	for j := 0; j < len(s); j++ {
+		c := s[j]
+		switch {
+		case quote == '"' && c == '\\':
+			j++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+func (p *yamlParser) blockScalar(header string, indent int) (Value, *runtimeError) {
+	header = stripComment(header)
+	folded := header[0] == '>'
+	chomp := byte(0)
+	contentIndent := 0
+	for _, c := range []byte(header[1:]) {
+		switch {
+		case c == '-' || c == '+':
+			chomp = c
+		case c >= '1' && c <= '9':
+			contentIndent = indent + int(c-'0')
+			if indent < 0 {
+				contentIndent = int(c - '0')
+			}
+		default:
+			return nil, p.errorf("invalid block scalar header %s", header)
+		}
+	}
+	p.i++
+
+	var lines []string
+	for ; p.i < len(p.lines); p.i++ {
+		line := p.lines[p.i]
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		if contentIndent == 0 {
+			contentIndent = indentOf(line)
+			if contentIndent <= indent {
+				break
+			}
+		}
+		if indentOf(line) < contentIndent {
+			break
+		}
+		lines = append(lines, line[contentIndent:])
+	}
+
+	// trailing empty lines are only kept with the + chomping indicator
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+
+	var b strings.Builder
+	if folded {
+		breaks := 0
+		prevMoreIndented := false
+		for j, line := range lines {
+			if line == "" {
+				breaks++
+				continue
+			}
+			moreIndented := line[0] == ' ' || line[0] == '\t'
+			if j > 0 {
+				switch {
+				case moreIndented || prevMoreIndented:
+					b.WriteString(strings.Repeat("\n", breaks+1))
+				case breaks > 0:
+					b.WriteString(strings.Repeat("\n", breaks))
+				default:
+					b.WriteByte(' ')
+				}
+			}
+			b.WriteString(line)
+			breaks = 0
+			prevMoreIndented = moreIndented
+		}
+	} else {
+		b.WriteString(strings.Join(lines, "\n"))
+	}
+
+	if len(lines) > 0 && chomp != '-' {
+		b.WriteByte('\n')
+	}
+	if chomp == '+' {
+		b.WriteString(strings.Repeat("\n", trailing))
+	}
+	return MakeString(b.String()), nil
+}
+
+func (p *yamlParser) sequence(indent int) (Value, *runtimeError) {
+	elems := []Value{}
+	for {
+		p.skipBlank()
+		if p.i >= len(p.lines) {
+			break
+		}
+		line := p.lines[p.i]
+		if indentOf(line) != indent || !seqItem(line[indent:]) {
+			if indentOf(line) > indent {
+				return nil, p.errorf("unexpected indentation")
+			}
+			break
+		}
+
+		rest := line[indent+1:]
+		text := strings.TrimLeft(rest, " \t")
+		itemIndent := indent + 1 + len(rest) - len(text)
+
+		var v Value
+		var err *runtimeError
+		_, _, isKey, keyErr := p.splitKey(text)
+		switch {
+		case keyErr != nil:
+			return nil, keyErr
+		case isKey || seqItem(text):
+			// a mapping or sequence that begins on this line continues on
+			// the following lines at the indentation of its first entry
+			p.lines[p.i] = strings.Repeat(" ", itemIndent) + text
+			v, err = p.node(itemIndent)
+		default:
+			v, err = p.value(text, indent, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, v)
+	}
+	return MakeList(elems...), nil
+}
+
+func (p *yamlParser) mapping(indent int) (Value, *runtimeError) {
+	obj := ObjectValue{}
+	var merges []Value
+	for {
+		p.skipBlank()
+		if p.i >= len(p.lines) {
+			break
+		}
+		line := p.lines[p.i]
+		if indentOf(line) < indent {
+			break
+		}
+		if indentOf(line) > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+
+		key, rest, ok, err := p.splitKey(line[indent:])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if seqItem(line[indent:]) {
+				break
+			}
+			return nil, p.errorf("expected a mapping key")
+		}
+		start := p.i
+
+		v, err := p.value(rest, indent, true)
+		if err != nil {
+			return nil, err
+		}
+		if key == "<<" {
+			merges = append(merges, v)
+			continue
+		}
+		if _, ok := obj[key]; ok {
+			p.i = start
+			return nil, p.errorf("duplicate key %s", key)
+		}
+		obj[key] = v
+	}
+
+	// merged entries never override the mapping's own
+	for _, merge := range merges {
+		sources := []Value{merge}
+		if list, ok := merge.(*ListValue); ok {
+			sources = list.elems
+		}
+		for _, source := range sources {
+			sourceObj, ok := source.(ObjectValue)
+			if !ok {
+				return nil, p.errorf("cannot merge %s into a mapping", source)
+			}
+			for key, v := range sourceObj {
+				if _, ok := obj[key]; !ok {
+					obj[key] = v
+				}
+			}
+		}
+	}
+	return obj, nil
+}
+
+// yamlFlow parses flow collections and quoted scalars within a single line.
+type yamlFlow struct {
+	p *yamlParser
+	s string
+	i int
+}
+
+func (f *yamlFlow) skipSpace() {
+	for f.i < len(f.s) && (f.s[f.i] == ' ' || f.s[f.i] == '\t' || f.s[f.i] == '\n') {
+		f.i++
+	}
+}
+
+func (f *yamlFlow) node() (Value, *runtimeError) {
+	f.skipSpace()
+	start := f.i
+	for f.i < len(f.s) && (f.s[f.i] == '&' || f.s[f.i] == '!') {
+		for f.i < len(f.s) && f.s[f.i] != ' ' {
+			f.i++
+		}
+		f.skipSpace()
+	}
+	anchor, tag, _ := props(f.s[start:f.i])
+
+	var v Value
+	var err *runtimeError
+	if f.i >= len(f.s) {
+		v = null
+	} else {
+		switch f.s[f.i] {
+		case '[':
+			v, err = f.sequence()
+		case '{':
+			v, err = f.mapping()
+		case '"', '\'':
+			var s string
+			s, err = f.quoted()
+			v = MakeString(s)
+		case '*':
+			f.i++
+			v, err = f.p.alias(f.plain())
+		default:
+			s := f.plain()
+			v = yamlTag(tag, yamlResolve(s), s)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tag != "" {
+		v = yamlTag(tag, v, "")
+	}
+	if anchor != "" {
+		f.p.anchors[anchor] = v
+	}
+	return v, nil
+}
+
+// plain reads a plain scalar in a flow collection.
+func (f *yamlFlow) plain() string {
+	start := f.i
+	for f.i < len(f.s) {
+		c := f.s[f.i]
+		if c == ',' || c == ']' || c == '}' {
+			break
+		}
+		if c == ':' && (f.i+1 == len(f.s) || strings.IndexByte(" \t,]}", f.s[f.i+1]) >= 0) {
+			break
+		}
+		f.i++
+	}
+	return strings.TrimSpace(f.s[start:f.i])
+}
+
+func (f *yamlFlow) quoted() (string, *runtimeError) {
+	quote := f.s[f.i]
+	f.i++
+
+	var b strings.Builder
+	for f.i < len(f.s) {
+		c := f.s[f.i]
+		f.i++
+		switch {
+		case c == quote && quote == '\'' && f.i < len(f.s) && f.s[f.i] == '\'':
+			b.WriteByte('\'')
+			f.i++
+		case c == quote:
+			return b.String(), nil
+		case c == '\\' && quote == '"':
+			if err := f.escape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", f.p.errorf("unterminated string")
+}
+
+func (f *yamlFlow) escape(b *strings.Builder) *runtimeError {
+	if f.i >= len(f.s) {
+		return f.p.errorf("unterminated string")
+	}
+	c := f.s[f.i]
+	f.i++
+
+	simple := map[byte]string{
+		'0': "\x00", 'a': "\a", 'b': "\b", 't': "\t", '\t': "\t", 'n': "\n",
+		'v': "\v", 'f': "\f", 'r': "\r", 'e': "\x1b", ' ': " ", '"': "\"",
+		'/': "/", '\\': "\\", 'N': "\u0085", '_': "\u00a0", 'L': "\u2028",
+		'P': "\u2029",
+	}
+	if s, ok := simple[c]; ok {
+		b.WriteString(s)
+		return nil
+	}
+
+	size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[c]
+	if size == 0 {
+		return f.p.errorf("invalid escape \\%c", c)
+	}
+	if f.i+size > len(f.s) {
+		return f.p.errorf("invalid escape \\%c", c)
+	}
+	n, err := strconv.ParseUint(f.s[f.i:f.i+size], 16, 32)
+	if err != nil || !utf8.ValidRune(rune(n)) {
+		return f.p.errorf("invalid escape \\%c%s", c, f.s[f.i:f.i+size])
+	}
+	f.i += size
+	b.WriteRune(rune(n))
+	return nil
+}
+
+func (f *yamlFlow) sequence() (Value, *runtimeError) {
+	f.i++
+	elems := []Value{}
+	for {
+		f.skipSpace()
+		if f.i >= len(f.s) {
+			return nil, f.p.errorf("unterminated flow sequence")
+		}
+		if f.s[f.i] == ']' {
+			f.i++
+			return MakeList(elems...), nil
+		}
+
+		v, err := f.node()
+		if err != nil {
+			return nil, err
+		}
+		f.skipSpace()
+		// a single key: value pair in a flow sequence is a mapping
+		if f.i < len(f.s) && f.s[f.i] == ':' {
+			f.i++
+			val, err := f.node()
+			if err != nil {
+				return nil, err
+			}
+			key, err := f.key(v)
+			if err != nil {
+				return nil, err
+			}
+			v = ObjectValue{key: val}
+			f.skipSpace()
+		}
+		elems = append(elems, v)
+
+		if f.i < len(f.s) && f.s[f.i] == ',' {
+			f.i++
+		} else if f.i >= len(f.s) || f.s[f.i] != ']' {
+			return nil, f.p.errorf("expected , or ] in flow sequence")
+		}
+	}
+}
+
+func (f *yamlFlow) mapping() (Value, *runtimeError) {
+	f.i++
+	obj := ObjectValue{}
+	for {
+		f.skipSpace()
+		if f.i >= len(f.s) {
+			return nil, f.p.errorf("unterminated flow mapping")
+		}
+		if f.s[f.i] == '}' {
+			f.i++
+			return obj, nil
+		}
+
+		k, err := f.node()
+		if err != nil {
+			return nil, err
+		}
+		key, err := f.key(k)
+		if err != nil {
+			return nil, err
+		}
+
+		var v Value = null
+		f.skipSpace()
+		if f.i < len(f.s) && f.s[f.i] == ':' {
+			f.i++
+			if v, err = f.node(); err != nil {
+				return nil, err
+			}
+			f.skipSpace()
+		}
+		if _, ok := obj[key]; ok {
+			return nil, f.p.errorf("duplicate key %s", key)
+		}
+		obj[key] = v
+
+		if f.i < len(f.s) && f.s[f.i] == ',' {
+			f.i++
+		} else if f.i >= len(f.s) || f.s[f.i] != '}' {
+			return nil, f.p.errorf("expected , or } in flow mapping")
+		}
+	}
+}
+
+// key converts a scalar used as a mapping key to a string.
+func (f *yamlFlow) key(k Value) (string, *runtimeError) {
+	switch k := k.(type) {
+	case *StringValue:
+		return string(*k), nil
+	case NullValue:
+		return "null", nil
+	case IntValue, FloatValue, BoolValue:
+		return k.String(), nil
+	}
+	return "", f.p.errorf("unsupported mapping key %s", k)
+}
+
+// yamlDocuments parses each document in a YAML stream.
+func yamlDocuments(s string) ([]Value, *runtimeError) {
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	docs := []Value{}
+
+	start := 0
+	explicit := false
+	parse := func(end int) *runtimeError {
+		docLines := lines[start:end]
+		empty := true
+		for _, line := range docLines {
+			if !blankLine(line) {
+				empty = false
+			}
+		}
+		if empty && !explicit {
+			return nil
+		}
+
+		p := yamlParser{lines: docLines, line: start + 1, anchors: map[string]Value{}}
+		v, err := p.node(0)
+		if err != nil {
+			return err
+		}
+		p.skipBlank()
+		if p.i < len(p.lines) {
+			return p.errorf("unexpected content")
+		}
+		docs = append(docs, v)
+		return nil
+	}
+
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "%") && !explicit:
+			// directives are ignored
+			lines[i] = ""
+		case line == "---" || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "---\t"):
+			if err := parse(i); err != nil {
+				return nil, err
+			}
+			start, explicit = i, true
+			lines[i] = strings.TrimSpace(line[3:])
+		case line == "..." || strings.HasPrefix(line, "... "):
+			if err := parse(i); err != nil {
+				return nil, err
+			}
+			start, explicit = i+1, false
+		}
+	}
+	if err := parse(len(lines)); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// yamlString returns s as a plain scalar if it would parse back as the same
+// string, and as a double-quoted scalar otherwise.
+func yamlString(s string) string {
+	plain := s != "" &&
+		strings.IndexByte("-?:,[]{}#&*!|>'\"%@` \t", s[0]) < 0 &&
+		!strings.ContainsAny(s, "\n\r\t\\") &&
+		!strings.Contains(s, ": ") && !strings.Contains(s, " #") &&
+		!strings.HasSuffix(s, ":") && !strings.HasSuffix(s, " ")
+	// YAML 1.1 booleans are quoted for parsers that still read them as such
+	switch strings.ToLower(s) {
+	case "y", "n", "yes", "no", "on", "off":
+		plain = false
+	}
+	if plain {
+		if _, ok := yamlResolve(s).(*StringValue); ok {
+			for _, r := range s {
+				if r < 0x20 || r == 0x7f {
+					plain = false
+				}
+			}
+			if plain {
+				return s
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\x%02x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func yamlFloatString(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return ".inf"
+	case math.IsInf(f, -1):
+		return "-.inf"
+	case math.IsNaN(f):
+		return ".nan"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+type yamlSerializer struct {
+	b       strings.Builder
+	parents map[uintptr]bool
+}
+
+// scalar returns the text of a value that is written within a line, which is
+// any value other than a non-empty list or object.
+func (y *yamlSerializer) scalar(v Value) (string, bool, *runtimeError) {
+	switch val := v.(type) {
+	case NullValue, EmptyValue:
+		return "null", true, nil
+	case BoolValue, IntValue:
+		return val.String(), true, nil
+	case FloatValue:
+		return yamlFloatString(float64(val)), true, nil
+	case *StringValue:
+		if !utf8.ValidString(string(*val)) {
+			return "", false, &runtimeError{
+				kind:   "valueError",
+				reason: "Cannot serialize a string that is not valid UTF-8 to YAML",
+			}
+		}
+		return yamlString(string(*val)), true, nil
+	case AtomValue:
+		return yamlString(string(val)), true, nil
+	case numArray:
+		if val.length() == 0 {
+			return "[]", true, nil
+		}
+		return "", false, nil
+	case *ListValue:
+		if len(val.elems) == 0 {
+			return "[]", true, nil
+		}
+		return "", false, nil
+	case ObjectValue:
+		if len(val) == 0 {
+			return "{}", true, nil
+		}
+		return "", false, nil
+	}
+	return "", false, &runtimeError{
+		kind:   "typeError",
+		reason: fmt.Sprintf("Cannot serialize %s to YAML", v),
+	}
+}
+
+// node writes a value as a block node, with each of its lines indented.
+func (y *yamlSerializer) node(v Value, indent int) *runtimeError {
+	if s, ok, err := y.scalar(v); err != nil {
+		return err
+	} else if ok {
+		y.b.WriteString(strings.Repeat(" ", indent) + s + "\n")
+		return nil
+	}
+
+	if arr, ok := v.(numArray); ok {
+		v = arr.list()
+	}
+	id, _ := containerID(v)
+	if y.parents[id] {
+		return &runtimeError{
+			kind:   "valueError",
+			reason: "Cannot serialize a value that contains itself",
+		}
+	}
+	y.parents[id] = true
+	defer delete(y.parents, id)
+
+	prefix := strings.Repeat(" ", indent)
+	switch val := v.(type) {
+	case *ListValue:
+		for _, el := range val.elems {
+			// the first line of each element follows its "- "
+			sub := yamlSerializer{parents: y.parents}
+			if err := sub.node(el, indent+2); err != nil {
+				return err
+			}
+			y.b.WriteString(prefix + "- " + sub.b.String()[indent+2:])
+		}
+	case ObjectValue:
+		for _, key := range sortedKeys(val) {
+			el := val[key]
+			s, ok, err := y.scalar(el)
+			if err != nil {
+				return err
+			}
+			if ok {
+				y.b.WriteString(prefix + yamlString(key) + ": " + s + "\n")
+				continue
+			}
+			y.b.WriteString(prefix + yamlString(key) + ":\n")
+			if err := y.node(el, indent+2); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Context) oakYamlParse(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___yaml_parse", args, 1); err != nil {
+		return nil, err
+	}
+
+	s, ok := args[0].(*StringValue)
+	if !ok {
+		return nil, &runtimeError{
+			kind:   "typeError",
+			reason: fmt.Sprintf("Mismatched types in call ___yaml_parse(%s)", args[0]),
+		}
+	}
+
+	docs, err := yamlDocuments(string(*s))
+	if err != nil {
+		return nil, err
+	}
+	list := MakeList(docs...)
+	if err := c.allocValue(list, map[uintptr]bool{}); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (c *Context) oakYamlSerialize(args []Value) (Value, *runtimeError) {
+	if err := c.requireArgLen("___yaml_serialize", args, 1); err != nil {
+		return nil, err
+	}
+
+	y := yamlSerializer{parents: map[uintptr]bool{}}
+	if err := y.node(args[0], 0); err != nil {
+		return nil, err
+	}
+	s := y.b.String()
+	if err := c.allocString(len(s), len(s)); err != nil {
+		return nil, err
+	}
+	return MakeString(s), nil
+}
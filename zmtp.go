@@ -0,0 +1,194 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// A minimal implementation of ZMTP 3.0, the wire protocol of ZeroMQ, with the
+// NULL security mechanism. It's just enough for oak kernel to talk to Jupyter
+// frontends without linking against libzmq: a zmtpConn sends and receives
+// multipart messages over one TCP connection, and the socket types (ROUTER,
+// PUB, REP) are up to the code using it. See https://rfc.zeromq.org/spec/23/
+
+const (
+	zmtpFlagMore    = 0x01
+	zmtpFlagLong    = 0x02
+	zmtpFlagCommand = 0x04
+)
+
+type zmtpConn struct {
+	// guards writes, since messages are sent from more than one goroutine
+	sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// zmtpGreeting returns the greeting that opens a ZMTP 3.0 connection.
+func zmtpGreeting(asServer bool) []byte {
+	greeting := make([]byte, 64)
+	greeting[0] = 0xff
+	greeting[9] = 0x7f
+	greeting[10] = 3 // version 3.0
+	copy(greeting[12:32], "NULL")
+	if asServer {
+		greeting[32] = 1
+	}
+	return greeting
+}
+
+// zmtpHandshake exchanges greetings and READY commands with the peer on
+// conn, announcing a socket of type socketType.
+func zmtpHandshake(conn net.Conn, socketType string, asServer bool) (*zmtpConn, error) {
+	zc := &zmtpConn{conn: conn, reader: bufio.NewReader(conn)}
+	if _, err := conn.Write(zmtpGreeting(asServer)); err != nil {
+		return nil, err
+	}
+
+	greeting := make([]byte, 64)
+	if _, err := io.ReadFull(zc.reader, greeting); err != nil {
+		return nil, err
+	}
+	if greeting[0] != 0xff || greeting[9] != 0x7f || greeting[10] < 3 {
+		return nil, errors.New("peer does not speak ZMTP 3")
+	}
+	if mechanism := string(bytes.TrimRight(greeting[12:32], "\x00")); mechanism != "NULL" {
+		return nil, fmt.Errorf("unsupported security mechanism %s", mechanism)
+	}
+
+	// READY has a property list of 1-byte name lengths, names, 4-byte value
+	// lengths, and values
+	ready := append([]byte{5}, "READY"...)
+	ready = append(ready, byte(len("Socket-Type")))
+	ready = append(ready, "Socket-Type"...)
+	ready = append(ready, 0, 0, 0, byte(len(socketType)))
+	ready = append(ready, socketType...)
+	if err := zc.writeFrame(zmtpFlagCommand, ready); err != nil {
+		return nil, err
+	}
+
+	flags, body, err := zc.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if flags&zmtpFlagCommand == 0 || len(body) < 6 || string(body[1:6]) != "READY" {
+		return nil, errors.New("peer did not send READY")
+	}
+	return zc, nil
+}
+
+func (zc *zmtpConn) writeFrame(flags byte, body []byte) error {
+	var header []byte
+	if len(body) > 255 {
+		header = make([]byte, 9)
+		header[0] = flags | zmtpFlagLong
+		binary.BigEndian.PutUint64(header[1:], uint64(len(body)))
+	} else {
+		header = []byte{flags, byte(len(body))}
+	}
+	if _, err := zc.conn.Write(append(header, body...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (zc *zmtpConn) readFrame() (byte, []byte, error) {
+	flags, err := zc.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var size uint64
+	if flags&zmtpFlagLong != 0 {
+		sizeBytes := make([]byte, 8)
+		if _, err := io.ReadFull(zc.reader, sizeBytes); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(sizeBytes)
+	} else {
+		sizeByte, err := zc.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		size = uint64(sizeByte)
+	}
+	if size > 1<<32 {
+		return 0, nil, fmt.Errorf("frame of %d bytes is too large", size)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(zc.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+// send writes a multipart message of frames.
+func (zc *zmtpConn) send(frames [][]byte) error {
+	zc.Lock()
+	defer zc.Unlock()
+
+	for i, frame := range frames {
+		var flags byte
+		if i < len(frames)-1 {
+			flags = zmtpFlagMore
+		}
+		if err := zc.writeFrame(flags, frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receive reads the next multipart message, skipping over commands.
+func (zc *zmtpConn) receive() ([][]byte, error) {
+	frames := [][]byte{}
+	for {
+		flags, body, err := zc.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if flags&zmtpFlagCommand != 0 {
+			continue
+		}
+
+		frames = append(frames, body)
+		if flags&zmtpFlagMore == 0 {
+			return frames, nil
+		}
+	}
+}
+
+func (zc *zmtpConn) Close() error {
+	return zc.conn.Close()
+}
+
+// zmtpListen accepts connections on listener for a socket of type socketType,
+// and calls handle with each connection in its own goroutine, until listener
+// is closed.
+func zmtpListen(listener net.Listener, socketType string, handle func(zc *zmtpConn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			zc, err := zmtpHandshake(conn, socketType, true)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			defer zc.Close()
+			handle(zc)
+		}()
+	}
+}